@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const bundleCommand = "bundle"
+
+// bundleFile is a file of a support bundle. The error of a file which could
+// not be gathered is written in its place.
+type bundleFile struct {
+	name    string
+	content func() ([]byte, error)
+}
+
+// runBundle gathers the information needed to diagnose the agent into a
+// tar.gz archive, with secrets redacted.
+func runBundle(args []string, out io.Writer) error {
+	var output string
+	var probeDuration time.Duration
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+bundleCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Writes a support bundle, with the same flags as the agent: the configuration, the doctor checks, the certificate and known hosts, crash reports, the output of a short ssh -vvv connection to the gateway, and with -http.addr, the status and recent logs of the running agent. Secrets are redacted.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	agent := registerAgentFlags(fs)
+	fs.StringVar(&output, "output", fmt.Sprintf("pdc-bundle-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")), "the path of the bundle")
+	fs.DurationVar(&probeDuration, "ssh-probe-duration", 10*time.Second, "how long to run ssh -vvv to the gateway for. Disabled if 0")
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if agent.mf.PrintHelp {
+		fs.Usage()
+		return nil
+	}
+	mf, sshConfig, pdcClientCfg := agent.mf, agent.ssh, agent.pdc
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := agent.effectiveConfig(fs)
+	if err != nil {
+		return err
+	}
+	// The bundle is written even if the token cannot be loaded, the error is
+	// in the output of the ssh probe.
+	resolveErr := resolveConfig(ctx, mf, sshConfig, pdcClientCfg)
+	secrets := agent.secrets()
+	crashDir := mf.CrashDir
+	if crashDir == "" {
+		crashDir = sshConfig.KeyFileDir()
+	}
+
+	files := []bundleFile{
+		{"version.json", func() ([]byte, error) {
+			return json.MarshalIndent(currentVersion(sshConfig.BinaryPath), "", "  ")
+		}},
+		{"config.yaml", func() ([]byte, error) {
+			var b bytes.Buffer
+			err := cfg.write(&b, "yaml")
+			return b.Bytes(), err
+		}},
+		{"doctor.txt", func() ([]byte, error) {
+			var b bytes.Buffer
+			doctorReport(ctx, sshConfig, pdcClientCfg).print(&b)
+			return b.Bytes(), nil
+		}},
+		{"certificate.txt", func() ([]byte, error) {
+			var b bytes.Buffer
+			err := printCert(&b, sshConfig.KeyFile)
+			return b.Bytes(), err
+		}},
+		{"known_hosts.txt", func() ([]byte, error) {
+			return knownHostsSummary(sshConfig.KnownHostsFilePath())
+		}},
+	}
+	if probeDuration > 0 {
+		files = append(files, bundleFile{"ssh-probe.txt", func() ([]byte, error) {
+			if resolveErr != nil {
+				return nil, resolveErr
+			}
+			return sshProbeOutput(ctx, sshConfig, probeDuration)
+		}})
+	}
+	if mf.HTTPAddr != "" {
+		files = append(files,
+			bundleFile{"status.json", func() ([]byte, error) {
+				return getFromAgent(ctx, mf.HTTPAddr, "/status")
+			}},
+			bundleFile{"logs.txt", func() ([]byte, error) {
+				return getFromAgent(ctx, mf.HTTPAddr, "/logs")
+			}},
+		)
+	}
+	crashReports, _ := filepath.Glob(filepath.Join(crashDir, "pdc-crash-*.txt"))
+	for _, path := range crashReports {
+		path := path
+		files = append(files, bundleFile{"crash/" + filepath.Base(path), func() ([]byte, error) {
+			return os.ReadFile(path)
+		}})
+	}
+
+	if err := writeBundle(output, files, secrets); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "support bundle written to %s\n", output)
+	return err
+}
+
+// writeBundle writes files to a tar.gz archive at path, with secrets
+// redacted.
+func writeBundle(path string, files []bundleFile, secrets []string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeBundleTo(f, files, secrets); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeBundleTo writes files to w as a tar.gz archive, with secrets
+// redacted.
+func writeBundleTo(w io.Writer, files []bundleFile, secrets []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range files {
+		content, err := file.content()
+		if err != nil {
+			content = append(content, fmt.Sprintf("\nerror: %s\n", err)...)
+		}
+		content = []byte(logging.Redact(string(content), secrets...))
+
+		hdr := &tar.Header{Name: file.name, Mode: 0600, Size: int64(len(content)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// runningAgentBundle returns a support bundle of the running agent, for the
+// upload-support-bundle remote command. It holds the files of pdc bundle
+// which do not require a separate ssh process.
+func runningAgentBundle(sshConfig *ssh.Config, collect func() agentStatus, secrets []string) ([]byte, error) {
+	files := []bundleFile{
+		{"version.json", func() ([]byte, error) {
+			return json.MarshalIndent(currentVersion(sshConfig.BinaryPath), "", "  ")
+		}},
+		{"status.json", func() ([]byte, error) {
+			return json.MarshalIndent(collect(), "", "  ")
+		}},
+		{"logs.txt", func() ([]byte, error) {
+			return []byte(strings.Join(crash.RecentLogs(), "")), nil
+		}},
+		{"certificate.txt", func() ([]byte, error) {
+			var b bytes.Buffer
+			err := printCert(&b, sshConfig.KeyFile)
+			return b.Bytes(), err
+		}},
+		{"known_hosts.txt", func() ([]byte, error) {
+			return knownHostsSummary(sshConfig.KnownHostsFilePath())
+		}},
+	}
+
+	var b bytes.Buffer
+	if err := writeBundleTo(&b, files, secrets); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// knownHostsSummary returns the hosts, key type and fingerprint of each
+// entry of a known hosts file.
+func knownHostsSummary(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	for {
+		marker, hosts, key, _, rest, err := gossh.ParseKnownHosts(data)
+		if errors.Is(err, io.EOF) {
+			return b.Bytes(), nil
+		}
+		if err != nil {
+			return b.Bytes(), err
+		}
+		if marker != "" {
+			fmt.Fprintf(&b, "@%s ", marker)
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", strings.Join(hosts, ","), key.Type(), gossh.FingerprintSHA256(key))
+		data = rest
+	}
+}
+
+// sshProbeOutput runs ssh with the flags of the agent and -vvv for d, and
+// returns its output. Port forwards are not set up.
+func sshProbeOutput(ctx context.Context, sshConfig *ssh.Config, d time.Duration) ([]byte, error) {
+	cfg := *sshConfig
+	cfg.Forwards = nil
+	client := ssh.NewClient(&cfg, log.NewNopLogger(), nil)
+	client.SetLogLevel(3)
+	flags, err := client.SSHFlagsFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	var b bytes.Buffer
+	cmd := exec.CommandContext(ctx, client.SSHCmd, append(flags, "-o", "BatchMode=yes")...)
+	cmd.Env = append(os.Environ(), cfg.Env...)
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	fmt.Fprintf(&b, "$ %s %s\n", client.SSHCmd, strings.Join(cmd.Args[1:], " "))
+	err = cmd.Run()
+	// ssh keeps the connection open until it is stopped.
+	if ctx.Err() != nil {
+		return b.Bytes(), nil
+	}
+	return b.Bytes(), err
+}
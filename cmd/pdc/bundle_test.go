@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/dskit/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestRunBundle(t *testing.T) {
+	running := services.NewIdleService(nil, nil)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), running))
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), running) })
+	ts := httptest.NewServer(newServeMux(http.NotFoundHandler(), statusHandler([]string{""}, []services.Service{running}), http.NotFoundHandler()))
+	t.Cleanup(ts.Close)
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "grafana_pdc")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pdc-crash-20260101T000000Z.txt"), []byte("panic: boom, token glc_s3cr3t"), 0600))
+	output := filepath.Join(dir, "bundle.tar.gz")
+
+	out := &strings.Builder{}
+	err := runBundle([]string{
+		"-token", "glc_s3cr3t", "-cluster", "prod", "-gcloud-hosted-grafana-id", "1",
+		"-ssh-key-file", keyFile, "-http.addr", strings.TrimPrefix(ts.URL, "http://"),
+		"-ssh-probe-duration", "0", "-output", output,
+	}, out)
+	require.NoError(t, err)
+	assert.Equal(t, "support bundle written to "+output+"\n", out.String())
+
+	f, err := os.Open(output)
+	require.NoError(t, err)
+	defer f.Close()
+	files := readBundle(t, f)
+
+	assert.ElementsMatch(t, []string{
+		"version.json", "config.yaml", "doctor.txt", "certificate.txt", "known_hosts.txt",
+		"status.json", "logs.txt", "crash/pdc-crash-20260101T000000Z.txt",
+	}, keys(files))
+	assert.Contains(t, files["config.yaml"], "token: <redacted>")
+	assert.Contains(t, files["status.json"], `"state":"Running"`)
+	assert.Contains(t, files["certificate.txt"], "error: reading certificate file")
+	assert.Equal(t, "panic: boom, token <redacted>", files["crash/pdc-crash-20260101T000000Z.txt"])
+	for name, content := range files {
+		assert.NotContains(t, content, "glc_s3cr3t", name)
+	}
+}
+
+func TestRunningAgentBundle(t *testing.T) {
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+	collect := func() agentStatus {
+		return agentStatus{Tunnels: []tunnelStatus{{State: "Running", Error: "token glc_s3cr3t"}}}
+	}
+
+	bundle, err := runningAgentBundle(sshConfig, collect, []string{"glc_s3cr3t"})
+	require.NoError(t, err)
+
+	files := readBundle(t, bytes.NewReader(bundle))
+	assert.ElementsMatch(t, []string{"version.json", "status.json", "logs.txt", "certificate.txt", "known_hosts.txt"}, keys(files))
+	assert.Contains(t, files["status.json"], "token <redacted>")
+}
+
+// readBundle returns the files of a support bundle by name.
+func readBundle(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+
+	gz, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(content)
+	}
+	return files
+}
+
+func keys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
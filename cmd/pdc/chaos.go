@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/grafana/pdc-agent/pkg/httpclient"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/random"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// chaosConfig injects faults with -dev-mode, to exercise the reconnection
+// and renewal logic locally.
+type chaosConfig struct {
+	// APILatency is added to every request to the PDC API.
+	APILatency time.Duration
+	// APIErrorRate is the probability, between 0 and 1, that a request to the
+	// PDC API fails with a 503 without being sent.
+	APIErrorRate float64
+	// DropInterval is how long each ssh process runs before it is killed.
+	DropInterval time.Duration
+	// CertTTL is how long a certificate is used before it is renewed.
+	CertTTL time.Duration
+}
+
+func (cc *chaosConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&cc.APILatency, "dev.chaos-api-latency", 0, "[DEVELOPMENT ONLY] the latency added to every request to the PDC API, with -dev-mode")
+	fs.Float64Var(&cc.APIErrorRate, "dev.chaos-api-error-rate", 0, "[DEVELOPMENT ONLY] the probability, between 0 and 1, that a request to the PDC API fails with a 503, with -dev-mode")
+	fs.DurationVar(&cc.DropInterval, "dev.chaos-drop-interval", 0, "[DEVELOPMENT ONLY] kill the ssh connection after this duration, to have it reconnect, with -dev-mode. Disabled if 0")
+	fs.DurationVar(&cc.CertTTL, "dev.chaos-cert-ttl", 0, "[DEVELOPMENT ONLY] renew the certificate once it is this old, whatever its validity, with -dev-mode. Disabled if 0")
+}
+
+// apply sets the faults of cc on the configs.
+func (cc chaosConfig) apply(sshCfg *ssh.Config, pdcClientCfg *pdc.Config) {
+	if cc.APILatency > 0 || cc.APIErrorRate > 0 {
+		pdcClientCfg.Middlewares = append(pdcClientCfg.Middlewares, chaosMiddleware(cc.APILatency, cc.APIErrorRate, random.Crypto))
+	}
+	sshCfg.DevDropInterval = cc.DropInterval
+	sshCfg.DevCertTTL = cc.CertTTL
+}
+
+// chaosMiddleware delays every request by latency, then fails it with a 503
+// with the probability errorRate.
+func chaosMiddleware(latency time.Duration, errorRate float64, src random.Source) httpclient.Middleware {
+	const precision = 1_000_000
+	return func(next http.RoundTripper) http.RoundTripper {
+		return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if latency > 0 {
+				select {
+				case <-time.After(latency):
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				}
+			}
+			if src.Int63n(precision) < int64(errorRate*precision) {
+				return &http.Response{
+					Status:     "503 Service Unavailable",
+					StatusCode: http.StatusServiceUnavailable,
+					Proto:      "HTTP/1.1",
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Header:     http.Header{},
+					Body:       io.NopCloser(strings.NewReader("injected by -dev.chaos-api-error-rate")),
+					Request:    req,
+				}, nil
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
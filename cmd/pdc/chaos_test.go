@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/httpclient"
+	"github.com/grafana/pdc-agent/pkg/random"
+)
+
+func TestChaosMiddleware(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+
+	testcases := []struct {
+		name      string
+		latency   time.Duration
+		errorRate float64
+		expected  int
+	}{
+		{name: "latency", latency: 50 * time.Millisecond, expected: http.StatusOK},
+		{name: "no errors", errorRate: 0, expected: http.StatusOK},
+		{name: "always failing", errorRate: 1, expected: http.StatusServiceUnavailable},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{Transport: httpclient.Chain(nil, chaosMiddleware(tc.latency, tc.errorRate, random.NewSeeded(1)))}
+			start := time.Now()
+			resp, err := client.Get(srv.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.expected, resp.StatusCode)
+			assert.GreaterOrEqual(t, time.Since(start), tc.latency)
+		})
+	}
+
+	t.Run("error rate", func(t *testing.T) {
+		client := &http.Client{Transport: httpclient.Chain(nil, chaosMiddleware(0, 0.5, random.NewSeeded(1)))}
+		failed := 0
+		for i := 0; i < 100; i++ {
+			resp, err := client.Get(srv.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				failed++
+			}
+		}
+		assert.InDelta(t, 50, failed, 15)
+	})
+
+	t.Run("canceled while delayed", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		_, err = chaosMiddleware(time.Hour, 0, random.NewSeeded(1))(http.DefaultTransport).RoundTrip(req)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
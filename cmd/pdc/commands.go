@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a pdc subcommand.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// commands are the pdc subcommands. Running pdc without a command runs the
+// agent. They are set in init, as the usage of the run command lists them.
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: runCommand, summary: "run the agent (the default when no command is given)", run: func(args []string) error {
+			runAgent(args)
+			return nil
+		}},
+		{name: statusCommand, summary: "print the status of the tunnels of a running agent", run: func(args []string) error {
+			return runStatus(args, os.Stdout)
+		}},
+		{name: healthcheckCommand, summary: "check that the tunnels of a running agent are running, for container health checks", run: func(args []string) error {
+			return runHealthcheck(args, os.Stdout)
+		}},
+		{name: testCommand, summary: "check that the agent can connect, without setting up a tunnel", run: func(args []string) error {
+			return runTest(args, os.Stdout)
+		}},
+		{name: doctorCommand, summary: "check the local setup of the agent: ssh binary, key files and token", run: func(args []string) error {
+			return runDoctor(args, os.Stdout)
+		}},
+		{name: keygenCommand, summary: "generate the key pair and have it signed, without connecting to the gateway", run: runKeygen},
+		{name: certCommand, summary: "print the certificate of the key pair", run: func(args []string) error {
+			return runCert(args, os.Stdout)
+		}},
+		{name: enrollCommand, summary: "exchange a one-time enrollment code for a token", run: runEnroll},
+		{name: credentialsCommand, summary: "export the key pair and certificate to an encrypted bundle, or import them (credentials export|import)", run: func(args []string) error {
+			return runCredentials(args, os.Stdout)
+		}},
+		{name: configCommand, summary: "print the configuration the agent runs with (config print)", run: func(args []string) error {
+			return runConfig(args, os.Stdout)
+		}},
+		{name: bundleCommand, summary: "write a support bundle with the configuration, checks and logs, secrets redacted", run: func(args []string) error {
+			return runBundle(args, os.Stdout)
+		}},
+		{name: serviceCommand, summary: "print a systemd unit running the agent with the given flags", run: func(args []string) error {
+			return runService(args, os.Stdout)
+		}},
+		{name: migrateLegacyCommand, summary: "print the flags equivalent to the ssh arguments of a legacy invocation", run: func(args []string) error {
+			return runMigrateLegacy(args, os.Stdout)
+		}},
+		{name: selfUpdateCommand, summary: "replace the agent binary with the latest release", run: runSelfUpdate},
+		{name: versionCommand, summary: "print the version of the agent and of OpenSSH", run: func(args []string) error {
+			return runVersion(args, os.Stdout)
+		}},
+	}
+}
+
+const runCommand = "run"
+
+// errChecksFailed is returned by the commands which print a report of
+// checks when one of them failed. The report already describes the failure.
+var errChecksFailed = errors.New("some checks failed")
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// parseCommand returns the command of args, or nil when args are the flags
+// of the agent, or a legacy invocation of ssh, which may start with the
+// destination.
+func parseCommand(args []string) (*command, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return nil, nil
+	}
+	if cmd := findCommand(args[0]); cmd != nil {
+		return cmd, nil
+	}
+	if inLegacyMode(args) {
+		return nil, nil
+	}
+	return nil, unknownCommandError(args[0])
+}
+
+// unknownCommandError returns an error for a command which does not exist,
+// suggesting the closest one.
+func unknownCommandError(name string) error {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	if s := closest(name, names); s != "" {
+		return fmt.Errorf("unknown command %q, did you mean %q?", name, s)
+	}
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// printCommands prints the commands and their summary.
+func printCommands(w io.Writer) {
+	width := 0
+	for _, c := range commands {
+		width = max(width, len(c.name))
+	}
+	fmt.Fprintf(w, "Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-*s %s\n", width, c.name, c.summary)
+	}
+}
+
+// parseArgs parses args. When a flag does not exist, the returned error
+// suggests the closest flag.
+func parseArgs(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err == nil {
+		return nil
+	}
+
+	const undefined = "flag provided but not defined: -"
+	msg := err.Error()
+	if !strings.HasPrefix(msg, undefined) {
+		return err
+	}
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	if s := closest(strings.TrimPrefix(msg, undefined), names); s != "" {
+		err = fmt.Errorf("%w, did you mean -%s?", err, s)
+		fmt.Fprintln(fs.Output(), err)
+	}
+	return err
+}
+
+// printGroupedDefaults prints the flags of fs like PrintDefaults, grouped by
+// the prefix before the first dot of their name.
+func printGroupedDefaults(fs *flag.FlagSet) {
+	groups := map[string]*flag.FlagSet{}
+	fs.VisitAll(func(f *flag.Flag) {
+		group := "general"
+		if prefix, _, ok := strings.Cut(f.Name, "."); ok {
+			group = prefix
+		}
+		g, ok := groups[group]
+		if !ok {
+			g = flag.NewFlagSet(group, flag.ContinueOnError)
+			g.SetOutput(fs.Output())
+			groups[group] = g
+		}
+		g.Var(f.Value, f.Name, f.Usage)
+		// Var takes the current value as the default, which differs once
+		// the flags are parsed.
+		g.Lookup(f.Name).DefValue = f.DefValue
+	})
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		if name != "general" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := groups["general"]; ok {
+		names = append([]string{"general"}, names...)
+	}
+
+	for _, name := range names {
+		if name == "general" {
+			fmt.Fprintf(fs.Output(), "\nFlags:\n")
+		} else {
+			fmt.Fprintf(fs.Output(), "\n-%s.* flags:\n", name)
+		}
+		groups[name].PrintDefaults()
+	}
+}
+
+// closest returns the candidate closest to s, if it is close enough, at most
+// two edits away, to be a typo of it.
+func closest(s string, candidates []string) string {
+	best, bestDist := "", 3
+	for _, c := range candidates {
+		if d := editDistance(s, c); d < bestDist && d < len(s) {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
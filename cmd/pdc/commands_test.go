@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClosest(t *testing.T) {
+	t.Parallel()
+
+	candidates := []string{"token", "token-file", "cluster", "ssh-key-file", "h"}
+	testcases := []struct {
+		s        string
+		expected string
+	}{
+		{s: "tokn", expected: "token"},
+		{s: "toekn", expected: "token"},
+		{s: "token-fil", expected: "token-file"},
+		{s: "clustr", expected: "cluster"},
+		{s: "ssh-keyfile", expected: "ssh-key-file"},
+		{s: "x", expected: ""},
+		{s: "domain", expected: ""},
+	}
+
+	for _, tc := range testcases {
+		assert.Equal(t, tc.expected, closest(tc.s, candidates), tc.s)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	t.Parallel()
+
+	fs := flag.NewFlagSet("pdc", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.String("token", "", "")
+	fs.String("cluster", "", "")
+
+	require.NoError(t, parseArgs(fs, []string{"-token", "t"}))
+	assert.EqualError(t, parseArgs(fs, []string{"-tokne", "t"}), "flag provided but not defined: -tokne, did you mean -token?")
+	assert.EqualError(t, parseArgs(fs, []string{"-domain", "d"}), "flag provided but not defined: -domain")
+}
+
+func TestUnknownCommandError(t *testing.T) {
+	t.Parallel()
+
+	assert.EqualError(t, unknownCommandError("stauts"), `unknown command "stauts", did you mean "status"?`)
+	assert.EqualError(t, unknownCommandError("install"), `unknown command "install"`)
+}
+
+func TestParseCommand(t *testing.T) {
+	t.Parallel()
+
+	cmd, err := parseCommand([]string{"status", "-http.addr", ":8090"})
+	require.NoError(t, err)
+	assert.Equal(t, "status", cmd.name)
+
+	// The flags of the agent, and legacy invocations of ssh, including the
+	// ones starting with the destination, run the agent.
+	for _, args := range [][]string{
+		nil,
+		{"-token", "t", "-cluster", "prod"},
+		{"-p", "22", "-i", "key", "123@host.example"},
+		{"123@host.example", "-p", "22", "-R", "0"},
+	} {
+		cmd, err := parseCommand(args)
+		assert.NoError(t, err, args)
+		assert.Nil(t, cmd, args)
+	}
+
+	// A command taking legacy arguments is not mistaken for one.
+	cmd, err = parseCommand([]string{migrateLegacyCommand, "-p", "22", "123@host.example"})
+	require.NoError(t, err)
+	assert.Equal(t, migrateLegacyCommand, cmd.name)
+
+	_, err = parseCommand([]string{"stauts"})
+	assert.EqualError(t, err, `unknown command "stauts", did you mean "status"?`)
+}
+
+func TestPrintCommands(t *testing.T) {
+	t.Parallel()
+
+	out := &bytes.Buffer{}
+	printCommands(out)
+
+	// The summaries are aligned after the longest command name.
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")[1:]
+	require.Len(t, lines, len(commands))
+	column := strings.Index(lines[0], commands[0].summary)
+	for i, c := range commands {
+		assert.Equal(t, column, strings.Index(lines[i], c.summary), c.name)
+	}
+}
+
+func TestPrintGroupedDefaults(t *testing.T) {
+	t.Parallel()
+
+	out := &bytes.Buffer{}
+	fs := flag.NewFlagSet("pdc", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.String("ssh.binary-path", "ssh", "the ssh binary")
+	fs.String("cluster", "", "the cluster")
+	fs.Duration("api.timeout", 0, "the API timeout")
+	require.NoError(t, fs.Parse([]string{"-ssh.binary-path", "/usr/bin/ssh"}))
+
+	printGroupedDefaults(fs)
+	assert.Equal(t, `
+Flags:
+  -cluster string
+    	the cluster
+
+-api.* flags:
+  -api.timeout duration
+    	the API timeout
+
+-ssh.* flags:
+  -ssh.binary-path string
+    	the ssh binary (default "ssh")
+`, out.String())
+}
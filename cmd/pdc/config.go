@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const configCommand = "config"
+
+// recordingValue records the values a flag is set to, so that flags which
+// can be set more than once are printed with all their values.
+type recordingValue struct {
+	flag.Value
+	values []string
+}
+
+func (v *recordingValue) Set(s string) error {
+	v.values = append(v.values, s)
+	return v.Value.Set(s)
+}
+
+func (v *recordingValue) IsBoolFlag() bool {
+	b, ok := v.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// effectiveConfig is the configuration the agent runs with.
+type effectiveConfig struct {
+	// Flags are the values of all the flags, including defaults. Flags which
+	// can be set more than once have a list of values.
+	Flags map[string]interface{} `json:"flags" yaml:"flags"`
+	// Set are the names of the flags given on the command line.
+	Set []string `json:"set" yaml:"set"`
+	// Resolved are the values derived from several flags.
+	Resolved map[string]string `json:"resolved" yaml:"resolved"`
+}
+
+// agentFlags are the flags of the agent, which record the values they are
+// set to.
+type agentFlags struct {
+	mf        *mainFlags
+	ssh       *ssh.Config
+	pdc       *pdc.Config
+	recorders map[string]*recordingValue
+}
+
+// registerAgentFlags registers the flags of the agent on fs.
+func registerAgentFlags(fs *flag.FlagSet) *agentFlags {
+	a := &agentFlags{
+		mf:        &mainFlags{},
+		ssh:       ssh.DefaultConfig(),
+		pdc:       &pdc.Config{},
+		recorders: map[string]*recordingValue{},
+	}
+	a.mf.RegisterFlags(fs)
+	a.ssh.RegisterFlags(fs)
+	a.pdc.RegisterFlags(fs)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		rv := &recordingValue{Value: f.Value}
+		f.Value = rv
+		a.recorders[f.Name] = rv
+	})
+	return a
+}
+
+// secrets returns the secrets set by the flags.
+func (a *agentFlags) secrets() []string {
+	return agentSecrets(a.mf, a.pdc)
+}
+
+// effectiveConfig returns the configuration of the agent once fs is parsed,
+// with secrets redacted.
+func (a *agentFlags) effectiveConfig(fs *flag.FlagSet) (*effectiveConfig, error) {
+	secrets := a.secrets()
+	cfg := &effectiveConfig{
+		Flags:    map[string]interface{}{},
+		Set:      []string{},
+		Resolved: map[string]string{},
+	}
+	for name, rv := range a.recorders {
+		value := rv.String()
+		// Flags which can be set more than once, or are parsed by a
+		// function, don't keep the value they were set to.
+		if value == "" && len(rv.values) > 0 {
+			redacted := make([]string, len(rv.values))
+			for i, v := range rv.values {
+				redacted[i] = logging.Redact(v, secrets...)
+			}
+			cfg.Flags[name] = redacted
+			continue
+		}
+		cfg.Flags[name] = logging.Redact(value, secrets...)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := a.recorders[f.Name]; ok {
+			cfg.Set = append(cfg.Set, f.Name)
+		}
+	})
+
+	apiURL, gatewayURL, gatewayPort, err := resolveURLs(a.mf)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig, pdcClientCfg := *a.ssh, *a.pdc
+	if gatewayPort != 0 {
+		sshConfig.Port = gatewayPort
+	}
+	if a.mf.DevMode {
+		pdcClientCfg.URL = apiURL
+		sshConfig.URL = gatewayURL
+		if err := setDevelopmentConfig(a.mf, &sshConfig, &pdcClientCfg); err != nil {
+			return nil, err
+		}
+		apiURL, gatewayURL = pdcClientCfg.URL, sshConfig.URL
+	}
+	cfg.Resolved["api_url"] = logging.Redact(apiURL.String(), secrets...)
+	cfg.Resolved["gateway"] = fmt.Sprintf("%s:%d", gatewayURL, sshConfig.Port)
+	setDefaultTokenFile(&pdcClientCfg, &sshConfig)
+	cfg.Resolved["token_file"] = pdcClientCfg.TokenFile
+	return cfg, nil
+}
+
+// write writes cfg as YAML, or JSON if format is "json".
+func (cfg *effectiveConfig) write(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(cfg)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// runConfig runs the config subcommands. `config print` prints the
+// configuration the agent would run with, given the same flags, with secrets
+// redacted.
+func runConfig(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: %s %s print [flags]", os.Args[0], configCommand)
+	}
+
+	var format string
+	fs := flag.NewFlagSet(os.Args[0]+" "+configCommand+" print", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Prints the configuration the agent runs with given the same flags, with secrets redacted.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	agent := registerAgentFlags(fs)
+	fs.StringVar(&format, "format", "yaml", `the output format: "yaml" or "json"`)
+	if err := parseArgs(fs, args[1:]); err != nil {
+		return err
+	}
+	if agent.mf.PrintHelp {
+		fs.Usage()
+		return nil
+	}
+	if format != "yaml" && format != "json" {
+		return fmt.Errorf("invalid -format %q", format)
+	}
+
+	cfg, err := agent.effectiveConfig(fs)
+	if err != nil {
+		return err
+	}
+	return cfg.write(out, format)
+}
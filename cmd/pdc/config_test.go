@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunConfig(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := runConfig([]string{"print", "-format", "json",
+		"-token", "glc_s3cr3t", "-cluster", "prod", "-gcloud-hosted-grafana-id", "1",
+		"-api-url", "https://pdc.example.com", "-label", "env=prod", "-label", "team=a", "-network.token", "other=glc_0th3r",
+		"-log.push-password", "l0g_s3cr3t",
+	}, out)
+	require.NoError(t, err)
+	assert.NotContains(t, out.String(), "glc_s3cr3t")
+	assert.NotContains(t, out.String(), "glc_0th3r")
+	assert.NotContains(t, out.String(), "l0g_s3cr3t")
+
+	var cfg effectiveConfig
+	require.NoError(t, json.Unmarshal(out.Bytes(), &cfg))
+	assert.Equal(t, "<redacted>", cfg.Flags["token"])
+	assert.Equal(t, "prod", cfg.Flags["cluster"])
+	assert.Equal(t, "grafana.net", cfg.Flags["domain"])
+	assert.Equal(t, []interface{}{"env=prod", "team=a"}, cfg.Flags["label"])
+	assert.Equal(t, []interface{}{"other=<redacted>"}, cfg.Flags["network.token"])
+	assert.Equal(t, []string{"api-url", "cluster", "gcloud-hosted-grafana-id", "label", "log.push-password", "network.token", "token"}, cfg.Set)
+	assert.Equal(t, "https://pdc.example.com", cfg.Resolved["api_url"])
+	assert.Equal(t, "private-datasource-connect-prod.grafana.net:22", cfg.Resolved["gateway"])
+
+	t.Run("print is required", func(t *testing.T) {
+		assert.Error(t, runConfig(nil, out))
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const testCommand = "test"
+
+// Status of a step of the connectivity test.
+const (
+	stepOK      = "ok"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+type testStep struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type testReport struct {
+	OK    bool       `json:"ok"`
+	Steps []testStep `json:"steps"`
+
+	// blocked is true once a required step failed.
+	blocked bool
+}
+
+// run runs a step of the test. Once a required step failed, the next steps
+// are skipped.
+func (r *testReport) run(name string, required bool, fn func() (string, error)) {
+	if r.blocked {
+		r.Steps = append(r.Steps, testStep{Name: name, Status: stepSkipped})
+		return
+	}
+
+	start := time.Now()
+	detail, err := fn()
+	step := testStep{Name: name, Status: stepOK, DurationMS: time.Since(start).Milliseconds(), Detail: detail}
+	if err != nil {
+		step.Status = stepFailed
+		step.Error = err.Error()
+		r.OK = false
+		r.blocked = required
+	}
+	r.Steps = append(r.Steps, step)
+}
+
+// write prints the report, as JSON if asJSON is true. It returns
+// errChecksFailed if a step failed.
+func (r *testReport) write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	} else {
+		r.print(w)
+	}
+
+	if !r.OK {
+		return errChecksFailed
+	}
+	return nil
+}
+
+func (r *testReport) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, s := range r.Steps {
+		msg := s.Detail
+		if s.Error != "" {
+			msg = s.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%dms\t%s\n", s.Name, s.Status, s.DurationMS, msg)
+	}
+	_ = tw.Flush()
+}
+
+// runTest checks that the agent can connect: it generates a key pair in a
+// temporary directory, has it signed by the PDC API, and authenticates to the
+// gateway, without setting up a tunnel.
+func runTest(args []string, out io.Writer) error {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+	var asJSON bool
+	var timeout time.Duration
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+testCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Checks that the agent can connect, with the same flags as the agent: generates a key pair in a temporary directory, has it signed by the PDC API, and authenticates to the gateway without setting up a tunnel.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	mf.RegisterFlags(fs)
+	sshConfig.RegisterFlags(fs)
+	pdcClientCfg.RegisterFlags(fs)
+	fs.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	fs.DurationVar(&timeout, "timeout", 30*time.Second, "the timeout of the test")
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if mf.PrintHelp {
+		fs.Usage()
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	report := &testReport{OK: true}
+	var tmpDir string
+	defer func() {
+		if tmpDir != "" {
+			_ = os.RemoveAll(tmpDir)
+		}
+	}()
+
+	report.run("config", true, func() (string, error) {
+		if err := resolveConfig(ctx, mf, sshConfig, pdcClientCfg); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("api %s, gateway %s:%d", pdcClientCfg.URL, sshConfig.URL, sshConfig.Port), nil
+	})
+
+	// The ssh binary is not used by the test, but is required to run the
+	// agent.
+	report.run("ssh_binary", false, func() (string, error) {
+		return ssh.CheckSSH(ctx, sshConfig.BinaryPath)
+	})
+
+	report.run("certificate", true, func() (string, error) {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "pdc-test")
+		if err != nil {
+			return "", err
+		}
+		sshConfig.KeyFile = filepath.Join(tmpDir, "grafana_pdc")
+
+		// Logs go to stderr, so they don't mix with the report.
+		mf.LogSink = logging.SinkStderr
+		logger, _, _, err := setupLogger(mf, nil, agentSecrets(mf, pdcClientCfg)...)
+		if err != nil {
+			return "", err
+		}
+		pdcClient, err := pdc.NewClient(pdcClientCfg, logger)
+		if err != nil {
+			return "", err
+		}
+		if err := ssh.NewKeyManager(sshConfig, logger, pdcClient).CreateKeys(ctx); err != nil {
+			return "", err
+		}
+		return "key pair generated and signed by the PDC API", nil
+	})
+
+	report.run("gateway_handshake", true, func() (string, error) {
+		if err := ssh.Probe(ctx, sshConfig); err != nil {
+			return "", err
+		}
+		return "authenticated to the gateway", nil
+	})
+
+	return report.write(out, asJSON)
+}
+
+// resolveConfig loads the token, and sets the URLs and the options derived
+// from mf, the way the agent does on start.
+func resolveConfig(ctx context.Context, mf *mainFlags, sshConfig *ssh.Config, pdcClientCfg *pdc.Config) error {
+	setDefaultTokenFile(pdcClientCfg, sshConfig)
+	if err := pdcClientCfg.LoadToken(ctx); err != nil {
+		return err
+	}
+	apiURL, gatewayURL, gatewayPort, err := resolveURLs(mf)
+	if err != nil {
+		return err
+	}
+	pdcClientCfg.URL = apiURL
+	sshConfig.URL = gatewayURL
+	if gatewayPort != 0 {
+		sshConfig.Port = gatewayPort
+	}
+	if mf.DevMode {
+		if err := setDevelopmentConfig(mf, sshConfig, pdcClientCfg); err != nil {
+			return err
+		}
+	}
+	if mf.FIPS {
+		if err := sshConfig.EnableFIPS(); err != nil {
+			return err
+		}
+	}
+	sshConfig.PDC = *pdcClientCfg
+	return nil
+}
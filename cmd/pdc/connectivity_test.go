@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/pdc-agent/pkg/pdctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunTest(t *testing.T) {
+	ts := pdctest.NewServer(t, pdctest.Config{StatusCode: http.StatusUnauthorized})
+
+	testcases := []struct {
+		name     string
+		args     []string
+		statuses map[string]string
+	}{
+		{
+			name: "invalid config skips the next steps",
+			args: []string{"-api-url", "ftp://example.com"},
+			statuses: map[string]string{
+				"config":            stepFailed,
+				"certificate":       stepSkipped,
+				"gateway_handshake": stepSkipped,
+			},
+		},
+		{
+			name: "rejected token",
+			args: []string{"-api-url", ts.URL, "-gateway-url", "127.0.0.1:1", "-token", "token", "-gcloud-hosted-grafana-id", "1"},
+			statuses: map[string]string{
+				"config":            stepOK,
+				"certificate":       stepFailed,
+				"gateway_handshake": stepSkipped,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := runTest(append(tc.args, "-json", "-ssh-key-file", filepath.Join(t.TempDir(), "grafana_pdc")), out)
+			assert.ErrorIs(t, err, errChecksFailed)
+
+			var report testReport
+			require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+			assert.False(t, report.OK)
+			for _, s := range report.Steps {
+				if want, ok := tc.statuses[s.Name]; ok {
+					assert.Equal(t, want, s.Status, s.Name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const credentialsCommand = "credentials"
+
+// credentialsPassphraseEnv is the environment variable the passphrase of a
+// credentials bundle is read from when -passphrase-file is not set.
+const credentialsPassphraseEnv = "PDC_CREDENTIALS_PASSPHRASE"
+
+// credentialsMagic starts a credentials bundle. It is authenticated with the
+// encrypted credentials.
+var credentialsMagic = []byte("pdc-credentials-v1\n")
+
+const (
+	credentialsSaltSize = 16
+	// scrypt parameters recommended for interactive logins in 2017, see
+	// the scrypt package docs.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// runCredentials exports the credentials of the agent to an encrypted
+// bundle, or imports them from one.
+func runCredentials(args []string, out io.Writer) error {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		return fmt.Errorf("usage: %s %s export|import [flags]", os.Args[0], credentialsCommand)
+	}
+	export := args[0] == "export"
+
+	var file, passphraseFile string
+	var force bool
+	keyFile := ssh.DefaultConfig().KeyFile
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+credentialsCommand+" "+args[0], flag.ContinueOnError)
+	fs.Usage = func() {
+		desc := "Writes the key pair, certificate, known hosts and arguments hash of -ssh-key-file to a bundle encrypted with a passphrase, to move the identity of the agent to another host or bake it into an image."
+		if !export {
+			desc = "Writes the key pair, certificate, known hosts and arguments hash of an encrypted bundle to -ssh-key-file. The agent uses them without a new certificate as long as it runs with the same flags as the exporting agent."
+		}
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+%s The passphrase is read from -passphrase-file, or else from the %s environment variable.
+
+`, fs.Name(), desc, credentialsPassphraseEnv)
+		fs.PrintDefaults()
+	}
+	help := fs.Bool("h", false, "Print help")
+	fs.StringVar(&keyFile, "ssh-key-file", keyFile, "The path to the SSH key file.")
+	fs.StringVar(&file, "file", "pdc-credentials.bin", "the path of the bundle")
+	fs.StringVar(&passphraseFile, "passphrase-file", "", "the path of a file containing the passphrase of the bundle")
+	if !export {
+		fs.BoolVar(&force, "force", false, "replace an existing key file")
+	}
+	if err := parseArgs(fs, args[1:]); err != nil {
+		return err
+	}
+	if *help {
+		fs.Usage()
+		return nil
+	}
+
+	passphrase, err := readPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = keyFile
+
+	if export {
+		creds, err := ssh.ReadCredentials(sshConfig)
+		if err != nil {
+			return fmt.Errorf("reading credentials: %w", err)
+		}
+		defer creds.Wipe()
+		data, err := sealCredentials(creds, passphrase)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "credentials of %s written to %s\n", keyFile, file)
+		return err
+	}
+
+	if _, err := os.Stat(keyFile); err == nil && !force {
+		return fmt.Errorf("%s already exists, set -force to replace it", keyFile)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	creds, err := openCredentials(data, passphrase)
+	if err != nil {
+		return err
+	}
+	defer creds.Wipe()
+	if err := ssh.WriteCredentials(sshConfig, creds); err != nil {
+		return fmt.Errorf("writing credentials: %w", err)
+	}
+	_, err = fmt.Fprintf(out, "credentials of %s written to %s\n", file, keyFile)
+	return err
+}
+
+// readPassphrase reads the passphrase from path, or else from the
+// environment.
+func readPassphrase(path string) ([]byte, error) {
+	passphrase := os.Getenv(credentialsPassphraseEnv)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("no passphrase: set -passphrase-file or %s", credentialsPassphraseEnv)
+	}
+	return []byte(passphrase), nil
+}
+
+// sealCredentials encrypts creds with AES-256-GCM, with a key derived from
+// passphrase with scrypt.
+func sealCredentials(creds *ssh.Credentials, passphrase []byte) ([]byte, error) {
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plaintext)
+
+	salt := make([]byte, credentialsSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := credentialsAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	data := append(append(append([]byte(nil), credentialsMagic...), salt...), nonce...)
+	return aead.Seal(data, nonce, plaintext, credentialsMagic), nil
+}
+
+// openCredentials decrypts a bundle written by sealCredentials.
+func openCredentials(data, passphrase []byte) (*ssh.Credentials, error) {
+	if !bytes.HasPrefix(data, credentialsMagic) {
+		return nil, errors.New("not a credentials bundle")
+	}
+	data = data[len(credentialsMagic):]
+	if len(data) < credentialsSaltSize {
+		return nil, errors.New("truncated credentials bundle")
+	}
+	salt, data := data[:credentialsSaltSize], data[credentialsSaltSize:]
+
+	aead, err := credentialsAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("truncated credentials bundle")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, credentialsMagic)
+	if err != nil {
+		return nil, errors.New("cannot decrypt credentials bundle: wrong passphrase or corrupted bundle")
+	}
+	defer clear(plaintext)
+
+	creds := &ssh.Credentials{}
+	if err := json.Unmarshal(plaintext, creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func credentialsAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikesmitty/edkey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestRunCredentials(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "grafana_pdc")
+	writeTestCredentials(t, keyFile)
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, os.WriteFile(passphraseFile, []byte("correct horse\n"), 0600))
+	bundle := filepath.Join(t.TempDir(), "credentials.bin")
+
+	out := &strings.Builder{}
+	require.NoError(t, runCredentials([]string{"export", "-ssh-key-file", keyFile, "-file", bundle, "-passphrase-file", passphraseFile}, out))
+	data, err := os.ReadFile(bundle)
+	require.NoError(t, err)
+	key, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), string(key))
+
+	t.Run("import", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "grafana_pdc")
+		require.NoError(t, runCredentials([]string{"import", "-ssh-key-file", target, "-file", bundle, "-passphrase-file", passphraseFile}, out))
+
+		for _, suffix := range []string{"", ".pub", "-cert.pub", "_hash"} {
+			expected, err := os.ReadFile(keyFile + suffix)
+			require.NoError(t, err)
+			actual, err := os.ReadFile(target + suffix)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual, suffix)
+		}
+		_, err := os.Stat(filepath.Join(filepath.Dir(target), ssh.KnownHostsFile))
+		assert.NoError(t, err)
+	})
+
+	t.Run("existing key file", func(t *testing.T) {
+		err := runCredentials([]string{"import", "-ssh-key-file", keyFile, "-file", bundle, "-passphrase-file", passphraseFile}, out)
+		assert.ErrorContains(t, err, "set -force to replace it")
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		t.Setenv(credentialsPassphraseEnv, "wrong")
+		err := runCredentials([]string{"import", "-ssh-key-file", filepath.Join(t.TempDir(), "grafana_pdc"), "-file", bundle}, out)
+		assert.ErrorContains(t, err, "wrong passphrase")
+	})
+
+	t.Run("no passphrase", func(t *testing.T) {
+		t.Setenv(credentialsPassphraseEnv, "")
+		err := runCredentials([]string{"export", "-ssh-key-file", keyFile, "-file", bundle}, out)
+		assert.ErrorContains(t, err, "no passphrase")
+	})
+}
+
+// writeTestCredentials writes a key pair, a certificate signed by a test CA,
+// a known hosts file and an arguments hash.
+func writeTestCredentials(t *testing.T, keyFile string) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := gossh.NewPublicKey(pub)
+	require.NoError(t, err)
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := gossh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	cert := &gossh.Certificate{
+		Key:             sshPub,
+		CertType:        gossh.UserCert,
+		KeyId:           "key",
+		ValidPrincipals: []string{"key"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+
+	key := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: edkey.MarshalED25519PrivateKey(priv)})
+	require.NoError(t, os.WriteFile(keyFile, key, 0600))
+	require.NoError(t, os.WriteFile(keyFile+".pub", gossh.MarshalAuthorizedKey(sshPub), 0600))
+	require.NoError(t, os.WriteFile(keyFile+"-cert.pub", gossh.MarshalAuthorizedKey(cert), 0600))
+	require.NoError(t, os.WriteFile(keyFile+"_hash", []byte("hash"), 0600))
+	kh := knownhosts.Line([]string{"gateway.example.com"}, ca.PublicKey()) + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(keyFile), ssh.KnownHostsFile), []byte(kh), 0600))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// newDebugMux returns the handler of the debug HTTP server. It is kept apart
+// from the agent HTTP server so profiling is never exposed by accident.
+func newDebugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// logGoroutineStacks writes the stack of every goroutine to the logger, one
+// log line per goroutine.
+func logGoroutineStacks(logger log.Logger) {
+	buf := &bytes.Buffer{}
+	if err := runtimepprof.Lookup("goroutine").WriteTo(buf, 2); err != nil {
+		level.Error(logger).Log("msg", "cannot dump goroutine stacks", "err", err)
+		return
+	}
+
+	for _, stack := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n\n")) {
+		level.Info(logger).Log("msg", "goroutine dump", "stack", stack)
+	}
+}
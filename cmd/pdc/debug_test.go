@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDebugMux(t *testing.T) {
+	t.Parallel()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/vars"} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			newDebugMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+		})
+	}
+}
+
+func TestLogGoroutineStacks(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	logGoroutineStacks(log.NewLogfmtLogger(buf))
+
+	assert.Contains(t, buf.String(), "TestLogGoroutineStacks")
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-kit/log"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+)
+
+// handleStackDumpSignal logs the goroutine stacks every time the process
+// receives SIGUSR1, until ctx is done.
+func handleStackDumpSignal(ctx context.Context, logger log.Logger) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+
+	crash.Go(func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				logGoroutineStacks(logger)
+			}
+		}
+	})
+}
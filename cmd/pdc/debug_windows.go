@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+)
+
+// handleStackDumpSignal is a no-op: there is no SIGUSR1 on Windows. Use the
+// -debug.addr endpoint instead.
+func handleStackDumpSignal(_ context.Context, _ log.Logger) {}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// discoveryTimeout bounds the discovery request, so that a slow PDC API does
+// not hold up the tunnel, which can use the gateway derived from -cluster.
+const discoveryTimeout = 10 * time.Second
+
+// discoveryEnabled is true when the gateways are not set by flags, so they
+// can be discovered from the PDC API.
+func discoveryEnabled(mf *mainFlags, sshConfig *ssh.Config) bool {
+	return mf.GatewayDiscovery && mf.GatewayURL == "" && !mf.DevMode &&
+		len(sshConfig.GatewayEndpoints) == 0 && !sshConfig.NoAPI && !sshConfig.LegacyMode
+}
+
+// discoverGateways returns the ssh gateways of the stack, in order of
+// preference, or nil if the PDC API does not return any. The agent then
+// connects to the gateway derived from -cluster and -domain.
+func discoverGateways(ctx context.Context, client pdc.Client, logger log.Logger) []pdc.Gateway {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+
+	d, err := client.Discover(ctx)
+	if errors.Is(err, pdc.ErrNotFound) {
+		level.Debug(logger).Log("msg", "the PDC API does not support gateway discovery, using the gateway of -cluster")
+		return nil
+	}
+	if err != nil {
+		level.Warn(logger).Log("msg", "cannot discover the gateways, using the gateway of -cluster", "err", err)
+		return nil
+	}
+
+	var gateways []pdc.Gateway
+	for _, g := range d.Gateways {
+		if g.Supports(pdc.TransportSSH) {
+			gateways = append(gateways, g)
+		}
+	}
+	if len(gateways) == 0 {
+		level.Warn(logger).Log("msg", "the PDC API returned no ssh gateway, using the gateway of -cluster", "gateways", len(d.Gateways))
+		return nil
+	}
+
+	endpoints := make([]string, len(gateways))
+	for i, g := range gateways {
+		endpoints[i] = gatewayEndpoint(g)
+	}
+	level.Info(logger).Log("msg", "discovered gateways", "gateways", strings.Join(endpoints, ","))
+	return gateways
+}
+
+// applyGateways sets the first of gateways as the gateway of cfg, and the
+// others as its -gateway.endpoints, so the tunnel connects to the one with the
+// lowest latency.
+func applyGateways(cfg *ssh.Config, gateways []pdc.Gateway) error {
+	u, err := url.Parse(gateways[0].Host)
+	if err != nil {
+		return fmt.Errorf("invalid discovered gateway: %w", err)
+	}
+	cfg.URL = u
+	if gateways[0].Port != 0 {
+		cfg.Port = gateways[0].Port
+	}
+
+	cfg.GatewayEndpoints = nil
+	for _, g := range gateways[1:] {
+		cfg.GatewayEndpoints = append(cfg.GatewayEndpoints, gatewayEndpoint(g))
+	}
+	return nil
+}
+
+// gatewayEndpoint returns the host[:port] of g.
+func gatewayEndpoint(g pdc.Gateway) string {
+	if g.Port == 0 {
+		return g.Host
+	}
+	return net.JoinHostPort(g.Host, strconv.Itoa(g.Port))
+}
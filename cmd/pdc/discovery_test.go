@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverGateways(t *testing.T) {
+	status, body := http.StatusOK, ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	client, err := pdc.NewClient(&pdc.Config{URL: u}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	// Gateways without the ssh transport are skipped.
+	body = `{"gateways":[{"host":"gw-a.example.com","transports":["quic"]},{"host":"gw-b.example.com","port":2222},{"host":"gw-c.example.com"}]}`
+	gateways := discoverGateways(context.Background(), client, log.NewNopLogger())
+	assert.Equal(t, []pdc.Gateway{{Host: "gw-b.example.com", Port: 2222}, {Host: "gw-c.example.com"}}, gateways)
+
+	body = `{"gateways":[{"host":"gw-a.example.com","transports":["quic"]}]}`
+	assert.Nil(t, discoverGateways(context.Background(), client, log.NewNopLogger()), "no ssh gateway")
+
+	status, body = http.StatusNotFound, ""
+	assert.Nil(t, discoverGateways(context.Background(), client, log.NewNopLogger()), "older PDC API")
+}
+
+func TestApplyGateways(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	cfg.URL, _ = url.Parse("private-datasource-connect-prod-us-east-0.grafana.net")
+
+	require.NoError(t, applyGateways(cfg, []pdc.Gateway{{Host: "gw-b.example.com", Port: 2222}, {Host: "gw-c.example.com"}, {Host: "gw-d.example.com", Port: 2223}}))
+	assert.Equal(t, "gw-b.example.com", cfg.URL.String())
+	assert.Equal(t, 2222, cfg.Port)
+	assert.Equal(t, []string{"gw-c.example.com", "gw-d.example.com:2223"}, cfg.GatewayEndpoints)
+
+	// The port of the flags is kept when the gateway has none.
+	cfg = ssh.DefaultConfig()
+	require.NoError(t, applyGateways(cfg, []pdc.Gateway{{Host: "gw-c.example.com"}}))
+	assert.Equal(t, 22, cfg.Port)
+	assert.Empty(t, cfg.GatewayEndpoints)
+}
+
+func TestDiscoveryEnabled(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	assert.True(t, discoveryEnabled(&mainFlags{GatewayDiscovery: true}, cfg))
+	assert.False(t, discoveryEnabled(&mainFlags{}, cfg))
+	assert.False(t, discoveryEnabled(&mainFlags{GatewayDiscovery: true, GatewayURL: "gw.example.com"}, cfg))
+	assert.False(t, discoveryEnabled(&mainFlags{GatewayDiscovery: true, DevMode: true}, cfg))
+
+	cfg.GatewayEndpoints = []string{"gw-b.example.com"}
+	assert.False(t, discoveryEnabled(&mainFlags{GatewayDiscovery: true}, cfg))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const doctorCommand = "doctor"
+
+// runDoctor checks the local setup of the agent, without contacting the PDC
+// API or the gateway, unless the token is read from a secret manager.
+func runDoctor(args []string, out io.Writer) error {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+	var asJSON bool
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+doctorCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Checks the local setup of the agent, with the same flags as the agent: the ssh binary, the token, and the key pair, certificate and known hosts files.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	mf.RegisterFlags(fs)
+	sshConfig.RegisterFlags(fs)
+	pdcClientCfg.RegisterFlags(fs)
+	fs.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if mf.PrintHelp {
+		fs.Usage()
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	return doctorReport(ctx, sshConfig, pdcClientCfg).write(out, asJSON)
+}
+
+// doctorReport checks the local setup of the agent.
+func doctorReport(ctx context.Context, sshConfig *ssh.Config, pdcClientCfg *pdc.Config) *testReport {
+	report := &testReport{OK: true}
+
+	report.run("ssh_binary", false, func() (string, error) {
+		return ssh.CheckSSH(ctx, sshConfig.BinaryPath)
+	})
+
+	report.run("token", false, func() (string, error) {
+		setDefaultTokenFile(pdcClientCfg, sshConfig)
+		if err := pdcClientCfg.LoadToken(ctx); err != nil {
+			return "", err
+		}
+		if pdcClientCfg.Auth.Mode != pdc.AuthModeToken {
+			return fmt.Sprintf("-auth.mode=%s", pdcClientCfg.Auth.Mode), nil
+		}
+		if pdcClientCfg.Token == "" {
+			return "", fmt.Errorf("no token: set -token, -token-source, or run %s %s", os.Args[0], enrollCommand)
+		}
+		return "token set", nil
+	})
+
+	report.run("key_file", false, func() (string, error) {
+		if err := checkPrivateFile(sshConfig.KeyFile); err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(sshConfig.KeyFile)
+		if err != nil {
+			return "", err
+		}
+		if _, err := gossh.ParseRawPrivateKey(data); err != nil {
+			return "", fmt.Errorf("parsing key file: %w", err)
+		}
+		return sshConfig.KeyFile, nil
+	})
+
+	report.run("certificate", false, func() (string, error) {
+		cert, err := ssh.ReadCertificate(sshConfig.KeyFile)
+		if err != nil {
+			return "", err
+		}
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		switch now := time.Now(); {
+		case now.Before(time.Unix(int64(cert.ValidAfter), 0)):
+			return "", errors.New("the certificate is not yet valid, check the clock of the host")
+		case !now.Before(validBefore):
+			return "", fmt.Errorf("the certificate expired at %s, the agent renews it on start", validBefore.UTC().Format(time.RFC3339))
+		}
+		return fmt.Sprintf("valid until %s", validBefore.UTC().Format(time.RFC3339)), nil
+	})
+
+	report.run("known_hosts", false, func() (string, error) {
+		path := sshConfig.KnownHostsFilePath()
+		if err := checkPrivateFile(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	})
+
+	return report
+}
+
+// checkPrivateFile returns an error if path does not exist, or can be read by
+// other users.
+func checkPrivateFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// File modes don't reflect the ACLs of files on Windows.
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s has mode %s, it should only be accessible by its owner", path, fi.Mode().Perm())
+	}
+	return nil
+}
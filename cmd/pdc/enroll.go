@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const enrollCommand = "enroll"
+
+// setDefaultTokenFile stores the token next to the ssh key file, unless
+// -token-file is set.
+func setDefaultTokenFile(pdcConfig *pdc.Config, sshConfig *ssh.Config) {
+	if pdcConfig.TokenFile == "" {
+		pdcConfig.TokenFile = sshConfig.KeyFile + "_token"
+	}
+}
+
+// runEnroll exchanges a one-time enrollment code for a token, and writes the
+// token to the token file, where the agent reads it on start.
+func runEnroll(args []string) error {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+	var code string
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+enrollCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Exchanges a one-time enrollment code for a token, and stores it in -token-file.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	mf.RegisterFlags(fs)
+	sshConfig.RegisterFlags(fs)
+	pdcClientCfg.RegisterFlags(fs)
+	fs.StringVar(&code, "code", "", "The one-time enrollment code")
+
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if mf.PrintHelp {
+		fs.Usage()
+		return nil
+	}
+	if code == "" {
+		return errors.New("-code is required")
+	}
+
+	logger, _, _, err := setupLogger(mf, nil, code)
+	if err != nil {
+		return fmt.Errorf("setting up logger: %w", err)
+	}
+
+	apiURL, _, _, err := resolveURLs(mf)
+	if err != nil {
+		return err
+	}
+	pdcClientCfg.URL = apiURL
+	setDefaultTokenFile(pdcClientCfg, sshConfig)
+
+	pdcClient, err := pdc.NewClient(pdcClientCfg, logger)
+	if err != nil {
+		return fmt.Errorf("cannot initialise PDC client: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	resp, err := pdcClient.Enroll(ctx, code)
+	if err != nil {
+		return fmt.Errorf("enrolling agent: %w", err)
+	}
+
+	if err := pdc.WriteTokenFile(pdcClientCfg.TokenFile, resp.Token); err != nil {
+		return fmt.Errorf("writing token file: %w", err)
+	}
+
+	level.Info(logger).Log("msg", "agent enrolled", "token_file", pdcClientCfg.TokenFile)
+	return nil
+}
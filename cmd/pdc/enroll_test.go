@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunEnroll(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body["code"] != "ABCD-1234" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token":"scoped token"}`))
+	}))
+	t.Cleanup(ts.Close)
+
+	keyFile := filepath.Join(t.TempDir(), "grafana_pdc")
+
+	t.Run("writes the token next to the key file", func(t *testing.T) {
+		err := runEnroll([]string{"-api-url", ts.URL, "-ssh-key-file", keyFile, "-code", "ABCD-1234"})
+		require.NoError(t, err)
+
+		token, err := os.ReadFile(keyFile + "_token")
+		require.NoError(t, err)
+		assert.Equal(t, "scoped token\n", string(token))
+	})
+
+	t.Run("invalid code", func(t *testing.T) {
+		err := runEnroll([]string{"-api-url", ts.URL, "-ssh-key-file", keyFile, "-code", "WRONG"})
+		assert.Error(t, err)
+	})
+
+	t.Run("code is required", func(t *testing.T) {
+		err := runEnroll([]string{"-api-url", ts.URL, "-ssh-key-file", keyFile})
+		assert.EqualError(t, err, "-code is required")
+	})
+}
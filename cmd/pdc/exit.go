@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/grafana/pdc-agent/pkg/approval"
+	"github.com/grafana/pdc-agent/pkg/exitcode"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// configError is an invalid flag or configuration found by run, for the agent
+// to exit with exitcode.Config.
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string { return e.err.Error() }
+func (e configError) Unwrap() error { return e.err }
+
+// exitCode returns the exit code of the agent for the error of run.
+func exitCode(err error) int {
+	var cfgErr configError
+	switch {
+	case err == nil:
+		return exitcode.OK
+	case errors.As(err, &cfgErr):
+		return exitcode.Config
+	case errors.Is(err, pdc.ErrInvalidCredentials):
+		return exitcode.Auth
+	case errors.Is(err, ssh.ErrSigningFailed):
+		return exitcode.CertSigning
+	case errors.Is(err, ssh.ErrSSHNotFound), errors.Is(err, ssh.ErrSSHTooOld):
+		return exitcode.SSH
+	case errors.Is(err, approval.ErrDenied):
+		return exitcode.Approval
+	case errors.Is(err, ssh.ErrRetryBudgetExhausted):
+		return exitcode.RetryBudgetExhausted
+	default:
+		return exitcode.Error
+	}
+}
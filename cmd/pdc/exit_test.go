@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/grafana/dskit/services"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/pdc-agent/pkg/approval"
+	"github.com/grafana/pdc-agent/pkg/exitcode"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestExitCode(t *testing.T) {
+	// The errors of the ssh clients are wrapped by the failure of the
+	// service.
+	failedService := func(err error) error {
+		s := services.NewIdleService(func(context.Context) error { return err }, nil)
+		return services.StartAndAwaitRunning(context.Background(), s)
+	}
+
+	testcases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "nil", err: nil, want: exitcode.OK},
+		{name: "other", err: errors.New("failed"), want: exitcode.Error},
+		{name: "expiring certificate", err: errCertificateExpiring, want: exitcode.Error},
+		{name: "config", err: configError{errors.New("-status.file-interval must be positive")}, want: exitcode.Config},
+		{name: "wrapped config", err: fmt.Errorf("starting: %w", configError{errors.New("invalid")}), want: exitcode.Config},
+		{name: "invalid token", err: failedService(fmt.Errorf("ensuring certificate exists: %w: %w", ssh.ErrSigningFailed, pdc.ErrInvalidCredentials)), want: exitcode.Auth},
+		{name: "signing", err: failedService(fmt.Errorf("ensuring certificate exists: %w: %w", ssh.ErrSigningFailed, pdc.ErrInternal)), want: exitcode.CertSigning},
+		{name: "ssh not found", err: failedService(fmt.Errorf("%w: not in $PATH", ssh.ErrSSHNotFound)), want: exitcode.SSH},
+		{name: "ssh too old", err: failedService(fmt.Errorf("%w: OpenSSH_6.0", ssh.ErrSSHTooOld)), want: exitcode.SSH},
+		{name: "retry budget", err: failedService(fmt.Errorf("%w: ssh client exited", ssh.ErrRetryBudgetExhausted)), want: exitcode.RetryBudgetExhausted},
+		{name: "not approved", err: fmt.Errorf("%w by -approval.command: exit status 1", approval.ErrDenied), want: exitcode.Approval},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, exitCode(tc.err))
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// failoverProbeTimeout bounds each request to the API and connection to the
+// gateway of a cluster.
+const failoverProbeTimeout = 10 * time.Second
+
+var failoverActive = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "pdc_agent_failover_active",
+	Help: "1 while the tunnel is connected to the -failover.cluster, 0 while it is connected to the primary cluster.",
+})
+
+var failoverSwitches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_failover_switches_total",
+	Help: "The number of times the tunnel switched cluster, by the cluster it switched to: primary or failover.",
+}, []string{"to"})
+
+// failoverConfig configures a secondary cluster, which the tunnel of the
+// -token flag fails over to while the primary cluster is unreachable.
+type failoverConfig struct {
+	Cluster string
+	Domain  string
+	// After is how long the primary cluster must be unreachable before the
+	// tunnel fails over, and reachable again before it fails back.
+	After time.Duration
+	// ProbeInterval is how often the API and gateway of the primary cluster
+	// are probed.
+	ProbeInterval time.Duration
+}
+
+func (fc *failoverConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&fc.Cluster, "failover.cluster", "", "a secondary PDC cluster of the same stack, which the tunnel connects to while neither the API nor the gateway of the primary cluster can be reached for -failover.after. Disabled if empty")
+	fs.StringVar(&fc.Domain, "failover.domain", defaultDomain, "the domain of -failover.cluster")
+	fs.DurationVar(&fc.After, "failover.after", 5*time.Minute, "how long the primary cluster must be unreachable before the tunnel fails over, and reachable again before it fails back")
+	fs.DurationVar(&fc.ProbeInterval, "failover.probe-interval", 30*time.Second, "how often the API and gateway of the primary cluster are probed, with -failover.cluster")
+}
+
+func (fc failoverConfig) enabled() bool {
+	return fc.Cluster != ""
+}
+
+// validate checks fc against the other flags. Only the tunnel of the -token
+// flag can fail over.
+func (fc failoverConfig) validate(mf *mainFlags, sshConfig *ssh.Config, pdcConfig *pdc.Config) error {
+	if !fc.enabled() {
+		return nil
+	}
+	switch {
+	case fc.After <= 0:
+		return errors.New("-failover.after must be positive")
+	case fc.ProbeInterval <= 0:
+		return errors.New("-failover.probe-interval must be positive")
+	case fc.Cluster == mf.Cluster && fc.Domain == mf.Domain:
+		return errors.New("-failover.cluster must differ from -cluster")
+	case mf.DevMode:
+		return errors.New("-failover.cluster cannot be used with -dev-mode")
+	case sshConfig.NoAPI:
+		return errors.New("-failover.cluster requires the PDC API, and cannot be used with -no-api")
+	case len(mf.Networks) > 0 || len(pdcConfig.Stacks()) > 0:
+		return errors.New("-failover.cluster cannot be used with -network.token or -stack.token")
+	}
+	return nil
+}
+
+// tunnelConfig returns the configuration of the tunnel of tc to the failover
+// cluster. It uses its own key, hash and known hosts files, next to the ones
+// of tc, so that the certificates and host keys of both clusters are kept.
+func (fc failoverConfig) tunnelConfig(tc tunnelConfig) (tunnelConfig, error) {
+	api, gateway, err := createURLsFromCluster(fc.Cluster, fc.Domain)
+	if err != nil {
+		return tunnelConfig{}, fmt.Errorf("parsing the URLs of -failover.cluster: %w", err)
+	}
+
+	pc := *tc.pdc
+	pc.URL = api
+
+	sc := *tc.ssh
+	sc.URL = gateway
+	sc.Port = ssh.DefaultConfig().Port
+	// The endpoints of the primary cluster do not serve the failover one.
+	sc.GatewayEndpoints = nil
+	sc.KeyFile = tc.ssh.KeyFile + "_failover"
+	if tc.ssh.HashFile != "" {
+		sc.HashFile = tc.ssh.HashFile + "_failover"
+	}
+	// The host keys of the clusters differ: sharing the known hosts file,
+	// each key manager would drop the keys of the other cluster.
+	sc.KnownHostsFile = tc.ssh.KnownHostsFilePath() + "_failover"
+	sc.PDC = pc
+
+	return tunnelConfig{network: tc.network, stack: tc.stack, ssh: &sc, pdc: &pc}, nil
+}
+
+// failoverSite is a cluster the failover tunnel connects to.
+type failoverSite struct {
+	name string
+	// newClient returns a new client to the cluster. A stopped client cannot
+	// be started again, so one is created on every switch.
+	newClient func() tunnelClient
+	// reachable is true when the API or the gateway of the cluster answers.
+	reachable func(ctx context.Context) bool
+}
+
+// siteReachable returns whether the PDC API at api answers an HTTP request,
+// whatever its status, or the gateway of sshConfig sends an ssh banner.
+func siteReachable(api *url.URL, sshConfig *ssh.Config) func(ctx context.Context) bool {
+	httpClient := &http.Client{Timeout: failoverProbeTimeout}
+	return func(ctx context.Context) bool {
+		ctx, cancel := context.WithTimeout(ctx, failoverProbeTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.String(), nil)
+		if err == nil {
+			if resp, err := httpClient.Do(req); err == nil {
+				resp.Body.Close()
+				return true
+			}
+		}
+		return ssh.ProbeGateway(ctx, sshConfig) == nil
+	}
+}
+
+// failoverTunnel runs the tunnel to the primary cluster, and replaces it with
+// a tunnel to the secondary cluster once the primary one has been unreachable
+// for after. It fails back once the primary cluster has been reachable again
+// for after.
+type failoverTunnel struct {
+	*services.BasicService
+	logger             log.Logger
+	primary, secondary failoverSite
+	after              time.Duration
+	probeInterval      time.Duration
+
+	// mu guards active and onSecondary, and the settings applied to the
+	// clients created on a switch.
+	mu                sync.Mutex
+	active            tunnelClient
+	onSecondary       bool
+	logLevel          *int
+	certCheckInterval *time.Duration
+}
+
+// newFailoverTunnel returns the tunnel of tc, which fails over to the cluster
+// of fc. km manages the keys of tc.
+func newFailoverTunnel(fc failoverConfig, tc tunnelConfig, km *ssh.KeyManager, logger log.Logger) (*failoverTunnel, error) {
+	secondary, err := fc.tunnelConfig(tc)
+	if err != nil {
+		return nil, err
+	}
+	secondaryLogger := log.With(logger, "cluster", fc.Cluster)
+	pdcClient, err := pdc.NewClient(secondary.pdc, secondaryLogger)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialise the PDC client of -failover.cluster: %w", err)
+	}
+	secondaryKM := ssh.NewKeyManager(secondary.ssh, secondaryLogger, pdcClient)
+
+	primarySSH := tc.ssh
+	t := &failoverTunnel{
+		logger: logger,
+		primary: failoverSite{
+			name:      "primary",
+			newClient: func() tunnelClient { return ssh.NewClient(primarySSH, logger, km) },
+			reachable: siteReachable(tc.pdc.URL, primarySSH),
+		},
+		secondary: failoverSite{
+			name:      "failover",
+			newClient: func() tunnelClient { return ssh.NewClient(secondary.ssh, secondaryLogger, secondaryKM) },
+			reachable: siteReachable(secondary.pdc.URL, secondary.ssh),
+		},
+		after:         fc.After,
+		probeInterval: fc.ProbeInterval,
+	}
+	t.BasicService = services.NewBasicService(t.starting, t.running, t.stopping)
+	return t, nil
+}
+
+// starting starts the tunnel to the primary cluster, or to the secondary
+// one if the primary cluster cannot be reached.
+func (t *failoverTunnel) starting(ctx context.Context) error {
+	defer crash.Recover()
+
+	client := t.primary.newClient()
+	err := services.StartAndAwaitRunning(ctx, client)
+	if err == nil {
+		t.setActive(client, false)
+		return nil
+	}
+	if ctx.Err() != nil || t.primary.reachable(ctx) {
+		return err
+	}
+
+	level.Warn(t.logger).Log("msg", "cannot start the tunnel to the primary cluster, which is unreachable. Failing over", "err", err)
+	client = t.secondary.newClient()
+	if err := services.StartAndAwaitRunning(ctx, client); err != nil {
+		return err
+	}
+	t.setActive(client, true)
+	failoverSwitches.WithLabelValues(t.secondary.name).Inc()
+	return nil
+}
+
+func (t *failoverTunnel) running(ctx context.Context) error {
+	defer crash.Recover()
+
+	ticker := time.NewTicker(t.probeInterval)
+	defer ticker.Stop()
+
+	// since is when the primary cluster started to be in the state which
+	// switches the tunnel: unreachable while on the primary cluster, and
+	// reachable while on the secondary one.
+	var since time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		active, onSecondary := t.current()
+		if active.State() == services.Failed {
+			// A client which gave up reconnecting is replaced with one to
+			// the other cluster, if it can be reached.
+			err := active.FailureCase()
+			other := t.secondary
+			if onSecondary {
+				other = t.primary
+			}
+			if !errors.Is(err, ssh.ErrRetryBudgetExhausted) || !other.reachable(ctx) {
+				return err
+			}
+			level.Warn(t.logger).Log("msg", "the tunnel gave up reconnecting, switching cluster", "err", err)
+			if err := t.switchTo(ctx, other, !onSecondary); err != nil {
+				return err
+			}
+			since = time.Time{}
+			continue
+		}
+
+		if t.primary.reachable(ctx) != onSecondary {
+			since = time.Time{}
+			continue
+		}
+		if since.IsZero() {
+			since = time.Now()
+			if onSecondary {
+				level.Info(t.logger).Log("msg", "the primary cluster is reachable again", "fail_back_in", t.after)
+			} else {
+				level.Warn(t.logger).Log("msg", "the primary cluster is unreachable", "fail_over_in", t.after)
+			}
+		}
+		if time.Since(since) < t.after {
+			continue
+		}
+
+		to := t.primary
+		if !onSecondary {
+			to = t.secondary
+			if !to.reachable(ctx) {
+				level.Warn(t.logger).Log("msg", "the failover cluster is unreachable too, keeping the primary cluster")
+				continue
+			}
+		}
+		if err := t.switchTo(ctx, to, !onSecondary); err != nil {
+			return err
+		}
+		since = time.Time{}
+	}
+}
+
+// switchTo replaces the active client with a client to site. The active
+// client is stopped first, as both would set up the same port forwards. If
+// the new client cannot start, a new client to the previous cluster is
+// started instead.
+func (t *failoverTunnel) switchTo(ctx context.Context, site failoverSite, onSecondary bool) error {
+	level.Info(t.logger).Log("msg", "switching the tunnel", "to", site.name)
+
+	previous, wasSecondary := t.current()
+	previous.StopAsync()
+	_ = previous.AwaitTerminated(context.Background())
+
+	next := t.newClient(site)
+	err := services.StartAndAwaitRunning(ctx, next)
+	if err == nil {
+		t.setActive(next, onSecondary)
+		failoverSwitches.WithLabelValues(site.name).Inc()
+		// The certificate may have expired while the tunnel was connected
+		// to the other cluster.
+		_ = next.RenewCertificate()
+		return nil
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	level.Error(t.logger).Log("msg", "cannot start the tunnel, keeping the current cluster", "to", site.name, "err", err)
+	back := t.secondary
+	if !wasSecondary {
+		back = t.primary
+	}
+	next = t.newClient(back)
+	if err := services.StartAndAwaitRunning(ctx, next); err != nil {
+		return err
+	}
+	t.setActive(next, wasSecondary)
+	return nil
+}
+
+func (t *failoverTunnel) stopping(_ error) error {
+	active, _ := t.current()
+	if active == nil {
+		return nil
+	}
+	active.StopAsync()
+	_ = active.AwaitTerminated(context.Background())
+	return nil
+}
+
+// newClient returns a client to site, with the settings changed on the
+// previous clients.
+func (t *failoverTunnel) newClient(site failoverSite) tunnelClient {
+	client := site.newClient()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.logLevel != nil {
+		client.SetLogLevel(*t.logLevel)
+	}
+	if t.certCheckInterval != nil {
+		client.SetCertCheckInterval(*t.certCheckInterval)
+	}
+	return client
+}
+
+func (t *failoverTunnel) setActive(client tunnelClient, onSecondary bool) {
+	t.mu.Lock()
+	t.active, t.onSecondary = client, onSecondary
+	t.mu.Unlock()
+
+	if onSecondary {
+		failoverActive.Set(1)
+	} else {
+		failoverActive.Set(0)
+	}
+}
+
+func (t *failoverTunnel) current() (tunnelClient, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active, t.onSecondary
+}
+
+func (t *failoverTunnel) SetLogLevel(lvl int) {
+	t.mu.Lock()
+	t.logLevel = &lvl
+	active := t.active
+	t.mu.Unlock()
+
+	if active != nil {
+		active.SetLogLevel(lvl)
+	}
+}
+
+func (t *failoverTunnel) SetCertCheckInterval(d time.Duration) {
+	t.mu.Lock()
+	t.certCheckInterval = &d
+	active := t.active
+	t.mu.Unlock()
+
+	if active != nil {
+		active.SetCertCheckInterval(d)
+	}
+}
+
+func (t *failoverTunnel) Reconnect() {
+	if active, _ := t.current(); active != nil {
+		active.Reconnect()
+	}
+}
+
+func (t *failoverTunnel) RenewCertificate() error {
+	active, _ := t.current()
+	if active == nil {
+		return errors.New("the tunnel is not started")
+	}
+	return active.RenewCertificate()
+}
+
+// Status returns the status of the active client.
+func (t *failoverTunnel) Status() ssh.Status {
+	active, _ := t.current()
+	if active == nil {
+		return ssh.Status{}
+	}
+	return active.Status()
+}
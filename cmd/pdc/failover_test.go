@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/pdctest"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeTunnel is a tunnelClient which does not connect anywhere. It fails
+// with the error sent to fail.
+type fakeTunnel struct {
+	*services.BasicService
+	site     string
+	logLevel atomic.Int32
+	renewed  atomic.Int32
+	fail     chan error
+}
+
+func newFakeTunnel(site string, startErr error) *fakeTunnel {
+	t := &fakeTunnel{site: site, fail: make(chan error, 1)}
+	t.BasicService = services.NewBasicService(func(context.Context) error { return startErr }, func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-t.fail:
+			return err
+		}
+	}, nil)
+	return t
+}
+
+func (t *fakeTunnel) SetLogLevel(lvl int)                { t.logLevel.Store(int32(lvl)) }
+func (t *fakeTunnel) SetCertCheckInterval(time.Duration) {}
+func (t *fakeTunnel) Reconnect()                         {}
+func (t *fakeTunnel) Status() ssh.Status                 { return ssh.Status{} }
+
+func (t *fakeTunnel) RenewCertificate() error {
+	t.renewed.Add(1)
+	return nil
+}
+
+// testFailoverTunnel returns a failover tunnel between fake clients. The
+// primary cluster is reachable while primaryUp is true, and its clients fail
+// to start with primaryErr.
+func testFailoverTunnel(primaryUp *atomic.Bool, primaryErr error) (*failoverTunnel, func() []*fakeTunnel) {
+	var created []*fakeTunnel
+	var mu sync.Mutex
+	site := func(name string, startErr error, reachable func() bool) failoverSite {
+		return failoverSite{
+			name: name,
+			newClient: func() tunnelClient {
+				c := newFakeTunnel(name, startErr)
+				mu.Lock()
+				created = append(created, c)
+				mu.Unlock()
+				return c
+			},
+			reachable: func(context.Context) bool { return reachable() },
+		}
+	}
+	ft := &failoverTunnel{
+		logger:        log.NewNopLogger(),
+		primary:       site("primary", primaryErr, primaryUp.Load),
+		secondary:     site("failover", nil, func() bool { return true }),
+		after:         50 * time.Millisecond,
+		probeInterval: 10 * time.Millisecond,
+	}
+	ft.BasicService = services.NewBasicService(ft.starting, ft.running, ft.stopping)
+	return ft, func() []*fakeTunnel {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*fakeTunnel(nil), created...)
+	}
+}
+
+func activeSite(ft *failoverTunnel) string {
+	active, _ := ft.current()
+	return active.(*fakeTunnel).site
+}
+
+func TestFailoverTunnel(t *testing.T) {
+	var primaryUp atomic.Bool
+	primaryUp.Store(true)
+	ft, created := testFailoverTunnel(&primaryUp, nil)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ft))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ft))
+		for _, c := range created() {
+			assert.Equal(t, services.Terminated, c.State())
+		}
+	}()
+	assert.Equal(t, "primary", activeSite(ft))
+
+	ft.SetLogLevel(3)
+
+	// The tunnel fails over once the primary cluster is unreachable for
+	// after, with the settings of the previous client.
+	primaryUp.Store(false)
+	require.Eventually(t, func() bool { return activeSite(ft) == "failover" }, 5*time.Second, 10*time.Millisecond)
+	clients := created()
+	require.Len(t, clients, 2)
+	assert.Equal(t, services.Terminated, clients[0].State())
+	assert.Equal(t, int32(3), clients[1].logLevel.Load())
+	assert.Equal(t, int32(1), clients[1].renewed.Load())
+
+	// And fails back once it is reachable again.
+	primaryUp.Store(true)
+	require.Eventually(t, func() bool { return activeSite(ft) == "primary" }, 5*time.Second, 10*time.Millisecond)
+	clients = created()
+	require.Len(t, clients, 3)
+	assert.Equal(t, services.Terminated, clients[1].State())
+}
+
+func TestFailoverTunnel_RetryBudgetExhausted(t *testing.T) {
+	// The tunnel fails over at once when the client to the primary cluster
+	// gives up reconnecting, although the PDC API of the cluster answers.
+	var primaryUp atomic.Bool
+	primaryUp.Store(true)
+	ft, created := testFailoverTunnel(&primaryUp, nil)
+	ft.after = time.Hour
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ft))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ft))
+	}()
+
+	created()[0].fail <- fmt.Errorf("%w: ssh client exited", ssh.ErrRetryBudgetExhausted)
+	require.Eventually(t, func() bool { return activeSite(ft) == "failover" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, services.Running, ft.State())
+}
+
+func TestFailoverTunnel_StartUnreachable(t *testing.T) {
+	var primaryUp atomic.Bool
+	ft, _ := testFailoverTunnel(&primaryUp, errors.New("cannot sign the certificate"))
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ft))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ft))
+	}()
+	assert.Equal(t, "failover", activeSite(ft))
+}
+
+func TestFailoverTunnel_StartReachable(t *testing.T) {
+	// The agent does not fail over when the primary cluster answers, as the
+	// error is not an outage.
+	var primaryUp atomic.Bool
+	primaryUp.Store(true)
+	ft, _ := testFailoverTunnel(&primaryUp, errors.New("invalid token"))
+	assert.Error(t, services.StartAndAwaitRunning(context.Background(), ft))
+}
+
+// kmTunnel is a fakeTunnel which gets its certificate from a key manager.
+type kmTunnel struct {
+	*fakeTunnel
+	km *ssh.KeyManager
+}
+
+func newKMTunnel(site string, km *ssh.KeyManager) *kmTunnel {
+	t := &kmTunnel{fakeTunnel: newFakeTunnel(site, nil), km: km}
+	t.BasicService = services.NewIdleService(km.CreateKeys, nil)
+	return t
+}
+
+func (t *kmTunnel) RenewCertificate() error {
+	return t.km.RenewCertificate(context.Background())
+}
+
+// hostKeyLine returns a known hosts line of a new host key of host.
+func hostKeyLine(t *testing.T, host string) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := gossh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return knownhosts.Line([]string{host}, key)
+}
+
+func TestFailoverTunnel_KnownHosts(t *testing.T) {
+	primaryKH := hostKeyLine(t, "private-datasource-connect-prod-us-east-0.grafana.net")
+	secondaryKH := hostKeyLine(t, "private-datasource-connect-prod-eu-west-0.grafana.net")
+	primaryAPI := pdctest.NewServer(t, pdctest.Config{KnownHosts: primaryKH})
+	secondaryAPI := pdctest.NewServer(t, pdctest.Config{KnownHosts: secondaryKH})
+
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+	// Without a grace period, a shared file would only hold the host keys
+	// of the cluster which signed last.
+	sshConfig.KnownHostsGracePeriod = 0
+	pdcConfig := &pdc.Config{URL: primaryAPI.APIURL(), Token: "token", HostedGrafanaID: "1"}
+	sshConfig.PDC = *pdcConfig
+
+	secondary, err := failoverConfig{Cluster: "prod-eu-west-0", Domain: defaultDomain}.tunnelConfig(tunnelConfig{ssh: sshConfig, pdc: pdcConfig})
+	require.NoError(t, err)
+	secondary.ssh.PDC.URL = secondaryAPI.APIURL()
+
+	newKM := func(cfg *ssh.Config) *ssh.KeyManager {
+		client, err := pdc.NewClient(&cfg.PDC, log.NewNopLogger())
+		require.NoError(t, err)
+		return ssh.NewKeyManager(cfg, log.NewNopLogger(), client)
+	}
+	primaryKM, secondaryKM := newKM(sshConfig), newKM(secondary.ssh)
+
+	var primaryUp atomic.Bool
+	primaryUp.Store(true)
+	ft := &failoverTunnel{
+		logger: log.NewNopLogger(),
+		primary: failoverSite{
+			name:      "primary",
+			newClient: func() tunnelClient { return newKMTunnel("primary", primaryKM) },
+			reachable: func(context.Context) bool { return primaryUp.Load() },
+		},
+		secondary: failoverSite{
+			name:      "failover",
+			newClient: func() tunnelClient { return newKMTunnel("failover", secondaryKM) },
+			reachable: func(context.Context) bool { return true },
+		},
+		after:         50 * time.Millisecond,
+		probeInterval: 10 * time.Millisecond,
+	}
+	ft.BasicService = services.NewBasicService(ft.starting, ft.running, ft.stopping)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ft))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ft))
+	}()
+
+	site := func() string {
+		active, _ := ft.current()
+		return active.(*kmTunnel).site
+	}
+	knownHosts := func(path string) string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return strings.TrimSpace(string(data))
+	}
+
+	// Each cluster keeps its host keys across a switch and a switch back.
+	primaryUp.Store(false)
+	require.Eventually(t, func() bool { return site() == "failover" }, 5*time.Second, 10*time.Millisecond)
+	primaryUp.Store(true)
+	require.Eventually(t, func() bool { return site() == "primary" }, 5*time.Second, 10*time.Millisecond)
+
+	assert.NotEqual(t, sshConfig.KnownHostsFilePath(), secondary.ssh.KnownHostsFilePath())
+	assert.Equal(t, primaryKH, knownHosts(sshConfig.KnownHostsFilePath()))
+	assert.Equal(t, secondaryKH, knownHosts(secondary.ssh.KnownHostsFilePath()))
+}
+
+func TestFailoverConfig_Validate(t *testing.T) {
+	valid := failoverConfig{Cluster: "prod-eu-west-0", Domain: defaultDomain, After: time.Minute, ProbeInterval: time.Second}
+
+	for _, tc := range []struct {
+		name   string
+		fc     failoverConfig
+		mf     mainFlags
+		noAPI  bool
+		stacks map[string]string
+		err    string
+	}{
+		{name: "disabled", fc: failoverConfig{}},
+		{name: "valid", fc: valid, mf: mainFlags{Cluster: "prod-us-east-0", Domain: defaultDomain}},
+		{name: "same cluster", fc: valid, mf: mainFlags{Cluster: "prod-eu-west-0", Domain: defaultDomain}, err: "must differ"},
+		{name: "no after", fc: failoverConfig{Cluster: "prod-eu-west-0", ProbeInterval: time.Second}, err: "-failover.after"},
+		{name: "dev mode", fc: valid, mf: mainFlags{DevMode: true}, err: "-dev-mode"},
+		{name: "no api", fc: valid, noAPI: true, err: "-no-api"},
+		{name: "networks", fc: valid, mf: mainFlags{Networks: []network{{name: "staging", token: "t"}}}, err: "-network.token"},
+		{name: "stacks", fc: valid, stacks: map[string]string{"2": "t"}, err: "-stack.token"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sshConfig := ssh.DefaultConfig()
+			sshConfig.NoAPI = tc.noAPI
+			err := tc.fc.validate(&tc.mf, sshConfig, &pdc.Config{StackTokens: tc.stacks})
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestFailoverConfig_TunnelConfig(t *testing.T) {
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = "/keys/grafana_pdc"
+	sshConfig.HashFile = "/keys/hash"
+	sshConfig.Port = 2222
+	sshConfig.GatewayEndpoints = []string{"gw-a"}
+	pdcConfig := &pdc.Config{Token: "token", HostedGrafanaID: "1"}
+
+	fc := failoverConfig{Cluster: "prod-eu-west-0", Domain: "grafana.net"}
+	tc, err := fc.tunnelConfig(tunnelConfig{ssh: sshConfig, pdc: pdcConfig})
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://private-datasource-connect-api-prod-eu-west-0.grafana.net", tc.pdc.URL.String())
+	assert.Equal(t, "private-datasource-connect-prod-eu-west-0.grafana.net", tc.ssh.URL.String())
+	assert.Equal(t, 22, tc.ssh.Port)
+	assert.Empty(t, tc.ssh.GatewayEndpoints)
+	assert.Equal(t, "/keys/grafana_pdc_failover", tc.ssh.KeyFile)
+	assert.Equal(t, "/keys/hash_failover", tc.ssh.HashFile)
+	assert.Equal(t, filepath.Join("/keys", ssh.KnownHostsFile+"_failover"), tc.ssh.KnownHostsFile)
+	assert.Equal(t, "token", tc.ssh.PDC.Token)
+
+	// The primary tunnel is not modified.
+	assert.Equal(t, "/keys/grafana_pdc", sshConfig.KeyFile)
+	assert.Equal(t, 2222, sshConfig.Port)
+}
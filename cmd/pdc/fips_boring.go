@@ -0,0 +1,15 @@
+//go:build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+	// Restrict TLS to FIPS 140 approved settings.
+	_ "crypto/tls/fipsonly"
+)
+
+// fipsBackend reports whether crypto operations use the FIPS 140 validated
+// BoringCrypto module.
+func fipsBackend() bool {
+	return boring.Enabled()
+}
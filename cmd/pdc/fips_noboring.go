@@ -0,0 +1,9 @@
+//go:build !boringcrypto
+
+package main
+
+// fipsBackend reports whether crypto operations use the FIPS 140 validated
+// BoringCrypto module. It needs a build with GOEXPERIMENT=boringcrypto.
+func fipsBackend() bool {
+	return false
+}
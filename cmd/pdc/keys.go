@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const (
+	keygenCommand = "keygen"
+	certCommand   = "cert"
+)
+
+// runKeygen generates the key pair and has it signed by the PDC API, like the
+// agent does on start, without connecting to the gateway. The agent uses
+// them as long as it is run with the same flags.
+func runKeygen(args []string) error {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+keygenCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Generates the key pair at -ssh-key-file and has it signed by the PDC API, with the same flags as the agent, if they don't exist or the certificate expired. The agent does not generate them again when run with the same flags.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	mf.RegisterFlags(fs)
+	sshConfig.RegisterFlags(fs)
+	pdcClientCfg.RegisterFlags(fs)
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if mf.PrintHelp {
+		fs.Usage()
+		return nil
+	}
+	// The agent generates new keys when its arguments change.
+	sshConfig.Args = args
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := resolveConfig(ctx, mf, sshConfig, pdcClientCfg); err != nil {
+		return err
+	}
+	logger, _, _, err := setupLogger(mf, nil, agentSecrets(mf, pdcClientCfg)...)
+	if err != nil {
+		return fmt.Errorf("setting up logger: %w", err)
+	}
+	pdcClient, err := pdc.NewClient(pdcClientCfg, logger)
+	if err != nil {
+		return fmt.Errorf("cannot initialise PDC client: %w", err)
+	}
+	if err := ssh.NewKeyManager(sshConfig, logger, pdcClient).CreateKeys(ctx); err != nil {
+		return err
+	}
+
+	level.Info(logger).Log("msg", "key pair ready", "key_file", sshConfig.KeyFile)
+	return nil
+}
+
+// provisionCredentials generates the key pair, certificate and known hosts
+// file of every tunnel, for -run-once.
+func provisionCredentials(ctx context.Context, logger log.Logger, networks []string, keyManagers []*ssh.KeyManager) error {
+	for i, km := range keyManagers {
+		if err := km.CreateKeys(ctx); err != nil {
+			if networks[i] == "" {
+				return fmt.Errorf("generating the credentials: %w", err)
+			}
+			return fmt.Errorf("generating the credentials of %s: %w", networks[i], err)
+		}
+	}
+	level.Info(logger).Log("msg", "credentials ready, exiting", "tunnels", len(keyManagers))
+	return nil
+}
+
+// runCert prints the certificate of the key pair at -ssh-key-file.
+func runCert(args []string, out io.Writer) error {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+certCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Prints the certificate of the key pair at -ssh-key-file.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	mf.RegisterFlags(fs)
+	sshConfig.RegisterFlags(fs)
+	pdcClientCfg.RegisterFlags(fs)
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if mf.PrintHelp {
+		fs.Usage()
+		return nil
+	}
+
+	return printCert(out, sshConfig.KeyFile)
+}
+
+// printCert prints the certificate of the key pair at keyFile.
+func printCert(out io.Writer, keyFile string) error {
+	cert, err := ssh.ReadCertificate(keyFile)
+	if err != nil {
+		return err
+	}
+
+	validAfter := time.Unix(int64(cert.ValidAfter), 0).UTC()
+	validBefore := time.Unix(int64(cert.ValidBefore), 0).UTC()
+	var status string
+	switch now := time.Now(); {
+	case now.Before(validAfter):
+		status = "not yet valid"
+	case !now.Before(validBefore):
+		status = "expired"
+	default:
+		status = fmt.Sprintf("valid, expires in %s", validBefore.Sub(now).Round(time.Second))
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "file\t%s-cert.pub\n", keyFile)
+	fmt.Fprintf(tw, "key id\t%s\n", cert.KeyId)
+	fmt.Fprintf(tw, "serial\t%d\n", cert.Serial)
+	fmt.Fprintf(tw, "principals\t%s\n", strings.Join(cert.ValidPrincipals, ", "))
+	fmt.Fprintf(tw, "valid after\t%s\n", validAfter.Format(time.RFC3339))
+	fmt.Fprintf(tw, "valid before\t%s\n", validBefore.Format(time.RFC3339))
+	fmt.Fprintf(tw, "status\t%s\n", status)
+	return tw.Flush()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const migrateLegacyCommand = "migrate-legacy"
+
+// inLegacyMode is true when the agent is run with the arguments of ssh, which
+// are passed through to it. This is deprecated.
+func inLegacyMode(args []string) bool {
+	for _, a := range args {
+		if a == "-p" || a == "-i" || a == "-R" || a == "-o" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitLegacyArgs splits the arguments of legacy mode into the agent flags,
+// given as -name=value, and the arguments of ssh.
+func splitLegacyArgs(args []string, registerers ...func(fs *flag.FlagSet)) (agentArgs, sshArgs []string) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	for _, r := range registerers {
+		r(fs)
+	}
+	for _, a := range args {
+		name, _, ok := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if ok && strings.HasPrefix(a, "-") && fs.Lookup(name) != nil {
+			agentArgs = append(agentArgs, a)
+			continue
+		}
+		sshArgs = append(sshArgs, a)
+	}
+	return agentArgs, sshArgs
+}
+
+// runLegacyMode runs ssh with the arguments of sshConfig, without the key
+// manager: the key pair and certificate are managed by the user. The ssh
+// metrics and the agent status are served on -http.addr.
+func runLegacyMode(logger log.Logger, levelFilter *logging.LevelFilter, mf *mainFlags, sshConfig *ssh.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	level.Warn(logger).Log("msg", fmt.Sprintf("the agent runs in legacy mode, passing its arguments to ssh, which is deprecated. Run %s %s with the same arguments to get the flags to use instead", os.Args[0], migrateLegacyCommand))
+
+	sshClient := ssh.NewClient(sshConfig, logger, nil)
+	if mf.HTTPAddr != "" {
+		// Certificates are not managed by the agent in legacy mode.
+		startHTTPServer(ctx, logger, mf.HTTPAddr, newServeMux(logLevelHandler(logger, levelFilter, sshClient), statusHandler([]string{""}, []services.Service{sshClient}), http.NotFoundHandler()))
+	}
+
+	// Start the ssh client
+	err := services.StartAndAwaitRunning(ctx, sshClient)
+	if err != nil {
+		level.Error(logger).Log("msg", fmt.Sprintf("cannot start ssh client: %s", err))
+		return err
+	}
+	// Wait for the ssh client to exit. It fails once it gives up
+	// reconnecting.
+	return sshClient.AwaitTerminated(context.Background())
+}
+
+// legacyKeyFile returns the -i argument of ssh, or "" if there is none.
+func legacyKeyFile(sshArgs []string) string {
+	for i, a := range sshArgs {
+		if a == "-i" && i+1 < len(sshArgs) {
+			return sshArgs[i+1]
+		}
+	}
+	return ""
+}
+
+// sshArgFlags are the ssh flags which take an argument.
+const sshArgFlags = "BbcDEeFIiJLlmOopQRSWw"
+
+// migration is the agent flags equivalent to a legacy invocation.
+type migration struct {
+	flags []string
+	notes []string
+}
+
+// migrateLegacyArgs converts the arguments of ssh of a legacy invocation to
+// the flags of the agent.
+func migrateLegacyArgs(args []string) (migration, error) {
+	var m migration
+	var user, host string
+	port := ssh.DefaultConfig().Port
+	keyFile := ""
+
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") || len(a) < 2 {
+			if host != "" {
+				return m, fmt.Errorf("unexpected argument %q: commands run by ssh are not supported", a)
+			}
+			host = a
+			if u, h, ok := strings.Cut(a, "@"); ok {
+				user, host = u, h
+			}
+			continue
+		}
+
+		name, value := a[:2], a[2:]
+		if strings.ContainsRune(sshArgFlags, rune(name[1])) && value == "" {
+			if i+1 >= len(args) {
+				return m, fmt.Errorf("missing argument of %s", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch name {
+		case "-i":
+			keyFile = value
+		case "-p":
+			p, err := strconv.Atoi(value)
+			if err != nil {
+				return m, fmt.Errorf("invalid port %q", value)
+			}
+			port = p
+		case "-l":
+			user = value
+		case "-R":
+			if value != "0" {
+				m.flags = append(m.flags, "-ssh.remote-forward="+value)
+			}
+		case "-L":
+			m.flags = append(m.flags, "-ssh.local-forward="+value)
+		case "-o":
+			option, optionValue, ok := strings.Cut(value, "=")
+			if !ok {
+				option, optionValue, _ = strings.Cut(value, " ")
+			}
+			switch strings.ToLower(option) {
+			case "certificatefile", "userknownhostsfile", "identityfile":
+				m.notes = append(m.notes, fmt.Sprintf("%s is dropped: the agent writes the certificate and known hosts file next to -ssh-key-file", option))
+			case "stricthostkeychecking":
+				m.flags = append(m.flags, "-ssh.strict-host-key-checking="+strings.ToLower(optionValue))
+			default:
+				m.flags = append(m.flags, fmt.Sprintf("-ssh-flag=-o %s=%s", option, optionValue))
+			}
+		case "-v":
+			m.flags = append(m.flags, "-log.level=debug")
+		default:
+			if strings.ContainsRune(sshArgFlags, rune(name[1])) {
+				a = name + " " + value
+			}
+			m.flags = append(m.flags, "-ssh-flag="+a)
+		}
+	}
+
+	if host == "" {
+		return m, fmt.Errorf("missing the user@host of the gateway")
+	}
+	if user == "" {
+		return m, fmt.Errorf("missing the user of the gateway, the ID of the Grafana Cloud stack")
+	}
+
+	gateway := []string{"-gcloud-hosted-grafana-id=" + user}
+	cluster, domain, ok := strings.Cut(strings.TrimPrefix(host, "private-datasource-connect-"), ".")
+	if ok && strings.HasPrefix(host, "private-datasource-connect-") && port == ssh.DefaultConfig().Port {
+		gateway = append(gateway, "-cluster="+cluster)
+		if domain != defaultDomain {
+			gateway = append(gateway, "-domain="+domain)
+		}
+	} else {
+		gateway = append(gateway, "-gateway-url="+net.JoinHostPort(host, strconv.Itoa(port)))
+		m.notes = append(m.notes, "the gateway is not derived from a cluster: set -api-url to the URL of the PDC API")
+	}
+	if keyFile != "" {
+		gateway = append(gateway, "-ssh-key-file="+keyFile)
+	}
+	m.flags = append(append(gateway, "-token=<token>"), dedupe(m.flags)...)
+	m.notes = append(m.notes, "set -token to a token with the pdc-signing:write scope: the agent generates the key pair and has it signed, with no need for a certificate obtained beforehand")
+	return m, nil
+}
+
+// dedupe removes the repeated values of s, keeping the first.
+func dedupe(s []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// runMigrateLegacy prints the agent flags equivalent to the ssh arguments of
+// a legacy invocation.
+func runMigrateLegacy(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" {
+		fmt.Fprintf(out, `Usage of %s %s:
+
+Prints the flags of the agent equivalent to the ssh arguments of a legacy invocation, e.g.
+
+  %s %s -i ~/.ssh/grafana_pdc 123@private-datasource-connect-prod-us-central-0.grafana.net -p 22 -R 0 -vv
+`, os.Args[0], migrateLegacyCommand, os.Args[0], migrateLegacyCommand)
+		return nil
+	}
+
+	agentArgs, sshArgs := splitLegacyArgs(args, (&mainFlags{}).RegisterFlags, ssh.DefaultConfig().RegisterFlags, (&pdc.Config{}).RegisterFlags)
+	m, err := migrateLegacyArgs(sshArgs)
+	if err != nil {
+		return err
+	}
+	// The agent flags given alongside the ssh arguments are kept.
+	m.flags = append(m.flags, agentArgs...)
+	for _, n := range m.notes {
+		fmt.Fprintf(out, "# %s\n", n)
+	}
+	cmdline := []string{shellQuote(os.Args[0])}
+	for _, f := range m.flags {
+		cmdline = append(cmdline, shellQuote(f))
+	}
+	_, err = fmt.Fprintln(out, strings.Join(cmdline, " "))
+	return err
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\$`;&|<>*?()[]{}~#!") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
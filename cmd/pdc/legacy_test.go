@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestSplitLegacyArgs(t *testing.T) {
+	agentArgs, sshArgs := splitLegacyArgs(
+		[]string{"-http.addr=:8090", "-i", "/tmp/key", "123@gateway", "-p", "22", "-log.level=debug", "-unknown=1", "-o", "ConnectTimeout=5"},
+		(&mainFlags{}).RegisterFlags, ssh.DefaultConfig().RegisterFlags, (&pdc.Config{}).RegisterFlags,
+	)
+	assert.Equal(t, []string{"-http.addr=:8090", "-log.level=debug"}, agentArgs)
+	assert.Equal(t, []string{"-i", "/tmp/key", "123@gateway", "-p", "22", "-unknown=1", "-o", "ConnectTimeout=5"}, sshArgs)
+	assert.Equal(t, "/tmp/key", legacyKeyFile(sshArgs))
+}
+
+func TestMigrateLegacyArgs(t *testing.T) {
+	for _, tt := range []struct {
+		description string
+		args        []string
+		flags       []string
+		err         string
+	}{
+		{
+			description: "cluster gateway",
+			args: []string{
+				"-i", "/home/pdc/.ssh/grafana_pdc", "123@private-datasource-connect-prod-us-central-0.grafana.net", "-p", "22", "-R", "0",
+				"-o", "UserKnownHostsFile=/home/pdc/.ssh/known_hosts", "-o", "CertificateFile=/home/pdc/.ssh/grafana_pdc-cert.pub",
+				"-o", "ServerAliveInterval=30", "-vvv",
+			},
+			flags: []string{
+				"-gcloud-hosted-grafana-id=123", "-cluster=prod-us-central-0", "-ssh-key-file=/home/pdc/.ssh/grafana_pdc", "-token=<token>",
+				"-ssh-flag=-o ServerAliveInterval=30", "-log.level=debug",
+			},
+		},
+		{
+			description: "other domain",
+			args:        []string{"-p", "22", "-l", "123", "private-datasource-connect-dev-0.example.com"},
+			flags:       []string{"-gcloud-hosted-grafana-id=123", "-cluster=dev-0", "-domain=example.com", "-token=<token>"},
+		},
+		{
+			description: "gateway host and port, forwards and flags",
+			args: []string{
+				"-p2222", "123@gateway.example.com", "-R", "0", "-R", "8080:localhost:80", "-L", "9090:gateway:90",
+				"-oStrictHostKeyChecking=accept-new", "-NT", "-J", "bastion", "-v", "-v",
+			},
+			flags: []string{
+				"-gcloud-hosted-grafana-id=123", "-gateway-url=gateway.example.com:2222", "-token=<token>",
+				"-ssh.remote-forward=8080:localhost:80", "-ssh.local-forward=9090:gateway:90",
+				"-ssh.strict-host-key-checking=accept-new", "-ssh-flag=-NT", "-ssh-flag=-J bastion", "-log.level=debug",
+			},
+		},
+		{
+			description: "missing gateway",
+			args:        []string{"-i", "/tmp/key", "-p", "22"},
+			err:         "missing the user@host of the gateway",
+		},
+		{
+			description: "missing user",
+			args:        []string{"-p", "22", "gateway.example.com"},
+			err:         "missing the user of the gateway",
+		},
+		{
+			description: "remote command",
+			args:        []string{"-p", "22", "123@gateway.example.com", "uptime"},
+			err:         "commands run by ssh are not supported",
+		},
+		{
+			description: "missing argument",
+			args:        []string{"123@gateway.example.com", "-p"},
+			err:         "missing argument of -p",
+		},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			m, err := migrateLegacyArgs(tt.args)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.flags, m.flags)
+			assert.NotEmpty(t, m.notes)
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "-cluster=prod-us-central-0", shellQuote("-cluster=prod-us-central-0"))
+	assert.Equal(t, "'-ssh-flag=-o ServerAliveInterval=30'", shellQuote("-ssh-flag=-o ServerAliveInterval=30"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	assert.Equal(t, "''", shellQuote(""))
+}
@@ -1,25 +1,38 @@
-
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/approval"
+	"github.com/grafana/pdc-agent/pkg/crash"
+	"github.com/grafana/pdc-agent/pkg/events"
+	"github.com/grafana/pdc-agent/pkg/exitcode"
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/logpush"
 	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/remotewrite"
+	"github.com/grafana/pdc-agent/pkg/sandbox"
+	"github.com/grafana/pdc-agent/pkg/selfupdate"
 	"github.com/grafana/pdc-agent/pkg/ssh"
 )
 
@@ -34,26 +47,164 @@ var (
 	date string
 )
 
-const logLevelinfo = "info"
+const (
+	logLevelinfo  = "info"
+	logLevelError = "error"
+)
+
+// instanceIDFileSuffix is added to the key file path to get the path of the
+// file holding the agent instance ID.
+const instanceIDFileSuffix = "_instance_id"
+
+// Actions of -identity.on-copy.
+const (
+	identityOnCopyWarn       = "warn"
+	identityOnCopyRegenerate = "regenerate"
+)
 
 type mainFlags struct {
 	PrintHelp bool
 	LogLevel  string
+	LogSink   string
 	Cluster   string
 	Domain    string
+	HTTPAddr  string
+	DebugAddr string
+	FIPS      bool
+
+	// Quiet skips the startup info and only logs errors, unless LogLevel is
+	// debug or warn.
+	Quiet bool
+
+	// CrashDir is where crash reports are written. Defaults to the
+	// directory of the key file.
+	CrashDir string
+
+	// LogRateLimit is the number of identical log lines logged per
+	// LogRateLimitInterval. 0 disables the limit.
+	LogRateLimit         int
+	LogRateLimitInterval time.Duration
+
+	// AuditLog is the sink or file the connections forwarded by the gateway
+	// are logged to. Disabled if empty.
+	AuditLog string
+
+	// RunOnce generates the credentials of the tunnels and exits, without
+	// connecting to the gateway.
+	RunOnce bool
+
+	// FixPermissions sets the modes of the private keys and of their
+	// directories to 0600 and 0700 when other users can access them.
+	FixPermissions bool
+
+	// Sandbox restricts the agent once its ssh clients have started: off or
+	// strict.
+	Sandbox string
+
+	// IdentityOnCopy is what to do when the key files were copied from
+	// another machine: warn or regenerate.
+	IdentityOnCopy string
+
+	// SelfUpdate configures the automatic update of the agent.
+	SelfUpdate selfupdate.Config
+
+	// RemoteWrite pushes the agent metrics to a remote write endpoint.
+	RemoteWrite remotewrite.Config
+
+	// LogPush ships the agent logs to an OTLP or Loki endpoint.
+	LogPush logpush.Config
+
+	// Events sends the tunnel lifecycle events to a webhook.
+	Events events.Config
+
+	// Approval must approve the agent before it establishes its first
+	// tunnel.
+	Approval approval.Config
+
+	// Failover is a secondary cluster the tunnel switches to while the
+	// primary one is unreachable.
+	Failover failoverConfig
+
+	// StatusFile is written with the status of the tunnels every
+	// StatusFileInterval, when set.
+	StatusFile         string
+	StatusFileInterval time.Duration
+
+	// RemoteConfigInterval is how often the remote configuration is fetched
+	// from the PDC API. Disabled if 0.
+	RemoteConfigInterval time.Duration
+	// AllowRemoteManagement runs the commands of the remote configuration.
+	AllowRemoteManagement bool
+
+	// Networks are served by the agent in addition to the network of the
+	// -token flag.
+	Networks []network
+
+	// APIURL and GatewayURL override the URLs derived from Cluster and Domain.
+	APIURL     string
+	GatewayURL string
+	// GatewayDiscovery fetches the gateways of the stack from the PDC API,
+	// unless they are set by flags.
+	GatewayDiscovery bool
 
 	// The fields below were added to make local development easier.
 	//
 	// DevMode is true when the agent is being run locally while someone is working on it.
 	DevMode bool
+	// DevAPIURL, DevGatewayHost and DevGatewayPort are the endpoints of the
+	// PDC API and gateway with DevMode.
+	DevAPIURL      string
+	DevGatewayHost string
+	DevGatewayPort int
+	// Chaos injects faults with DevMode.
+	Chaos chaosConfig
 }
 
 func (mf *mainFlags) RegisterFlags(fs *flag.FlagSet) {
 	fs.BoolVar(&mf.PrintHelp, "h", false, "Print help")
 	fs.StringVar(&mf.LogLevel, "log.level", logLevelinfo, `"debug", "info", "warn" or "error"`)
+	fs.BoolVar(&mf.Quiet, "quiet", false, "only log errors, unless -log.level is debug or warn, and skip the startup info, which pdc version prints")
+	fs.StringVar(&mf.LogSink, "log.sink", logging.SinkStdout, `where to write logs: "stdout", "stderr", "syslog" (Unix only) or "eventlog" (Windows only)`)
+	fs.IntVar(&mf.LogRateLimit, "log.rate-limit", 10, "the number of identical log lines logged per -log.rate-limit-interval. Further lines are counted and reported once the interval elapses. 0 disables the limit")
+	fs.DurationVar(&mf.LogRateLimitInterval, "log.rate-limit-interval", time.Minute, "the interval of -log.rate-limit")
+	fs.StringVar(&mf.AuditLog, "audit.log", "", `where to log the target, duration and bytes transferred of every connection the gateway forwards to the agent network: "stdout", "stderr", "syslog" (Unix only), "eventlog" (Windows only) or the path of a file. Disabled if empty`)
+	fs.BoolVar(&mf.FixPermissions, "fix-permissions", false, "set the mode of the private keys to 0600 and of their directories to 0700 on start, when other users can access them. Otherwise the agent exits, as ssh refuses to use a private key which other users can read")
+	fs.StringVar(&mf.Sandbox, "sandbox", sandbox.ModeOff, `restrict the agent and ssh once started, on Linux: "strict" only lets them write to the directories of the agent and denies the system calls they never need, such as ptrace or mount. The agent exits if the kernel does not support Landlock and seccomp. "off" disables it`)
+	fs.BoolVar(&mf.RunOnce, "run-once", false, "generate the key pair of every tunnel and have it signed, with its certificate and known hosts file, then exit without connecting to the gateway, e.g. in an init container. The agent uses them when run with the same flags")
+	fs.StringVar(&mf.IdentityOnCopy, "identity.on-copy", identityOnCopyWarn, `what to do when the key files appear to have been copied from another machine, so two agents would share credentials: "warn", or "regenerate" to generate a new instance ID and new keys`)
 	fs.StringVar(&mf.Cluster, "cluster", "", "the PDC cluster to connect to use")
-	fs.StringVar(&mf.Domain, "domain", "grafana.net", "the domain of the PDC cluster")
+	fs.StringVar(&mf.Domain, "domain", defaultDomain, "the domain of the PDC cluster")
+	fs.StringVar(&mf.APIURL, "api-url", "", "the URL of the PDC API, e.g. https://pdc.example.com/prefix. Overrides the URL derived from -cluster and -domain")
+	fs.StringVar(&mf.GatewayURL, "gateway-url", "", "the host[:port] of the PDC gateway. Overrides the host derived from -cluster and -domain")
+	fs.BoolVar(&mf.GatewayDiscovery, "gateway.discovery", true, "fetch the gateways of the stack from the PDC API on start, falling back to the host derived from -cluster and -domain when the API does not return any. Ignored with -gateway-url or -gateway.endpoints")
+	fs.Func("network.token", "A name=token pair of an additional PDC network to connect to, with a token of that network. Can be set more than once.", mf.addNetwork)
+	fs.StringVar(&mf.HTTPAddr, "http.addr", "", "the address to serve the agent HTTP endpoints, such as /metrics, on. Disabled if empty")
+	fs.StringVar(&mf.StatusFile, "status.file", "", "the path of a JSON file to write the status of the tunnels to, for monitoring without -http.addr. Disabled if empty")
+	fs.DurationVar(&mf.StatusFileInterval, "status.file-interval", 10*time.Second, "how often -status.file is written")
+	fs.DurationVar(&mf.RemoteConfigInterval, "remote-config.interval", 0, "how often to fetch the configuration of the agent from the PDC API and apply its log level and certificate check interval. Disabled if 0")
+	fs.BoolVar(&mf.AllowRemoteManagement, "allow-remote-management", false, "run the commands of the remote configuration: renew-certificate, reconnect and upload-support-bundle. Requires -remote-config.interval")
+	mf.RemoteWrite.RegisterFlags(fs)
+	mf.LogPush.RegisterFlags(fs)
+	mf.Events.RegisterFlags(fs)
+	mf.Approval.RegisterFlags(fs)
+	mf.Failover.RegisterFlags(fs)
+	mf.SelfUpdate.RegisterFlags(fs)
+	fs.StringVar(&mf.DebugAddr, "debug.addr", "", "the address to serve pprof and expvar debug endpoints on. Disabled if empty")
+	fs.StringVar(&mf.CrashDir, "crash.dir", "", "the directory to write a crash report to if the agent panics. Defaults to the directory of -ssh-key-file")
+	fs.BoolVar(&mf.FIPS, "fips", false, "only use FIPS 140 approved algorithms. Requires an agent built with GOEXPERIMENT=boringcrypto")
 	fs.BoolVar(&mf.DevMode, "dev-mode", false, "[DEVELOPMENT ONLY] run the agent in development mode")
+	fs.StringVar(&mf.DevAPIURL, "dev.api-url", "http://localhost:9181", "[DEVELOPMENT ONLY] the URL of the PDC API, with -dev-mode")
+	fs.StringVar(&mf.DevGatewayHost, "dev.gateway-host", "localhost", "[DEVELOPMENT ONLY] the host of the PDC gateway, with -dev-mode")
+	fs.IntVar(&mf.DevGatewayPort, "dev.gateway-port", 2244, "[DEVELOPMENT ONLY] the port of the PDC gateway, with -dev-mode")
+	mf.Chaos.RegisterFlags(fs)
+}
+
+// applyQuiet lowers the log level to errors with -quiet, unless a more
+// verbose level than the default was asked for.
+func (mf *mainFlags) applyQuiet() {
+	if mf.Quiet && mf.LogLevel == logLevelinfo {
+		mf.LogLevel = logLevelError
+	}
 }
 
 func logLevelToSSHLogLevel(level string) (int, error) {
@@ -68,133 +219,536 @@ func logLevelToSSHLogLevel(level string) (int, error) {
 }
 
 // Tries to get the openssh version. Returns "UNKNOWN" on error.
-func tryGetOpenSSHVersion() string {
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-
-	buffer := bytes.NewBuffer([]byte{})
-
-	cmd := exec.CommandContext(timeoutCtx, "ssh", "-V")
-	// ssh -V outputs to stderr.
-	cmd.Stderr = buffer
-
-	if err := cmd.Run(); err != nil {
+func tryGetOpenSSHVersion(sshCmd string) string {
+	version, err := ssh.OpenSSHVersion(context.Background(), sshCmd)
+	if err != nil {
 		return "UNKNOWN"
 	}
-
-	// ssh -V adds \n to the end of the output.
-	return strings.Replace(buffer.String(), "\n", "", 1)
+	return version
 }
 
 func main() {
+	cmd, err := parseCommand(os.Args[1:])
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(exitcode.Config)
+	}
+	if cmd != nil {
+		if err := cmd.run(os.Args[2:]); err != nil {
+			if !errors.Is(err, errChecksFailed) {
+				fmt.Printf("error: %s\n", err)
+			}
+			os.Exit(exitcode.Error)
+		}
+		return
+	}
+
+	runAgent(os.Args[1:])
+}
+
+// runAgent runs the agent with args, and exits on error.
+func runAgent(args []string) {
+	defer crash.Recover()
+
 	sshConfig := ssh.DefaultConfig()
 	mf := &mainFlags{}
 	pdcClientCfg := &pdc.Config{}
 
-	usageFn, err := parseFlags(mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags)
+	// In legacy mode, the arguments are passed to ssh, except for the agent
+	// flags given as -name=value.
+	var legacyArgs []string
+	if inLegacyMode(args) {
+		args, legacyArgs = splitLegacyArgs(args, mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags)
+	}
+
+	usageFn, err := parseFlags(args, mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags)
 	if err != nil {
 		fmt.Println("cannot parse flags")
-		os.Exit(1)
+		os.Exit(exitcode.Config)
 	}
 
-	sshConfig.Args = os.Args[1:]
+	sshConfig.Args = args
+	mf.applyQuiet()
 	sshConfig.LogLevel, err = logLevelToSSHLogLevel(mf.LogLevel)
 	if err != nil {
 		usageFn()
 		fmt.Printf("setting log level: %s\n", err)
-		os.Exit(1)
+		os.Exit(exitcode.Config)
 	}
 
-	logger := setupLogger(mf.LogLevel)
+	setDefaultTokenFile(pdcClientCfg, sshConfig)
+	if err := pdcClientCfg.LoadToken(context.Background()); err != nil {
+		fmt.Println(err)
+		os.Exit(exitcode.Config)
+	}
 
-	level.Info(logger).Log("msg", "PDC agent info",
-		"version", fmt.Sprintf("v%s", version),
-		"commit", commit,
-		"date", date,
-		"ssh version", tryGetOpenSSHVersion(),
-		"os", runtime.GOOS,
-		"arch", runtime.GOARCH,
-	)
+	secrets := agentSecrets(mf, pdcClientCfg)
+	var logPusher *logpush.Pusher
+	if mf.LogPush.URL != "" {
+		logPusher, err = logpush.NewPusher(mf.LogPush, remoteWriteLabels(pdcClientCfg.Labels))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitcode.Config)
+		}
+	}
+	logger, levelFilter, redactor, err := setupLogger(mf, logPusher, secrets...)
+	if err != nil {
+		usageFn()
+		fmt.Printf("setting up logger: %s\n", err)
+		os.Exit(exitcode.Config)
+	}
+	pdcClientCfg.RedactSecrets = redactor.AddSecrets
+	if mf.CrashDir == "" {
+		mf.CrashDir = sshConfig.KeyFileDir()
+	}
+	crash.Setup(mf.CrashDir, version, append([]string{os.Args[0]}, args...), secrets...)
+	logger = withLabels(logger, pdcClientCfg.Labels)
+
+	// stopLogPush pushes the last log lines once the agent stops.
+	stopLogPush := func() {}
+	if logPusher != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		crash.Go(func() {
+			defer close(done)
+			logPusher.Run(ctx, logger)
+		})
+		stopLogPush = func() {
+			cancel()
+			<-done
+		}
+	}
+
+	if mf.FIPS {
+		if !fipsBackend() {
+			level.Error(logger).Log("msg", "cannot enable FIPS mode: the agent was not built with GOEXPERIMENT=boringcrypto")
+			os.Exit(exitcode.Config)
+		}
+		if err := sshConfig.EnableFIPS(); err != nil {
+			level.Error(logger).Log("msg", "cannot enable FIPS mode", "err", err)
+			os.Exit(exitcode.Config)
+		}
+	}
+
+	if !mf.Quiet {
+		level.Info(logger).Log("msg", "PDC agent info",
+			"version", fmt.Sprintf("v%s", version),
+			"commit", commit,
+			"date", date,
+			"ssh version", tryGetOpenSSHVersion(sshConfig.BinaryPath),
+			"os", runtime.GOOS,
+			"arch", runtime.GOARCH,
+			"fips", mf.FIPS,
+			"fips_backend", fipsBackend(),
+		)
+	}
+
+	if err := registerAgentInfo(prometheus.DefaultRegisterer, pdcClientCfg.Labels); err != nil {
+		level.Error(logger).Log("msg", "cannot register agent info metric", "err", err)
+		os.Exit(exitcode.Error)
+	}
+	if err := registerBuildInfo(prometheus.DefaultRegisterer, versionInfo{Version: version, Commit: commit, GoVersion: runtime.Version()}); err != nil {
+		level.Error(logger).Log("msg", "cannot register build info metric", "err", err)
+		os.Exit(exitcode.Error)
+	}
+	if err := registerFIPSMode(prometheus.DefaultRegisterer, mf.FIPS); err != nil {
+		level.Error(logger).Log("msg", "cannot register FIPS mode metric", "err", err)
+		os.Exit(exitcode.Error)
+	}
 
 	if mf.PrintHelp {
 		usageFn()
 		return
 	}
 
-	if inLegacyMode() {
+	if legacyArgs != nil {
 		sshConfig.LegacyMode = true
-		err = runLegacyMode(sshConfig)
-		if err != nil {
-			fmt.Printf("error: %s", err)
-			os.Exit(1)
+		sshConfig.Args = legacyArgs
+		if keyFile := legacyKeyFile(legacyArgs); keyFile != "" {
+			sshConfig.KeyFile = keyFile
+		}
+		if err := registerLegacyMode(prometheus.DefaultRegisterer); err != nil {
+			level.Error(logger).Log("msg", "cannot register legacy mode metric", "err", err)
+			os.Exit(exitcode.Error)
 		}
+		if err := runLegacyMode(logger, levelFilter, mf, sshConfig); err != nil {
+			stopLogPush()
+			os.Exit(exitCode(err))
+		}
+		stopLogPush()
 		return
 	}
 
-	apiURL, gatewayURL, err := createURLsFromCluster(mf.Cluster, mf.Domain)
+	errs, warnings := validateFlags(mf, sshConfig, pdcClientCfg)
+	for _, w := range warnings {
+		level.Warn(logger).Log("msg", w)
+	}
+	for _, err := range errs {
+		level.Error(logger).Log("msg", "invalid flags", "err", err)
+	}
+	if len(errs) > 0 {
+		os.Exit(exitcode.Config)
+	}
+
+	apiURL, gatewayURL, gatewayPort, err := resolveURLs(mf)
 	if err != nil {
 		level.Error(logger).Log("err", err)
-		os.Exit(1)
+		os.Exit(exitcode.Config)
 	}
 
 	pdcClientCfg.URL = apiURL
 	sshConfig.PDC = *pdcClientCfg
 	sshConfig.URL = gatewayURL
+	if gatewayPort != 0 {
+		sshConfig.Port = gatewayPort
+	}
 
 	if mf.DevMode {
-		setDevelopmentConfig(sshConfig, pdcClientCfg)
+		mf.Chaos.apply(sshConfig, pdcClientCfg)
+		if err := setDevelopmentConfig(mf, sshConfig, pdcClientCfg); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(exitcode.Config)
+		}
 	}
 
-	err = run(logger, sshConfig, pdcClientCfg)
-	if err != nil {
+	err = run(logger, levelFilter, mf, sshConfig, pdcClientCfg)
+	if err != nil && !errors.Is(err, errUpdated) {
 		level.Error(logger).Log("err", err)
-		os.Exit(1)
+	}
+	stopLogPush()
+	if errors.Is(err, errUpdated) {
+		exe, err := executable()
+		if err == nil {
+			err = restart(exe)
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "cannot restart the agent, restart it to use the new version", "err", err)
+			os.Exit(exitcode.Error)
+		}
+		return
+	}
+	if err != nil {
+		os.Exit(exitCode(err))
 	}
 
 }
 
+// loadInstanceID loads the instance ID of the agent. If the key files were
+// copied from another machine, it warns or, with -identity.on-copy=regenerate,
+// generates a new instance ID and removes the keys of the tunnels so new ones
+// are generated.
+func loadInstanceID(mf *mainFlags, sshConfig *ssh.Config, pdcConfig *pdc.Config, logger log.Logger) (string, error) {
+	path := sshConfig.KeyFile + instanceIDFileSuffix
+	id, err := pdc.LoadInstanceID(path)
+	if !errors.Is(err, pdc.ErrIdentityCopied) {
+		return id, err
+	}
+
+	if mf.IdentityOnCopy != identityOnCopyRegenerate {
+		level.Warn(logger).Log("msg", "the key files appear to have been copied from another machine: two agents may share the same credentials. Use separate keys for every agent, or restart with -identity.on-copy=regenerate", "instance_id", id)
+		return id, nil
+	}
+
+	level.Warn(logger).Log("msg", "the key files appear to have been copied from another machine, generating a new instance ID and new keys", "previous_instance_id", id)
+	for _, tc := range tunnelConfigs(mf.Networks, sshConfig, pdcConfig) {
+		if err := ssh.RemoveKeyPair(tc.ssh); err != nil {
+			return "", fmt.Errorf("removing the copied keys: %w", err)
+		}
+	}
+	return pdc.RegenerateInstanceID(path)
+}
+
 // Configures the agent for local development
-func setDevelopmentConfig(sshCfg *ssh.Config, pdcClientCfg *pdc.Config) {
-	pdcClientCfg.URL, _ = url.Parse("http://localhost:9181")
+func setDevelopmentConfig(mf *mainFlags, sshCfg *ssh.Config, pdcClientCfg *pdc.Config) error {
+	apiURL, err := url.Parse(mf.DevAPIURL)
+	if err != nil {
+		return fmt.Errorf("parsing -dev.api-url: %w", err)
+	}
+	if apiURL.Scheme == "" || apiURL.Host == "" {
+		return fmt.Errorf("-dev.api-url must be an absolute URL, got %q", mf.DevAPIURL)
+	}
+	pdcClientCfg.URL = apiURL
 
-	pdcClientCfg.DevHeaders = map[string]string{
-		"X-Scope-OrgID":      pdcClientCfg.HostedGrafanaID,
-		"X-Access-Policy-ID": pdcClientCfg.DevNetwork,
+	// The local PDC API routes requests by tenant. Headers set with
+	// -api.header take precedence.
+	if pdcClientCfg.Headers == nil {
+		pdcClientCfg.Headers = map[string]string{}
+	}
+	for name, value := range map[string]string{"X-Scope-OrgID": pdcClientCfg.HostedGrafanaID, "X-Access-Policy-ID": pdcClientCfg.DevNetwork} {
+		if _, ok := pdcClientCfg.Headers[name]; !ok {
+			pdcClientCfg.Headers[name] = value
+		}
 	}
 	pdcClientCfg.SignPublicKeyEndpoint = "/api/v1/sign-public-key"
+	pdcClientCfg.CapabilitiesEndpoint = "/api/v1/capabilities"
+	pdcClientCfg.RemoteConfigEndpoint = "/api/v1/agent-config"
+	pdcClientCfg.SupportBundleEndpoint = "/api/v1/support-bundles"
 
-	sshCfg.Port = 2244
-	sshCfg.URL, _ = url.Parse("localhost")
+	sshCfg.Port = mf.DevGatewayPort
+	sshCfg.URL, err = url.Parse(mf.DevGatewayHost)
+	if err != nil {
+		return fmt.Errorf("parsing -dev.gateway-host: %w", err)
+	}
 	sshCfg.PDC = *pdcClientCfg
+	return nil
 }
 
-func run(logger log.Logger, sshConfig *ssh.Config, pdcConfig *pdc.Config) error {
+func run(logger log.Logger, levelFilter *logging.LevelFilter, mf *mainFlags, sshConfig *ssh.Config, pdcConfig *pdc.Config) error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	pdcClient, err := pdc.NewClient(pdcConfig, logger)
-	if err != nil {
-		level.Error(logger).Log("msg", fmt.Sprintf("cannot initialise PDC client: %s", err))
-		return err
+	tunnels := tunnelConfigs(mf.Networks, sshConfig, pdcConfig)
+	paths := writablePaths(mf, tunnels)
+	if err := checkWritablePaths(paths); err != nil {
+		return configError{err}
+	}
+	for _, tc := range tunnels {
+		if err := ssh.CheckKeyPermissions(tc.ssh.KeyFile, mf.FixPermissions, logger); err != nil {
+			return configError{err}
+		}
+	}
+
+	clients := sshClients{}
+	var networks []string
+	var keyManagers []*ssh.KeyManager
+	// defaultClient is the PDC client of the default network, shared with
+	// the additional stacks.
+	var defaultClient pdc.Client
+	// gateways are discovered with defaultClient, and used by every tunnel.
+	var gateways []pdc.Gateway
+	var sink events.Sink
+	if mf.Events.WebhookURL != "" {
+		webhook, err := events.NewWebhook(mf.Events, pdcConfig.Labels, logger)
+		if err != nil {
+			return configError{err}
+		}
+		sink = webhook
+	}
+	var audit log.Logger
+	if mf.AuditLog != "" {
+		a, err := newAuditLogger(mf.AuditLog)
+		if err != nil {
+			return configError{err}
+		}
+		audit = withLabels(a, pdcConfig.Labels)
+	}
+	if !sshConfig.NoAPI {
+		instanceID, err := loadInstanceID(mf, sshConfig, pdcConfig, logger)
+		if err != nil {
+			level.Warn(logger).Log("msg", "cannot load the agent instance ID, signing requests will not include it", "err", err)
+		}
+		pdcConfig.Machine = pdc.CurrentMachine(instanceID)
+	}
+	for _, tc := range tunnels {
+		tunnelLogger := logger
+		name := tc.network
+		if tc.network != "" {
+			tunnelLogger = log.With(logger, "network", tc.network)
+		}
+		if tc.stack != "" {
+			tunnelLogger = log.With(logger, "stack", tc.stack)
+			name = "stack/" + tc.stack
+		}
+
+		// With -no-api, the key manager only validates the provisioned files.
+		var pdcClient pdc.Client
+		switch {
+		case tc.ssh.NoAPI:
+		case tc.stack != "" && defaultClient != nil:
+			pdcClient = defaultClient
+		default:
+			tc.pdc.Tunnel = name
+			c, err := pdc.NewClient(tc.pdc, tunnelLogger)
+			if err != nil {
+				level.Error(tunnelLogger).Log("msg", fmt.Sprintf("cannot initialise PDC client: %s", err))
+				return configError{err}
+			}
+			pdcClient = c
+			if tc.network == "" && tc.stack == "" {
+				defaultClient = c
+				if discoveryEnabled(mf, sshConfig) {
+					gateways = discoverGateways(ctx, c, logger)
+				}
+			}
+		}
+		if gateways != nil {
+			if err := applyGateways(tc.ssh, gateways); err != nil {
+				return configError{err}
+			}
+		}
+
+		tc.ssh.Events = events.Tunnel(sink, name)
+		if audit != nil {
+			tc.ssh.Audit = audit
+			if name != "" {
+				tc.ssh.Audit = log.With(audit, "network", name)
+			}
+		}
+		tc.ssh.Capabilities = agentCapabilities()
+		km := ssh.NewKeyManager(tc.ssh, tunnelLogger, pdcClient)
+		keyManagers = append(keyManagers, km)
+
+		// Create the SSH Service. KeyManager must be in running state when passed to ssh.NewClient
+		var client tunnelClient = ssh.NewClient(tc.ssh, tunnelLogger, km)
+		if mf.Failover.enabled() && !mf.RunOnce {
+			// Only the tunnel of the -token flag is allowed with -failover.cluster.
+			t, err := newFailoverTunnel(mf.Failover, tc, km, tunnelLogger)
+			if err != nil {
+				return configError{err}
+			}
+			client = t
+		}
+		clients = append(clients, client)
+		networks = append(networks, name)
 	}
 
-	km := ssh.NewKeyManager(sshConfig, logger, pdcClient)
+	if mf.RunOnce {
+		return provisionCredentials(ctx, logger, networks, keyManagers)
+	}
 
-	// Create the SSH Service. KeyManager must be in running state when passed to ssh.NewClient
-	sshClient := ssh.NewClient(sshConfig, logger, km)
-	// Start the ssh client
-	err = services.StartAndAwaitRunning(ctx, sshClient)
-	if err != nil {
-		level.Error(logger).Log("msg", fmt.Sprintf("cannot start ssh client: %s", err))
+	if mf.HTTPAddr != "" {
+		startHTTPServer(ctx, logger, mf.HTTPAddr, newServeMux(logLevelHandler(logger, levelFilter, clients), statusHandler(networks, clients.services()), renewHandler(logger, clients)))
+	}
+	if mf.StatusFile != "" {
+		crash.Go(func() {
+			writeStatusFiles(ctx, logger, mf.StatusFile, mf.StatusFileInterval, func() agentStatus {
+				return collectStatus(networks, clients.services())
+			})
+		})
+	}
+	if mf.DebugAddr != "" {
+		startHTTPServer(ctx, logger, mf.DebugAddr, newDebugMux())
+	}
+	if mf.RemoteConfigInterval > 0 {
+		rc := &remoteConfig{
+			logger:        logger,
+			levelFilter:   levelFilter,
+			client:        defaultClient,
+			target:        clients,
+			allowCommands: mf.AllowRemoteManagement,
+			bundle: func() ([]byte, error) {
+				return runningAgentBundle(sshConfig, func() agentStatus { return collectStatus(networks, clients.services()) }, agentSecrets(mf, pdcConfig))
+			},
+		}
+		crash.Go(func() { rc.poll(ctx, mf.RemoteConfigInterval) })
+	}
+	if mf.RemoteWrite.URL != "" {
+		pusher, err := remotewrite.NewPusher(mf.RemoteWrite, prometheus.DefaultGatherer, remoteWriteLabels(pdcConfig.Labels), logger)
+		if err != nil {
+			return configError{err}
+		}
+		crash.Go(func() { pusher.Run(ctx) })
+	}
+	var updated atomic.Bool
+	if mf.SelfUpdate.Interval > 0 {
+		err := autoUpdate(ctx, logger, mf.SelfUpdate, func() {
+			updated.Store(true)
+			stop()
+		})
+		if err != nil {
+			return configError{err}
+		}
+	}
+	handleStackDumpSignal(ctx, logger)
+	handleRenewSignal(ctx, logger, clients)
+	if err := approval.Wait(ctx, mf.Approval, approvalRequest(pdcConfig), logger); err != nil {
+		if ctx.Err() != nil {
+			// The agent was stopped while waiting.
+			return nil
+		}
 		return err
 	}
+	// Start the ssh clients
+	for i, sshClient := range clients {
+		err := services.StartAndAwaitRunning(ctx, sshClient)
+		if err != nil {
+			level.Error(logger).Log("msg", fmt.Sprintf("cannot start ssh client: %s", err))
+			// Stop the clients which already started.
+			stop()
+			for _, c := range clients[:i] {
+				_ = c.AwaitTerminated(context.Background())
+			}
+			return err
+		}
+	}
+	if mf.Sandbox != sandbox.ModeOff {
+		sandboxCfg := sandbox.Config{Mode: mf.Sandbox}
+		for _, p := range paths {
+			sandboxCfg.WritableDirs = append(sandboxCfg.WritableDirs, p.dir)
+		}
+		if err := sandbox.Apply(sandboxCfg); err != nil {
+			level.Error(logger).Log("msg", fmt.Sprintf("cannot apply the sandbox: %s", err))
+			stop()
+			for _, c := range clients {
+				_ = c.AwaitTerminated(context.Background())
+			}
+			return configError{err}
+		}
+		level.Info(logger).Log("msg", "sandbox applied", "mode", mf.Sandbox, "writable_dirs", strings.Join(sandboxCfg.WritableDirs, ","))
+	}
 
-	// Wait for the ssh client to exit
-	_ = sshClient.AwaitTerminated(context.Background())
+	var expiring atomic.Bool
+	if sshConfig.NoAPI {
+		exitAt, err := noAPIExitTime(keyManagers, sshConfig.NoAPIExitBeforeExpiry)
+		if err != nil {
+			stop()
+			for _, c := range clients {
+				_ = c.AwaitTerminated(context.Background())
+			}
+			return fmt.Errorf("reading the provisioned certificate: %w", err)
+		}
+		if !exitAt.IsZero() {
+			level.Info(logger).Log("msg", "the agent will exit before the provisioned certificate expires", "exit_at", exitAt.UTC().Format(time.RFC3339))
+			timer := time.AfterFunc(time.Until(exitAt), func() {
+				expiring.Store(true)
+				stop()
+			})
+			defer timer.Stop()
+		}
+	}
+
+	// Wait for the ssh clients to exit. When one fails, such as when it gives
+	// up reconnecting, the others are stopped, and the agent exits with its
+	// error.
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, sshClient := range clients {
+		i, sshClient := i, sshClient
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = sshClient.AwaitTerminated(context.Background()); errs[i] != nil {
+				stop()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 
+	if updated.Load() {
+		return errUpdated
+	}
+	if expiring.Load() {
+		return errCertificateExpiring
+	}
 	return nil
 }
 
+// approvalRequest describes the agent to the approval hook.
+func approvalRequest(pdcConfig *pdc.Config) approval.Request {
+	req := approval.Request{HostedGrafanaID: pdcConfig.HostedGrafanaID, Labels: pdcConfig.Labels}
+	if pdcConfig.Machine != nil {
+		req.Hostname = pdcConfig.Machine.Hostname
+	} else {
+		req.Hostname, _ = os.Hostname()
+	}
+	return req
+}
+
 func createURLsFromCluster(cluster string, domain string) (api *url.URL, gateway *url.URL, err error) {
 	apiURL := fmt.Sprintf("https://private-datasource-connect-api-%s.%s", cluster, domain)
 	gatewayURL := fmt.Sprintf("private-datasource-connect-%s.%s", cluster, domain)
@@ -208,66 +762,158 @@ func createURLsFromCluster(cluster string, domain string) (api *url.URL, gateway
 	return
 }
 
-// parseFlags creates a flagset, registers all given flags, and parses. It
-// returns the flagset's usage function and the parsing error.
-func parseFlags(registerers ...func(fs *flag.FlagSet)) (func(), error) {
+// resolveURLs returns the API and gateway URLs, and the gateway port if one
+// was given. The -api-url and -gateway-url flags take precedence over the URLs
+// derived from the cluster and domain.
+func resolveURLs(mf *mainFlags) (api *url.URL, gateway *url.URL, port int, err error) {
+	api, gateway, err = createURLsFromCluster(mf.Cluster, mf.Domain)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if mf.APIURL != "" {
+		api, err = parseAPIURL(mf.APIURL)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	if mf.GatewayURL != "" {
+		gateway, port, err = parseGatewayURL(mf.GatewayURL)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	return api, gateway, port, nil
+}
+
+func parseAPIURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -api-url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid -api-url %q: scheme must be http or https", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid -api-url %q: missing host", s)
+	}
+	return u, nil
+}
+
+// parseGatewayURL parses a host[:port] gateway address. The port is 0 when
+// it is not part of the address.
+func parseGatewayURL(s string) (*url.URL, int, error) {
+	host, port := s, 0
+
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, 0, fmt.Errorf("invalid -gateway-url %q: invalid port %q", s, p)
+		}
+	}
+
+	if host == "" || strings.ContainsAny(host, "/@ ") {
+		return nil, 0, fmt.Errorf("invalid -gateway-url %q: expecting host[:port]", s)
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid -gateway-url: %w", err)
+	}
+	return u, port, nil
+}
+
+// parseFlags creates a flagset, registers all given flags, and parses args.
+// It returns the flagset's usage function and the parsing error.
+func parseFlags(args []string, registerers ...func(fs *flag.FlagSet)) (func(), error) {
 	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 
 	fs.Usage = func() {
 		prog := os.Args[0]
 		fmt.Fprintf(fs.Output(), `Usage of %s:
-`, prog)
-		fs.PrintDefaults()
+
+  %s [command] [flags]
+
+`, prog, prog)
+		printCommands(fs.Output())
+		printGroupedDefaults(fs)
 		fmt.Fprintf(fs.Output(), `
 
-If pdc-agent is run with SSH flags, it will pass all arguments directly through to the "ssh" binary. This is deprecated behaviour.
+If pdc-agent is run with SSH flags, it will pass all arguments directly through to the "ssh" binary. This is deprecated behaviour: run %s %s with the same arguments to get the flags to use instead.
 
-Run %s <command> -h for more information
-`, prog)
+Run %s <command> -h for more information on a command.
+`, prog, migrateLegacyCommand, prog)
 	}
 
 	for _, r := range registerers {
 		r(fs)
 	}
 
-	return fs.Usage, fs.Parse(os.Args[1:])
+	return fs.Usage, parseArgs(fs, args)
 }
 
-func inLegacyMode() bool {
-	args := os.Args[1:]
+// withLabels adds the agent labels to every log line, in a deterministic order.
+func withLabels(logger log.Logger, labels map[string]string) log.Logger {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	for _, a := range args {
-		if a == "-p" || a == "-i" || a == "-R" || a == "-o" {
-			return true
-		}
+	for _, name := range names {
+		logger = log.With(logger, "label_"+name, labels[name])
 	}
+	return logger
+}
 
-	return false
+// newAuditLogger writing to name, a log sink or else the path of a file.
+func newAuditLogger(name string) (log.Logger, error) {
+	var sink log.Logger
+	var err error
+	switch name {
+	case logging.SinkStdout, logging.SinkStderr, logging.SinkSyslog, logging.SinkEventLog:
+		sink, err = logging.NewSink(name)
+	default:
+		sink, err = logging.NewFileSink(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid -audit.log: %w", err)
+	}
+	return log.With(sink, "ts", log.DefaultTimestamp), nil
 }
 
-func runLegacyMode(sshConfig *ssh.Config) error {
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+// agentSecrets returns the secrets set by the flags, which are redacted from
+// the logs, the crash reports and the support bundles.
+func agentSecrets(mf *mainFlags, pdcConfig *pdc.Config) []string {
+	secrets := append(pdcConfig.Secrets(), mf.networkTokens()...)
+	secrets = append(secrets, mf.RemoteWrite.Secrets()...)
+	return append(secrets, mf.LogPush.Secrets()...)
+}
 
-	logger := log.NewLogfmtLogger(os.Stdout)
-	sshClient := ssh.NewClient(sshConfig, logger, nil)
-	// Start the ssh client
-	err := services.StartAndAwaitRunning(ctx, sshClient)
+// setupLogger writing to mf.LogSink, and to push if it is not nil, with level
+// filter, rate limiting and secrets redaction. The returned LevelFilter
+// changes the level at runtime, and the Redactor redacts secrets fetched
+// later. mf.LogLevel must have been validated with logLevelToSSHLogLevel.
+func setupLogger(mf *mainFlags, push *logpush.Pusher, secrets ...string) (log.Logger, *logging.LevelFilter, *logging.Redactor, error) {
+	sink, err := logging.NewSink(mf.LogSink)
 	if err != nil {
-		level.Error(logger).Log("msg", fmt.Sprintf("cannot start ssh client: %s", err))
-		return err
+		return nil, nil, nil, err
+	}
+	if push != nil {
+		sink = logging.NewTee(sink, push)
 	}
-	// Wait for the ssh client to exit
-	_ = sshClient.AwaitTerminated(context.Background())
-	return nil
-}
 
-// setupLogger with level filter.
-func setupLogger(lvl string) log.Logger {
-	logger := log.NewLogfmtLogger(os.Stdout)
-	logger = level.NewFilter(logger, level.Allow(level.ParseDefault(lvl, level.DebugValue())))
-	logger = log.With(logger, "caller", log.DefaultCaller)
+	redactor := logging.NewRedactor(crash.NewLogger(sink), secrets...)
+	var logger log.Logger = redactor
+	if mf.LogRateLimit > 0 && mf.LogRateLimitInterval > 0 {
+		logger = logging.NewDeduplicator(logger, mf.LogRateLimit, mf.LogRateLimitInterval)
+	}
+	levelFilter, _ := logging.NewLevelFilter(logger, mf.LogLevel)
+	logger = log.With(levelFilter, "caller", log.DefaultCaller)
 	logger = log.With(logger, "ts", log.DefaultTimestamp)
 
-	return logger
-}
\ No newline at end of file
+	return logger, levelFilter, redactor, nil
+}
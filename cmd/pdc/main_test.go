@@ -2,9 +2,20 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"io"
+	"net/url"
+	"path/filepath"
 	"testing"
 
+	"github.com/go-kit/log"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/pdctest"
+	"github.com/grafana/pdc-agent/pkg/sandbox"
+	"github.com/grafana/pdc-agent/pkg/ssh"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLogLevelToSSHLogLevel(t *testing.T) {
@@ -58,3 +69,296 @@ func TestLogLevelToSSHLogLevel(t *testing.T) {
 		})
 	}
 }
+
+func TestMainFlags_ApplyQuiet(t *testing.T) {
+	cases := []struct {
+		description string
+		args        []string
+		expected    string
+	}{
+		{
+			description: "without -quiet, the level is unchanged",
+			args:        nil,
+			expected:    "info",
+		},
+		{
+			description: "-quiet only logs errors",
+			args:        []string{"-quiet"},
+			expected:    "error",
+		},
+		{
+			description: "-quiet keeps a more verbose level",
+			args:        []string{"-quiet", "-log.level=debug"},
+			expected:    "debug",
+		},
+		{
+			description: "-quiet keeps warnings",
+			args:        []string{"-quiet", "-log.level=warn"},
+			expected:    "warn",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			mf := &mainFlags{}
+			_, err := parseFlags(tt.args, mf.RegisterFlags)
+			require.NoError(t, err)
+
+			mf.applyQuiet()
+			assert.Equal(t, tt.expected, mf.LogLevel)
+		})
+	}
+}
+
+func TestResolveURLs(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		description     string
+		flags           mainFlags
+		expectedAPI     string
+		expectedGateway string
+		expectedPort    int
+		wantErr         bool
+	}{
+		{
+			description:     "urls are derived from the cluster and domain",
+			flags:           mainFlags{Cluster: "prod-eu-west-0", Domain: "grafana.net"},
+			expectedAPI:     "https://private-datasource-connect-api-prod-eu-west-0.grafana.net",
+			expectedGateway: "private-datasource-connect-prod-eu-west-0.grafana.net",
+		},
+		{
+			description:     "api url override keeps its port and path prefix",
+			flags:           mainFlags{Cluster: "prod-eu-west-0", Domain: "grafana.net", APIURL: "https://proxy.corp:8443/grafana-pdc"},
+			expectedAPI:     "https://proxy.corp:8443/grafana-pdc",
+			expectedGateway: "private-datasource-connect-prod-eu-west-0.grafana.net",
+		},
+		{
+			description:     "gateway url override without port",
+			flags:           mainFlags{Cluster: "prod-eu-west-0", Domain: "grafana.net", GatewayURL: "pdc-gateway.corp"},
+			expectedAPI:     "https://private-datasource-connect-api-prod-eu-west-0.grafana.net",
+			expectedGateway: "pdc-gateway.corp",
+		},
+		{
+			description:     "gateway url override with port",
+			flags:           mainFlags{APIURL: "https://pdc-api.corp", GatewayURL: "pdc-gateway.corp:2222"},
+			expectedAPI:     "https://pdc-api.corp",
+			expectedGateway: "pdc-gateway.corp",
+			expectedPort:    2222,
+		},
+		{
+			description: "api url without scheme",
+			flags:       mainFlags{APIURL: "pdc-api.corp"},
+			wantErr:     true,
+		},
+		{
+			description: "gateway url with invalid port",
+			flags:       mainFlags{GatewayURL: "pdc-gateway.corp:ssh"},
+			wantErr:     true,
+		},
+		{
+			description: "gateway url with a scheme",
+			flags:       mainFlags{GatewayURL: "ssh://pdc-gateway.corp"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			t.Parallel()
+
+			api, gateway, port, err := resolveURLs(&tt.flags)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedAPI, api.String())
+			assert.Equal(t, tt.expectedGateway, gateway.String())
+			assert.Equal(t, tt.expectedPort, port)
+		})
+	}
+}
+
+func TestSetDevelopmentConfig(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		description     string
+		flags           mainFlags
+		expectedAPI     string
+		expectedGateway string
+		expectedPort    int
+		wantErr         bool
+	}{
+		{
+			description:     "endpoints of the local stack",
+			flags:           mainFlags{DevAPIURL: "http://localhost:9181", DevGatewayHost: "localhost", DevGatewayPort: 2244},
+			expectedAPI:     "http://localhost:9181",
+			expectedGateway: "localhost",
+			expectedPort:    2244,
+		},
+		{
+			description:     "endpoints of a docker-compose stack",
+			flags:           mainFlags{DevAPIURL: "http://pdc-api:8080", DevGatewayHost: "pdc-gateway", DevGatewayPort: 22},
+			expectedAPI:     "http://pdc-api:8080",
+			expectedGateway: "pdc-gateway",
+			expectedPort:    22,
+		},
+		{
+			description: "api url without scheme",
+			flags:       mainFlags{DevAPIURL: "localhost:9181"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			t.Parallel()
+
+			sshCfg, pdcCfg := ssh.DefaultConfig(), &pdc.Config{}
+			err := setDevelopmentConfig(&tt.flags, sshCfg, pdcCfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedAPI, pdcCfg.URL.String())
+			assert.Equal(t, tt.expectedAPI, sshCfg.PDC.URL.String())
+			assert.Equal(t, tt.expectedGateway, sshCfg.URL.String())
+			assert.Equal(t, tt.expectedPort, sshCfg.Port)
+		})
+	}
+}
+
+func TestTunnelConfigs(t *testing.T) {
+	mf := &mainFlags{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	mf.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-network.token=staging=token-a", "-network.token=prod=token-b"}))
+
+	assert.Error(t, fs.Parse([]string{"-network.token=staging=token-c"}), "duplicate network")
+	assert.Error(t, fs.Parse([]string{"-network.token=token"}), "missing name")
+	assert.Error(t, fs.Parse([]string{"-network.token=a b=token"}), "invalid name")
+	assert.Equal(t, []string{"token-a", "token-b"}, mf.networkTokens())
+
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = "/keys/grafana_pdc"
+	sshConfig.Forwards = []ssh.Forward{{Port: 8080, Host: "db", HostPort: 5432}}
+	sshConfig.SOCKSListenAddr = "127.0.0.1:1080"
+	pdcConfig := &pdc.Config{Token: "token", HostedGrafanaID: "1"}
+
+	configs := tunnelConfigs(mf.Networks, sshConfig, pdcConfig)
+	require.Len(t, configs, 3)
+
+	assert.Equal(t, "", configs[0].network)
+	assert.Same(t, sshConfig, configs[0].ssh)
+	assert.Same(t, pdcConfig, configs[0].pdc)
+
+	for i, expected := range []struct{ network, token, keyFile string }{
+		{network: "staging", token: "token-a", keyFile: "/keys/grafana_pdc_staging"},
+		{network: "prod", token: "token-b", keyFile: "/keys/grafana_pdc_prod"},
+	} {
+		tc := configs[i+1]
+		assert.Equal(t, expected.network, tc.network)
+		assert.Equal(t, expected.token, tc.pdc.Token)
+		assert.Equal(t, expected.token, tc.ssh.PDC.Token)
+		assert.Equal(t, "1", tc.pdc.HostedGrafanaID)
+		assert.Equal(t, expected.keyFile, tc.ssh.KeyFile)
+		assert.Empty(t, tc.ssh.Forwards)
+		assert.Empty(t, tc.ssh.SOCKSListenAddr)
+	}
+
+	// The default network is not modified.
+	assert.Equal(t, "token", pdcConfig.Token)
+	assert.Equal(t, "/keys/grafana_pdc", sshConfig.KeyFile)
+	assert.Len(t, sshConfig.Forwards, 1)
+}
+
+func TestTunnelConfigs_AccessPolicyHeader(t *testing.T) {
+	networks := []network{{name: "staging", token: "token-a"}}
+	sshConfig := ssh.DefaultConfig()
+	pdcConfig := &pdc.Config{Token: "token", HostedGrafanaID: "1", Headers: map[string]string{"X-Access-Policy-ID": "default", "X-Proxy-Client": "pdc"}}
+
+	configs := tunnelConfigs(networks, sshConfig, pdcConfig)
+	require.Len(t, configs, 2)
+	assert.Equal(t, map[string]string{"X-Access-Policy-ID": "staging", "X-Proxy-Client": "pdc"}, configs[1].pdc.Headers)
+	assert.Equal(t, "default", pdcConfig.Headers["X-Access-Policy-ID"])
+
+	// Other headers are shared by the networks.
+	pdcConfig.Headers = map[string]string{"X-Proxy-Client": "pdc"}
+	configs = tunnelConfigs(networks, sshConfig, pdcConfig)
+	assert.Equal(t, pdcConfig.Headers, configs[1].pdc.Headers)
+}
+
+func TestTunnelConfigs_Stacks(t *testing.T) {
+	pdcConfig := &pdc.Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	pdcConfig.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-token=token", "-gcloud-hosted-grafana-id=1", "-stack.token=3=token-3", "-stack.token=2=token-2"}))
+
+	assert.Error(t, fs.Parse([]string{"-stack.token=2=token-c"}), "duplicate stack")
+	assert.Error(t, fs.Parse([]string{"-stack.token=token"}), "missing id")
+	assert.Error(t, fs.Parse([]string{"-stack.token=4="}), "missing token")
+	assert.Subset(t, pdcConfig.Secrets(), []string{"token-2", "token-3"})
+
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = "/keys/grafana_pdc"
+	sshConfig.Forwards = []ssh.Forward{{Port: 8080, Host: "db", HostPort: 5432}}
+	sshConfig.SOCKSListenAddr = "127.0.0.1:1080"
+
+	configs := tunnelConfigs(nil, sshConfig, pdcConfig)
+	require.Len(t, configs, 3)
+	assert.Same(t, sshConfig, configs[0].ssh)
+
+	for i, expected := range []struct{ stack, token, keyFile string }{
+		{stack: "2", token: "token-2", keyFile: "/keys/grafana_pdc_stack_2"},
+		{stack: "3", token: "token-3", keyFile: "/keys/grafana_pdc_stack_3"},
+	} {
+		tc := configs[i+1]
+		assert.Equal(t, expected.stack, tc.stack)
+		assert.Empty(t, tc.network)
+		// The PDC client of the default network signs the keys of every stack.
+		assert.Same(t, pdcConfig, tc.pdc)
+		assert.Equal(t, expected.stack, tc.ssh.PDC.HostedGrafanaID)
+		assert.Equal(t, expected.token, tc.ssh.PDC.Token)
+		assert.Equal(t, expected.keyFile, tc.ssh.KeyFile)
+		assert.Empty(t, tc.ssh.Forwards)
+		assert.Empty(t, tc.ssh.SOCKSListenAddr)
+	}
+}
+
+func TestRun_RunOnce(t *testing.T) {
+	ts := pdctest.NewServer(t, pdctest.Config{})
+
+	dir := t.TempDir()
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = filepath.Join(dir, "grafana_pdc")
+	gatewayURL, err := url.Parse("127.0.0.1")
+	require.NoError(t, err)
+	sshConfig.URL = gatewayURL
+	pdcConfig := &pdc.Config{URL: ts.APIURL(), Token: "token", HostedGrafanaID: "1"}
+	sshConfig.PDC = *pdcConfig
+	mf := &mainFlags{
+		RunOnce:        true,
+		IdentityOnCopy: identityOnCopyWarn,
+		Sandbox:        sandbox.ModeOff,
+		Networks:       []network{{name: "other", token: "other token"}},
+	}
+
+	require.NoError(t, run(log.NewNopLogger(), nil, mf, sshConfig, pdcConfig))
+
+	for _, keyFile := range []string{sshConfig.KeyFile, sshConfig.KeyFile + "_other"} {
+		for _, suffix := range []string{"", ".pub", "-cert.pub"} {
+			assert.FileExists(t, keyFile+suffix)
+		}
+	}
+	assert.FileExists(t, filepath.Join(dir, ssh.KnownHostsFile))
+	assert.Len(t, ts.Requests(), 2)
+}
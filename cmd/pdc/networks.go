@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+var networkNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// network is an additional PDC network served by the agent. The token of a
+// PDC network determines the principals of the certificates it signs.
+type network struct {
+	name  string
+	token string
+}
+
+func (mf *mainFlags) addNetwork(s string) error {
+	name, token, ok := strings.Cut(s, "=")
+	if !ok || token == "" {
+		return fmt.Errorf("invalid network %q, expecting name=token", s)
+	}
+	if !networkNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid network name %q, must match %s", name, networkNameRegexp)
+	}
+	for _, n := range mf.Networks {
+		if n.name == name {
+			return fmt.Errorf("network %q is set more than once", name)
+		}
+	}
+	mf.Networks = append(mf.Networks, network{name: name, token: token})
+	return nil
+}
+
+// networkTokens returns the tokens of the additional networks, which must be
+// redacted from logs.
+func (mf *mainFlags) networkTokens() []string {
+	tokens := make([]string, 0, len(mf.Networks))
+	for _, n := range mf.Networks {
+		tokens = append(tokens, n.token)
+	}
+	return tokens
+}
+
+// tunnelConfig is the configuration of the ssh connection to one network of
+// one stack.
+type tunnelConfig struct {
+	// network is empty for the network of the -token flag.
+	network string
+	// stack is set for the additional stacks of -stack.token.
+	stack string
+	ssh   *ssh.Config
+	pdc   *pdc.Config
+}
+
+// tunnelConfigs returns a configuration for the network of the -token flag,
+// one for each additional network, and one for each additional stack.
+// Additional networks and stacks use their own key files, next to the default
+// one, and do not set up port forwards, which would conflict with the ones of
+// the default network. Additional stacks share the PDC client configuration
+// of the default network, which selects the token of the stack of each
+// signing request.
+func tunnelConfigs(networks []network, sshConfig *ssh.Config, pdcConfig *pdc.Config) []tunnelConfig {
+	configs := []tunnelConfig{{ssh: sshConfig, pdc: pdcConfig}}
+
+	for _, n := range networks {
+		pc := *pdcConfig
+		pc.Token = n.token
+		// -token-source is the token of the default network only.
+		pc.TokenSource = ""
+		if _, ok := pdcConfig.Headers["X-Access-Policy-ID"]; ok {
+			// The header routes the requests of each network.
+			pc.DevNetwork = n.name
+			pc.Headers = map[string]string{}
+			for k, v := range pdcConfig.Headers {
+				pc.Headers[k] = v
+			}
+			pc.Headers["X-Access-Policy-ID"] = n.name
+		}
+
+		sc := *sshConfig
+		sc.KeyFile = fmt.Sprintf("%s_%s", sshConfig.KeyFile, n.name)
+		if sshConfig.HashFile != "" {
+			sc.HashFile = fmt.Sprintf("%s_%s", sshConfig.HashFile, n.name)
+		}
+		// Forwards and the SOCKS5 listener are set up by the default
+		// network only.
+		sc.Forwards = nil
+		sc.SOCKSListenAddr = ""
+		sc.PDC = pc
+
+		configs = append(configs, tunnelConfig{network: n.name, ssh: &sc, pdc: &pc})
+	}
+
+	for _, id := range pdcConfig.Stacks() {
+		pc := *pdcConfig
+		pc.HostedGrafanaID = id
+		pc.Token = pdcConfig.StackTokens[id]
+		pc.TokenSource = ""
+		pc.StackTokens = nil
+
+		sc := *sshConfig
+		sc.KeyFile = fmt.Sprintf("%s_stack_%s", sshConfig.KeyFile, id)
+		if sshConfig.HashFile != "" {
+			sc.HashFile = fmt.Sprintf("%s_stack_%s", sshConfig.HashFile, id)
+		}
+		sc.Forwards = nil
+		sc.SOCKSListenAddr = ""
+		sc.PDC = pc
+
+		configs = append(configs, tunnelConfig{stack: id, ssh: &sc, pdc: pdcConfig})
+	}
+
+	return configs
+}
+
+// tunnelClient is the tunnel to one network: an ssh.Client, or a
+// failoverTunnel switching between the clients of two clusters.
+type tunnelClient interface {
+	services.Service
+	SetLogLevel(lvl int)
+	SetCertCheckInterval(d time.Duration)
+	Reconnect()
+	RenewCertificate() error
+	Status() ssh.Status
+}
+
+// sshClients changes the log level of several ssh clients.
+type sshClients []tunnelClient
+
+func (c sshClients) SetLogLevel(lvl int) {
+	for _, client := range c {
+		client.SetLogLevel(lvl)
+	}
+}
+
+func (c sshClients) SetCertCheckInterval(d time.Duration) {
+	for _, client := range c {
+		client.SetCertCheckInterval(d)
+	}
+}
+
+// Reconnect has the connection of every tunnel replaced.
+func (c sshClients) Reconnect() {
+	for _, client := range c {
+		client.Reconnect()
+	}
+}
+
+func (c sshClients) services() []services.Service {
+	svcs := make([]services.Service, len(c))
+	for i, client := range c {
+		svcs[i] = client
+	}
+	return svcs
+}
+
+// RenewCertificates has the certificate of every tunnel renewed, and their
+// connections replaced.
+func (c sshClients) RenewCertificates() error {
+	var errs []error
+	for _, client := range c {
+		if err := client.RenewCertificate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
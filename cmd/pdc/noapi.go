@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// errCertificateExpiring is returned by run when the agent stopped before its
+// provisioned certificate expires, with -no-api.
+var errCertificateExpiring = errors.New("the provisioned certificate is about to expire, provision new files and restart the agent")
+
+// noAPIExitTime returns when the agent must exit with -no-api: before the
+// first of the provisioned certificates expires. It is the zero time if none
+// of them expire.
+func noAPIExitTime(keyManagers []*ssh.KeyManager, before time.Duration) (time.Time, error) {
+	var first time.Time
+	for _, km := range keyManagers {
+		validBefore, err := km.CertValidBefore()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !validBefore.IsZero() && (first.IsZero() || validBefore.Before(first)) {
+			first = validBefore
+		}
+	}
+	if first.IsZero() {
+		return first, nil
+	}
+	return first.Add(-before), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writablePath is a directory the agent writes to, and the flag setting it.
+type writablePath struct {
+	flag string
+	dir  string
+}
+
+// writablePaths returns the directories the agent writes to, for the tunnels
+// of tunnels. The key files are provisioned with -no-api, and not written.
+func writablePaths(mf *mainFlags, tunnels []tunnelConfig) []writablePath {
+	var paths []writablePath
+	for _, tc := range tunnels {
+		if tc.ssh.NoAPI {
+			continue
+		}
+		paths = append(paths,
+			writablePath{flag: "-ssh-key-file", dir: tc.ssh.KeyFileDir()},
+			writablePath{flag: "-ssh.hash-file", dir: filepath.Dir(tc.ssh.HashFilePath())},
+		)
+	}
+	if mf.CrashDir != "" {
+		paths = append(paths, writablePath{flag: "-crash.dir", dir: mf.CrashDir})
+	}
+	if mf.StatusFile != "" {
+		paths = append(paths, writablePath{flag: "-status.file", dir: filepath.Dir(mf.StatusFile)})
+	}
+	return paths
+}
+
+// checkWritablePaths returns an error naming each directory of paths the
+// agent cannot write to, and the flag setting it. A directory which does not
+// exist yet is created by the agent, so its closest existing parent must be
+// writable.
+func checkWritablePaths(paths []writablePath) error {
+	var errs []error
+	checked := map[string]bool{}
+	for _, p := range paths {
+		if checked[p.flag+p.dir] {
+			continue
+		}
+		checked[p.flag+p.dir] = true
+		if err := checkWritableDir(p.dir); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w: set %s to a writable path", p.flag, err, p.flag))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkWritableDir checks that a file can be created in dir or, if it does
+// not exist, in its closest existing parent. It does not create dir.
+func checkWritableDir(dir string) error {
+	existing, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", existing)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return err
+		}
+		existing = parent
+	}
+
+	f, err := os.CreateTemp(existing, ".pdc-agent-write-check")
+	if err != nil {
+		// The error of CreateTemp names a random file.
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return fmt.Errorf("cannot write to %s: %w", existing, err)
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestWritablePaths(t *testing.T) {
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = "/keys/grafana_pdc"
+	sshConfig.HashFile = "/state/grafana_pdc_hash"
+	mf := &mainFlags{CrashDir: "/crash", StatusFile: "/run/pdc/status.json", Networks: []network{{name: "prod"}}}
+
+	paths := writablePaths(mf, tunnelConfigs(mf.Networks, sshConfig, &pdc.Config{}))
+	assert.Equal(t, []writablePath{
+		{flag: "-ssh-key-file", dir: "/keys"},
+		{flag: "-ssh.hash-file", dir: "/state"},
+		{flag: "-ssh-key-file", dir: "/keys"},
+		{flag: "-ssh.hash-file", dir: "/state"},
+		{flag: "-crash.dir", dir: "/crash"},
+		{flag: "-status.file", dir: "/run/pdc"},
+	}, paths)
+
+	// The provisioned key files are not written.
+	sshConfig.NoAPI = true
+	paths = writablePaths(&mainFlags{}, tunnelConfigs(nil, sshConfig, &pdc.Config{}))
+	assert.Empty(t, paths)
+}
+
+func TestCheckWritablePaths(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+
+	t.Run("writable", func(t *testing.T) {
+		assert.NoError(t, checkWritablePaths([]writablePath{{flag: "-crash.dir", dir: dir}}))
+	})
+
+	t.Run("missing directory with a writable parent", func(t *testing.T) {
+		missing := filepath.Join(dir, "a", "b")
+		assert.NoError(t, checkWritablePaths([]writablePath{{flag: "-crash.dir", dir: missing}}))
+		// The directory is created by the agent when it writes to it.
+		assert.NoDirExists(t, missing)
+	})
+
+	t.Run("not a directory", func(t *testing.T) {
+		err := checkWritablePaths([]writablePath{{flag: "-ssh-key-file", dir: file}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "-ssh-key-file: ")
+		assert.Contains(t, err.Error(), "is not a directory")
+	})
+
+	t.Run("read-only directory", func(t *testing.T) {
+		if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+			t.Skip("directory permissions do not apply")
+		}
+		readOnly := filepath.Join(dir, "read-only")
+		require.NoError(t, os.Mkdir(readOnly, 0500))
+
+		err := checkWritablePaths([]writablePath{
+			{flag: "-ssh-key-file", dir: filepath.Join(readOnly, "keys")},
+			{flag: "-crash.dir", dir: dir},
+			{flag: "-status.file", dir: readOnly},
+		})
+		require.Error(t, err)
+		assert.Equal(t, "-ssh-key-file: cannot write to "+readOnly+": permission denied: set -ssh-key-file to a writable path\n"+
+			"-status.file: cannot write to "+readOnly+": permission denied: set -status.file to a writable path", err.Error())
+	})
+}
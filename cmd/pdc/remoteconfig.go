@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// minRemoteCertCheckInterval is the shortest certificate check interval the
+// PDC API can set, so a misconfigured fleet does not flood it.
+const minRemoteCertCheckInterval = 10 * time.Second
+
+// remoteConfigClient fetches the remote configuration, and uploads the
+// support bundles of remote commands.
+type remoteConfigClient interface {
+	RemoteConfig(ctx context.Context) (*pdc.RemoteConfig, error)
+	UploadSupportBundle(ctx context.Context, commandID string, bundle []byte) error
+}
+
+// remoteConfigTarget is changed by the remote configuration and commands.
+type remoteConfigTarget interface {
+	SetLogLevel(lvl int)
+	SetCertCheckInterval(d time.Duration)
+	RenewCertificates() error
+	Reconnect()
+}
+
+// remoteConfig applies the configuration fetched from the PDC API. Only
+// settings which are safe to change at runtime are supported.
+type remoteConfig struct {
+	logger      log.Logger
+	levelFilter *logging.LevelFilter
+	client      remoteConfigClient
+	target      remoteConfigTarget
+
+	// allowCommands is true when the commands of the remote configuration
+	// are run. bundle returns the support bundle uploaded by the
+	// upload-support-bundle command.
+	allowCommands bool
+	bundle        func() ([]byte, error)
+	// ran holds the IDs of the commands already run, as a command is
+	// returned until the PDC API considers it done.
+	ran map[string]bool
+	// ignoredCommands is true once the commands were logged as ignored.
+	ignoredCommands bool
+
+	// logLevel, certCheckInterval and unknown are the last fetched values.
+	// Settings are only applied, and logged, when they change.
+	logLevel          string
+	certCheckInterval string
+	unknown           string
+}
+
+// poll fetches and applies the remote configuration every interval until ctx
+// is done.
+func (rc *remoteConfig) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		cfg, err := rc.client.RemoteConfig(ctx)
+		switch {
+		case errors.Is(err, pdc.ErrNotFound):
+			level.Debug(rc.logger).Log("msg", "the PDC API does not serve a remote configuration")
+		case err != nil:
+			level.Warn(rc.logger).Log("msg", "could not fetch the remote configuration", "err", err)
+		default:
+			rc.apply(cfg)
+			rc.runCommands(ctx, cfg.Commands)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// apply changes the settings of cfg which changed since the last fetch.
+// Invalid settings are logged and ignored.
+func (rc *remoteConfig) apply(cfg *pdc.RemoteConfig) {
+	if cfg.LogLevel != rc.logLevel && cfg.LogLevel != "" {
+		if err := rc.applyLogLevel(cfg.LogLevel); err != nil {
+			level.Warn(rc.logger).Log("msg", "ignoring invalid remote configuration", "setting", "log_level", "err", err)
+		} else {
+			level.Info(rc.logger).Log("msg", "applied remote configuration", "setting", "log_level", "value", cfg.LogLevel)
+		}
+	}
+	rc.logLevel = cfg.LogLevel
+
+	if cfg.CertCheckInterval != rc.certCheckInterval && cfg.CertCheckInterval != "" {
+		d, err := parseRemoteCertCheckInterval(cfg.CertCheckInterval)
+		if err != nil {
+			level.Warn(rc.logger).Log("msg", "ignoring invalid remote configuration", "setting", "cert_check_interval", "err", err)
+		} else {
+			rc.target.SetCertCheckInterval(d)
+			level.Info(rc.logger).Log("msg", "applied remote configuration", "setting", "cert_check_interval", "value", d)
+		}
+	}
+	rc.certCheckInterval = cfg.CertCheckInterval
+
+	names := make([]string, 0, len(cfg.Unknown))
+	for name := range cfg.Unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if unknown := strings.Join(names, ","); unknown != rc.unknown {
+		rc.unknown = unknown
+		if unknown != "" {
+			level.Warn(rc.logger).Log("msg", "ignoring unsupported remote configuration settings", "settings", unknown)
+		}
+	}
+}
+
+func (rc *remoteConfig) applyLogLevel(lvl string) error {
+	sshLevel, err := logLevelToSSHLogLevel(lvl)
+	if err != nil {
+		return err
+	}
+	if err := rc.levelFilter.SetLevel(lvl); err != nil {
+		return err
+	}
+	rc.target.SetLogLevel(sshLevel)
+	return nil
+}
+
+func parseRemoteCertCheckInterval(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < minRemoteCertCheckInterval {
+		return 0, fmt.Errorf("%s is shorter than %s", d, minRemoteCertCheckInterval)
+	}
+	return d, nil
+}
+
+// runCommands runs the commands which were not run yet, if allowed by
+// -allow-remote-management.
+func (rc *remoteConfig) runCommands(ctx context.Context, cmds []pdc.RemoteCommand) {
+	if len(cmds) == 0 {
+		return
+	}
+	if !rc.allowCommands {
+		if !rc.ignoredCommands {
+			rc.ignoredCommands = true
+			level.Warn(rc.logger).Log("msg", "ignoring remote commands, set -allow-remote-management to run them")
+		}
+		return
+	}
+	if rc.ran == nil {
+		rc.ran = map[string]bool{}
+	}
+
+	for _, cmd := range cmds {
+		if cmd.ID == "" || rc.ran[cmd.ID] {
+			continue
+		}
+		rc.ran[cmd.ID] = true
+
+		level.Info(rc.logger).Log("msg", "running remote command", "id", cmd.ID, "action", cmd.Action)
+		if err := rc.runCommand(ctx, cmd); err != nil {
+			level.Error(rc.logger).Log("msg", "remote command failed", "id", cmd.ID, "action", cmd.Action, "err", err)
+		}
+	}
+}
+
+func (rc *remoteConfig) runCommand(ctx context.Context, cmd pdc.RemoteCommand) error {
+	switch cmd.Action {
+	case pdc.ActionRenewCertificate:
+		return rc.target.RenewCertificates()
+	case pdc.ActionReconnect:
+		rc.target.Reconnect()
+		return nil
+	case pdc.ActionUploadSupportBundle:
+		bundle, err := rc.bundle()
+		if err != nil {
+			return fmt.Errorf("writing support bundle: %w", err)
+		}
+		return rc.client.UploadSupportBundle(ctx, cmd.ID, bundle)
+	default:
+		return fmt.Errorf("unknown action %q", cmd.Action)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+type fakeRemoteConfigTarget struct {
+	logLevel          int
+	certCheckInterval time.Duration
+	renewals          int
+	reconnects        int
+}
+
+func (f *fakeRemoteConfigTarget) SetLogLevel(lvl int) { f.logLevel = lvl }
+
+func (f *fakeRemoteConfigTarget) SetCertCheckInterval(d time.Duration) { f.certCheckInterval = d }
+
+func (f *fakeRemoteConfigTarget) RenewCertificates() error {
+	f.renewals++
+	return nil
+}
+
+func (f *fakeRemoteConfigTarget) Reconnect() { f.reconnects++ }
+
+func TestRemoteConfig_Apply(t *testing.T) {
+	testcases := []struct {
+		name              string
+		cfg               pdc.RemoteConfig
+		expectedLevel     string
+		expectedSSHLevel  int
+		expectedInterval  time.Duration
+		expectedLogSubstr string
+	}{
+		{
+			name:             "empty configuration keeps the local one",
+			expectedLevel:    "info",
+			expectedInterval: time.Minute,
+		},
+		{
+			name:              "log level and certificate check interval",
+			cfg:               pdc.RemoteConfig{LogLevel: "debug", CertCheckInterval: "5m"},
+			expectedLevel:     "debug",
+			expectedSSHLevel:  3,
+			expectedInterval:  5 * time.Minute,
+			expectedLogSubstr: "applied remote configuration",
+		},
+		{
+			name:              "invalid log level",
+			cfg:               pdc.RemoteConfig{LogLevel: "verbose"},
+			expectedLevel:     "info",
+			expectedInterval:  time.Minute,
+			expectedLogSubstr: "ignoring invalid remote configuration",
+		},
+		{
+			name:              "certificate check interval too short",
+			cfg:               pdc.RemoteConfig{CertCheckInterval: "1s"},
+			expectedLevel:     "info",
+			expectedInterval:  time.Minute,
+			expectedLogSubstr: "shorter than 10s",
+		},
+		{
+			name:              "unsupported settings",
+			cfg:               pdc.RemoteConfig{Unknown: map[string]json.RawMessage{"connections": json.RawMessage("2")}},
+			expectedLevel:     "info",
+			expectedInterval:  time.Minute,
+			expectedLogSubstr: "settings=connections",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := &strings.Builder{}
+			levelFilter, err := logging.NewLevelFilter(log.NewLogfmtLogger(logs), "info")
+			require.NoError(t, err)
+			target := &fakeRemoteConfigTarget{certCheckInterval: time.Minute}
+			rc := &remoteConfig{logger: log.NewLogfmtLogger(logs), levelFilter: levelFilter, target: target}
+
+			rc.apply(&tc.cfg)
+			assert.Equal(t, tc.expectedLevel, levelFilter.Level())
+			assert.Equal(t, tc.expectedSSHLevel, target.logLevel)
+			assert.Equal(t, tc.expectedInterval, target.certCheckInterval)
+			assert.Contains(t, logs.String(), tc.expectedLogSubstr)
+
+			// Applying the same configuration again changes and logs
+			// nothing.
+			logs.Reset()
+			rc.apply(&tc.cfg)
+			assert.Empty(t, logs.String())
+		})
+	}
+}
+
+type fakeRemoteConfigClient struct {
+	calls   chan struct{}
+	bundles map[string][]byte
+}
+
+func (f fakeRemoteConfigClient) RemoteConfig(_ context.Context) (*pdc.RemoteConfig, error) {
+	f.calls <- struct{}{}
+	return &pdc.RemoteConfig{LogLevel: "warn"}, nil
+}
+
+func (f fakeRemoteConfigClient) UploadSupportBundle(_ context.Context, commandID string, bundle []byte) error {
+	f.bundles[commandID] = bundle
+	return nil
+}
+
+func TestRemoteConfig_Poll(t *testing.T) {
+	levelFilter, err := logging.NewLevelFilter(log.NewNopLogger(), "info")
+	require.NoError(t, err)
+	client := fakeRemoteConfigClient{calls: make(chan struct{}, 10)}
+	rc := &remoteConfig{logger: log.NewNopLogger(), levelFilter: levelFilter, client: client, target: &fakeRemoteConfigTarget{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rc.poll(ctx, 10*time.Millisecond)
+	}()
+	// Fetched on start, then every interval.
+	for i := 0; i < 3; i++ {
+		<-client.calls
+	}
+	cancel()
+	<-done
+	assert.Equal(t, "warn", levelFilter.Level())
+}
+
+func TestRemoteConfig_Commands(t *testing.T) {
+	cmds := []pdc.RemoteCommand{
+		{ID: "1", Action: pdc.ActionRenewCertificate},
+		{ID: "2", Action: pdc.ActionReconnect},
+		{ID: "3", Action: pdc.ActionUploadSupportBundle},
+		{ID: "4", Action: "reboot"},
+	}
+
+	t.Run("ignored without -allow-remote-management", func(t *testing.T) {
+		logs := &strings.Builder{}
+		target := &fakeRemoteConfigTarget{}
+		rc := &remoteConfig{logger: log.NewLogfmtLogger(logs), target: target}
+
+		rc.runCommands(context.Background(), cmds)
+		rc.runCommands(context.Background(), cmds)
+		assert.Zero(t, target.renewals)
+		assert.Zero(t, target.reconnects)
+		assert.Equal(t, 1, strings.Count(logs.String(), "ignoring remote commands"))
+	})
+
+	t.Run("run once with -allow-remote-management", func(t *testing.T) {
+		logs := &strings.Builder{}
+		target := &fakeRemoteConfigTarget{}
+		client := fakeRemoteConfigClient{bundles: map[string][]byte{}}
+		rc := &remoteConfig{
+			logger:        log.NewLogfmtLogger(logs),
+			client:        client,
+			target:        target,
+			allowCommands: true,
+			bundle:        func() ([]byte, error) { return []byte("bundle"), nil },
+		}
+
+		// Commands are returned until done, they are run once.
+		rc.runCommands(context.Background(), cmds)
+		rc.runCommands(context.Background(), cmds)
+		assert.Equal(t, 1, target.renewals)
+		assert.Equal(t, 1, target.reconnects)
+		assert.Equal(t, map[string][]byte{"3": []byte("bundle")}, client.bundles)
+		assert.Contains(t, logs.String(), `unknown action \"reboot\"`)
+	})
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+)
+
+// handleRenewSignal has the certificates renewed every time the process
+// receives SIGUSR2, until ctx is done.
+func handleRenewSignal(ctx context.Context, logger log.Logger, renewer certRenewer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+
+	crash.Go(func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				level.Info(logger).Log("msg", "certificate renewal requested", "source", "SIGUSR2")
+				if err := renewer.RenewCertificates(); err != nil {
+					level.Error(logger).Log("msg", "cannot renew certificate", "err", err)
+				}
+			}
+		}
+	})
+}
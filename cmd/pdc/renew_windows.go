@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+)
+
+// handleRenewSignal is a no-op: there is no SIGUSR2 on Windows. Use the
+// /cert/renew endpoint of -http.addr instead.
+func handleRenewSignal(_ context.Context, _ log.Logger, _ certRenewer) {}
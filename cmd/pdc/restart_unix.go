@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restart replaces the process with a new one running exe, with the same
+// arguments and environment.
+func restart(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
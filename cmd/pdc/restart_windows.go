@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// restart starts a new process running exe, with the same arguments and
+// environment. There is no exec on Windows, the caller must exit once it
+// returns.
+func restart(exe string) error {
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Start()
+}
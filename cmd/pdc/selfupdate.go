@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+	"github.com/grafana/pdc-agent/pkg/selfupdate"
+)
+
+const selfUpdateCommand = "self-update"
+
+// errUpdated is returned by run when the agent stopped to restart with a new
+// binary.
+var errUpdated = errors.New("the agent was updated")
+
+// executable returns the path of the running binary, with symlinks resolved
+// so that the binary itself is replaced.
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// runSelfUpdate replaces the agent binary with the latest release.
+func runSelfUpdate(args []string) error {
+	cfg := selfupdate.Config{}
+	var check bool
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+selfUpdateCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Replaces the agent binary with the latest release, once its checksum, and signature if -self-update.public-key is set, are verified.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	cfg.RegisterFlags(fs)
+	fs.BoolVar(&check, "check", false, "only check whether a new release is available")
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	updater, err := selfupdate.NewUpdater(cfg)
+	if err != nil {
+		return err
+	}
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	rel, err := updater.Latest(ctx, version)
+	if errors.Is(err, selfupdate.ErrUpToDate) {
+		fmt.Printf("pdc-agent v%s is up to date\n", version)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if check {
+		fmt.Printf("pdc-agent v%s is available\n", rel.Version)
+		return nil
+	}
+
+	if err := updater.Install(ctx, rel, exe); err != nil {
+		return fmt.Errorf("installing v%s: %w", rel.Version, err)
+	}
+	fmt.Printf("updated %s to v%s. Restart the agent to use it\n", exe, rel.Version)
+	return nil
+}
+
+// autoUpdate checks for a new release every interval. Once one is installed,
+// onUpdate is called to stop the agent, which then restarts with the new
+// binary.
+func autoUpdate(ctx context.Context, logger log.Logger, cfg selfupdate.Config, onUpdate func()) error {
+	if version == "" {
+		return errors.New("-self-update.interval cannot be used with a development build")
+	}
+	updater, err := selfupdate.NewUpdater(cfg)
+	if err != nil {
+		return err
+	}
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+
+	crash.Go(func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			rel, err := updater.Latest(ctx, version)
+			if errors.Is(err, selfupdate.ErrUpToDate) {
+				continue
+			}
+			if err != nil {
+				level.Warn(logger).Log("msg", "could not check for a new release", "err", err)
+				continue
+			}
+
+			if err := updater.Install(ctx, rel, exe); err != nil {
+				level.Error(logger).Log("msg", "could not update the agent", "version", rel.Version, "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "updated the agent, restarting", "version", rel.Version)
+			onUpdate()
+			return
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/crash"
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registerAgentInfo registers a constant gauge carrying the agent labels, so
+// that metrics from a fleet of agents can be joined on them.
+func registerAgentInfo(reg prometheus.Registerer, labels map[string]string) error {
+	return reg.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "pdc_agent_info",
+		Help:        "Always 1. Labels are the ones configured with the -label flag.",
+		ConstLabels: labels,
+	}))
+}
+
+// registerFIPSMode registers a gauge which is 1 when the agent only uses FIPS
+// 140 approved algorithms.
+func registerFIPSMode(reg prometheus.Registerer, enabled bool) error {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pdc_agent_fips_mode",
+		Help: "1 if the agent runs with -fips, 0 otherwise.",
+	})
+	if enabled {
+		g.Set(1)
+	}
+	return reg.Register(g)
+}
+
+// registerLegacyMode registers a gauge which is 1 when the agent runs in
+// legacy mode, so agents still to be migrated can be found.
+func registerLegacyMode(reg prometheus.Registerer) error {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pdc_agent_legacy_mode",
+		Help: "1 if the agent runs in legacy mode, passing its arguments to ssh.",
+	})
+	g.Set(1)
+	return reg.Register(g)
+}
+
+// registerBuildInfo registers a constant gauge carrying the version of the
+// agent, so that fleet metrics can be sliced by version. The go_* runtime
+// metrics are registered by the default registry.
+func registerBuildInfo(reg prometheus.Registerer, info versionInfo) error {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pdc_agent_build_info",
+		Help: "Always 1. Labels are the version and commit of the agent, and the Go version it was built with.",
+		ConstLabels: prometheus.Labels{
+			"version":   info.Version,
+			"commit":    info.Commit,
+			"goversion": info.GoVersion,
+		},
+	})
+	g.Set(1)
+	return reg.Register(g)
+}
+
+// remoteWriteLabels returns the labels added to the pushed series: the agent
+// labels, and the job and instance labels a scrape would add.
+func remoteWriteLabels(agentLabels map[string]string) map[string]string {
+	labels := map[string]string{"job": "pdc-agent"}
+	if hostname, err := os.Hostname(); err == nil {
+		labels["instance"] = hostname
+	}
+	for k, v := range agentLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// newServeMux returns the handler of the agent HTTP server.
+func newServeMux(logLevel, status, renew http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/log/level", logLevel)
+	mux.Handle("/status", status)
+	mux.Handle("/cert/renew", renew)
+	mux.HandleFunc("/logs", recentLogsHandler)
+	return mux
+}
+
+// recentLogsHandler returns the recent log lines, with secrets redacted.
+func recentLogsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, l := range crash.RecentLogs() {
+		_, _ = io.WriteString(w, l)
+	}
+}
+
+// tunnelStatus is the status of the tunnel to one network.
+type tunnelStatus struct {
+	// Network is empty for the network of the -token flag.
+	Network string `json:"network"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+	// LastError is why the last ssh process exited.
+	LastError       string     `json:"last_error,omitempty"`
+	LastConnected   *time.Time `json:"last_connected,omitempty"`
+	CertValidBefore *time.Time `json:"cert_valid_before,omitempty"`
+}
+
+type agentStatus struct {
+	Version string         `json:"version"`
+	Time    time.Time      `json:"time"`
+	Tunnels []tunnelStatus `json:"tunnels"`
+}
+
+// tunnelStatusReporter is implemented by ssh.Client.
+type tunnelStatusReporter interface {
+	Status() ssh.Status
+}
+
+// collectStatus returns the state of the ssh client of each network.
+func collectStatus(networks []string, clients []services.Service) agentStatus {
+	status := agentStatus{Version: version, Time: time.Now().UTC(), Tunnels: make([]tunnelStatus, len(clients))}
+	for i, c := range clients {
+		status.Tunnels[i] = tunnelStatus{Network: networks[i], State: c.State().String()}
+		if err := c.FailureCase(); err != nil {
+			status.Tunnels[i].Error = err.Error()
+		}
+		if r, ok := c.(tunnelStatusReporter); ok {
+			s := r.Status()
+			status.Tunnels[i].LastError = s.LastError
+			status.Tunnels[i].LastConnected = timeOrNil(s.LastConnected)
+			status.Tunnels[i].CertValidBefore = timeOrNil(s.CertValidBefore)
+		}
+	}
+	return status
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// statusHandler returns the state of the ssh client of each network as
+// JSON.
+func statusHandler(networks []string, clients []services.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := collectStatus(networks, clients)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
+
+// sshLogLevelSetter changes the verbosity of the ssh process.
+type sshLogLevelSetter interface {
+	SetLogLevel(lvl int)
+}
+
+// logLevelHandler returns the current log level on GET, and changes it on
+// POST or PUT with a "level" form value. The ssh verbosity is changed
+// accordingly, and applied the next time ssh reconnects.
+func logLevelHandler(logger log.Logger, levelFilter *logging.LevelFilter, ssh sshLogLevelSetter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			lvl := r.FormValue("level")
+			sshLevel, err := logLevelToSSHLogLevel(lvl)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := levelFilter.SetLevel(lvl); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ssh.SetLogLevel(sshLevel)
+			level.Info(logger).Log("msg", "log level changed", "level", lvl)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fmt.Fprintln(w, levelFilter.Level())
+	})
+}
+
+// certRenewer renews the certificates of the tunnels.
+type certRenewer interface {
+	RenewCertificates() error
+}
+
+// renewHandler has the certificates renewed on POST. The renewal is
+// asynchronous, its outcome is logged.
+func renewHandler(logger log.Logger, renewer certRenewer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		level.Info(logger).Log("msg", "certificate renewal requested", "source", "http")
+		if err := renewer.RenewCertificates(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "certificate renewal scheduled")
+	})
+}
+
+// startHTTPServer serves the agent HTTP endpoints on addr until ctx is done.
+func startHTTPServer(ctx context.Context, logger log.Logger, addr string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	crash.Go(func() {
+		level.Info(logger).Log("msg", "starting http server", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			level.Error(logger).Log("msg", "http server stopped", "err", err)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSSHLogLevelSetter struct {
+	lvl int
+}
+
+func (f *fakeSSHLogLevelSetter) SetLogLevel(lvl int) {
+	f.lvl = lvl
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	t.Parallel()
+
+	levelFilter, err := logging.NewLevelFilter(log.NewNopLogger(), "info")
+	require.NoError(t, err)
+	ssh := &fakeSSHLogLevelSetter{}
+	handler := logLevelHandler(log.NewNopLogger(), levelFilter, ssh)
+
+	do := func(method string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/log/level", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "info\n", rec.Body.String())
+
+	rec = do(http.MethodPost, url.Values{"level": {"debug"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "debug\n", rec.Body.String())
+	assert.Equal(t, "debug", levelFilter.Level())
+	assert.Equal(t, 3, ssh.lvl)
+
+	rec = do(http.MethodPut, url.Values{"level": {"verbose"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "debug", levelFilter.Level())
+
+	rec = do(http.MethodDelete, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+type fakeCertRenewer struct {
+	calls int
+	err   error
+}
+
+func (f *fakeCertRenewer) RenewCertificates() error {
+	f.calls++
+	return f.err
+}
+
+func TestRenewHandler(t *testing.T) {
+	t.Parallel()
+
+	renewer := &fakeCertRenewer{}
+	handler := renewHandler(log.NewNopLogger(), renewer)
+
+	do := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/cert/renew", nil))
+		return rec
+	}
+
+	rec := do(http.MethodGet)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, 0, renewer.calls)
+
+	rec = do(http.MethodPost)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, 1, renewer.calls)
+
+	renewer.err = errors.New("the certificate of this tunnel cannot be renewed")
+	rec = do(http.MethodPost)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "cannot be renewed")
+}
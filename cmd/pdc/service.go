@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/grafana/pdc-agent/pkg/exitcode"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const serviceCommand = "service"
+
+const systemdUnit = `[Unit]
+Description=Grafana Private Datasource Connect agent
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%s
+Restart=always
+RestartSec=5
+RestartPreventExitStatus=%d
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// runService prints a systemd unit which runs the agent with args. The flags
+// are validated first, so that the unit does not fail on start.
+func runService(args []string, out io.Writer) error {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+serviceCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Prints a systemd unit which runs the agent with the given flags, e.g.
+
+  %s -token=<token> -cluster=<cluster> -gcloud-hosted-grafana-id=<id> > /etc/systemd/system/pdc-agent.service
+
+`, fs.Name(), fs.Name())
+		fs.PrintDefaults()
+	}
+	mf.RegisterFlags(fs)
+	sshConfig.RegisterFlags(fs)
+	pdcClientCfg.RegisterFlags(fs)
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if mf.PrintHelp {
+		fs.Usage()
+		return nil
+	}
+	if _, _, _, err := resolveURLs(mf); err != nil {
+		return err
+	}
+
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	cmdline := []string{systemdQuote(exe)}
+	for _, a := range args {
+		cmdline = append(cmdline, systemdQuote(a))
+	}
+	_, err = fmt.Fprintf(out, systemdUnit, strings.Join(cmdline, " "), exitcode.Config)
+	return err
+}
+
+// systemdQuote quotes s for the command line of a systemd unit, where % starts
+// a specifier.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s == "" || strings.ContainsAny(s, " \t\"'\\;$") {
+		s = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	return s
+}
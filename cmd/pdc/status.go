@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grafana/dskit/services"
+)
+
+const (
+	statusCommand      = "status"
+	healthcheckCommand = "healthcheck"
+)
+
+// runStatus prints the status of the tunnels of an agent running with
+// -http.addr.
+func runStatus(args []string, out io.Writer) error {
+	var addr string
+	var asJSON, help bool
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+statusCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Prints the status of the tunnels of an agent running with -http.addr.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&help, "h", false, "Print help")
+	fs.StringVar(&addr, "http.addr", "", "the -http.addr of the agent")
+	fs.BoolVar(&asJSON, "json", false, "print the status as JSON")
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if help {
+		fs.Usage()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	status, err := getStatus(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	}
+
+	fmt.Fprintf(out, "pdc-agent v%s\n", status.Version)
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, t := range status.Tunnels {
+		network := t.Network
+		if network == "" {
+			network = "(default)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", network, t.State, t.Error)
+	}
+	return tw.Flush()
+}
+
+// runHealthcheck returns an error unless the tunnels of an agent running with
+// -http.addr are all running, for container health checks.
+func runHealthcheck(args []string, out io.Writer) error {
+	var addr string
+	var timeout time.Duration
+	var help bool
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+healthcheckCommand, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %s:
+
+Exits with status 0 if the tunnels of an agent running with -http.addr are all running, 1 otherwise. For Docker HEALTHCHECK or Nomad script checks.
+
+`, fs.Name())
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&help, "h", false, "Print help")
+	fs.StringVar(&addr, "http.addr", "", "the -http.addr of the agent")
+	fs.DurationVar(&timeout, "timeout", 5*time.Second, "the timeout of the check")
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if help {
+		fs.Usage()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	status, err := getStatus(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range status.Tunnels {
+		if t.State != services.Running.String() {
+			network := t.Network
+			if network == "" {
+				network = "default"
+			}
+			return fmt.Errorf("the tunnel of the %s network is %s", network, t.State)
+		}
+	}
+	_, err = fmt.Fprintln(out, "healthy")
+	return err
+}
+
+// getStatus returns the status of an agent running with -http.addr addr.
+func getStatus(ctx context.Context, addr string) (*agentStatus, error) {
+	body, err := getFromAgent(ctx, addr, "/status")
+	if err != nil {
+		return nil, err
+	}
+	var status agentStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("parsing the status of the agent: %w", err)
+	}
+	return &status, nil
+}
+
+// getFromAgent returns the response to a GET request to path on the HTTP
+// server of an agent running with -http.addr addr.
+func getFromAgent(ctx context.Context, addr, path string) ([]byte, error) {
+	if addr == "" {
+		return nil, errors.New("-http.addr is required")
+	}
+	// An agent listening on all interfaces is reachable on localhost.
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the agent: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from the agent: %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStatus(t *testing.T) {
+	running := services.NewIdleService(nil, nil)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), running))
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), running) })
+
+	failed := services.NewIdleService(func(context.Context) error { return errors.New("key signing request failed") }, nil)
+	_ = services.StartAndAwaitRunning(context.Background(), failed)
+
+	ts := httptest.NewServer(statusHandler([]string{"", "staging"}, []services.Service{running, failed}))
+	t.Cleanup(ts.Close)
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	out := &bytes.Buffer{}
+	require.NoError(t, runStatus([]string{"-http.addr", addr}, out))
+	assert.Contains(t, out.String(), "(default)  Running")
+	assert.Contains(t, out.String(), "staging    Failed   key signing request failed")
+
+	assert.EqualError(t, runStatus(nil, out), "-http.addr is required")
+}
+
+func TestRunHealthcheck(t *testing.T) {
+	running := services.NewIdleService(nil, nil)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), running))
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), running) })
+	starting := services.NewIdleService(nil, nil)
+
+	healthy := httptest.NewServer(statusHandler([]string{""}, []services.Service{running}))
+	t.Cleanup(healthy.Close)
+	unhealthy := httptest.NewServer(statusHandler([]string{"", "staging"}, []services.Service{running, starting}))
+	t.Cleanup(unhealthy.Close)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, runHealthcheck([]string{"-http.addr", strings.TrimPrefix(healthy.URL, "http://")}, out))
+	assert.Equal(t, "healthy\n", out.String())
+	assert.EqualError(t, runHealthcheck([]string{"-http.addr", strings.TrimPrefix(unhealthy.URL, "http://")}, out), "the tunnel of the staging network is New")
+	assert.Error(t, runHealthcheck([]string{"-http.addr", "localhost:1"}, out))
+}
+
+func TestWriteStatusFiles(t *testing.T) {
+	running := services.NewIdleService(nil, nil)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), running))
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), running) })
+
+	path := filepath.Join(t.TempDir(), "status.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeStatusFiles(ctx, log.NewNopLogger(), path, 10*time.Millisecond, func() agentStatus {
+			return collectStatus([]string{"staging"}, []services.Service{running})
+		})
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var status agentStatus
+	require.NoError(t, json.Unmarshal(data, &status))
+	require.Len(t, status.Tunnels, 1)
+	assert.Equal(t, "staging", status.Tunnels[0].Network)
+	assert.Equal(t, "Running", status.Tunnels[0].State)
+	assert.WithinDuration(t, time.Now(), status.Time, time.Minute)
+
+	// No temporary file is left behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// writeStatusFiles writes the status returned by collect to path every
+// interval until ctx is done, and once more when it is, so monitoring
+// without an HTTP listener can check the file instead of /status.
+func writeStatusFiles(ctx context.Context, logger log.Logger, path string, interval time.Duration, collect func() agentStatus) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := writeStatusFile(path, collect()); err != nil {
+			level.Warn(logger).Log("msg", "could not write status file", "path", path, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			// Record that the tunnels are stopping.
+			_ = writeStatusFile(path, collect())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeStatusFile writes status to path atomically, so readers never see a
+// partial file.
+func writeStatusFile(path string, status agentStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	// CreateTemp creates the file with 0600 permissions: let monitoring
+	// agents running as other users read it.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
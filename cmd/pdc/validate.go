@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/sandbox"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// knownClusters are the PDC clusters of Grafana Cloud, to suggest the closest
+// one when -cluster is misspelled.
+var knownClusters = []string{
+	"prod-ap-northeast-0",
+	"prod-ap-south-0",
+	"prod-ap-south-1",
+	"prod-ap-southeast-0",
+	"prod-ap-southeast-1",
+	"prod-au-southeast-0",
+	"prod-ca-east-0",
+	"prod-eu-central-0",
+	"prod-eu-north-0",
+	"prod-eu-west-0",
+	"prod-eu-west-2",
+	"prod-eu-west-3",
+	"prod-gb-south-0",
+	"prod-me-central-0",
+	"prod-sa-east-0",
+	"prod-us-central-0",
+	"prod-us-central-3",
+	"prod-us-central-4",
+	"prod-us-central-5",
+	"prod-us-central-6",
+	"prod-us-central-7",
+	"prod-us-east-0",
+	"prod-us-east-1",
+	"prod-us-east-2",
+	"prod-us-east-3",
+	"prod-us-west-0",
+}
+
+// defaultDomain is the domain of the Grafana Cloud PDC clusters.
+const defaultDomain = "grafana.net"
+
+// validateFlags checks the flags of the agent for common mistakes, which would
+// otherwise only fail once the agent calls the PDC API or connects to the
+// gateway, and for settings the agent cannot run with, before it creates any
+// file or connection. It returns the errors, and warnings for flags which are
+// likely but not certainly wrong.
+func validateFlags(mf *mainFlags, sshConfig *ssh.Config, pdcConfig *pdc.Config) (errs []error, warnings []string) {
+	errs = validateSettings(mf, sshConfig, pdcConfig)
+	if mf.DevMode {
+		return errs, nil
+	}
+
+	if mf.APIURL == "" || mf.GatewayURL == "" {
+		warning, err := validateCluster(mf.Cluster, mf.Domain)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	switch {
+	case pdcConfig.HostedGrafanaID == "":
+		errs = append(errs, errors.New("-gcloud-hosted-grafana-id is required: the ID of the Grafana Cloud stack, shown with the token in the Private data source connect page"))
+	case !isDigits(pdcConfig.HostedGrafanaID) && isDigits(pdcConfig.Token):
+		errs = append(errs, errors.New("-gcloud-hosted-grafana-id is not a stack ID and -token is a number: the values of -token and -gcloud-hosted-grafana-id appear to be swapped"))
+	case !isDigits(pdcConfig.HostedGrafanaID):
+		errs = append(errs, fmt.Errorf("invalid -gcloud-hosted-grafana-id %q: must be the numeric ID of the Grafana Cloud stack", pdcConfig.HostedGrafanaID))
+	}
+
+	if !sshConfig.NoAPI && pdcConfig.Auth.Mode == pdc.AuthModeToken && pdcConfig.Token == "" {
+		errs = append(errs, errors.New("-token is required with -auth.mode=token: set -token, -token-file or -token-source, or run pdc enroll"))
+	}
+
+	if err := sshConfig.CheckSSHFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := sshConfig.CheckHostCAKeysFile(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs, warnings
+}
+
+// validateSettings checks the combinations of flags the agent cannot run
+// with, in development mode too.
+func validateSettings(mf *mainFlags, sshConfig *ssh.Config, pdcConfig *pdc.Config) (errs []error) {
+	if err := (sandbox.Config{Mode: mf.Sandbox}).Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := mf.SelfUpdate.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if mf.Sandbox == sandbox.ModeStrict && mf.SelfUpdate.Interval > 0 {
+		errs = append(errs, errors.New("-sandbox=strict cannot be used with -self-update.interval, as the agent cannot replace its binary once sandboxed"))
+	}
+	if err := mf.Approval.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := mf.Failover.validate(mf, sshConfig, pdcConfig); err != nil {
+		errs = append(errs, err)
+	}
+	if mf.IdentityOnCopy != identityOnCopyWarn && mf.IdentityOnCopy != identityOnCopyRegenerate {
+		errs = append(errs, fmt.Errorf("invalid -identity.on-copy %q: must be %q or %q", mf.IdentityOnCopy, identityOnCopyWarn, identityOnCopyRegenerate))
+	}
+	if mf.StatusFile != "" && mf.StatusFileInterval <= 0 {
+		errs = append(errs, errors.New("-status.file-interval must be positive"))
+	}
+	if mf.RemoteConfigInterval > 0 && sshConfig.NoAPI {
+		errs = append(errs, errors.New("-remote-config.interval requires the PDC API, and cannot be used with -no-api"))
+	}
+	return errs
+}
+
+// validateCluster checks -cluster, which the API and gateway URLs are derived
+// from. New clusters are not known by older agents, so an unknown cluster is
+// only a warning.
+func validateCluster(cluster, domain string) (string, error) {
+	if cluster == "" {
+		return "", errors.New("-cluster is required, e.g. -cluster=prod-us-central-0, unless -api-url and -gateway-url are set")
+	}
+	if strings.ContainsAny(cluster, ".:/") {
+		// A host name derived from the cluster, e.g. the one of the gateway.
+		name := strings.TrimPrefix(cluster, "https://")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "private-datasource-connect-api-"), "private-datasource-connect-")
+		name, _, _ = strings.Cut(name, ".")
+		return "", fmt.Errorf("invalid -cluster %q: must be the name of the cluster, e.g. -cluster=%s, not a URL", cluster, name)
+	}
+	if domain != defaultDomain {
+		return "", nil
+	}
+	for _, c := range knownClusters {
+		if c == cluster {
+			return "", nil
+		}
+	}
+	if s := closest(cluster, knownClusters); s != "" {
+		return fmt.Sprintf("unknown -cluster %q, did you mean %q?", cluster, s), nil
+	}
+	return "", nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/sandbox"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestValidateFlags(t *testing.T) {
+	valid := func() (*mainFlags, *ssh.Config, *pdc.Config) {
+		sshConfig := ssh.DefaultConfig()
+		pdcConfig := &pdc.Config{Token: "glc_token", HostedGrafanaID: "123"}
+		pdcConfig.Auth.Mode = pdc.AuthModeToken
+		mf := &mainFlags{Cluster: "prod-us-central-0", Domain: defaultDomain, Sandbox: sandbox.ModeOff, IdentityOnCopy: identityOnCopyWarn}
+		return mf, sshConfig, pdcConfig
+	}
+
+	for _, tt := range []struct {
+		description string
+		modify      func(mf *mainFlags, sshConfig *ssh.Config, pdcConfig *pdc.Config)
+		errs        []string
+		warnings    []string
+	}{
+		{
+			description: "valid",
+			modify:      func(*mainFlags, *ssh.Config, *pdc.Config) {},
+		},
+		{
+			description: "misspelled cluster",
+			modify:      func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) { mf.Cluster = "prod-us-centrl-0" },
+			warnings:    []string{`unknown -cluster "prod-us-centrl-0", did you mean "prod-us-central-0"?`},
+		},
+		{
+			description: "unknown cluster of another domain",
+			modify: func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) {
+				mf.Cluster = "prod-us-centrl-0"
+				mf.Domain = "example.com"
+			},
+		},
+		{
+			description: "gateway host as cluster",
+			modify: func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) {
+				mf.Cluster = "private-datasource-connect-prod-eu-west-2.grafana.net"
+			},
+			errs: []string{"must be the name of the cluster, e.g. -cluster=prod-eu-west-2, not a URL"},
+		},
+		{
+			description: "missing cluster",
+			modify:      func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) { mf.Cluster = "" },
+			errs:        []string{"-cluster is required"},
+		},
+		{
+			description: "URLs without cluster",
+			modify: func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) {
+				mf.Cluster = ""
+				mf.APIURL = "https://pdc.example.com"
+				mf.GatewayURL = "gateway.example.com"
+			},
+		},
+		{
+			description: "missing token and stack ID",
+			modify: func(_ *mainFlags, _ *ssh.Config, pdcConfig *pdc.Config) {
+				pdcConfig.Token = ""
+				pdcConfig.HostedGrafanaID = ""
+			},
+			errs: []string{"-gcloud-hosted-grafana-id is required", "-token is required"},
+		},
+		{
+			description: "swapped token and stack ID",
+			modify: func(_ *mainFlags, _ *ssh.Config, pdcConfig *pdc.Config) {
+				pdcConfig.Token = "123"
+				pdcConfig.HostedGrafanaID = "glc_token"
+			},
+			errs: []string{"appear to be swapped"},
+		},
+		{
+			description: "no token with another auth mode",
+			modify: func(_ *mainFlags, _ *ssh.Config, pdcConfig *pdc.Config) {
+				pdcConfig.Token = ""
+				pdcConfig.Auth.Mode = pdc.AuthModeAWS
+			},
+		},
+		{
+			description: "agent managed ssh flag",
+			modify: func(_ *mainFlags, sshConfig *ssh.Config, _ *pdc.Config) {
+				sshConfig.SSHFlags = []string{"-i/tmp/key"}
+			},
+			errs: []string{`invalid -ssh-flag "-i/tmp/key"`},
+		},
+		{
+			description: "dev mode",
+			modify: func(mf *mainFlags, _ *ssh.Config, pdcConfig *pdc.Config) {
+				mf.DevMode = true
+				mf.Cluster = ""
+				pdcConfig.HostedGrafanaID = "dev"
+			},
+		},
+		{
+			description: "invalid settings in dev mode",
+			modify: func(mf *mainFlags, _ *ssh.Config, pdcConfig *pdc.Config) {
+				mf.DevMode = true
+				mf.Cluster = ""
+				pdcConfig.HostedGrafanaID = "dev"
+				mf.Sandbox = "on"
+			},
+			errs: []string{`invalid -sandbox "on"`},
+		},
+		{
+			description: "strict sandbox with self-update",
+			modify: func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) {
+				mf.Sandbox = sandbox.ModeStrict
+				mf.SelfUpdate.Interval = time.Hour
+				mf.SelfUpdate.PublicKey = "key"
+			},
+			errs: []string{"-sandbox=strict cannot be used with -self-update.interval"},
+		},
+		{
+			description: "self-update without public key",
+			modify:      func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) { mf.SelfUpdate.Interval = time.Hour },
+			errs:        []string{"-self-update.interval requires -self-update.public-key"},
+		},
+		{
+			description: "invalid approval URL",
+			modify:      func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) { mf.Approval.URL = "ftp://approval" },
+			errs:        []string{`invalid -approval.url "ftp://approval"`},
+		},
+		{
+			description: "failover to the same cluster",
+			modify: func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) {
+				mf.Failover = failoverConfig{Cluster: mf.Cluster, Domain: mf.Domain, After: time.Minute, ProbeInterval: time.Second}
+			},
+			errs: []string{"-failover.cluster must differ from -cluster"},
+		},
+		{
+			description: "invalid identity on copy",
+			modify:      func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) { mf.IdentityOnCopy = "ignore" },
+			errs:        []string{`invalid -identity.on-copy "ignore"`},
+		},
+		{
+			description: "status file without interval",
+			modify:      func(mf *mainFlags, _ *ssh.Config, _ *pdc.Config) { mf.StatusFile = "/tmp/status.json" },
+			errs:        []string{"-status.file-interval must be positive"},
+		},
+		{
+			description: "remote config without API",
+			modify: func(mf *mainFlags, sshConfig *ssh.Config, _ *pdc.Config) {
+				mf.RemoteConfigInterval = time.Minute
+				sshConfig.NoAPI = true
+			},
+			errs: []string{"-remote-config.interval requires the PDC API"},
+		},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			mf, sshConfig, pdcConfig := valid()
+			tt.modify(mf, sshConfig, pdcConfig)
+
+			errs, warnings := validateFlags(mf, sshConfig, pdcConfig)
+			assert.Len(t, errs, len(tt.errs))
+			for i := range errs {
+				if i < len(tt.errs) {
+					assert.ErrorContains(t, errs[i], tt.errs[i])
+				}
+			}
+			assert.Equal(t, tt.warnings, warnings)
+		})
+	}
+}
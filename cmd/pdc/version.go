@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const versionCommand = "version"
+
+// versionInfo is the version of the agent and of its dependencies.
+type versionInfo struct {
+	Version        string `json:"version"`
+	Commit         string `json:"commit"`
+	Date           string `json:"date"`
+	GoVersion      string `json:"go_version"`
+	OS             string `json:"os"`
+	Arch           string `json:"arch"`
+	OpenSSHVersion string `json:"openssh_version"`
+	// FIPSBackend is true when the agent was built with a FIPS 140
+	// validated crypto module, as required by -fips.
+	FIPSBackend bool `json:"fips_backend"`
+}
+
+// runVersion prints the version of the agent.
+func runVersion(args []string, out io.Writer) error {
+	var help, asJSON bool
+	sshBinary := ssh.DefaultConfig().BinaryPath
+
+	fs := flag.NewFlagSet(os.Args[0]+" "+versionCommand, flag.ContinueOnError)
+	fs.BoolVar(&help, "h", false, "Print help")
+	fs.BoolVar(&asJSON, "json", false, "print the versions as JSON")
+	fs.StringVar(&sshBinary, "ssh.binary-path", sshBinary, "The ssh binary to report the version of. Looked up in PATH if it is not a path.")
+	if err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if help {
+		fs.Usage()
+		return nil
+	}
+
+	info := currentVersion(sshBinary)
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	_, err := fmt.Fprintf(out, "pdc-agent v%s (commit %s, built %s, %s %s/%s)\nssh: %s\nfips backend: %t\n", info.Version, info.Commit, info.Date, info.GoVersion, info.OS, info.Arch, info.OpenSSHVersion, info.FIPSBackend)
+	return err
+}
+
+// currentVersion returns the version of the agent, and of the ssh binary.
+func currentVersion(sshBinary string) versionInfo {
+	return versionInfo{
+		Version:        version,
+		Commit:         commit,
+		Date:           date,
+		GoVersion:      runtime.Version(),
+		OS:             runtime.GOOS,
+		Arch:           runtime.GOARCH,
+		OpenSSHVersion: tryGetOpenSSHVersion(sshBinary),
+		FIPSBackend:    fipsBackend(),
+	}
+}
+
+// agentFeatures are the features of the agent reported to the PDC API, so it
+// can tell which protocols an agent supports.
+var agentFeatures = []string{
+	"socks5-remote-forward",
+	"port-forwards",
+	"connection-replacement",
+	"certificate-renewal",
+	"stack-tokens",
+}
+
+// agentCapabilities returns the capabilities reported to the PDC API. The
+// version of ssh is added by each tunnel.
+func agentCapabilities() *pdc.Capabilities {
+	return &pdc.Capabilities{
+		Version:  version,
+		Commit:   commit,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Features: agentFeatures,
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunVersion(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.NoError(t, runVersion([]string{"--json", "-ssh.binary-path", "/nonexistent/ssh"}, out))
+
+	var info versionInfo
+	require.NoError(t, json.Unmarshal(out.Bytes(), &info))
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.Equal(t, runtime.GOOS, info.OS)
+	assert.Equal(t, "UNKNOWN", info.OpenSSHVersion)
+	assert.Equal(t, fipsBackend(), info.FIPSBackend)
+}
+
+func TestRegisterBuildInfo(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	require.NoError(t, registerBuildInfo(reg, versionInfo{Version: "1.2.3", Commit: "abc123", GoVersion: "go1.21.0"}))
+
+	expected := `
+# HELP pdc_agent_build_info Always 1. Labels are the version and commit of the agent, and the Go version it was built with.
+# TYPE pdc_agent_build_info gauge
+pdc_agent_build_info{commit="abc123",goversion="go1.21.0",version="1.2.3"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected)))
+}
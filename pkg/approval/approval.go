@@ -0,0 +1,162 @@
+// Package approval runs a hook which must approve the agent before it
+// establishes its first tunnel, for human approval or ticket verification
+// workflows: a command which must exit with status 0, or a URL which must
+// respond with a 2xx status.
+package approval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/httpclient"
+)
+
+// ErrDenied is returned when the hook does not approve the agent.
+var ErrDenied = errors.New("the agent was not approved")
+
+// Config is the approval hook. It is disabled if Command and URL are empty,
+// and both must approve the agent if both are set.
+type Config struct {
+	// Command is split on spaces, and run with the Request in the
+	// environment.
+	Command string
+	// URL is sent the Request as JSON in a POST request.
+	URL string
+	// Timeout is how long the hook may take to approve the agent, e.g.
+	// waiting for a human.
+	Timeout time.Duration
+}
+
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Command, "approval.command", "", "a command, split on spaces, which must exit with status 0 before the agent establishes its first tunnel, e.g. to wait for a human approval or check a change ticket. It is run with PDC_AGENT_HOSTED_GRAFANA_ID, PDC_AGENT_HOSTNAME and PDC_AGENT_LABELS in its environment. Disabled if empty")
+	fs.StringVar(&cfg.URL, "approval.url", "", "a URL which must respond with a 2xx status to a POST request before the agent establishes its first tunnel, sent the hosted_grafana_id, hostname and labels of the agent as JSON. Disabled if empty")
+	fs.DurationVar(&cfg.Timeout, "approval.timeout", 10*time.Minute, "how long -approval.command and -approval.url may take to approve the agent")
+}
+
+// Enabled returns true if a hook is set.
+func (cfg Config) Enabled() bool {
+	return cfg.Command != "" || cfg.URL != ""
+}
+
+// Validate returns an error if the command is blank or the URL is invalid.
+func (cfg Config) Validate() error {
+	if cfg.Command != "" && len(strings.Fields(cfg.Command)) == 0 {
+		return fmt.Errorf("invalid -approval.command %q", cfg.Command)
+	}
+	if cfg.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -approval.url %q", cfg.URL)
+	}
+	return nil
+}
+
+// Request describes the agent asking for approval.
+type Request struct {
+	HostedGrafanaID string            `json:"hosted_grafana_id"`
+	Hostname        string            `json:"hostname"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// Wait runs the hooks of cfg, and returns an error wrapping ErrDenied if one
+// of them does not approve the agent in time.
+func Wait(ctx context.Context, cfg Config, req Request, logger log.Logger) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	level.Info(logger).Log("msg", "waiting for the approval of the agent")
+	if cfg.Command != "" {
+		if err := runCommand(ctx, cfg.Command, req); err != nil {
+			return fmt.Errorf("%w by -approval.command: %w", ErrDenied, err)
+		}
+	}
+	if cfg.URL != "" {
+		if err := post(ctx, cfg.URL, req); err != nil {
+			return fmt.Errorf("%w by -approval.url: %w", ErrDenied, err)
+		}
+	}
+	level.Info(logger).Log("msg", "the agent was approved")
+	return nil
+}
+
+func runCommand(ctx context.Context, command string, req Request) error {
+	args := strings.Fields(command)
+	labels, err := json.Marshal(req.Labels)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"PDC_AGENT_HOSTED_GRAFANA_ID="+req.HostedGrafanaID,
+		"PDC_AGENT_HOSTNAME="+req.Hostname,
+		"PDC_AGENT_LABELS="+string(labels),
+	)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("%w: %s", err, truncate(msg))
+	}
+	return err
+}
+
+func post(ctx context.Context, u string, req Request) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Transport: httpclient.UserAgentTransport(nil)}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// truncate shortens the output of a command to the length of a log line.
+func truncate(s string) string {
+	const max = 512
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
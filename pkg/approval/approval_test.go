@@ -0,0 +1,115 @@
+package approval_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/approval"
+)
+
+var request = approval.Request{HostedGrafanaID: "1", Hostname: "db-proxy-1", Labels: map[string]string{"dc": "eu-west"}}
+
+func TestWait_Disabled(t *testing.T) {
+	assert.NoError(t, approval.Wait(context.Background(), approval.Config{}, request, log.NewNopLogger()))
+}
+
+func TestWait_Command(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands are shell scripts")
+	}
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700))
+		return path
+	}
+	env := filepath.Join(dir, "env")
+
+	testcases := []struct {
+		name    string
+		command string
+		timeout time.Duration
+		wantErr string
+	}{
+		{
+			name:    "approved",
+			command: script("approve", `echo "$PDC_AGENT_HOSTED_GRAFANA_ID $PDC_AGENT_HOSTNAME $PDC_AGENT_LABELS $1" > `+env),
+		},
+		{
+			name:    "denied",
+			command: script("deny", "echo ticket CHG-1 is not approved; exit 1"),
+			wantErr: "ticket CHG-1 is not approved",
+		},
+		{
+			name:    "timeout",
+			command: script("wait", "exec sleep 10"),
+			timeout: 100 * time.Millisecond,
+			wantErr: "deadline exceeded",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := approval.Config{Command: tc.command + " arg", Timeout: tc.timeout}
+			err := approval.Wait(context.Background(), cfg, request, log.NewNopLogger())
+			if tc.wantErr != "" {
+				assert.ErrorIs(t, err, approval.ErrDenied)
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			b, err := os.ReadFile(env)
+			require.NoError(t, err)
+			assert.Equal(t, "1 db-proxy-1 {\"dc\":\"eu-west\"} arg\n", string(b))
+		})
+	}
+}
+
+func TestWait_URL(t *testing.T) {
+	testcases := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "approved", status: http.StatusOK},
+		{name: "denied", status: http.StatusForbidden, wantErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got approval.Request
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+				w.WriteHeader(tc.status)
+			}))
+			t.Cleanup(ts.Close)
+
+			err := approval.Wait(context.Background(), approval.Config{URL: ts.URL}, request, log.NewNopLogger())
+			if tc.wantErr {
+				assert.ErrorIs(t, err, approval.ErrDenied)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, request, got)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, approval.Config{}.Validate())
+	assert.NoError(t, approval.Config{Command: "approve", URL: "https://approvals.example.com/pdc"}.Validate())
+	assert.Error(t, approval.Config{Command: " "}.Validate())
+	assert.Error(t, approval.Config{URL: "approvals.example.com"}.Validate())
+}
@@ -0,0 +1,202 @@
+// Package cloud obtains credentials from the instance metadata services of
+// AWS, GCP and Azure, so that the agent does not need static secrets on cloud
+// instances.
+package cloud
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The metadata endpoints are variables so that tests can override them.
+var (
+	awsMetadataURL   = "http://169.254.169.254"
+	gcpMetadataURL   = "http://metadata.google.internal"
+	azureMetadataURL = "http://169.254.169.254"
+)
+
+// metadataClient is used to query the instance metadata endpoints, which are
+// link local and must not go through a proxy.
+var metadataClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{Proxy: nil},
+}
+
+// GCPIdentityToken returns an identity token of the service account of the
+// GCE instance for audience, and its expiry.
+func GCPIdentityToken(ctx context.Context, audience string) (string, time.Time, error) {
+	q := url.Values{"audience": {audience}, "format": {"full"}}
+	body, err := metadataGet(ctx, gcpMetadataURL+"/computeMetadata/v1/instance/service-accounts/default/identity?"+q.Encode(), map[string]string{"Metadata-Flavor": "Google"})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("requesting GCP identity token: %w", err)
+	}
+
+	token := strings.TrimSpace(string(body))
+	expiry, err := jwtExpiry(token)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing GCP identity token: %w", err)
+	}
+
+	return token, expiry, nil
+}
+
+// GCPAccessToken returns an OAuth2 access token of the service account of the
+// GCE instance, used to call Google Cloud APIs, and its expiry.
+func GCPAccessToken(ctx context.Context) (string, time.Time, error) {
+	body, err := metadataGet(ctx, gcpMetadataURL+"/computeMetadata/v1/instance/service-accounts/default/token", map[string]string{"Metadata-Flavor": "Google"})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("requesting GCP access token: %w", err)
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing GCP access token: %w", err)
+	}
+
+	return resp.AccessToken, time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second), nil
+}
+
+// AzureToken returns an access token of the managed identity of the Azure VM
+// for resource, and its expiry.
+func AzureToken(ctx context.Context, resource string) (string, time.Time, error) {
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+	body, err := metadataGet(ctx, azureMetadataURL+"/metadata/identity/oauth2/token?"+q.Encode(), map[string]string{"Metadata": "true"})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("requesting Azure managed identity token: %w", err)
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing Azure managed identity token: %w", err)
+	}
+	expiresOn, err := strconv.ParseInt(resp.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing Azure managed identity token expiry: %w", err)
+	}
+
+	return resp.AccessToken, time.Unix(expiresOn, 0), nil
+}
+
+// AWSCredentials are the credentials used to sign AWS requests.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Token           string
+}
+
+// LoadAWSCredentials returns the credentials of the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables, or else
+// the credentials of the IAM role of the EC2 instance.
+func LoadAWSCredentials(ctx context.Context) (AWSCredentials, error) {
+	creds := AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Token:           os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
+		return creds, nil
+	}
+
+	creds, err := awsInstanceCredentials(ctx)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("no AWS credentials in the environment or from the instance metadata: %w", err)
+	}
+	return creds, nil
+}
+
+// awsInstanceCredentials returns the credentials of the IAM role of the EC2
+// instance, using IMDSv2.
+func awsInstanceCredentials(ctx context.Context) (AWSCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsMetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := metadataDo(req)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+
+	role, err := metadataGet(ctx, awsMetadataURL+"/latest/meta-data/iam/security-credentials/", headers)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	body, err := metadataGet(ctx, awsMetadataURL+"/latest/meta-data/iam/security-credentials/"+strings.TrimSpace(string(role)), headers)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+
+	var creds AWSCredentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return AWSCredentials{}, err
+	}
+	return creds, nil
+}
+
+// jwtExpiry returns the exp claim of a JWT. The signature is not verified,
+// the token is only forwarded.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, errors.New("no exp claim")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+func metadataGet(ctx context.Context, u string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return metadataDo(req)
+}
+
+func metadataDo(req *http.Request) ([]byte, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from %s: %d", req.URL.Host, resp.StatusCode)
+	}
+	return body, nil
+}
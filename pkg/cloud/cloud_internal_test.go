@@ -0,0 +1,91 @@
+package cloud
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla from the AWS Signature Version 4 test suite.
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	creds := AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+	SignV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", req.Header.Get("Authorization"))
+}
+
+func TestAWSInstanceCredentials(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			assert.Equal(t, http.MethodPut, r.Method)
+			_, _ = w.Write([]byte("imds token"))
+			return
+		}
+		assert.Equal(t, "imds token", r.Header.Get("X-aws-ec2-metadata-token"))
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			_, _ = w.Write([]byte("agent-role"))
+		case "/latest/meta-data/iam/security-credentials/agent-role":
+			_, _ = w.Write([]byte(`{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"session"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	setMetadataURL(t, &awsMetadataURL, ts.URL)
+
+	creds, err := awsInstanceCredentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", Token: "session"}, creds)
+}
+
+func TestGCPIdentityToken(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	payload, err := json.Marshal(map[string]interface{}{"aud": "pdc", "exp": exp.Unix()})
+	require.NoError(t, err)
+	jwt := "header." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+		assert.Equal(t, "pdc", r.URL.Query().Get("audience"))
+		_, _ = w.Write([]byte(jwt))
+	}))
+	t.Cleanup(ts.Close)
+	setMetadataURL(t, &gcpMetadataURL, ts.URL)
+
+	token, expiry, err := GCPIdentityToken(context.Background(), "pdc")
+	require.NoError(t, err)
+	assert.Equal(t, jwt, token)
+	assert.True(t, exp.Equal(expiry))
+}
+
+func TestAzureToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, "api://pdc", r.URL.Query().Get("resource"))
+		_, _ = w.Write([]byte(`{"access_token":"azure token","expires_on":"1690891200"}`))
+	}))
+	t.Cleanup(ts.Close)
+	setMetadataURL(t, &azureMetadataURL, ts.URL)
+
+	token, expiry, err := AzureToken(context.Background(), "api://pdc")
+	require.NoError(t, err)
+	assert.Equal(t, "azure token", token)
+	assert.Equal(t, int64(1690891200), expiry.Unix())
+}
+
+func setMetadataURL(t *testing.T, v *string, u string) {
+	prev := *v
+	*v = u
+	t.Cleanup(func() { *v = prev })
+}
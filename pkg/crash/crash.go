@@ -0,0 +1,164 @@
+// Package crash writes a report when the agent panics, with the stack of
+// every goroutine, the redacted command line and the recent log lines, and
+// exits with ExitCode.
+package crash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/grafana/pdc-agent/pkg/exitcode"
+	"github.com/grafana/pdc-agent/pkg/logging"
+)
+
+// ExitCode is the exit code of the agent after a panic.
+const ExitCode = exitcode.Crash
+
+// logLines is the number of recent log lines in a report.
+const logLines = 200
+
+var (
+	mu      sync.Mutex
+	enabled bool
+	dir     string
+	cmdline string
+	version string
+
+	recent = &ring{lines: make([]string, logLines)}
+
+	// exit is replaced in tests.
+	exit = os.Exit
+)
+
+// Setup enables crash reports, written to reportDir. args is the command
+// line, in which secrets are redacted.
+func Setup(reportDir, agentVersion string, args []string, secrets ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	enabled = true
+	dir = reportDir
+	version = agentVersion
+	cmdline = logging.Redact(strings.Join(args, " "), secrets...)
+}
+
+// Recover writes a crash report and exits if the calling goroutine panics.
+// It must be deferred at the top of the goroutine. Without Setup, the panic
+// continues.
+func Recover() {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	mu.Lock()
+	on := enabled
+	mu.Unlock()
+	if !on {
+		panic(v)
+	}
+
+	path, err := writeReport(v, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "panic: %v\ncannot write crash report: %s\n", v, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "panic: %v\ncrash report written to %s\n", v, path)
+	}
+	exit(ExitCode)
+}
+
+// Go runs fn in a goroutine which writes a crash report if it panics.
+func Go(fn func()) {
+	go func() {
+		defer Recover()
+		fn()
+	}()
+}
+
+func writeReport(v interface{}, now time.Time) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "pdc-agent v%s crashed at %s\n", version, now.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "%s %s/%s\n\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "panic: %v\n\n", v)
+	fmt.Fprintf(&b, "command line:\n%s\n\n", cmdline)
+	fmt.Fprintf(&b, "recent logs:\n")
+	for _, l := range recent.get() {
+		b.WriteString(l)
+	}
+	fmt.Fprintf(&b, "\ngoroutines:\n%s\n", stacks())
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("pdc-crash-%s.txt", now.UTC().Format("20060102T150405Z")))
+	return path, os.WriteFile(path, b.Bytes(), 0600)
+}
+
+// stacks returns the stack of every goroutine.
+func stacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 64<<20 {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// NewLogger returns a logger which keeps the recent log lines for the crash
+// reports, and passes them to next.
+func NewLogger(next log.Logger) log.Logger {
+	return log.LoggerFunc(func(keyvals ...interface{}) error {
+		var b bytes.Buffer
+		if err := log.NewLogfmtLogger(&b).Log(keyvals...); err == nil {
+			recent.add(b.String())
+		}
+		return next.Log(keyvals...)
+	})
+}
+
+// RecentLogs returns the recent log lines kept for the crash reports.
+func RecentLogs() []string {
+	return recent.get()
+}
+
+// ring keeps the last lines added to it.
+type ring struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func (r *ring) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *ring) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	return append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+}
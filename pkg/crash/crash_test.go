@@ -0,0 +1,72 @@
+package crash
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecover(t *testing.T) {
+	var code int
+	exit = func(c int) { code = c }
+	t.Cleanup(func() {
+		exit = os.Exit
+		enabled = false
+	})
+
+	t.Run("without setup the panic continues", func(t *testing.T) {
+		assert.PanicsWithValue(t, "boom", func() {
+			defer Recover()
+			panic("boom")
+		})
+	})
+
+	dir := filepath.Join(t.TempDir(), "crashes")
+	Setup(dir, "1.2.3", []string{"pdc", "-token", "glc_s3cr3t", "-cluster", "prod"}, "glc_s3cr3t")
+	logger := NewLogger(log.NewNopLogger())
+	require.NoError(t, logger.Log("msg", "connected"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer Recover()
+		panic("boom")
+	}()
+	<-done
+	assert.Equal(t, ExitCode, code)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	report, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+
+	assert.Contains(t, string(report), "pdc-agent v1.2.3 crashed")
+	assert.Contains(t, string(report), "panic: boom")
+	assert.Contains(t, string(report), "pdc -token <redacted> -cluster prod")
+	assert.Contains(t, string(report), "msg=connected\n")
+	assert.Contains(t, string(report), "crash.TestRecover")
+	assert.NotContains(t, string(report), "glc_s3cr3t")
+}
+
+func TestRing(t *testing.T) {
+	t.Parallel()
+
+	r := &ring{lines: make([]string, 3)}
+	assert.Empty(t, r.get())
+
+	for i := 0; i < 2; i++ {
+		r.add(fmt.Sprint(i))
+	}
+	assert.Equal(t, []string{"0", "1"}, r.get())
+
+	for i := 2; i < 5; i++ {
+		r.add(fmt.Sprint(i))
+	}
+	assert.Equal(t, []string{"2", "3", "4"}, r.get())
+}
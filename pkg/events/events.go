@@ -0,0 +1,148 @@
+// Package events notifies external systems of the tunnel lifecycle events of
+// the agent, such as connections and certificate renewals.
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/httpclient"
+)
+
+// The types of events.
+const (
+	// Connected is sent once an ssh connection has been up for long enough
+	// to be considered healthy.
+	Connected = "connected"
+	// Disconnected is sent when a connected ssh process exits.
+	Disconnected = "disconnected"
+	// CertRenewed is sent when a new certificate is signed.
+	CertRenewed = "cert-renewed"
+	// AuthFailed is sent when the PDC API or the gateway rejects the
+	// credentials of the agent.
+	AuthFailed = "auth-failed"
+	// ConnectionLimit is sent when the gateway refuses the connection
+	// because the limit of connections of the stack and network is reached.
+	ConnectionLimit = "connection-limit"
+)
+
+// Event is a tunnel lifecycle event.
+type Event struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	// Tunnel is the network or stack of the tunnel, empty for the one of
+	// the -token flag.
+	Tunnel  string            `json:"tunnel,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// Sink receives events. Send blocks until the event is delivered or dropped.
+type Sink interface {
+	Send(ev Event)
+}
+
+// Send sends an event of type typ to sink, if it is not nil.
+func Send(sink Sink, typ, msg string) {
+	if sink == nil {
+		return
+	}
+	sink.Send(Event{Type: typ, Timestamp: time.Now(), Message: msg})
+}
+
+type Config struct {
+	WebhookURL string
+	Timeout    time.Duration
+}
+
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.WebhookURL, "events.webhook-url", "", "the URL to POST tunnel lifecycle events to as JSON: connected, disconnected, cert-renewed, auth-failed and connection-limit. Disabled if empty")
+	fs.DurationVar(&cfg.Timeout, "events.webhook-timeout", 10*time.Second, "the timeout of an event webhook request")
+}
+
+// Webhook POSTs events as JSON to a URL.
+type Webhook struct {
+	url    string
+	labels map[string]string
+	logger log.Logger
+	client *http.Client
+}
+
+// NewWebhook returns a Webhook sending events to the URL of cfg. labels are
+// added to every event.
+func NewWebhook(cfg Config, labels map[string]string, logger log.Logger) (*Webhook, error) {
+	u, err := url.Parse(cfg.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid -events.webhook-url %q", cfg.WebhookURL)
+	}
+
+	return &Webhook{
+		url:    u.String(),
+		labels: labels,
+		logger: logger,
+		client: &http.Client{Timeout: cfg.Timeout, Transport: httpclient.UserAgentTransport(nil)},
+	}, nil
+}
+
+// Send posts ev. Failures are logged: events are not retried.
+func (w *Webhook) Send(ev Event) {
+	if ev.Labels == nil {
+		ev.Labels = w.labels
+	}
+	if err := w.post(context.Background(), ev); err != nil {
+		level.Warn(w.logger).Log("msg", "could not send event to webhook", "type", ev.Type, "err", err)
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Tunnel returns a sink setting the tunnel of the events sent to sink.
+func Tunnel(sink Sink, name string) Sink {
+	if sink == nil {
+		return nil
+	}
+	return tunnelSink{sink: sink, name: name}
+}
+
+type tunnelSink struct {
+	sink Sink
+	name string
+}
+
+func (t tunnelSink) Send(ev Event) {
+	ev.Tunnel = t.name
+	t.sink.Send(ev)
+}
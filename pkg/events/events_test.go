@@ -0,0 +1,50 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWebhook(t *testing.T) {
+	for _, u := range []string{"", "localhost:8080", "ftp://example.com", "http://"} {
+		_, err := NewWebhook(Config{WebhookURL: u}, nil, log.NewNopLogger())
+		assert.Error(t, err, u)
+	}
+}
+
+func TestWebhook_Send(t *testing.T) {
+	received := make(chan Event, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var ev Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&ev))
+		received <- ev
+	}))
+	t.Cleanup(ts.Close)
+
+	webhook, err := NewWebhook(Config{WebhookURL: ts.URL, Timeout: time.Second}, map[string]string{"env": "prod"}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	Send(Tunnel(webhook, "staging"), CertRenewed, "principals a,b")
+
+	ev := <-received
+	assert.Equal(t, CertRenewed, ev.Type)
+	assert.Equal(t, "staging", ev.Tunnel)
+	assert.Equal(t, "principals a,b", ev.Message)
+	assert.Equal(t, map[string]string{"env": "prod"}, ev.Labels)
+	assert.WithinDuration(t, time.Now(), ev.Timestamp, time.Minute)
+}
+
+func TestSend_NilSink(t *testing.T) {
+	assert.Nil(t, Tunnel(nil, "staging"))
+	assert.NotPanics(t, func() { Send(nil, Connected, "") })
+}
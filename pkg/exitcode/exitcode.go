@@ -0,0 +1,38 @@
+// Package exitcode defines the exit codes of the agent, one per class of
+// failure, so that supervisors such as systemd or Kubernetes can react
+// differently to each: restarting on a dropped connection, but not on an
+// invalid flag.
+package exitcode
+
+const (
+	// OK is the exit code of the agent when it stops normally.
+	OK = 0
+	// Error is the exit code of the failures with no class of their own.
+	Error = 1
+	// Config is the exit code of invalid flags or configuration, including
+	// unreadable token files. Restarting the agent does not fix them.
+	Config = 2
+	// Crash is the exit code of the agent after a panic. The Go runtime exits
+	// with 2 on an unrecovered panic, but the agent recovers it to write a
+	// crash report.
+	Crash = 3
+	// RetryBudgetExhausted is the exit code of the agent when it gives up
+	// reconnecting, once -ssh.retry-max-attempts or -ssh.retry-max-elapsed is
+	// reached.
+	RetryBudgetExhausted = 4
+	// Auth is the exit code of the agent when the PDC API rejects its token.
+	Auth = 5
+	// ConnectionLimit is the exit code of the agent when the gateway refuses
+	// the connection because the stack and network have reached their limit
+	// of connections.
+	ConnectionLimit = 6
+	// CertSigning is the exit code of the agent when it cannot get a
+	// certificate from the PDC API, for another reason than its token.
+	CertSigning = 7
+	// SSH is the exit code of the agent when ssh cannot run: the binary is
+	// missing or too old.
+	SSH = 8
+	// Approval is the exit code of the agent when -approval.command or
+	// -approval.url does not approve it.
+	Approval = 9
+)
@@ -0,0 +1,72 @@
+package httpclient
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Middleware wraps a transport, to change requests before they are sent or
+// observe their responses.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RequestMutator changes a request before it is sent. The request is a clone
+// of the one of the caller. An error stops the request.
+type RequestMutator func(req *http.Request) error
+
+// ResponseObserver is called once a request completes, with its response or
+// error, and its duration.
+type ResponseObserver func(req *http.Request, resp *http.Response, err error, d time.Duration)
+
+// Chain returns rt wrapped by middlewares. The first middleware sees the
+// request first. It wraps http.DefaultTransport if rt is nil.
+func Chain(rt http.RoundTripper, middlewares ...Middleware) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		rt = middlewares[i](rt)
+	}
+	return rt
+}
+
+// MutateRequest returns a middleware calling mutate with each request.
+func MutateRequest(mutate RequestMutator) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// A RoundTripper must not modify the request of the caller.
+			req = req.Clone(req.Context())
+			if err := mutate(req); err != nil {
+				return nil, err
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// ObserveResponse returns a middleware calling observe once each request
+// completes.
+func ObserveResponse(observe ResponseObserver) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			observe(req, resp, err, time.Since(start))
+			return resp, err
+		})
+	}
+}
+
+// Headers returns a middleware adding headers to each request. A header
+// already set on a request is kept.
+func Headers(headers map[string]string) Middleware {
+	return MutateRequest(func(req *http.Request) error {
+		for name, value := range headers {
+			if req.Header.Get(name) == "" {
+				req.Header.Set(name, value)
+			}
+		}
+		return nil
+	})
+}
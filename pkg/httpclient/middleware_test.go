@@ -0,0 +1,95 @@
+package httpclient_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/httpclient"
+)
+
+func TestChain(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	t.Cleanup(ts.Close)
+
+	var order []string
+	appendHeader := func(value string) httpclient.Middleware {
+		return httpclient.MutateRequest(func(req *http.Request) error {
+			order = append(order, value)
+			req.Header.Add("X-Order", value)
+			return nil
+		})
+	}
+	var observed int
+	var observedDuration time.Duration
+	observe := httpclient.ObserveResponse(func(req *http.Request, resp *http.Response, err error, d time.Duration) {
+		require.NoError(t, err)
+		observed = resp.StatusCode
+		observedDuration = d
+	})
+
+	client := &http.Client{Transport: httpclient.Chain(nil,
+		appendHeader("first"),
+		appendHeader("second"),
+		httpclient.Headers(map[string]string{"X-Custom": "custom", "User-Agent": "ignored"}),
+		observe,
+	)}
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "caller")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"first", "second"}, order)
+	assert.Equal(t, []string{"first", "second"}, got.Values("X-Order"))
+	assert.Equal(t, "custom", got.Get("X-Custom"))
+	// Headers set by the caller are kept.
+	assert.Equal(t, "caller", got.Get("User-Agent"))
+	// The request of the caller is not modified.
+	assert.Empty(t, req.Header.Get("X-Custom"))
+	assert.Equal(t, http.StatusTeapot, observed)
+	assert.Positive(t, observedDuration)
+}
+
+func TestMutateRequest_Error(t *testing.T) {
+	errMutate := errors.New("mutate failed")
+	called := false
+	rt := httpclient.Chain(promhttp.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		called = true
+		return nil, nil
+	}), httpclient.MutateRequest(func(*http.Request) error {
+		return errMutate
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	assert.ErrorIs(t, err, errMutate)
+	assert.False(t, called)
+}
+
+func TestUserAgentTransport(t *testing.T) {
+	var got string
+	rt := httpclient.UserAgentTransport(promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.UserAgent()
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, httpclient.UserAgent, got)
+}
@@ -0,0 +1,141 @@
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Keys ignored when comparing log lines, because they change on every line.
+var ignoredDedupKeys = map[string]bool{"ts": true, "caller": true}
+
+type dedupState struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+	// keyvals of the first suppressed line, used to report the repetitions.
+	keyvals []interface{}
+}
+
+type deduplicator struct {
+	next     log.Logger
+	limit    int
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	states    map[string]*dedupState
+	lastPurge time.Time
+}
+
+// NewDeduplicator returns a logger which passes at most limit identical log
+// lines per interval to next. Lines are identical when all their keys and
+// values but the timestamp and caller are equal. Once the interval elapses, a
+// "last message repeated N times" line reports the suppressed lines.
+func NewDeduplicator(next log.Logger, limit int, interval time.Duration) log.Logger {
+	return &deduplicator{
+		next:     next,
+		limit:    limit,
+		interval: interval,
+		now:      time.Now,
+		states:   map[string]*dedupState{},
+	}
+}
+
+// Log implements log.Logger.
+func (d *deduplicator) Log(keyvals ...interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if now.Sub(d.lastPurge) >= d.interval {
+		d.purge(now)
+		d.lastPurge = now
+	}
+
+	sig := lineWithout(keyvals)
+	st, ok := d.states[sig]
+	if !ok {
+		st = &dedupState{windowStart: now}
+		d.states[sig] = st
+	}
+
+	if now.Sub(st.windowStart) >= d.interval {
+		d.reportSuppressed(st)
+		st.windowStart, st.count = now, 0
+	}
+
+	if st.count >= d.limit {
+		if st.suppressed == 0 {
+			st.keyvals = keyvals
+		}
+		st.suppressed++
+		return nil
+	}
+
+	st.count++
+	return d.next.Log(keyvals...)
+}
+
+// purge reports and forgets the lines whose interval has elapsed.
+func (d *deduplicator) purge(now time.Time) {
+	sigs := make([]string, 0, len(d.states))
+	for sig := range d.states {
+		sigs = append(sigs, sig)
+	}
+	sort.Strings(sigs)
+
+	for _, sig := range sigs {
+		st := d.states[sig]
+		if now.Sub(st.windowStart) >= d.interval {
+			d.reportSuppressed(st)
+			delete(d.states, sig)
+		}
+	}
+}
+
+func (d *deduplicator) reportSuppressed(st *dedupState) {
+	if st.suppressed == 0 {
+		return
+	}
+
+	keyvals := []interface{}{}
+	for i := 0; i+1 < len(st.keyvals); i += 2 {
+		if st.keyvals[i] == level.Key() {
+			keyvals = append(keyvals, st.keyvals[i], st.keyvals[i+1])
+		}
+	}
+	keyvals = append(keyvals,
+		"msg", fmt.Sprintf("last message repeated %d times", st.suppressed),
+		"last_msg", lineWithout(st.keyvals),
+	)
+	_ = d.next.Log(keyvals...)
+
+	st.suppressed = 0
+	st.keyvals = nil
+}
+
+// lineWithout formats keyvals without the ignored keys. Identical log lines
+// have the same result.
+func lineWithout(keyvals []interface{}) string {
+	b := strings.Builder{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if k, ok := keyvals[i].(string); ok && ignoredDedupKeys[k] {
+			continue
+		}
+		v := keyvals[i+1]
+		if bs, ok := v.([]byte); ok {
+			v = string(bs)
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%v=%v", keyvals[i], v)
+	}
+	return b.String()
+}
@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicator(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	now := time.Unix(0, 0)
+	logger := NewDeduplicator(log.NewLogfmtLogger(buf), 2, time.Minute)
+	logger.(*deduplicator).now = func() time.Time { return now }
+
+	lines := func() []string {
+		out := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		buf.Reset()
+		return out
+	}
+
+	// Identical lines, with different timestamps, are limited.
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		level.Error(logger).Log("ts", now.String(), "msg", "ssh client exited. restarting")
+		level.Info(logger).Log("msg", "starting key manager")
+	}
+	assert.Equal(t, []string{
+		`level=error ts="1970-01-01 00:00:01 +0000 UTC" msg="ssh client exited. restarting"`,
+		`level=info msg="starting key manager"`,
+		`level=error ts="1970-01-01 00:00:02 +0000 UTC" msg="ssh client exited. restarting"`,
+		`level=info msg="starting key manager"`,
+	}, lines())
+
+	// Once the interval elapsed, the suppressed lines are reported.
+	now = now.Add(time.Minute)
+	level.Error(logger).Log("ts", now.String(), "msg", "ssh client exited. restarting")
+	assert.Equal(t, []string{
+		`level=error msg="last message repeated 8 times" last_msg="level=error msg=ssh client exited. restarting"`,
+		`level=info msg="last message repeated 8 times" last_msg="level=info msg=starting key manager"`,
+		`level=error ts="1970-01-01 00:01:10 +0000 UTC" msg="ssh client exited. restarting"`,
+	}, lines())
+
+	// Other lines are not affected.
+	level.Info(logger).Log("msg", "connected")
+	assert.Equal(t, []string{`level=info msg=connected`}, lines())
+}
@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Levels are the log levels accepted by LevelFilter, from most to least verbose.
+var Levels = []string{"debug", "info", "warn", "error"}
+
+// LevelFilter is like level.NewFilter, but its level can be changed at runtime.
+type LevelFilter struct {
+	next log.Logger
+
+	mu       sync.RWMutex
+	level    string
+	filtered log.Logger
+}
+
+// NewLevelFilter returns a LevelFilter wrapping next, allowing lvl and above.
+func NewLevelFilter(next log.Logger, lvl string) (*LevelFilter, error) {
+	f := &LevelFilter{next: next}
+	if err := f.SetLevel(lvl); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Log implements log.Logger.
+func (f *LevelFilter) Log(keyvals ...interface{}) error {
+	f.mu.RLock()
+	filtered := f.filtered
+	f.mu.RUnlock()
+
+	return filtered.Log(keyvals...)
+}
+
+// Level returns the current level.
+func (f *LevelFilter) Level() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.level
+}
+
+// SetLevel changes the level. It returns an error if lvl is not one of Levels.
+func (f *LevelFilter) SetLevel(lvl string) error {
+	var option level.Option
+	switch lvl {
+	case "debug":
+		option = level.AllowDebug()
+	case "info":
+		option = level.AllowInfo()
+	case "warn":
+		option = level.AllowWarn()
+	case "error":
+		option = level.AllowError()
+	default:
+		return fmt.Errorf("invalid log level: %s", lvl)
+	}
+
+	filtered := level.NewFilter(f.next, option)
+
+	f.mu.Lock()
+	f.level = lvl
+	f.filtered = filtered
+	f.mu.Unlock()
+	return nil
+}
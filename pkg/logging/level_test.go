@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevelFilter(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	f, err := NewLevelFilter(log.NewLogfmtLogger(buf), "info")
+	require.NoError(t, err)
+	assert.Equal(t, "info", f.Level())
+
+	level.Debug(f).Log("msg", "hidden")
+	level.Info(f).Log("msg", "shown")
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "shown")
+
+	require.NoError(t, f.SetLevel("debug"))
+	assert.Equal(t, "debug", f.Level())
+
+	level.Debug(f).Log("msg", "now shown")
+	assert.Contains(t, buf.String(), "now shown")
+
+	require.NoError(t, f.SetLevel("error"))
+	level.Warn(f).Log("msg", "warning")
+	assert.NotContains(t, buf.String(), "warning")
+
+	assert.Error(t, f.SetLevel("verbose"))
+	assert.Equal(t, "error", f.Level())
+
+	_, err = NewLevelFilter(log.NewNopLogger(), "verbose")
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+)
+
+// Redacted replaces secrets in log lines.
+const Redacted = "<redacted>"
+
+var (
+	// authorizationRegexp matches the credentials of an Authorization header.
+	authorizationRegexp = regexp.MustCompile(`(?i)(authorization["']?\s*[:=]\s*["']?(?:(?:basic|bearer)\s+)?)[^\s"',]+`)
+	// privateKeyRegexp matches PEM encoded private keys, including truncated ones.
+	privateKeyRegexp = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----.*?(?:-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`)
+	// secretKeyRegexp matches the keys whose values are always redacted.
+	secretKeyRegexp = regexp.MustCompile(`(?i)(token|password|secret|authorization|private_?key)`)
+)
+
+// Redactor is a logger which redacts secrets before passing log lines to the
+// next one.
+type Redactor struct {
+	next log.Logger
+
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// NewRedactor returns a logger which redacts secrets before passing log
+// lines to next. The given secrets are redacted wherever they appear, as are
+// Authorization header credentials, PEM private keys and the values of keys
+// such as "token" or "password".
+func NewRedactor(next log.Logger, secrets ...string) *Redactor {
+	return newRedactor(next, secrets)
+}
+
+// AddSecrets redacts secrets from the following log lines, for example
+// credentials which are rotated while the agent runs.
+func (r *Redactor) AddSecrets(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range secrets {
+		if s != "" && !slices.Contains(r.secrets, s) {
+			r.secrets = append(r.secrets, s)
+		}
+	}
+}
+
+// Redact returns s with the given secrets, Authorization header credentials
+// and PEM private keys removed.
+func Redact(s string, secrets ...string) string {
+	return newRedactor(nil, secrets).redact(s)
+}
+
+func newRedactor(next log.Logger, secrets []string) *Redactor {
+	r := &Redactor{next: next}
+	r.AddSecrets(secrets...)
+	return r
+}
+
+// Log implements log.Logger.
+func (r *Redactor) Log(keyvals ...interface{}) error {
+	redacted := make([]interface{}, len(keyvals))
+	for i, v := range keyvals {
+		if i%2 == 1 && isSecretKey(keyvals[i-1]) {
+			redacted[i] = Redacted
+			continue
+		}
+		redacted[i] = r.redactValue(v)
+	}
+	return r.next.Log(redacted...)
+}
+
+func isSecretKey(key interface{}) bool {
+	k, ok := key.(string)
+	return ok && secretKeyRegexp.MatchString(k)
+}
+
+// redactValue returns v with secrets removed. Values which are not text are
+// returned unchanged.
+func (r *Redactor) redactValue(v interface{}) interface{} {
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	case []byte:
+		s = string(t)
+	case error:
+		s = t.Error()
+	case fmt.Stringer:
+		s = t.String()
+	default:
+		return v
+	}
+
+	return r.redact(s)
+}
+
+// redact removes secrets from s.
+func (r *Redactor) redact(s string) string {
+	r.mu.RLock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	r.mu.RUnlock()
+	s = privateKeyRegexp.ReplaceAllString(s, Redacted)
+	s = authorizationRegexp.ReplaceAllString(s, "${1}"+Redacted)
+	return s
+}
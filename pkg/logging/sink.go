@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Log sinks supported by NewSink.
+const (
+	SinkStdout   = "stdout"
+	SinkStderr   = "stderr"
+	SinkSyslog   = "syslog"
+	SinkEventLog = "eventlog"
+)
+
+// sinkSource identifies the agent in syslog and in the Windows Event Log.
+const sinkSource = "pdc-agent"
+
+// NewSink returns a logfmt logger writing to the named sink. The syslog sink
+// is only supported on Unix, and the eventlog sink only on Windows.
+func NewSink(name string) (log.Logger, error) {
+	switch name {
+	case SinkStdout:
+		return log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)), nil
+	case SinkStderr:
+		return log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), nil
+	case SinkSyslog:
+		return newSyslogSink()
+	case SinkEventLog:
+		return newEventLogSink()
+	default:
+		return nil, fmt.Errorf("invalid log sink %q: must be one of %q, %q, %q or %q",
+			name, SinkStdout, SinkStderr, SinkSyslog, SinkEventLog)
+	}
+}
+
+// NewFileSink returns a logfmt logger appending to the file at path, which
+// is created readable by its owner only.
+func NewFileSink(path string) (log.Logger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return log.NewLogfmtLogger(log.NewSyncWriter(f)), nil
+}
+
+// NewTee returns a logger writing every line to all of loggers. It returns
+// the first error.
+func NewTee(loggers ...log.Logger) log.Logger {
+	return log.LoggerFunc(func(keyvals ...interface{}) error {
+		var err error
+		for _, l := range loggers {
+			if lerr := l.Log(keyvals...); lerr != nil && err == nil {
+				err = lerr
+			}
+		}
+		return err
+	})
+}
+
+// severityLogger formats log lines with logfmt and writes them with a
+// severity taken from their level, for sinks with their own severities.
+type severityLogger struct {
+	write func(severity string, line string) error
+}
+
+// Log implements log.Logger.
+func (l severityLogger) Log(keyvals ...interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := log.NewLogfmtLogger(buf).Log(keyvals...); err != nil {
+		return err
+	}
+	return l.write(severityOf(keyvals), strings.TrimSuffix(buf.String(), "\n"))
+}
+
+// severityOf returns the level of a log line, or info if it has none.
+func severityOf(keyvals []interface{}) string {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		if v, ok := keyvals[i+1].(level.Value); ok {
+			return v.String()
+		}
+	}
+	return "info"
+}
@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeverityLogger(t *testing.T) {
+	t.Parallel()
+
+	type line struct {
+		severity string
+		line     string
+	}
+	lines := []line{}
+	logger := severityLogger{write: func(severity string, l string) error {
+		lines = append(lines, line{severity, l})
+		return nil
+	}}
+
+	level.Error(logger).Log("msg", "ssh client exited")
+	level.Warn(logger).Log("msg", "retrying")
+	level.Debug(logger).Log("msg", "debug1: connecting")
+	logger.Log("msg", "no level")
+
+	assert.Equal(t, []line{
+		{"error", `level=error msg="ssh client exited"`},
+		{"warn", `level=warn msg=retrying`},
+		{"debug", `level=debug msg="debug1: connecting"`},
+		{"info", `msg="no level"`},
+	}, lines)
+}
+
+func TestNewSink(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{SinkStdout, SinkStderr} {
+		logger, err := NewSink(name)
+		require.NoError(t, err)
+		assert.NotNil(t, logger)
+	}
+
+	_, err := NewSink("file")
+	assert.ErrorContains(t, err, `invalid log sink "file"`)
+}
+
+func TestNewFileSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for _, msg := range []string{"first", "second"} {
+		logger, err := NewFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, logger.Log("msg", msg))
+	}
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "msg=first\nmsg=second\n", string(data))
+}
+
+func TestNewTee(t *testing.T) {
+	t.Parallel()
+
+	var a, b []string
+	logger := NewTee(
+		log.LoggerFunc(func(keyvals ...interface{}) error {
+			a = append(a, keyvals[1].(string))
+			return errors.New("unavailable")
+		}),
+		log.LoggerFunc(func(keyvals ...interface{}) error {
+			b = append(b, keyvals[1].(string))
+			return nil
+		}),
+	)
+	assert.EqualError(t, logger.Log("msg", "first"), "unavailable")
+	assert.Equal(t, []string{"first"}, a)
+	assert.Equal(t, []string{"first"}, b)
+}
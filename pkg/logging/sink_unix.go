@@ -0,0 +1,35 @@
+//go:build !windows
+
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+
+	"github.com/go-kit/log"
+)
+
+func newSyslogSink() (log.Logger, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, sinkSource)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+
+	return severityLogger{write: func(severity string, line string) error {
+		switch severity {
+		case "error":
+			return w.Err(line)
+		case "warn":
+			return w.Warning(line)
+		case "debug":
+			return w.Debug(line)
+		default:
+			return w.Info(line)
+		}
+	}}, nil
+}
+
+func newEventLogSink() (log.Logger, error) {
+	return nil, errors.New("the eventlog log sink is only supported on Windows")
+}
@@ -0,0 +1,41 @@
+//go:build windows
+
+package logging
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/log"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventID is the ID of all the events written by the agent.
+const eventID = 1
+
+func newSyslogSink() (log.Logger, error) {
+	return nil, errors.New("the syslog log sink is not supported on Windows")
+}
+
+func newEventLogSink() (log.Logger, error) {
+	// Registering the event source needs administrator rights, and fails if
+	// it is already registered. Events are still written if it fails, but
+	// without a message file.
+	_ = eventlog.InstallAsEventCreate(sinkSource, eventlog.Error|eventlog.Warning|eventlog.Info)
+
+	l, err := eventlog.Open(sinkSource)
+	if err != nil {
+		return nil, fmt.Errorf("opening the event log: %w", err)
+	}
+
+	return severityLogger{write: func(severity string, line string) error {
+		switch severity {
+		case "error":
+			return l.Error(eventID, line)
+		case "warn":
+			return l.Warning(eventID, line)
+		default:
+			return l.Info(eventID, line)
+		}
+	}}, nil
+}
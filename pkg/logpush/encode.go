@@ -0,0 +1,87 @@
+package logpush
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// encodeLoki encodes the lines as a request of the Loki push API, with a
+// stream per level.
+func encodeLoki(batch []entry, labels map[string]string) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	var streams []*stream
+	byLevel := map[string]*stream{}
+	for _, e := range batch {
+		s, ok := byLevel[e.level]
+		if !ok {
+			s = &stream{Stream: map[string]string{"level": e.level}}
+			for k, v := range labels {
+				s.Stream[k] = v
+			}
+			byLevel[e.level] = s
+			streams = append(streams, s)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+	}
+	return json.Marshal(map[string]interface{}{"streams": streams})
+}
+
+// otlpSeverities are the OTLP severity numbers of the levels.
+var otlpSeverities = map[string]int{
+	"debug": 5,
+	"info":  9,
+	"warn":  13,
+	"error": 17,
+}
+
+// encodeOTLP encodes the lines as an OTLP ExportLogsServiceRequest, in its
+// JSON encoding. The labels are resource attributes.
+func encodeOTLP(batch []entry, labels map[string]string) ([]byte, error) {
+	type value struct {
+		StringValue string `json:"stringValue"`
+	}
+	type attribute struct {
+		Key   string `json:"key"`
+		Value value  `json:"value"`
+	}
+	type logRecord struct {
+		TimeUnixNano   string `json:"timeUnixNano"`
+		SeverityNumber int    `json:"severityNumber"`
+		SeverityText   string `json:"severityText"`
+		Body           value  `json:"body"`
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attributes := []attribute{{Key: "service.name", Value: value{"pdc-agent"}}}
+	for _, name := range names {
+		attributes = append(attributes, attribute{Key: name, Value: value{labels[name]}})
+	}
+
+	records := make([]logRecord, 0, len(batch))
+	for _, e := range batch {
+		records = append(records, logRecord{
+			TimeUnixNano:   strconv.FormatInt(e.ts.UnixNano(), 10),
+			SeverityNumber: otlpSeverities[e.level],
+			SeverityText:   e.level,
+			Body:           value{e.line},
+		})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceLogs": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": attributes},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope":      map[string]string{"name": "pdc-agent"},
+				"logRecords": records,
+			}},
+		}},
+	})
+}
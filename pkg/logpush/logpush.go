@@ -0,0 +1,297 @@
+// Package logpush ships the agent logs to an OpenTelemetry collector, with
+// OTLP over HTTP, or to Loki, with its push API, for hosts without a log
+// shipper.
+package logpush
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/pdc-agent/pkg/retry"
+)
+
+// Protocols supported by the Pusher.
+const (
+	ProtocolOTLP = "otlp"
+	ProtocolLoki = "loki"
+)
+
+var droppedLines = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pdc_agent_log_push_dropped_lines_total",
+	Help: "Number of log lines which were not pushed to -log.push-url, because the buffer was full or the endpoint rejected them.",
+})
+
+// Config configures the log push.
+type Config struct {
+	URL          string
+	Protocol     string
+	Username     string
+	Password     string
+	PasswordFile string
+	Interval     time.Duration
+	BatchSize    int
+	Timeout      time.Duration
+}
+
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.URL, "log.push-url", "", "the URL to push the agent logs to, besides -log.sink: an OTLP/HTTP logs endpoint, e.g. http://collector:4318/v1/logs, or a Loki push endpoint, e.g. https://logs-prod-eu-west-0.grafana.net/loki/api/v1/push. Disabled if empty")
+	fs.StringVar(&cfg.Protocol, "log.push-protocol", ProtocolOTLP, `the protocol of -log.push-url: "otlp" or "loki"`)
+	fs.StringVar(&cfg.Username, "log.push-username", "", "the basic auth username of the log push endpoint. For Grafana Cloud, the Loki instance ID")
+	fs.StringVar(&cfg.Password, "log.push-password", "", "the basic auth password of the log push endpoint. For Grafana Cloud, a token with the logs:write scope")
+	fs.StringVar(&cfg.PasswordFile, "log.push-password-file", "", "the path of a file containing the basic auth password of the log push endpoint")
+	fs.DurationVar(&cfg.Interval, "log.push-interval", 5*time.Second, "how often the logs are pushed")
+	fs.IntVar(&cfg.BatchSize, "log.push-batch-size", 1000, "the maximum number of log lines of a push. Logs are pushed early once a batch is full")
+	fs.DurationVar(&cfg.Timeout, "log.push-timeout", 10*time.Second, "the timeout of a push")
+}
+
+// Secrets returns the values which must never be logged. The password file
+// is read here, as the logger redacting them is set up before NewPusher, which
+// reports a file which cannot be read.
+func (cfg *Config) Secrets() []string {
+	var secrets []string
+	if cfg.Password != "" {
+		secrets = append(secrets, cfg.Password)
+	}
+	if password, err := cfg.password(); err == nil && password != "" && password != cfg.Password {
+		secrets = append(secrets, password)
+	}
+	return secrets
+}
+
+// password returns the basic auth password, read from -log.push-password-file if set.
+func (cfg *Config) password() (string, error) {
+	if cfg.PasswordFile == "" {
+		return cfg.Password, nil
+	}
+	data, err := os.ReadFile(cfg.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("reading log push password file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// maxBatches is how many batches of lines are buffered while the endpoint
+// cannot be reached. The oldest lines are dropped beyond.
+const maxBatches = 10
+
+// entry is a log line.
+type entry struct {
+	ts    time.Time
+	level string
+	line  string
+}
+
+// Pusher is a log.Logger buffering the log lines, which Run pushes in
+// batches.
+type Pusher struct {
+	cfg      Config
+	url      string
+	password string
+	labels   map[string]string
+	client   *http.Client
+	// retryOpts are the retries of a failed push, before its lines are
+	// kept for the next one.
+	retryOpts retry.Opts
+
+	mu      sync.Mutex
+	entries []entry
+	// full is notified when a batch of lines is buffered.
+	full chan struct{}
+}
+
+// NewPusher returns a Pusher of the log lines. labels are added to every
+// line, as Loki stream labels or OTLP resource attributes.
+func NewPusher(cfg Config, labels map[string]string) (*Pusher, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid -log.push-url %q", cfg.URL)
+	}
+	if cfg.Protocol != ProtocolOTLP && cfg.Protocol != ProtocolLoki {
+		return nil, fmt.Errorf("invalid -log.push-protocol %q: must be %q or %q", cfg.Protocol, ProtocolOTLP, ProtocolLoki)
+	}
+	if cfg.Interval <= 0 || cfg.BatchSize <= 0 {
+		return nil, errors.New("-log.push-interval and -log.push-batch-size must be positive")
+	}
+
+	password, err := cfg.password()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pusher{
+		cfg:      cfg,
+		url:      u.String(),
+		password: password,
+		labels:   labels,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		retryOpts: retry.Opts{
+			InitialBackoff: time.Second,
+			MaxBackoff:     cfg.Interval,
+			MaxAttempts:    3,
+		},
+		full: make(chan struct{}, 1),
+	}, nil
+}
+
+// Log implements log.Logger. It buffers the line, formatted with logfmt,
+// until it is pushed.
+func (p *Pusher) Log(keyvals ...interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := log.NewLogfmtLogger(buf).Log(keyvals...); err != nil {
+		return err
+	}
+	e := entry{ts: time.Now(), level: levelOf(keyvals), line: strings.TrimSuffix(buf.String(), "\n")}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.entries) >= maxBatches*p.cfg.BatchSize {
+		p.entries = p.entries[1:]
+		droppedLines.Inc()
+	}
+	p.entries = append(p.entries, e)
+	if len(p.entries) >= p.cfg.BatchSize {
+		select {
+		case p.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Run pushes the buffered lines every interval, or once a batch is full,
+// until ctx is done. The lines left are then pushed once. Failed pushes are
+// logged to logger, and so pushed once the endpoint recovers if it writes to
+// the Pusher.
+func (p *Pusher) Run(ctx context.Context, logger log.Logger) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+			defer cancel()
+			if err := p.Push(flushCtx); err != nil {
+				level.Warn(logger).Log("msg", "could not push logs", "url", p.url, "err", err)
+			}
+			return
+		case <-ticker.C:
+		case <-p.full:
+		}
+
+		if err := retry.Forever(p.retryOpts, func() error { return p.Push(ctx) }); err != nil {
+			level.Warn(logger).Log("msg", "could not push logs", "url", p.url, "err", err)
+		}
+	}
+}
+
+// Push sends the buffered lines, a batch at a time. Lines of failed
+// requests are buffered again, unless the endpoint rejected them.
+func (p *Pusher) Push(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		n := len(p.entries)
+		if n > p.cfg.BatchSize {
+			n = p.cfg.BatchSize
+		}
+		batch := p.entries[:n:n]
+		p.entries = p.entries[n:]
+		p.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := p.send(ctx, batch)
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			droppedLines.Add(float64(len(batch)))
+			return err
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.entries = append(batch, p.entries...)
+			if over := len(p.entries) - maxBatches*p.cfg.BatchSize; over > 0 {
+				p.entries = p.entries[over:]
+				droppedLines.Add(float64(over))
+			}
+			p.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// rejectedError is returned when the endpoint rejects a request, which
+// would fail again if retried.
+type rejectedError struct {
+	code int
+	msg  string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("rejected with %d: %s", e.code, e.msg)
+}
+
+func (p *Pusher) send(ctx context.Context, batch []entry) error {
+	var body []byte
+	var err error
+	if p.cfg.Protocol == ProtocolLoki {
+		body, err = encodeLoki(batch, p.labels)
+	} else {
+		body, err = encodeOTLP(batch, p.labels)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.cfg.Username != "" || p.password != "" {
+		req.SetBasicAuth(p.cfg.Username, p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			return &rejectedError{code: resp.StatusCode, msg: strings.TrimSpace(string(msg))}
+		}
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// levelOf returns the level of a log line, or info if it has none.
+func levelOf(keyvals []interface{}) string {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		if v, ok := keyvals[i+1].(level.Value); ok {
+			return v.String()
+		}
+	}
+	return "info"
+}
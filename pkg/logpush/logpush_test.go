@@ -0,0 +1,176 @@
+package logpush
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig(url, protocol string) Config {
+	return Config{
+		URL:       url,
+		Protocol:  protocol,
+		Username:  "123",
+		Password:  "secret",
+		Interval:  time.Hour,
+		BatchSize: 2,
+		Timeout:   time.Second,
+	}
+}
+
+// testServer records the JSON bodies of the requests it receives, and
+// answers them with the next of codes, or 204.
+func testServer(t *testing.T, codes ...int) (*httptest.Server, func() []map[string]interface{}) {
+	var mu sync.Mutex
+	var bodies []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "123", user)
+		assert.Equal(t, "secret", password)
+
+		data, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var body map[string]interface{}
+		assert.NoError(t, json.Unmarshal(data, &body))
+
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body)
+		code := http.StatusNoContent
+		if len(codes) > 0 {
+			code, codes = codes[0], codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() []map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return bodies
+	}
+}
+
+func TestPusher_Loki(t *testing.T) {
+	ts, bodies := testServer(t)
+	p, err := NewPusher(testConfig(ts.URL, ProtocolLoki), map[string]string{"job": "pdc-agent"})
+	require.NoError(t, err)
+
+	level.Info(p).Log("msg", "starting")
+	level.Error(p).Log("msg", "failed")
+	level.Info(p).Log("msg", "retrying")
+	require.NoError(t, p.Push(context.Background()))
+
+	// A request per batch, a stream per level.
+	require.Len(t, bodies(), 2)
+	streams := bodies()[0]["streams"].([]interface{})
+	require.Len(t, streams, 2)
+	info := streams[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"job": "pdc-agent", "level": "info"}, info["stream"])
+	values := info["values"].([]interface{})
+	require.Len(t, values, 1)
+	assert.Equal(t, "level=info msg=starting", values[0].([]interface{})[1])
+	assert.Equal(t, map[string]interface{}{"job": "pdc-agent", "level": "error"}, streams[1].(map[string]interface{})["stream"])
+}
+
+func TestPusher_OTLP(t *testing.T) {
+	ts, bodies := testServer(t)
+	p, err := NewPusher(testConfig(ts.URL, ProtocolOTLP), map[string]string{"job": "pdc-agent"})
+	require.NoError(t, err)
+
+	level.Warn(p).Log("msg", "retrying")
+	require.NoError(t, p.Push(context.Background()))
+
+	require.Len(t, bodies(), 1)
+	resourceLogs := bodies()[0]["resourceLogs"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "pdc-agent"}},
+		map[string]interface{}{"key": "job", "value": map[string]interface{}{"stringValue": "pdc-agent"}},
+	}, resourceLogs["resource"].(map[string]interface{})["attributes"])
+	records := resourceLogs["scopeLogs"].([]interface{})[0].(map[string]interface{})["logRecords"].([]interface{})
+	require.Len(t, records, 1)
+	record := records[0].(map[string]interface{})
+	assert.Equal(t, float64(13), record["severityNumber"])
+	assert.Equal(t, "warn", record["severityText"])
+	assert.Equal(t, map[string]interface{}{"stringValue": "level=warn msg=retrying"}, record["body"])
+}
+
+func TestPusher_Failures(t *testing.T) {
+	ts, bodies := testServer(t, http.StatusServiceUnavailable, http.StatusBadRequest)
+	p, err := NewPusher(testConfig(ts.URL, ProtocolLoki), nil)
+	require.NoError(t, err)
+
+	p.Log("msg", "first")
+	// The lines of a failed push are pushed again.
+	require.Error(t, p.Push(context.Background()))
+	assert.Len(t, p.entries, 1)
+	// Unless the endpoint rejected them.
+	require.ErrorContains(t, p.Push(context.Background()), "rejected with 400")
+	assert.Empty(t, p.entries)
+	assert.Len(t, bodies(), 2)
+}
+
+func TestPusher_BufferFull(t *testing.T) {
+	cfg := testConfig("http://localhost", ProtocolLoki)
+	p, err := NewPusher(cfg, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < maxBatches*cfg.BatchSize+1; i++ {
+		p.Log("n", i)
+	}
+	assert.Len(t, p.entries, maxBatches*cfg.BatchSize)
+	assert.Equal(t, "n=1", p.entries[0].line, "the oldest lines are dropped")
+}
+
+func TestPusher_Run(t *testing.T) {
+	ts, bodies := testServer(t)
+	p, err := NewPusher(testConfig(ts.URL, ProtocolOTLP), nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx, log.NewNopLogger())
+	}()
+
+	// A full batch is pushed early.
+	p.Log("msg", "first")
+	p.Log("msg", "second")
+	require.Eventually(t, func() bool { return len(bodies()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The lines left are pushed when stopping.
+	p.Log("msg", "last")
+	cancel()
+	<-done
+	assert.Len(t, bodies(), 2)
+}
+
+func TestNewPusher_Invalid(t *testing.T) {
+	_, err := NewPusher(testConfig("localhost:3100", ProtocolLoki), nil)
+	assert.ErrorContains(t, err, "invalid -log.push-url")
+	_, err = NewPusher(testConfig("http://localhost:3100", "syslog"), nil)
+	assert.ErrorContains(t, err, "invalid -log.push-protocol")
+}
+
+func TestConfig_Secrets(t *testing.T) {
+	assert.Empty(t, (&Config{}).Secrets())
+	assert.Equal(t, []string{"secret"}, (&Config{Password: "secret"}).Secrets())
+
+	// The password file is read, as the logger is set up before the pusher.
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("file-secret\n"), 0o600))
+	assert.Equal(t, []string{"file-secret"}, (&Config{PasswordFile: passwordFile}).Secrets())
+}
@@ -0,0 +1,146 @@
+package pdc
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Authentication modes to the PDC API.
+const (
+	// AuthModeToken authenticates with the static Grafana Cloud token.
+	AuthModeToken = "token"
+	// AuthModeOAuth2 authenticates with an access token obtained with the
+	// OAuth2 client credentials grant.
+	AuthModeOAuth2 = "oauth2"
+	// AuthModeOIDC authenticates with an OIDC workload identity token read
+	// from a file, such as a Kubernetes projected service account token.
+	AuthModeOIDC = "oidc"
+)
+
+// oidcTokenRefresh is how often the OIDC token file is read again. The file
+// is rotated by the workload identity provider before the token expires.
+const oidcTokenRefresh = time.Minute
+
+// AuthConfig configures how the agent authenticates to the PDC API.
+type AuthConfig struct {
+	Mode string
+
+	OAuth2TokenURL         string
+	OAuth2ClientID         string
+	OAuth2ClientSecret     string
+	OAuth2ClientSecretFile string
+	OAuth2Scopes           string
+
+	OIDCTokenFile string
+
+	// Audience is the audience of the tokens requested from the cloud
+	// provider in the cloud workload identity modes.
+	Audience  string
+	AWSRegion string
+}
+
+func (cfg *AuthConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Mode, "auth.mode", AuthModeToken, `how to authenticate to the PDC API: "token" (the -token flag), "oauth2" (OAuth2 client credentials) "oidc" (a workload identity token), or the identity of the cloud instance: "aws", "gcp" or "azure"`)
+	fs.StringVar(&cfg.OAuth2TokenURL, "auth.oauth2.token-url", "", "the token endpoint of the OAuth2 authorization server, with -auth.mode=oauth2")
+	fs.StringVar(&cfg.OAuth2ClientID, "auth.oauth2.client-id", "", "the OAuth2 client ID, with -auth.mode=oauth2")
+	fs.StringVar(&cfg.OAuth2ClientSecret, "auth.oauth2.client-secret", "", "the OAuth2 client secret, with -auth.mode=oauth2")
+	fs.StringVar(&cfg.OAuth2ClientSecretFile, "auth.oauth2.client-secret-file", "", "the path of a file containing the OAuth2 client secret, with -auth.mode=oauth2")
+	fs.StringVar(&cfg.OAuth2Scopes, "auth.oauth2.scopes", "", "a comma separated list of OAuth2 scopes to request, with -auth.mode=oauth2")
+	fs.StringVar(&cfg.OIDCTokenFile, "auth.oidc.token-file", "", "the path of a file containing an OIDC workload identity token, with -auth.mode=oidc. It is read again every minute, so it can be rotated")
+	fs.StringVar(&cfg.Audience, "auth.audience", "", "the audience of the identity tokens, with -auth.mode=aws, gcp or azure. Required with gcp and azure, where it is the audience and the resource of the token respectively")
+	fs.StringVar(&cfg.AWSRegion, "auth.aws.region", os.Getenv("AWS_REGION"), "the region of the AWS STS endpoint, with -auth.mode=aws. Defaults to us-east-1")
+}
+
+// tokenSource returns the source of the access tokens sent to the PDC API, or
+// nil when the static token is used. hc is used to request OAuth2 tokens.
+func (cfg *AuthConfig) tokenSource(hc *http.Client) (oauth2.TokenSource, error) {
+	switch cfg.Mode {
+	case "", AuthModeToken:
+		return nil, nil
+
+	case AuthModeOAuth2:
+		if cfg.OAuth2TokenURL == "" || cfg.OAuth2ClientID == "" {
+			return nil, errors.New("-auth.oauth2.token-url and -auth.oauth2.client-id are required with -auth.mode=oauth2")
+		}
+		secret, err := cfg.clientSecret()
+		if err != nil {
+			return nil, err
+		}
+		cc := &clientcredentials.Config{
+			ClientID:     cfg.OAuth2ClientID,
+			ClientSecret: secret,
+			TokenURL:     cfg.OAuth2TokenURL,
+		}
+		if cfg.OAuth2Scopes != "" {
+			cc.Scopes = strings.Split(cfg.OAuth2Scopes, ",")
+		}
+		// The token source caches the access token, and requests a new one
+		// when it expires.
+		return cc.TokenSource(context.WithValue(context.Background(), oauth2.HTTPClient, hc)), nil
+
+	case AuthModeOIDC:
+		if cfg.OIDCTokenFile == "" {
+			return nil, errors.New("-auth.oidc.token-file is required with -auth.mode=oidc")
+		}
+		return oauth2.ReuseTokenSource(nil, fileTokenSource(cfg.OIDCTokenFile)), nil
+
+	default:
+		return cfg.cloudTokenSource()
+	}
+}
+
+// clientSecret returns the OAuth2 client secret, read from
+// -auth.oauth2.client-secret-file if set.
+func (cfg *AuthConfig) clientSecret() (string, error) {
+	if cfg.OAuth2ClientSecretFile == "" {
+		return cfg.OAuth2ClientSecret, nil
+	}
+	data, err := os.ReadFile(cfg.OAuth2ClientSecretFile)
+	if err != nil {
+		return "", fmt.Errorf("reading OAuth2 client secret file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// secrets returns the credentials which must never be logged. The client
+// secret file is read here, as the logger redacting them is set up before the
+// token source reads it. A file which cannot be read is reported by
+// tokenSource.
+func (cfg *AuthConfig) secrets() []string {
+	var secrets []string
+	if cfg.OAuth2ClientSecret != "" {
+		secrets = append(secrets, cfg.OAuth2ClientSecret)
+	}
+	if secret, err := cfg.clientSecret(); err == nil && secret != "" && secret != cfg.OAuth2ClientSecret {
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+// fileTokenSource reads a bearer token from a file.
+type fileTokenSource string
+
+func (path fileTokenSource) Token() (*oauth2.Token, error) {
+	data, err := os.ReadFile(string(path))
+	if err != nil {
+		return nil, fmt.Errorf("reading OIDC token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("OIDC token file %s is empty", path)
+	}
+	return &oauth2.Token{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(oidcTokenRefresh),
+	}, nil
+}
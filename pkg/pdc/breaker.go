@@ -0,0 +1,148 @@
+package pdc
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrCircuitOpen is returned without calling the PDC API while its circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("the PDC API is failing, requests are paused")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a circuit breaker for the PDC API. It opens after threshold
+// consecutive failures, so that renewal loops stop calling an API which is
+// down. Once cooldown elapsed, a single request probes the API: the breaker
+// closes if it succeeds, and opens again otherwise.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	logger    log.Logger
+	// now is replaced in tests.
+	now func() time.Time
+
+	stateGauge prometheus.Gauge
+	rejections prometheus.Counter
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// newBreaker returns a breaker whose metrics are labelled with api, the host
+// of the PDC API, and tunnel, as each tunnel has its own client.
+func newBreaker(threshold int, cooldown time.Duration, api, tunnel string, logger log.Logger) *breaker {
+	return &breaker{
+		threshold:  threshold,
+		cooldown:   cooldown,
+		logger:     logger,
+		now:        time.Now,
+		stateGauge: breakerState.WithLabelValues(api, tunnel),
+		rejections: breakerRejections.WithLabelValues(api, tunnel),
+	}
+}
+
+// allow returns ErrCircuitOpen if a request must not be sent. Otherwise, the
+// outcome of the request must be recorded with done.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			b.rejections.Inc()
+			return ErrCircuitOpen
+		}
+		b.setState(circuitHalfOpen)
+		b.probing = true
+		return nil
+	case circuitHalfOpen:
+		// Only one probe at a time.
+		if b.probing {
+			b.rejections.Inc()
+			return ErrCircuitOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// done records the outcome of a request allowed by allow. failed is true when
+// the PDC API did not respond, or responded with a server error.
+func (b *breaker) done(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(circuitOpen)
+	}
+}
+
+// abort releases a request allowed by allow without recording its outcome,
+// when it was canceled by the agent rather than failed by the PDC API.
+func (b *breaker) abort() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) setState(s circuitState) {
+	if s == b.state {
+		return
+	}
+	b.state = s
+	b.stateGauge.Set(float64(s))
+
+	switch s {
+	case circuitOpen:
+		level.Warn(b.logger).Log("msg", "the PDC API is failing, pausing requests", "circuit_breaker", s, "failures", b.failures, "retry_in", b.cooldown)
+	default:
+		level.Info(b.logger).Log("msg", "PDC API circuit breaker state changed", "circuit_breaker", s)
+	}
+}
@@ -0,0 +1,103 @@
+package pdc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(2, time.Minute, "api.example", "test", log.NewNopLogger())
+	b.now = func() time.Time { return now }
+
+	// Failures below the threshold, or interrupted by a success, keep the
+	// breaker closed.
+	require.NoError(t, b.allow())
+	b.done(true)
+	require.NoError(t, b.allow())
+	b.done(false)
+	require.NoError(t, b.allow())
+	b.done(true)
+	assert.Equal(t, circuitClosed, b.state)
+
+	require.NoError(t, b.allow())
+	b.done(true)
+	assert.Equal(t, circuitOpen, b.state)
+	assert.Equal(t, float64(circuitOpen), testutil.ToFloat64(breakerState.WithLabelValues("api.example", "test")))
+	assert.Zero(t, testutil.ToFloat64(breakerState.WithLabelValues("api.example", "other")), "each tunnel has its own state")
+	assert.ErrorIs(t, b.allow(), ErrCircuitOpen)
+
+	// Once the cooldown elapsed, a single probe is allowed. A failed probe
+	// opens the breaker again.
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow())
+	assert.Equal(t, circuitHalfOpen, b.state)
+	assert.ErrorIs(t, b.allow(), ErrCircuitOpen)
+	b.done(true)
+	assert.Equal(t, circuitOpen, b.state)
+	assert.ErrorIs(t, b.allow(), ErrCircuitOpen)
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow())
+	b.done(false)
+	assert.Equal(t, circuitClosed, b.state)
+	assert.NoError(t, b.allow())
+}
+
+func TestClient_Breaker(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	client, err := NewClient(&Config{URL: u, RetryMax: 1, BreakerThreshold: 2, BreakerCooldown: time.Hour}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.SignSSHKey(context.Background(), []byte("public key"))
+		assert.ErrorIs(t, err, ErrInternal)
+	}
+	sent := calls.Load()
+
+	_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, sent, calls.Load(), "no request is sent while the breaker is open")
+}
+
+func TestClient_Breaker_Canceled(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(release) })
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	client, err := NewClient(&Config{URL: u, RetryMax: 1, BreakerThreshold: 1, BreakerCooldown: time.Hour, Tunnel: "canceled"}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	// Requests canceled by the agent are not failures of the PDC API.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := client.SignSSHKey(ctx, []byte("public key"))
+		cancel()
+		assert.ErrorIs(t, err, ErrInternal)
+	}
+	assert.Equal(t, float64(circuitClosed), testutil.ToFloat64(breakerState.WithLabelValues(u.Host, "canceled")))
+}
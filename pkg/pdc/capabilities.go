@@ -0,0 +1,42 @@
+package pdc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrNotFound indicates the endpoint does not exist, for example on a PDC API
+// older than the agent.
+var ErrNotFound = errors.New("not found")
+
+// Capabilities describe the agent to the PDC API, so it can make protocol
+// decisions per agent.
+type Capabilities struct {
+	Version        string   `json:"version"`
+	Commit         string   `json:"commit,omitempty"`
+	OS             string   `json:"os"`
+	Arch           string   `json:"arch"`
+	OpenSSHVersion string   `json:"openssh_version,omitempty"`
+	Features       []string `json:"features"`
+}
+
+type capabilitiesRequest struct {
+	Capabilities
+	Labels  map[string]string `json:"labels,omitempty"`
+	Machine *Machine          `json:"machine,omitempty"`
+}
+
+// ReportCapabilities registers the capabilities of the agent with the PDC
+// API. It returns ErrNotFound if the PDC API does not support it.
+func (c *pdcClient) ReportCapabilities(ctx context.Context, caps Capabilities) error {
+	if caps.Features == nil {
+		caps.Features = []string{}
+	}
+	_, err := c.call(ctx, http.MethodPost, c.cfg.CapabilitiesEndpoint, nil, capabilitiesRequest{
+		Capabilities: caps,
+		Labels:       c.cfg.Labels,
+		Machine:      c.cfg.Machine,
+	})
+	return err
+}
@@ -4,23 +4,34 @@ package pdc
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
-	"path"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/grafana/pdc-agent/pkg/httpclient"
+	"github.com/grafana/pdc-agent/pkg/secrets"
 	"github.com/hashicorp/go-retryablehttp"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2"
 )
 
 var (
@@ -28,8 +39,22 @@ var (
 	ErrInternal = errors.New("internal error")
 	// ErrInvalidCredentials indicates the auth token is incorrect
 	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrConflict indicates the PDC API saw the key or instance ID of the
+	// agent on another host.
+	ErrConflict = errors.New("conflict")
+
+	labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// headerNameRegexp matches the tokens of RFC 9110 header names.
+	headerNameRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+	// secretHeaderRegexp matches the names of the headers whose values are
+	// redacted from the logs.
+	secretHeaderRegexp = regexp.MustCompile(`(?i)auth|token|key|secret|password|cookie|signature|credential`)
 )
 
+// requestIDHeader identifies a request in the logs of the agent and of the
+// PDC API.
+const requestIDHeader = "X-Request-ID"
+
 // Config describes all properties that can be configured for the PDC package
 type Config struct {
 	Token           string
@@ -37,13 +62,107 @@ type Config struct {
 	URL             *url.URL
 	RetryMax        int
 
+	// StackTokens are the tokens of additional stacks, by hosted Grafana
+	// ID, used for the requests made with WithStack.
+	StackTokens map[string]string
+
+	// TokenFile is read when Token is not set. pdc enroll writes the token
+	// it receives to it.
+	TokenFile string
+
+	// TokenSource is the URI of a secret containing the token, in a secret
+	// manager. The secret is fetched again every TokenSourceRefresh, and when
+	// the token is rejected, so it can be rotated.
+	TokenSource        string
+	TokenSourceRefresh time.Duration
+
+	// RedactSecrets, if set, is called with the credentials of each token
+	// fetched from TokenSource, which must be redacted from the logs.
+	RedactSecrets func(secrets ...string)
+
+	// Auth configures authentication with OAuth2 or OIDC tokens instead of
+	// the static token.
+	Auth AuthConfig
+
+	// Labels are arbitrary key/value pairs used to identify the agent. They
+	// are sent with every signing request.
+	Labels map[string]string
+
+	// Machine, if set, identifies the host of the agent in signing requests
+	// and capability reports.
+	Machine *Machine
+
+	// Tunnel is the name of the tunnel using the client in its metrics, as
+	// in the agent events: empty for the default tunnel, the network, or
+	// stack/<hosted Grafana ID>.
+	Tunnel string
+
+	// TLS options for connections to the PDC API.
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool
+
+	// HTTP client options for connections to the PDC API. The defaults of
+	// the transport are kept for zero values.
+	RequestTimeout      time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	DisableHTTP2        bool
+
+	// BreakerThreshold is the number of consecutive failed requests after
+	// which requests to the PDC API are paused for BreakerCooldown. A
+	// request fails if the PDC API does not respond, or responds with a
+	// server error. Disabled if 0.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// ResponseSigningKeysFile, if set, holds the public keys, in the format
+	// of authorized_keys, one of which must sign the body of each signing
+	// response, so a certificate and known hosts cannot be injected by
+	// whoever can intercept the connections to the PDC API.
+	ResponseSigningKeysFile string
+
+	// ClockSkewWarning is how far the local clock may be from the PDC API
+	// clock before a warning is logged. Disabled if 0.
+	ClockSkewWarning time.Duration
+
 	// The PDC api endpoint used to sign public keys.
 	// It is not a constant only to make it easier to override the endpoint in local development.
 	SignPublicKeyEndpoint string
 
-	// Used for local development.
-	// Contains headers that are included in each http request send to the pdc api.
-	DevHeaders map[string]string
+	// The PDC api endpoint used to exchange enrollment codes for tokens.
+	EnrollEndpoint string
+
+	// The PDC api endpoint the capabilities of the agent are reported to.
+	CapabilitiesEndpoint string
+
+	// The PDC api endpoint the remote configuration is fetched from.
+	RemoteConfigEndpoint string
+
+	// The PDC api endpoint support bundles are uploaded to.
+	SupportBundleEndpoint string
+
+	// The PDC api endpoint the gateways of the stack are discovered from.
+	DiscoveryEndpoint string
+
+	// UserAgentSuffix is appended to the user-agent of the requests, and
+	// Headers are added to them, for example to identify the agent to a
+	// corporate egress proxy, or to route requests by tenant. When set, the
+	// X-Scope-OrgID header is the ID of the stack of each request, and the
+	// X-Access-Policy-ID header the name of the network of each tunnel.
+	// Values of headers whose names look like credentials are redacted from
+	// the logs.
+	UserAgentSuffix string
+	Headers         map[string]string
+
+	// Middlewares are added to the chain of the HTTP client, after the
+	// user-agent and headers, for example to set headers required by a
+	// proxy.
+	Middlewares []httpclient.Middleware
 
 	// Used for local development.
 	// DevNetwork is the network that the agent will connect to.
@@ -53,14 +172,189 @@ type Config struct {
 func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
 	var deprecated string
 	fs.StringVar(&cfg.Token, "token", "", "The token to use to authenticate with Grafana Cloud. It must have the pdc-signing:write scope")
+	fs.StringVar(&cfg.TokenFile, "token-file", "", "The path of a file containing the token, read when -token is not set. Written by pdc enroll. Defaults to the -ssh-key-file path with a _token suffix")
 	fs.StringVar(&cfg.HostedGrafanaID, "gcloud-hosted-grafana-id", "", "The ID of the Hosted Grafana instance to connect to")
 	fs.StringVar(&cfg.DevNetwork, "dev-network", "", "[DEVELOPMENT ONLY] the network the agent will connect to")
 	fs.StringVar(&deprecated, "network", "", "DEPRECATED: The name of the PDC network to connect to")
+	fs.StringVar(&cfg.TLSCAFile, "api.tls-ca-file", "", "Path to a PEM encoded CA bundle used, in addition to the system roots, to verify the PDC API certificate")
+	fs.StringVar(&cfg.TLSCertFile, "api.tls-cert-file", "", "Path to a PEM encoded client certificate presented to the PDC API. Requires -api.tls-key-file")
+	fs.StringVar(&cfg.TLSKeyFile, "api.tls-key-file", "", "Path to the PEM encoded private key of the client certificate")
+	fs.BoolVar(&cfg.TLSInsecureSkipVerify, "api.tls-insecure-skip-verify", false, "[DEVELOPMENT ONLY] skip verification of the PDC API certificate")
+	fs.DurationVar(&cfg.RequestTimeout, "api.timeout", 0, "The timeout of each attempt of a request to the PDC API, including reading the response. Disabled if 0")
+	fs.DurationVar(&cfg.DialTimeout, "api.dial-timeout", 30*time.Second, "The timeout of establishing TCP connections to the PDC API")
+	fs.DurationVar(&cfg.TLSHandshakeTimeout, "api.tls-handshake-timeout", 10*time.Second, "The timeout of the TLS handshake with the PDC API")
+	fs.DurationVar(&cfg.IdleConnTimeout, "api.idle-conn-timeout", 90*time.Second, "How long idle connections to the PDC API are kept open")
+	fs.IntVar(&cfg.MaxIdleConns, "api.max-idle-conns", 100, "The maximum number of idle connections to the PDC API")
+	fs.IntVar(&cfg.MaxIdleConnsPerHost, "api.max-idle-conns-per-host", 0, "The maximum number of idle connections per PDC API host. Defaults to the number of CPUs + 1 if 0")
+	fs.BoolVar(&cfg.DisableHTTP2, "api.disable-http2", false, "Only use HTTP/1.1 for requests to the PDC API")
+	fs.IntVar(&cfg.BreakerThreshold, "api.breaker-threshold", 5, "The number of consecutive failed requests to the PDC API after which requests are paused for -api.breaker-cooldown, then resumed with a single probe. Disabled if 0")
+	fs.DurationVar(&cfg.BreakerCooldown, "api.breaker-cooldown", time.Minute, "How long requests to the PDC API are paused once -api.breaker-threshold is reached")
+	fs.StringVar(&cfg.ResponseSigningKeysFile, "api.response-signing-keys-file", "", "Path to a file of public keys, in the format of authorized_keys, one of which must sign the certificate and known hosts returned by the PDC API in the "+responseSignatureHeader+" header. Responses are not verified if empty")
+	fs.DurationVar(&cfg.ClockSkewWarning, "api.clock-skew-warning", time.Minute, "Log a warning when the local clock differs from the PDC API clock by more than this. Disabled if 0")
+	fs.StringVar(&cfg.TokenSource, "token-source", "", "The URI of a secret containing the token, instead of -token: awssm://<secret name or ARN>[?region=<region>], gcpsm://projects/<project>/secrets/<secret>[/versions/<version>] or azkv://<vault>/<secret>[/<version>]")
+	fs.DurationVar(&cfg.TokenSourceRefresh, "token-source.refresh-interval", 5*time.Minute, "How often the -token-source secret is fetched again, to pick up rotated tokens")
+	cfg.Auth.RegisterFlags(fs)
+	fs.Func("stack.token", "A hosted-grafana-id=token pair of an additional stack to connect to, with a token of that stack. Can be set more than once.", cfg.addStackToken)
+	fs.Func("label", "A key=value label used to identify the agent. Can be set more than once.", cfg.addLabel)
+	fs.StringVar(&cfg.UserAgentSuffix, "api.user-agent-suffix", "", "A suffix appended to the user-agent of the requests to the PDC API, e.g. to identify the agent to an egress proxy")
+	fs.Func("api.header", "A name=value header added to the requests to the PDC API, e.g. an identification header required by an egress proxy. Can be set more than once.", cfg.addHeader)
+}
+
+func (cfg *Config) addLabel(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("invalid label %q, expecting key=value", s)
+	}
+	if !labelNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid label name %q, must match %s", name, labelNameRegexp)
+	}
+	if cfg.Labels == nil {
+		cfg.Labels = map[string]string{}
+	}
+	cfg.Labels[name] = value
+	return nil
+}
+
+func (cfg *Config) addHeader(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("invalid header %q, expecting name=value", s)
+	}
+	if !headerNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Host", "User-Agent":
+		return fmt.Errorf("header %s cannot be set: it is set by the agent, see -api.user-agent-suffix for User-Agent", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid value of header %s: it contains a new line", name)
+	}
+	if cfg.Headers == nil {
+		cfg.Headers = map[string]string{}
+	}
+	cfg.Headers[http.CanonicalHeaderKey(name)] = value
+	return nil
+}
+
+// userAgent returns the user-agent of the requests to the PDC API.
+func (cfg *Config) userAgent() string {
+	if cfg.UserAgentSuffix == "" {
+		return httpclient.UserAgent
+	}
+	return httpclient.UserAgent + " " + cfg.UserAgentSuffix
+}
+
+// Secrets returns the values which must never be logged: the token and the
+// Authorization header credentials derived from it.
+func (cfg *Config) Secrets() []string {
+	secrets := cfg.Auth.secrets()
+	for _, id := range cfg.Stacks() {
+		secrets = append(secrets, cfg.StackTokens[id], basicAuth(id, cfg.StackTokens[id]))
+	}
+	for name, value := range cfg.Headers {
+		if value != "" && secretHeaderRegexp.MatchString(name) {
+			secrets = append(secrets, value)
+		}
+	}
+	if cfg.Token == "" {
+		return secrets
+	}
+	return append(secrets, cfg.Token, cfg.basicAuth())
+}
+
+// basicAuth returns the base64 encoded id:token credentials.
+func (cfg *Config) basicAuth() string {
+	return basicAuth(cfg.HostedGrafanaID, cfg.Token)
+}
+
+func basicAuth(id, token string) string {
+	return base64.StdEncoding.EncodeToString([]byte(id + ":" + token))
+}
+
+// tlsConfig returns the TLS configuration for the PDC API client, or nil if
+// no TLS option is set.
+func (cfg *Config) tlsConfig() (*tls.Config, error) {
+	if cfg.TLSCAFile == "" && cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" && !cfg.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in CA file %s", cfg.TLSCAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("-api.tls-cert-file and -api.tls-key-file must be set together")
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+// configureTransport applies the TLS configuration and the HTTP client
+// options to tr. Options with a zero value keep the value of tr.
+func (cfg *Config) configureTransport(tr *http.Transport, tlsCfg *tls.Config) {
+	if tlsCfg != nil {
+		tr.TLSClientConfig = tlsCfg
+	}
+	if cfg.DialTimeout > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		tr.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	if cfg.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.MaxIdleConns > 0 {
+		tr.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil empty map disables HTTP/2, see the net/http docs.
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
 }
 
 // Client is a PDC API client
 type Client interface {
 	SignSSHKey(ctx context.Context, key []byte) (*SigningResponse, error)
+	Enroll(ctx context.Context, code string) (*EnrollResponse, error)
+	ReportCapabilities(ctx context.Context, caps Capabilities) error
+	RemoteConfig(ctx context.Context) (*RemoteConfig, error)
+	UploadSupportBundle(ctx context.Context, commandID string, bundle []byte) error
+	Discover(ctx context.Context) (*Discovery, error)
+}
+
+// EnrollResponse is the response received from an enrollment request
+type EnrollResponse struct {
+	// Token is scoped to signing the keys of the enrolled agent.
+	Token string `json:"token"`
 }
 
 // SigningResponse is the response received from a SSH key signing request
@@ -114,8 +408,35 @@ func NewClient(cfg *Config, logger log.Logger) (Client, error) {
 	if cfg.SignPublicKeyEndpoint == "" {
 		cfg.SignPublicKeyEndpoint = "/pdc/api/v1/sign-public-key"
 	}
+	if cfg.EnrollEndpoint == "" {
+		cfg.EnrollEndpoint = "/pdc/api/v1/enroll"
+	}
+	if cfg.CapabilitiesEndpoint == "" {
+		cfg.CapabilitiesEndpoint = "/pdc/api/v1/capabilities"
+	}
+	if cfg.RemoteConfigEndpoint == "" {
+		cfg.RemoteConfigEndpoint = "/pdc/api/v1/agent-config"
+	}
+	if cfg.SupportBundleEndpoint == "" {
+		cfg.SupportBundleEndpoint = "/pdc/api/v1/support-bundles"
+	}
+	if cfg.DiscoveryEndpoint == "" {
+		cfg.DiscoveryEndpoint = "/pdc/api/v1/discovery"
+	}
+
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TLSInsecureSkipVerify {
+		level.Warn(logger).Log("msg", "PDC API certificate verification is disabled")
+	}
 
 	rc := retryablehttp.NewClient()
+	if tr, ok := rc.HTTPClient.Transport.(*http.Transport); ok {
+		cfg.configureTransport(tr, tlsCfg)
+	}
+	rc.HTTPClient.Timeout = cfg.RequestTimeout
 	if cfg.RetryMax != 0 {
 		rc.RetryMax = cfg.RetryMax
 	}
@@ -123,42 +444,200 @@ func NewClient(cfg *Config, logger log.Logger) (Client, error) {
 	rc.CheckRetry = retryablehttp.ErrorPropagatedRetryPolicy
 	hc := rc.StandardClient()
 
-	hc.Transport = httpclient.UserAgentTransport(hc.Transport)
+	ts, err := cfg.Auth.tokenSource(hc)
+	if err != nil {
+		return nil, err
+	}
+	if ts != nil {
+		// Access tokens are requested, and refreshed once expired, by the
+		// transport.
+		hc = &http.Client{Transport: &oauth2.Transport{Source: ts, Base: hc.Transport}}
+	}
 
-	return &pdcClient{
+	c := &pdcClient{
 		cfg:        cfg,
 		httpClient: hc,
 		logger:     logger,
-	}, nil
+		bearer:     ts != nil,
+	}
+	if cfg.ResponseSigningKeysFile != "" {
+		if c.responseKeys, err = readResponseSigningKeys(cfg.ResponseSigningKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	hc.Transport = httpclient.Chain(hc.Transport, c.middlewares()...)
+	if cfg.BreakerThreshold > 0 {
+		c.breaker = newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown, cfg.URL.Host, cfg.Tunnel, logger)
+	}
+	if cfg.TokenSource != "" {
+		src, err := secrets.Parse(cfg.TokenSource)
+		if err != nil {
+			return nil, err
+		}
+		c.tokenCache = secrets.NewCache(src, cfg.TokenSourceRefresh)
+		if cfg.RedactSecrets != nil {
+			c.tokenCache.OnFetch = func(token string) {
+				token = strings.TrimSpace(token)
+				cfg.RedactSecrets(token, basicAuth(cfg.HostedGrafanaID, token))
+			}
+		}
+	}
+
+	return c, nil
 }
 
 type pdcClient struct {
 	cfg        *Config
 	httpClient *http.Client
 	logger     log.Logger
+	// bearer is true when the transport authenticates requests.
+	bearer bool
+	// tokenCache is set when the token is read from a secret manager.
+	tokenCache *secrets.Cache
+	// breaker is nil if disabled.
+	breaker *breaker
+	// responseKeys verify the signing responses, if set.
+	responseKeys []ssh.PublicKey
+}
+
+// middlewares returns the middlewares of the HTTP client, from the outermost
+// one: headers, authentication, and the metrics and logs of each request.
+// Retries happen below them.
+func (c *pdcClient) middlewares() []httpclient.Middleware {
+	mws := []httpclient.Middleware{
+		httpclient.Headers(map[string]string{"User-Agent": c.cfg.userAgent()}),
+		httpclient.Headers(c.cfg.Headers),
+	}
+	mws = append(mws, c.cfg.Middlewares...)
+	return append(mws,
+		httpclient.MutateRequest(c.authenticate),
+		httpclient.ObserveResponse(c.observe),
+	)
+}
+
+// authenticate sets the basic authorization header of req from the token of
+// its stack, unless the transport authenticates requests.
+func (c *pdcClient) authenticate(req *http.Request) error {
+	if c.bearer {
+		return nil
+	}
+
+	id, token, ok, err := c.cfg.stackCredentials(req.Context())
+	if err != nil {
+		return err
+	}
+	if _, tenant := c.cfg.Headers["X-Scope-OrgID"]; ok && tenant {
+		req.Header.Set("X-Scope-OrgID", id)
+	}
+	if !ok {
+		id, token = c.cfg.HostedGrafanaID, c.cfg.Token
+		if c.tokenCache != nil {
+			t, err := c.tokenCache.Get(req.Context())
+			if err != nil {
+				return fmt.Errorf("fetching the token from the secret manager: %w", err)
+			}
+			token = strings.TrimSpace(t)
+		}
+	}
+
+	// base64 id:token for auth
+	if token != "" {
+		req.Header.Set("Authorization", "Basic "+basicAuth(id, token))
+	}
+	return nil
+}
+
+// endpointKey is the context key of the endpoint of a request, used as a
+// metric label.
+type endpointKey struct{}
+
+// observe updates the metrics of the endpoint of req, and logs the outcome.
+func (c *pdcClient) observe(req *http.Request, resp *http.Response, err error, d time.Duration) {
+	endpoint, _ := req.Context().Value(endpointKey{}).(string)
+	apiRequestDuration.WithLabelValues(endpoint).Observe(d.Seconds())
+	if err != nil {
+		apiRequests.WithLabelValues(endpoint, "error").Inc()
+		return
+	}
+	apiRequests.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	level.Debug(c.logger).Log("msg", "PDC API request completed", "endpoint", endpoint, "code", resp.StatusCode, "request_id", responseRequestID(req, resp), "duration", d)
+}
+
+type signingRequest struct {
+	PublicKey string            `json:"publicKey"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Machine   *Machine          `json:"machine,omitempty"`
 }
 
 func (c *pdcClient) SignSSHKey(ctx context.Context, key []byte) (*SigningResponse, error) {
-	resp, err := c.call(ctx, http.MethodPost, c.cfg.SignPublicKeyEndpoint, nil, map[string]string{
-		"publicKey": string(key),
+	// Fail early rather than with a transport error for a stack without a token.
+	if _, _, _, err := c.cfg.stackCredentials(ctx); err != nil {
+		signingRequests.WithLabelValues("failure").Inc()
+		return nil, err
+	}
+	var header http.Header
+	ctx = context.WithValue(ctx, responseHeaderKey{}, &header)
+	resp, err := c.call(ctx, http.MethodPost, c.cfg.SignPublicKeyEndpoint, nil, signingRequest{
+		PublicKey: string(key),
+		Labels:    c.cfg.Labels,
+		Machine:   c.cfg.Machine,
 	})
 	if err != nil {
+		signingRequests.WithLabelValues("failure").Inc()
 		return nil, err
 	}
+	if c.responseKeys != nil {
+		if err := verifyResponseSignature(c.responseKeys, header, resp); err != nil {
+			signingRequests.WithLabelValues("failure").Inc()
+			level.Error(c.logger).Log("msg", "rejecting the signing response of the PDC API", "err", err)
+			return nil, err
+		}
+	}
 
 	sr := &SigningResponse{}
 	err = sr.UnmarshalJSON(resp)
 	if err != nil {
+		signingRequests.WithLabelValues("failure").Inc()
 		return nil, err
 	}
 
+	signingRequests.WithLabelValues("success").Inc()
+	lastSuccessfulSign.SetToCurrentTime()
 	return sr, nil
 }
 
-func (c *pdcClient) call(ctx context.Context, method, rpath string, params map[string]string, body map[string]string) ([]byte, error) {
+type enrollRequest struct {
+	Code   string            `json:"code"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Enroll exchanges a one-time enrollment code for a token. The code is the
+// only credential of the request.
+func (c *pdcClient) Enroll(ctx context.Context, code string) (*EnrollResponse, error) {
+	resp, err := c.call(ctx, http.MethodPost, c.cfg.EnrollEndpoint, nil, enrollRequest{
+		Code:   code,
+		Labels: c.cfg.Labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	er := &EnrollResponse{}
+	if err := json.Unmarshal(resp, er); err != nil {
+		return nil, err
+	}
+	if er.Token == "" {
+		return nil, errors.New("no token in enrollment response")
+	}
+
+	return er, nil
+}
+
+func (c *pdcClient) call(ctx context.Context, method, rpath string, params map[string]string, body interface{}) ([]byte, error) {
 
-	url := *c.cfg.URL
-	url.Path = path.Join(url.Path, rpath)
+	// The endpoint is relative to the path of the URL, which may be a
+	// prefix under which a proxy serves the PDC API. Its escaping is kept.
+	url := c.cfg.URL.JoinPath(rpath)
 
 	q := url.Query()
 	for k, v := range params {
@@ -166,53 +645,114 @@ func (c *pdcClient) call(ctx context.Context, method, rpath string, params map[s
 	}
 	url.RawQuery = q.Encode()
 
-	jsonB, err := json.Marshal(body)
-	if err != nil {
-		return nil, err
+	var jsonB []byte
+	if body != nil {
+		var err error
+		jsonB, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, method, url.String(), bytes.NewBuffer(jsonB))
-	if err != nil {
-		level.Error(c.logger).Log("msg", "error creating PDC API request", "err", err)
-		return nil, ErrInternal
+	respB, err := c.do(ctx, method, rpath, url.String(), jsonB)
+	if errors.Is(err, ErrInvalidCredentials) && c.tokenCache != nil {
+		// The token may have been rotated in the secret manager.
+		c.tokenCache.Invalidate()
+		respB, err = c.do(ctx, method, rpath, url.String(), jsonB)
 	}
+	return respB, err
+}
 
-	// base64 id:token for auth
-	b := []byte{}
-	buf := bytes.NewBuffer(b)
-	encoder := base64.NewEncoder(base64.StdEncoding, buf)
-	_, werr := encoder.Write([]byte(c.cfg.HostedGrafanaID + ":" + c.cfg.Token))
-	err = encoder.Close()
-	if werr != nil || err != nil {
-		level.Error(c.logger).Log("msg", "error encoding Authorization header", "err", err)
+// do sends a request to url. endpoint is the path of the request, used as a
+// metric label.
+func (c *pdcClient) do(ctx context.Context, method, endpoint, url string, jsonB []byte) ([]byte, error) {
+	ctx = context.WithValue(ctx, endpointKey{}, endpoint)
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(jsonB))
+	if err != nil {
+		level.Error(c.logger).Log("msg", "error creating PDC API request", "err", err)
 		return nil, ErrInternal
 	}
 
-	req.Header.Add("Authorization", "Basic "+buf.String())
+	requestID := newRequestID()
+	req.Header.Set(requestIDHeader, requestID)
 
-	for header, value := range c.cfg.DevHeaders {
-		req.Header.Add(header, value)
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
 	}
-
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		level.Error(c.logger).Log("msg", "error making request to PDC API", "err", err)
-		return nil, ErrInternal
+		if ctx.Err() != nil {
+			// Canceled by the agent, which says nothing of the PDC API.
+			c.breaker.abort()
+		} else {
+			c.breaker.done(true)
+		}
+		level.Error(c.logger).Log("msg", "error making request to PDC API", "request_id", requestID, "err", err)
+		return nil, withRequestID(ErrInternal, requestID)
 	}
 	defer resp.Body.Close()
+	c.breaker.done(resp.StatusCode >= http.StatusInternalServerError)
+	requestID = responseRequestID(req, resp)
+
+	c.checkClockSkew(resp, time.Now())
+	if h, ok := ctx.Value(responseHeaderKey{}).(*http.Header); ok {
+		*h = resp.Header
+	}
 	respB, err := io.ReadAll(resp.Body)
 	if err != nil {
-		level.Error(c.logger).Log("msg", "error reading response from PDC API", "err", err)
-		return nil, ErrInternal
+		level.Error(c.logger).Log("msg", "error reading response from PDC API", "request_id", requestID, "err", err)
+		return nil, withRequestID(ErrInternal, requestID)
 	}
 	switch resp.StatusCode {
 	case http.StatusOK:
 		return respB, nil
 	case http.StatusUnauthorized:
-		return respB, ErrInvalidCredentials
+		return respB, withRequestID(ErrInvalidCredentials, requestID)
+	case http.StatusNotFound:
+		return respB, withRequestID(ErrNotFound, requestID)
+	case http.StatusConflict:
+		return respB, withRequestID(ErrConflict, requestID)
 	default:
-		level.Error(c.logger).Log("msg", "unknown response from PDC API", "code", resp.StatusCode)
-		return respB, ErrInternal
+		level.Error(c.logger).Log("msg", "unknown response from PDC API", "code", resp.StatusCode, "request_id", requestID)
+		return respB, withRequestID(ErrInternal, requestID)
+	}
+}
+
+// responseRequestID returns the request ID returned by the PDC API, which is
+// the one of its logs, or the one of req.
+func responseRequestID(req *http.Request, resp *http.Response) string {
+	if id := resp.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	return req.Header.Get(requestIDHeader)
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID adds the request ID to err, so that a failed request can be
+// found in the logs of the PDC API.
+func withRequestID(err error, requestID string) error {
+	return fmt.Errorf("%w (request ID %s)", err, requestID)
+}
+
+// checkClockSkew compares now with the Date header of resp. A skewed clock
+// makes certificates appear not yet valid or expired.
+func (c *pdcClient) checkClockSkew(resp *http.Response, now time.Time) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	skew := now.Sub(date)
+	clockSkew.Set(skew.Seconds())
+
+	if c.cfg.ClockSkewWarning > 0 && (skew > c.cfg.ClockSkewWarning || skew < -c.cfg.ClockSkewWarning) {
+		level.Warn(c.logger).Log("msg", "the local clock differs from the PDC API clock, certificates may appear not yet valid or expired. Check the NTP configuration of the host", "skew", skew.Round(time.Second))
 	}
 }
 
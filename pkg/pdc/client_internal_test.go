@@ -0,0 +1,49 @@
+package pdc
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_ConfigureTransport(t *testing.T) {
+	t.Run("zero values keep the defaults", func(t *testing.T) {
+		tr := defaultTransport()
+		(&Config{}).configureTransport(tr, nil)
+
+		def := defaultTransport()
+		assert.Equal(t, def.TLSHandshakeTimeout, tr.TLSHandshakeTimeout)
+		assert.Equal(t, def.IdleConnTimeout, tr.IdleConnTimeout)
+		assert.Equal(t, def.MaxIdleConns, tr.MaxIdleConns)
+		assert.Equal(t, def.MaxIdleConnsPerHost, tr.MaxIdleConnsPerHost)
+		assert.True(t, tr.ForceAttemptHTTP2)
+		assert.Nil(t, tr.TLSNextProto)
+	})
+
+	t.Run("options are applied", func(t *testing.T) {
+		tr := defaultTransport()
+		(&Config{
+			TLSHandshakeTimeout: time.Second,
+			IdleConnTimeout:     2 * time.Second,
+			MaxIdleConns:        3,
+			MaxIdleConnsPerHost: 4,
+			DisableHTTP2:        true,
+		}).configureTransport(tr, nil)
+
+		assert.Equal(t, time.Second, tr.TLSHandshakeTimeout)
+		assert.Equal(t, 2*time.Second, tr.IdleConnTimeout)
+		assert.Equal(t, 3, tr.MaxIdleConns)
+		assert.Equal(t, 4, tr.MaxIdleConnsPerHost)
+		assert.False(t, tr.ForceAttemptHTTP2)
+		assert.NotNil(t, tr.TLSNextProto)
+		assert.Empty(t, tr.TLSNextProto)
+	})
+}
+
+// defaultTransport returns the transport of a new retryablehttp client.
+func defaultTransport() *http.Transport {
+	return retryablehttp.NewClient().HTTPClient.Transport.(*http.Transport)
+}
@@ -1,11 +1,32 @@
 package pdc_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/grafana/pdc-agent/pkg/httpclient"
 	"github.com/grafana/pdc-agent/pkg/pdc"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 var cert = `
@@ -108,3 +129,858 @@ func TestSigningResponse_UnmarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_LabelFlag(t *testing.T) {
+	testcases := []struct {
+		name     string
+		args     []string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name: "no labels",
+		},
+		{
+			name:     "repeated labels",
+			args:     []string{"-label", "dc=eu-west", "-label", "team=db"},
+			expected: map[string]string{"dc": "eu-west", "team": "db"},
+		},
+		{
+			name:     "value can contain an equals sign",
+			args:     []string{"-label", "query=a=b"},
+			expected: map[string]string{"query": "a=b"},
+		},
+		{
+			name:    "missing value",
+			args:    []string{"-label", "dc"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid label name",
+			args:    []string{"-label", "data-center=eu"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &pdc.Config{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.RegisterFlags(fs)
+
+			err := fs.Parse(tc.args)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg.Labels)
+		})
+	}
+}
+
+func TestClient_SignSSHKey_SendsLabels(t *testing.T) {
+	var body map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{
+		URL:     u,
+		Labels:  map[string]string{"dc": "eu-west"},
+		Machine: &pdc.Machine{Hostname: "db-proxy-1", OS: "linux", InstanceID: "5f0c6c1e-8a53-4b5e-9a3c-2f1d7f9c4b11"},
+	}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "public key", body["publicKey"])
+	assert.Equal(t, map[string]interface{}{"dc": "eu-west"}, body["labels"])
+	assert.Equal(t, map[string]interface{}{
+		"hostname":    "db-proxy-1",
+		"os":          "linux",
+		"instance_id": "5f0c6c1e-8a53-4b5e-9a3c-2f1d7f9c4b11",
+	}, body["machine"])
+}
+
+func TestLoadInstanceID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grafana_pdc_instance_id")
+
+	id, err := pdc.LoadInstanceID(path)
+	require.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+
+	// The ID is stable.
+	again, err := pdc.LoadInstanceID(path)
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	require.NoError(t, os.WriteFile(path, []byte("not a uuid\n"), 0600))
+	_, err = pdc.LoadInstanceID(path)
+	assert.ErrorContains(t, err, "invalid instance ID")
+}
+
+func TestClient_Middlewares(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{
+		URL:             u,
+		Token:           "token",
+		HostedGrafanaID: "1",
+		Headers:         map[string]string{"X-Dev": "dev"},
+		Middlewares:     []httpclient.Middleware{httpclient.Headers(map[string]string{"X-Proxy": "proxy"})},
+	}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "proxy", got.Get("X-Proxy"))
+	assert.Equal(t, "dev", got.Get("X-Dev"))
+	assert.Equal(t, httpclient.UserAgent, got.Get("User-Agent"))
+	assert.Equal(t, "Basic MTp0b2tlbg==", got.Get("Authorization"))
+	assert.NotEmpty(t, got.Get("X-Request-ID"))
+}
+
+func TestClient_StackTokens(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+		enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{
+		URL:             u,
+		Token:           "token",
+		HostedGrafanaID: "1",
+		StackTokens:     map[string]string{"2": "token-2"},
+	}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name     string
+		ctx      context.Context
+		expected string
+	}{
+		{name: "no stack", ctx: context.Background(), expected: "Basic MTp0b2tlbg=="},
+		{name: "default stack", ctx: pdc.WithStack(context.Background(), "1"), expected: "Basic MTp0b2tlbg=="},
+		{name: "additional stack", ctx: pdc.WithStack(context.Background(), "2"), expected: "Basic Mjp0b2tlbi0y"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.SignSSHKey(tc.ctx, []byte("public key"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+
+	t.Run("unknown stack", func(t *testing.T) {
+		_, err := client.SignSSHKey(pdc.WithStack(context.Background(), "3"), []byte("public key"))
+		assert.ErrorContains(t, err, "no token for stack 3")
+	})
+}
+
+func TestClient_TenantHeader(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Scope-OrgID")
+		enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{
+		URL:             u,
+		Token:           "token",
+		HostedGrafanaID: "1",
+		StackTokens:     map[string]string{"2": "token-2"},
+		Headers:         map[string]string{"X-Scope-OrgID": "1"},
+	}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", got)
+
+	// The tenant of the requests of another stack is that stack.
+	_, err = client.SignSSHKey(pdc.WithStack(context.Background(), "2"), []byte("public key"))
+	require.NoError(t, err)
+	assert.Equal(t, "2", got)
+}
+
+func TestClient_RequestID(t *testing.T) {
+	testcases := []struct {
+		name     string
+		serverID string
+	}{
+		{name: "request ID of the agent", serverID: ""},
+		{name: "request ID returned by the PDC API", serverID: "server-id"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var sent string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sent = r.Header.Get("X-Request-ID")
+				if tc.serverID != "" {
+					w.Header().Set("X-Request-ID", tc.serverID)
+				}
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			t.Cleanup(ts.Close)
+
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			client, err := pdc.NewClient(&pdc.Config{URL: u}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+			assert.ErrorIs(t, err, pdc.ErrInternal)
+			require.NotEmpty(t, sent)
+
+			expected := tc.serverID
+			if expected == "" {
+				expected = sent
+			}
+			assert.Contains(t, err.Error(), "request ID "+expected)
+		})
+	}
+}
+
+func TestClient_WarnsOnClockSkew(t *testing.T) {
+	testcases := []struct {
+		name     string
+		skew     time.Duration
+		expected bool
+	}{
+		{name: "clock in sync", skew: 0, expected: false},
+		{name: "clock ahead", skew: 10 * time.Minute, expected: true},
+		{name: "clock behind", skew: -10 * time.Minute, expected: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", time.Now().Add(-tc.skew).UTC().Format(http.TimeFormat))
+				enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+				assert.NoError(t, err)
+				_, _ = w.Write(enc)
+			}))
+			t.Cleanup(ts.Close)
+
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			logs := &bytes.Buffer{}
+			client, err := pdc.NewClient(&pdc.Config{URL: u, ClockSkewWarning: time.Minute}, log.NewLogfmtLogger(logs))
+			require.NoError(t, err)
+
+			_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+			assert.NoError(t, err)
+
+			assert.Equal(t, tc.expected, strings.Contains(logs.String(), "the local clock differs from the PDC API clock"))
+		})
+	}
+}
+
+func TestNewClient_TLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	caFile := path.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, caPEM, 0600))
+
+	t.Run("unknown authority fails", func(t *testing.T) {
+		client, err := pdc.NewClient(&pdc.Config{URL: u, RetryMax: 1}, log.NewNopLogger())
+		require.NoError(t, err)
+
+		_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+		assert.ErrorIs(t, err, pdc.ErrInternal)
+	})
+
+	t.Run("custom CA file is trusted", func(t *testing.T) {
+		client, err := pdc.NewClient(&pdc.Config{URL: u, TLSCAFile: caFile}, log.NewNopLogger())
+		require.NoError(t, err)
+
+		_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("insecure skip verify", func(t *testing.T) {
+		client, err := pdc.NewClient(&pdc.Config{URL: u, TLSInsecureSkipVerify: true}, log.NewNopLogger())
+		require.NoError(t, err)
+
+		_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid CA file", func(t *testing.T) {
+		_, err := pdc.NewClient(&pdc.Config{URL: u, TLSCAFile: path.Join(t.TempDir(), "missing.pem")}, log.NewNopLogger())
+		assert.Error(t, err)
+	})
+
+	t.Run("client certificate without key", func(t *testing.T) {
+		_, err := pdc.NewClient(&pdc.Config{URL: u, TLSCertFile: caFile}, log.NewNopLogger())
+		assert.Error(t, err)
+	})
+}
+
+func TestConfig_Fingerprint(t *testing.T) {
+	u, err := url.Parse("https://pdc.example.com")
+	require.NoError(t, err)
+	other, err := url.Parse("https://pdc.example.org")
+	require.NoError(t, err)
+
+	// Earlier versions hashed the stack ID only, sha256("1"). A running agent
+	// always has an API URL and credentials, so it renews its certificate
+	// once when upgraded.
+	assert.NotEqual(t, "6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b", (&pdc.Config{HostedGrafanaID: "1", URL: u, Token: "glc_1"}).Fingerprint())
+
+	base := pdc.Config{HostedGrafanaID: "1", URL: u, Token: "glc_1", Labels: map[string]string{"a": "1", "b": "2"}}
+	same := pdc.Config{HostedGrafanaID: "1", URL: u, Token: "glc_1", Labels: map[string]string{"b": "2", "a": "1"}}
+	assert.Equal(t, base.Fingerprint(), same.Fingerprint())
+	assert.NotContains(t, base.Fingerprint(), "glc_1")
+
+	// A token rotated in its secret manager keeps the fingerprint.
+	source := pdc.Config{HostedGrafanaID: "1", URL: u, TokenSource: "awssm://pdc", Token: "glc_1"}
+	rotated := pdc.Config{HostedGrafanaID: "1", URL: u, TokenSource: "awssm://pdc", Token: "glc_2"}
+	assert.Equal(t, source.Fingerprint(), rotated.Fingerprint())
+
+	for name, changed := range map[string]pdc.Config{
+		"stack":        {HostedGrafanaID: "2", URL: u, Token: "glc_1", Labels: base.Labels},
+		"network":      {HostedGrafanaID: "1", DevNetwork: "n", URL: u, Token: "glc_1", Labels: base.Labels},
+		"api url":      {HostedGrafanaID: "1", URL: other, Token: "glc_1", Labels: base.Labels},
+		"labels":       {HostedGrafanaID: "1", URL: u, Token: "glc_1", Labels: map[string]string{"a": "1"}},
+		"token":        {HostedGrafanaID: "1", URL: u, Token: "glc_2", Labels: base.Labels},
+		"token source": {HostedGrafanaID: "1", URL: u, TokenSource: "awssm://pdc", Labels: base.Labels},
+		"oauth2":       {HostedGrafanaID: "1", URL: u, Auth: pdc.AuthConfig{Mode: pdc.AuthModeOAuth2, OAuth2ClientID: "agent"}, Labels: base.Labels},
+	} {
+		assert.NotEqual(t, base.Fingerprint(), changed.Fingerprint(), name)
+	}
+}
+
+func TestConfig_Secrets(t *testing.T) {
+	assert.Empty(t, (&pdc.Config{HostedGrafanaID: "123"}).Secrets())
+
+	cfg := &pdc.Config{HostedGrafanaID: "123", Token: "abc"}
+	// base64("123:abc")
+	assert.Equal(t, []string{"abc", "MTIzOmFiYw=="}, cfg.Secrets())
+
+	cfg = &pdc.Config{Auth: pdc.AuthConfig{Mode: pdc.AuthModeOAuth2, OAuth2ClientSecret: "secret"}}
+	assert.Equal(t, []string{"secret"}, cfg.Secrets())
+
+	// The client secret file is read, as the logger is set up before the
+	// token source.
+	secretFile := filepath.Join(t.TempDir(), "client-secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("file-secret\n"), 0o600))
+	cfg = &pdc.Config{Auth: pdc.AuthConfig{Mode: pdc.AuthModeOAuth2, OAuth2ClientSecretFile: secretFile}}
+	assert.Equal(t, []string{"file-secret"}, cfg.Secrets())
+
+	// Only the values of the headers which look like credentials.
+	cfg = &pdc.Config{Headers: map[string]string{"X-Proxy-Authorization": "proxy-secret", "X-Tenant": "tenant-1"}}
+	assert.Equal(t, []string{"proxy-secret"}, cfg.Secrets())
+}
+
+func TestClient_Enroll(t *testing.T) {
+	var body map[string]interface{}
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/pdc/api/v1/enroll", r.URL.Path)
+		authorization = r.Header.Get("Authorization")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body["code"] != "ABCD-1234" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token":"scoped token"}`))
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{URL: u, HostedGrafanaID: "123"}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	resp, err := client.Enroll(context.Background(), "ABCD-1234")
+	require.NoError(t, err)
+	assert.Equal(t, "scoped token", resp.Token)
+	assert.Empty(t, authorization)
+
+	_, err = client.Enroll(context.Background(), "WRONG")
+	assert.ErrorIs(t, err, pdc.ErrInvalidCredentials)
+}
+
+func TestClient_SignSSHKey_Conflict(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{URL: u, Token: "token", HostedGrafanaID: "1"}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+	assert.ErrorIs(t, err, pdc.ErrConflict)
+}
+
+func TestClient_ReportCapabilities(t *testing.T) {
+	var body map[string]interface{}
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pdc/api/v1/capabilities" {
+			http.NotFound(w, r)
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	cfg := &pdc.Config{URL: u, HostedGrafanaID: "123", Token: "token", Labels: map[string]string{"dc": "eu-west"}}
+	client, err := pdc.NewClient(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	err = client.ReportCapabilities(context.Background(), pdc.Capabilities{
+		Version:        "1.0.0",
+		OS:             "linux",
+		Arch:           "amd64",
+		OpenSSHVersion: "OpenSSH_9.2p1",
+		Features:       []string{"socks5-remote-forward"},
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, authorization)
+	assert.Equal(t, map[string]interface{}{
+		"version":         "1.0.0",
+		"os":              "linux",
+		"arch":            "amd64",
+		"openssh_version": "OpenSSH_9.2p1",
+		"features":        []interface{}{"socks5-remote-forward"},
+		"labels":          map[string]interface{}{"dc": "eu-west"},
+	}, body)
+
+	// A PDC API without the endpoint.
+	cfg.CapabilitiesEndpoint = "/unknown"
+	err = client.ReportCapabilities(context.Background(), pdc.Capabilities{})
+	assert.ErrorIs(t, err, pdc.ErrNotFound)
+}
+
+func TestClient_RemoteConfig(t *testing.T) {
+	var query url.Values
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/pdc/api/v1/agent-config", r.URL.Path)
+		query = r.URL.Query()
+		body, _ = io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(`{"log_level":"debug","cert_check_interval":"5m","connections":2,"commands":[{"id":"1","action":"reconnect"}]}`))
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{URL: u, Labels: map[string]string{"dc": "eu-west"}}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	rc, err := client.RemoteConfig(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "debug", rc.LogLevel)
+	assert.Equal(t, "5m", rc.CertCheckInterval)
+	assert.Equal(t, []pdc.RemoteCommand{{ID: "1", Action: pdc.ActionReconnect}}, rc.Commands)
+	assert.Equal(t, map[string]json.RawMessage{"connections": json.RawMessage("2")}, rc.Unknown)
+	assert.Equal(t, "eu-west", query.Get("label.dc"))
+	assert.Empty(t, body)
+}
+
+func TestClient_Discover(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/pdc/api/v1/discovery", r.URL.Path)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	client, err := pdc.NewClient(&pdc.Config{URL: u}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	body = `{"gateways":[{"host":"gw-a.example.com","port":2222,"transports":["ssh","quic"]},{"host":"gw-b.example.com"},{"host":"gw-c.example.com","transports":["quic"]}]}`
+	d, err := client.Discover(context.Background())
+	require.NoError(t, err)
+	require.Len(t, d.Gateways, 3)
+	assert.Equal(t, pdc.Gateway{Host: "gw-a.example.com", Port: 2222, Transports: []string{"ssh", "quic"}}, d.Gateways[0])
+	assert.True(t, d.Gateways[0].Supports(pdc.TransportSSH))
+	assert.True(t, d.Gateways[1].Supports(pdc.TransportSSH), "no transports means ssh")
+	assert.False(t, d.Gateways[2].Supports(pdc.TransportSSH))
+
+	for _, invalid := range []string{
+		`{"gateways":[{"host":""}]}`,
+		`{"gateways":[{"host":"gw.example.com:22"}]}`,
+		`{"gateways":[{"host":"gw.example.com","port":70000}]}`,
+	} {
+		body = invalid
+		_, err = client.Discover(context.Background())
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestClient_UploadSupportBundle(t *testing.T) {
+	var body map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/pdc/api/v1/support-bundles", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{URL: u}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	require.NoError(t, client.UploadSupportBundle(context.Background(), "cmd-1", []byte("bundle")))
+	assert.Equal(t, map[string]string{"command_id": "cmd-1", "bundle": "YnVuZGxl"}, body)
+}
+
+func TestConfig_LoadToken(t *testing.T) {
+	tokenFile := path.Join(t.TempDir(), "dir", "token")
+
+	cfg := &pdc.Config{TokenFile: tokenFile}
+	require.NoError(t, cfg.LoadToken(context.Background()))
+	assert.Empty(t, cfg.Token)
+
+	require.NoError(t, pdc.WriteTokenFile(tokenFile, "abc"))
+	fi, err := os.Stat(tokenFile)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	require.NoError(t, cfg.LoadToken(context.Background()))
+	assert.Equal(t, "abc", cfg.Token)
+
+	cfg = &pdc.Config{Token: "from flag", TokenFile: tokenFile}
+	require.NoError(t, cfg.LoadToken(context.Background()))
+	assert.Equal(t, "from flag", cfg.Token)
+}
+
+func TestClient_Auth(t *testing.T) {
+	var tokenRequests int
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+		id, secret, _ := r.BasicAuth()
+		assert.Equal(t, "agent", id)
+		assert.Equal(t, "secret", secret)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"access token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	t.Cleanup(tokenServer.Close)
+
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	oidcTokenFile := path.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(oidcTokenFile, []byte("oidc token\n"), 0600))
+
+	testcases := []struct {
+		name     string
+		auth     pdc.AuthConfig
+		expected string
+	}{
+		{
+			name:     "static token",
+			auth:     pdc.AuthConfig{Mode: pdc.AuthModeToken},
+			expected: "Basic MTIzOmFiYw==",
+		},
+		{
+			name: "oauth2 client credentials",
+			auth: pdc.AuthConfig{
+				Mode:               pdc.AuthModeOAuth2,
+				OAuth2TokenURL:     tokenServer.URL,
+				OAuth2ClientID:     "agent",
+				OAuth2ClientSecret: "secret",
+			},
+			expected: "Bearer access token",
+		},
+		{
+			name:     "oidc token file",
+			auth:     pdc.AuthConfig{Mode: pdc.AuthModeOIDC, OIDCTokenFile: oidcTokenFile},
+			expected: "Bearer oidc token",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := pdc.NewClient(&pdc.Config{URL: u, HostedGrafanaID: "123", Token: "abc", Auth: tc.auth}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, authorization)
+			}
+		})
+	}
+
+	// The access token is reused until it expires.
+	assert.Equal(t, 1, tokenRequests)
+}
+
+func TestNewClient_InvalidAuth(t *testing.T) {
+	u, err := url.Parse("http://localhost")
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name string
+		auth pdc.AuthConfig
+	}{
+		{name: "unknown mode", auth: pdc.AuthConfig{Mode: "kerberos"}},
+		{name: "oauth2 without client id", auth: pdc.AuthConfig{Mode: pdc.AuthModeOAuth2, OAuth2TokenURL: "http://localhost/token"}},
+		{name: "oidc without token file", auth: pdc.AuthConfig{Mode: pdc.AuthModeOIDC}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := pdc.NewClient(&pdc.Config{URL: u, Auth: tc.auth}, log.NewNopLogger())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestClient_SignSSHKey_ResponseSignature(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		signer, err := ssh.NewSignerFromKey(key)
+		require.NoError(t, err)
+		return signer
+	}
+	signer, otherSigner := newSigner(), newSigner()
+
+	body, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+	require.NoError(t, err)
+	sign := func(s ssh.Signer, data []byte) string {
+		sig, err := s.Sign(rand.Reader, data)
+		require.NoError(t, err)
+		return base64.StdEncoding.EncodeToString(ssh.Marshal(sig))
+	}
+
+	testcases := []struct {
+		name      string
+		signature string
+		wantErr   bool
+	}{
+		{name: "signed", signature: sign(signer, body)},
+		{name: "no signature", wantErr: true},
+		{name: "signed by another key", signature: sign(otherSigner, body), wantErr: true},
+		{name: "signature of another body", signature: sign(signer, []byte("{}")), wantErr: true},
+		{name: "invalid signature", signature: "not base64", wantErr: true},
+	}
+
+	keysFile := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(keysFile, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600))
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.signature != "" {
+					w.Header().Set("X-PDC-Signature", tc.signature)
+				}
+				_, _ = w.Write(body)
+			}))
+			t.Cleanup(ts.Close)
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			client, err := pdc.NewClient(&pdc.Config{URL: u, ResponseSigningKeysFile: keysFile}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			resp, err := client.SignSSHKey(context.Background(), []byte("public key"))
+			if tc.wantErr {
+				assert.ErrorIs(t, err, pdc.ErrInvalidSignature)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "kh", string(resp.KnownHosts))
+		})
+	}
+
+	_, err = pdc.NewClient(&pdc.Config{URL: &url.URL{}, ResponseSigningKeysFile: filepath.Join(t.TempDir(), "missing")}, log.NewNopLogger())
+	assert.Error(t, err)
+}
+
+func TestConfig_HeaderFlag(t *testing.T) {
+	testcases := []struct {
+		name     string
+		args     []string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name: "no headers",
+		},
+		{
+			name:     "repeated headers",
+			args:     []string{"-api.header", "x-proxy-client=pdc", "-api.header", "X-Tenant=a=b"},
+			expected: map[string]string{"X-Proxy-Client": "pdc", "X-Tenant": "a=b"},
+		},
+		{
+			name:    "missing value",
+			args:    []string{"-api.header", "X-Tenant"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid name",
+			args:    []string{"-api.header", "X Tenant=a"},
+			wantErr: true,
+		},
+		{
+			name:    "header set by the agent",
+			args:    []string{"-api.header", "authorization=Bearer token"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &pdc.Config{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.RegisterFlags(fs)
+
+			err := fs.Parse(tc.args)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg.Headers)
+		})
+	}
+}
+
+func TestClient_Headers(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := pdc.NewClient(&pdc.Config{
+		URL:             u,
+		Token:           "token",
+		HostedGrafanaID: "1",
+		UserAgentSuffix: "corp-proxy-id/42",
+		Headers:         map[string]string{"X-Proxy-Client": "pdc"},
+	}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "pdc", got.Get("X-Proxy-Client"))
+	assert.Equal(t, httpclient.UserAgent+" corp-proxy-id/42", got.Get("User-Agent"))
+}
+
+func TestClient_PathPrefix(t *testing.T) {
+	testcases := []struct {
+		name    string
+		prefix  string
+		rawPath string
+	}{
+		{name: "no prefix", prefix: "", rawPath: "/pdc/api/v1/sign-public-key"},
+		{name: "prefix", prefix: "/grafana-pdc", rawPath: "/grafana-pdc/pdc/api/v1/sign-public-key"},
+		{name: "trailing slash", prefix: "/grafana-pdc/", rawPath: "/grafana-pdc/pdc/api/v1/sign-public-key"},
+		{name: "escaped prefix", prefix: "/tenants/a%2Fb", rawPath: "/tenants/a%2Fb/pdc/api/v1/sign-public-key"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.URL.EscapedPath()
+				enc, err := json.Marshal(map[string]string{"certificate": cert, "known_hosts": "kh"})
+				assert.NoError(t, err)
+				_, _ = w.Write(enc)
+			}))
+			t.Cleanup(ts.Close)
+
+			u, err := url.Parse(ts.URL + tc.prefix)
+			require.NoError(t, err)
+			client, err := pdc.NewClient(&pdc.Config{URL: u, Token: "token", HostedGrafanaID: "1"}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.rawPath, got)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package pdc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/grafana/pdc-agent/pkg/cloud"
+)
+
+// Cloud workload identity authentication modes. The agent proves its cloud
+// identity to the PDC API without any static secret.
+const (
+	// AuthModeAWS authenticates with a signed sts:GetCallerIdentity request,
+	// using the credentials of the environment or of the instance IAM role.
+	AuthModeAWS = "aws"
+	// AuthModeGCP authenticates with an identity token of the service account
+	// of the instance.
+	AuthModeGCP = "gcp"
+	// AuthModeAzure authenticates with an access token of the managed identity
+	// of the instance.
+	AuthModeAzure = "azure"
+)
+
+// awsTokenValidity is how long a signed sts:GetCallerIdentity request is
+// used. AWS rejects signed requests older than 15 minutes.
+const awsTokenValidity = 10 * time.Minute
+
+// audienceHeader binds signed AWS requests to the PDC API, so they cannot be
+// replayed against another service.
+const audienceHeader = "X-PDC-Audience"
+
+// cloudTokenSource returns the token source of a cloud workload identity mode.
+func (cfg *AuthConfig) cloudTokenSource() (oauth2.TokenSource, error) {
+	switch cfg.Mode {
+	case AuthModeAWS:
+		return oauth2.ReuseTokenSource(nil, &awsTokenSource{region: cfg.AWSRegion, audience: cfg.Audience, now: time.Now}), nil
+	case AuthModeGCP:
+		if cfg.Audience == "" {
+			return nil, errors.New("-auth.audience is required with -auth.mode=gcp")
+		}
+		return oauth2.ReuseTokenSource(nil, gcpTokenSource(cfg.Audience)), nil
+	case AuthModeAzure:
+		if cfg.Audience == "" {
+			return nil, errors.New("-auth.audience is required with -auth.mode=azure")
+		}
+		return oauth2.ReuseTokenSource(nil, azureTokenSource(cfg.Audience)), nil
+	default:
+		return nil, fmt.Errorf("invalid -auth.mode %q", cfg.Mode)
+	}
+}
+
+// gcpTokenSource requests identity tokens for an audience from the GCE
+// metadata server.
+type gcpTokenSource string
+
+func (audience gcpTokenSource) Token() (*oauth2.Token, error) {
+	token, expiry, err := cloud.GCPIdentityToken(context.Background(), string(audience))
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// azureTokenSource requests access tokens for a resource from the Azure
+// instance metadata service.
+type azureTokenSource string
+
+func (resource azureTokenSource) Token() (*oauth2.Token, error) {
+	token, expiry, err := cloud.AzureToken(context.Background(), string(resource))
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// awsTokenSource signs sts:GetCallerIdentity requests. The PDC API sends the
+// request to AWS STS to learn the IAM identity of the agent.
+type awsTokenSource struct {
+	region   string
+	audience string
+	now      func() time.Time
+}
+
+// awsSignedRequest is the JSON encoding of the signed request, sent base64
+// encoded as a bearer token.
+type awsSignedRequest struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+func (ts *awsTokenSource) Token() (*oauth2.Token, error) {
+	creds, err := cloud.LoadAWSCredentials(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	region := ts.region
+	if region == "" {
+		region = "us-east-1"
+	}
+	body := "Action=GetCallerIdentity&Version=2011-06-15"
+	req, err := http.NewRequest(http.MethodPost, "https://sts."+region+".amazonaws.com/", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if ts.audience != "" {
+		req.Header.Set(audienceHeader, ts.audience)
+	}
+	now := ts.now()
+	cloud.SignV4(req, []byte(body), creds, region, "sts", now)
+
+	enc, err := json.Marshal(awsSignedRequest{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Headers: req.Header,
+		Body:    body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: base64.StdEncoding.EncodeToString(enc),
+		TokenType:   "Bearer",
+		Expiry:      now.Add(awsTokenValidity),
+	}, nil
+}
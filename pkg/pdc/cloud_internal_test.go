@@ -0,0 +1,37 @@
+package pdc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSTokenSource(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+
+	now := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	ts := &awsTokenSource{region: "eu-west-1", audience: "pdc", now: func() time.Time { return now }}
+
+	token, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(awsTokenValidity), token.Expiry)
+
+	data, err := base64.StdEncoding.DecodeString(token.AccessToken)
+	require.NoError(t, err)
+	var signed awsSignedRequest
+	require.NoError(t, json.Unmarshal(data, &signed))
+
+	assert.Equal(t, http.MethodPost, signed.Method)
+	assert.Equal(t, "https://sts.eu-west-1.amazonaws.com/", signed.URL)
+	assert.Equal(t, "Action=GetCallerIdentity&Version=2011-06-15", signed.Body)
+	assert.Equal(t, []string{"pdc"}, signed.Headers[http.CanonicalHeaderKey(audienceHeader)])
+	assert.Equal(t, []string{"session"}, signed.Headers["X-Amz-Security-Token"])
+	assert.Contains(t, signed.Headers["Authorization"][0], "Credential=AKIDEXAMPLE/20230801/eu-west-1/sts/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-pdc-audience,")
+}
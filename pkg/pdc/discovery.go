@@ -0,0 +1,62 @@
+package pdc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// TransportSSH is the transport of gateways the agent connects to with ssh.
+const TransportSSH = "ssh"
+
+// Gateway is a gateway endpoint of the stack, as returned by Discover.
+type Gateway struct {
+	// Host is a host name, without port.
+	Host string `json:"host"`
+	// Port defaults to the port of the gateway flags if 0.
+	Port int `json:"port,omitempty"`
+	// Transports are the protocols the gateway accepts. An empty list means
+	// ssh only.
+	Transports []string `json:"transports,omitempty"`
+}
+
+// Supports reports whether the gateway accepts transport.
+func (g Gateway) Supports(transport string) bool {
+	if len(g.Transports) == 0 {
+		return transport == TransportSSH
+	}
+	return slices.Contains(g.Transports, transport)
+}
+
+// Discovery describes the gateways serving the stack, so the agent does not
+// derive them from the cluster name.
+type Discovery struct {
+	// Gateways are ordered by preference.
+	Gateways []Gateway `json:"gateways"`
+}
+
+// Discover fetches the gateway endpoints of the stack from the PDC API. It
+// returns ErrNotFound if the PDC API does not support it.
+func (c *pdcClient) Discover(ctx context.Context) (*Discovery, error) {
+	resp, err := c.call(ctx, http.MethodGet, c.cfg.DiscoveryEndpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Discovery{}
+	if err := json.Unmarshal(resp, d); err != nil {
+		return nil, err
+	}
+	for _, g := range d.Gateways {
+		if g.Host == "" || strings.ContainsAny(g.Host, "/@: ") {
+			return nil, fmt.Errorf("discovery response has invalid gateway host %q", g.Host)
+		}
+		if g.Port < 0 || g.Port > 65535 {
+			return nil, fmt.Errorf("discovery response has gateway %s with invalid port %d", g.Host, g.Port)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,59 @@
+package pdc
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fingerprint returns a hash of the resolved configuration which determines
+// the certificates signed by the PDC API: the stack, the network, the API, the
+// labels and the credentials, whose access policy sets the principals. A new
+// certificate is needed when it changes, however the configuration was set.
+//
+// The canonical form starts with the stack ID and the network, followed by the
+// other values as sorted name=value lines. Earlier versions only hashed the
+// stack ID and the network, so the agent renews its certificate once when
+// upgraded.
+func (cfg *Config) Fingerprint() string {
+	var b strings.Builder
+	b.WriteString(cfg.HostedGrafanaID)
+	if cfg.DevNetwork != "" {
+		fmt.Fprintf(&b, "/%s", cfg.DevNetwork)
+	}
+
+	var fields []string
+	if cfg.URL != nil {
+		fields = append(fields, fmt.Sprintf("api_url=%q", cfg.URL.String()))
+	}
+	for name, value := range cfg.Labels {
+		fields = append(fields, fmt.Sprintf("label.%s=%q", name, value))
+	}
+	if id := cfg.credentialsID(); id != "" {
+		// Only a hash of the credentials is written to the hash file.
+		fields = append(fields, fmt.Sprintf("credentials=%x", sha256.Sum256([]byte(id))))
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		fmt.Fprintf(&b, "\n%s", f)
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(b.String())))
+}
+
+// credentialsID identifies the credentials of the signing requests: the
+// token, the secret it is fetched from, or the identity of the other
+// authentication modes. It is empty without credentials.
+func (cfg *Config) credentialsID() string {
+	switch {
+	case cfg.Auth.Mode != "" && cfg.Auth.Mode != AuthModeToken:
+		return fmt.Sprintf("auth/%s/%s/%s/%s", cfg.Auth.Mode, cfg.Auth.OAuth2ClientID, cfg.Auth.OIDCTokenFile, cfg.Auth.Audience)
+	case cfg.TokenSource != "":
+		// The token is rotated in the secret manager, keeping its access
+		// policy.
+		return "source/" + cfg.TokenSource
+	default:
+		return cfg.Token
+	}
+}
@@ -0,0 +1,116 @@
+package pdc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// ErrIdentityCopied is returned by LoadInstanceID when the instance ID was
+// generated on another machine, which happens when the key files of an agent
+// are copied to another host.
+var ErrIdentityCopied = errors.New("the instance ID was generated on another machine")
+
+// machineIDFiles hold the machine ID of systemd and D-Bus hosts.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+var instanceIDRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// Machine identifies the host of the agent, so certificates can be traced
+// back to it. It is sent with signing requests and capability reports.
+type Machine struct {
+	Hostname string `json:"hostname,omitempty"`
+	OS       string `json:"os"`
+	// InstanceID is a UUID generated once per agent installation.
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+// CurrentMachine returns the identity of the host, with instanceID.
+func CurrentMachine(instanceID string) *Machine {
+	hostname, _ := os.Hostname()
+	return &Machine{Hostname: hostname, OS: runtime.GOOS, InstanceID: instanceID}
+}
+
+// LoadInstanceID reads the instance ID of the agent from the file at path.
+// If the file does not exist, a new ID is generated and written to it.
+//
+// The file also holds a hash of the machine ID of the host, where it has one.
+// If it differs, the ID is returned with an error wrapping ErrIdentityCopied.
+func LoadInstanceID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return RegenerateInstanceID(path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	id, machine, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	if !instanceIDRegexp.MatchString(id) {
+		return "", fmt.Errorf("invalid instance ID in %s: expecting a UUID", path)
+	}
+	current := machineHash()
+	switch {
+	case current == "" || machine == current:
+	case machine == "":
+		// Files written without a machine ID are bound to this host.
+		if err := writeInstanceID(path, id); err != nil {
+			return "", err
+		}
+	default:
+		return id, fmt.Errorf("%s: %w", path, ErrIdentityCopied)
+	}
+	return id, nil
+}
+
+// RegenerateInstanceID writes a new instance ID to the file at path, bound
+// to the machine ID of the host.
+func RegenerateInstanceID(path string) (string, error) {
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := writeInstanceID(path, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func writeInstanceID(path, id string) error {
+	data := id + "\n"
+	if machine := machineHash(); machine != "" {
+		data += machine + "\n"
+	}
+	return os.WriteFile(path, []byte(data), 0600)
+}
+
+// machineHash returns a hash of the machine ID of the host, which must not
+// be disclosed, or "" if it has none.
+func machineHash() string {
+	for _, path := range machineIDFiles {
+		data, err := os.ReadFile(path)
+		if id := strings.TrimSpace(string(data)); err == nil && id != "" {
+			sum := sha256.Sum256([]byte("pdc-agent:" + id))
+			return hex.EncodeToString(sum[:16])
+		}
+	}
+	return ""
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
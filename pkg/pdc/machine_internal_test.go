@@ -0,0 +1,48 @@
+package pdc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadInstanceID_Copied(t *testing.T) {
+	dir := t.TempDir()
+	machineIDPath := filepath.Join(dir, "machine-id")
+	orig := machineIDFiles
+	machineIDFiles = []string{machineIDPath}
+	t.Cleanup(func() { machineIDFiles = orig })
+
+	// Without a machine ID, copies cannot be detected.
+	path := filepath.Join(dir, "grafana_pdc_instance_id")
+	id, err := LoadInstanceID(path)
+	require.NoError(t, err)
+
+	// Files written without a machine ID are bound to the host.
+	require.NoError(t, os.WriteFile(machineIDPath, []byte("host-a\n"), 0600))
+	again, err := LoadInstanceID(path)
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	assert.NotContains(t, lines[1], "host-a")
+
+	// Another host.
+	require.NoError(t, os.WriteFile(machineIDPath, []byte("host-b\n"), 0600))
+	copied, err := LoadInstanceID(path)
+	assert.ErrorIs(t, err, ErrIdentityCopied)
+	assert.Equal(t, id, copied)
+
+	regenerated, err := RegenerateInstanceID(path)
+	require.NoError(t, err)
+	assert.NotEqual(t, id, regenerated)
+	again, err = LoadInstanceID(path)
+	require.NoError(t, err)
+	assert.Equal(t, regenerated, again)
+}
@@ -0,0 +1,42 @@
+package pdc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var clockSkew = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "pdc_agent_clock_skew_seconds",
+	Help: "Difference between the local clock and the Date header of the last PDC API response.",
+})
+
+var apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_api_requests_total",
+	Help: "Number of requests to the PDC API, by endpoint and status code. The code is \"error\" when no response was received.",
+}, []string{"endpoint", "code"})
+
+var apiRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pdc_agent_api_request_duration_seconds",
+	Help:    "Duration of requests to the PDC API, including retries, by endpoint.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"endpoint"})
+
+var signingRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_signing_requests_total",
+	Help: "Number of requests to sign the public key of the agent, by result: success or failure.",
+}, []string{"result"})
+
+var lastSuccessfulSign = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "pdc_agent_last_successful_signing_timestamp_seconds",
+	Help: "Unix time of the last successful signing of the public key of the agent.",
+})
+
+var breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pdc_agent_api_circuit_breaker_state",
+	Help: "State of the circuit breaker of the PDC API: 0 closed, 1 open, 2 half-open, by API host and tunnel.",
+}, []string{"api", "tunnel"})
+
+var breakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_api_circuit_breaker_rejections_total",
+	Help: "Number of requests to the PDC API not sent because its circuit breaker was open, by API host and tunnel.",
+}, []string{"api", "tunnel"})
@@ -0,0 +1,34 @@
+package pdc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Metrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	client, err := NewClient(&Config{URL: u, SignPublicKeyEndpoint: "/metrics-test"}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	failures := testutil.ToFloat64(signingRequests.WithLabelValues("failure"))
+	_, err = client.SignSSHKey(context.Background(), []byte("public key"))
+	assert.ErrorIs(t, err, ErrInternal)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiRequests.WithLabelValues("/metrics-test", "403")))
+	assert.Equal(t, failures+1, testutil.ToFloat64(signingRequests.WithLabelValues("failure")))
+}
@@ -0,0 +1,88 @@
+package pdc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// RemoteConfig is the configuration the PDC API wants the agent to run
+// with. Empty fields keep the local configuration.
+type RemoteConfig struct {
+	// LogLevel is "debug", "info", "warn" or "error".
+	LogLevel string `json:"log_level,omitempty"`
+	// CertCheckInterval is a duration, such as "5m".
+	CertCheckInterval string `json:"cert_check_interval,omitempty"`
+	// Commands are actions the PDC API asks the agent to take.
+	Commands []RemoteCommand `json:"commands,omitempty"`
+	// Unknown holds the fields the agent does not support, so they can be
+	// reported.
+	Unknown map[string]json.RawMessage `json:"-"`
+}
+
+func (rc *RemoteConfig) UnmarshalJSON(data []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	type plain RemoteConfig
+	if err := json.Unmarshal(data, (*plain)(rc)); err != nil {
+		return err
+	}
+	delete(fields, "log_level")
+	delete(fields, "cert_check_interval")
+	delete(fields, "commands")
+	if len(fields) > 0 {
+		rc.Unknown = fields
+	}
+	return nil
+}
+
+// The actions of a RemoteCommand.
+const (
+	ActionRenewCertificate    = "renew-certificate"
+	ActionReconnect           = "reconnect"
+	ActionUploadSupportBundle = "upload-support-bundle"
+)
+
+// RemoteCommand is an action the PDC API asks the agent to take. A command
+// is returned until the PDC API considers it done, its ID identifies it.
+type RemoteCommand struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+}
+
+// RemoteConfig fetches the configuration the PDC API wants the agent to run
+// with. It returns ErrNotFound if the PDC API does not support it.
+func (c *pdcClient) RemoteConfig(ctx context.Context) (*RemoteConfig, error) {
+	params := map[string]string{}
+	for k, v := range c.cfg.Labels {
+		params["label."+k] = v
+	}
+	resp, err := c.call(ctx, http.MethodGet, c.cfg.RemoteConfigEndpoint, params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &RemoteConfig{}
+	if err := json.Unmarshal(resp, rc); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+type supportBundleRequest struct {
+	CommandID string `json:"command_id,omitempty"`
+	// Bundle is a tar.gz archive, base64 encoded.
+	Bundle []byte `json:"bundle"`
+}
+
+// UploadSupportBundle sends a support bundle to the PDC API, in response to
+// the command with the ID commandID.
+func (c *pdcClient) UploadSupportBundle(ctx context.Context, commandID string, bundle []byte) error {
+	_, err := c.call(ctx, http.MethodPost, c.cfg.SupportBundleEndpoint, nil, supportBundleRequest{
+		CommandID: commandID,
+		Bundle:    bundle,
+	})
+	return err
+}
@@ -0,0 +1,70 @@
+package pdc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// responseSignatureHeader holds the detached signature of the body of a
+// signing response: the base64 encoded SSH signature of the body, in the
+// wire format of RFC 4253.
+const responseSignatureHeader = "X-PDC-Signature"
+
+// ErrInvalidSignature is returned when a signing response is not signed by
+// one of the keys of ResponseSigningKeysFile.
+var ErrInvalidSignature = errors.New("invalid signing response signature")
+
+// responseHeaderKey is the context key of a *http.Header the headers of the
+// response of a request are copied to.
+type responseHeaderKey struct{}
+
+// readResponseSigningKeys reads the public keys of path, one per line in the
+// format of authorized_keys.
+func readResponseSigningKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading -api.response-signing-keys-file: %w", err)
+	}
+	var keys []ssh.PublicKey
+	for rest := data; len(bytes.TrimSpace(rest)) > 0; {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -api.response-signing-keys-file: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("-api.response-signing-keys-file has no keys")
+	}
+	return keys, nil
+}
+
+// verifyResponseSignature checks that the signature of header is the one of
+// body by one of keys.
+func verifyResponseSignature(keys []ssh.PublicKey, header http.Header, body []byte) error {
+	value := header.Get(responseSignatureHeader)
+	if value == "" {
+		return fmt.Errorf("%w: the response has no %s header", ErrInvalidSignature, responseSignatureHeader)
+	}
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("%w: %s is not base64 encoded", ErrInvalidSignature, responseSignatureHeader)
+	}
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(b, sig); err != nil {
+		return fmt.Errorf("%w: %s is not an SSH signature: %w", ErrInvalidSignature, responseSignatureHeader, err)
+	}
+	for _, key := range keys {
+		if key.Verify(body, sig) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: not signed by a key of -api.response-signing-keys-file", ErrInvalidSignature)
+}
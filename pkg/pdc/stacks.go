@@ -0,0 +1,57 @@
+package pdc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stackKey is the context key of the stack a request is made for.
+type stackKey struct{}
+
+// WithStack returns a context for requests made on behalf of the stack with
+// the hosted Grafana ID id. Requests for a stack other than HostedGrafanaID
+// are authenticated with its token in StackTokens.
+func WithStack(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, stackKey{}, id)
+}
+
+func (cfg *Config) addStackToken(s string) error {
+	id, token, ok := strings.Cut(s, "=")
+	if !ok || id == "" || token == "" {
+		return fmt.Errorf("invalid stack token %q, expecting hosted-grafana-id=token", s)
+	}
+	if _, ok := cfg.StackTokens[id]; ok {
+		return fmt.Errorf("stack %q is set more than once", id)
+	}
+	if cfg.StackTokens == nil {
+		cfg.StackTokens = map[string]string{}
+	}
+	cfg.StackTokens[id] = token
+	return nil
+}
+
+// Stacks returns the hosted Grafana IDs of StackTokens, sorted.
+func (cfg *Config) Stacks() []string {
+	ids := make([]string, 0, len(cfg.StackTokens))
+	for id := range cfg.StackTokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// stackCredentials returns the hosted Grafana ID and token of the stack of
+// ctx. ok is false for the stack of HostedGrafanaID, whose token is Token.
+func (cfg *Config) stackCredentials(ctx context.Context) (id, token string, ok bool, err error) {
+	id, _ = ctx.Value(stackKey{}).(string)
+	if id == "" || id == cfg.HostedGrafanaID {
+		return "", "", false, nil
+	}
+	token, found := cfg.StackTokens[id]
+	if !found {
+		return "", "", false, fmt.Errorf("no token for stack %s, set it with -stack.token", id)
+	}
+	return id, token, true, nil
+}
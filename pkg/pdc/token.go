@@ -0,0 +1,77 @@
+package pdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grafana/pdc-agent/pkg/secrets"
+)
+
+// LoadToken reads the token from TokenSource, or else from TokenFile, when
+// Token is not set. A missing token file is not an error.
+func (cfg *Config) LoadToken(ctx context.Context) error {
+	if cfg.TokenSource != "" {
+		if cfg.Token != "" {
+			return errors.New("-token and -token-source cannot be set together")
+		}
+		src, err := secrets.Parse(cfg.TokenSource)
+		if err != nil {
+			return err
+		}
+		// Fetching the token on start reports errors early, and the token is
+		// redacted from logs.
+		token, err := src.Fetch(ctx)
+		if err != nil {
+			return fmt.Errorf("fetching token from -token-source: %w", err)
+		}
+		cfg.Token = strings.TrimSpace(token)
+		return nil
+	}
+
+	if cfg.Token != "" || cfg.TokenFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(cfg.TokenFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading token file: %w", err)
+	}
+
+	cfg.Token = strings.TrimSpace(string(data))
+	return nil
+}
+
+// WriteTokenFile writes token to path, readable by the current user only.
+// The file is replaced atomically, so a concurrent LoadToken never reads a
+// partial token.
+func WriteTokenFile(path, token string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	// CreateTemp creates the file with 0600 permissions.
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
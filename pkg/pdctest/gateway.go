@@ -0,0 +1,274 @@
+package pdctest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Gateway is an in-process PDC gateway: an ssh server accepting the
+// certificates of a certificate authority, and reverse forwards. It is closed
+// when the test ends.
+type Gateway struct {
+	// Addr is the host:port the gateway listens on.
+	Addr string
+	// HostKey is the host key of the gateway.
+	HostKey ssh.PublicKey
+
+	cfg      *ssh.ServerConfig
+	listener net.Listener
+
+	mu          sync.Mutex
+	conns       map[*ssh.ServerConn]struct{}
+	connections []Connection
+	forwards    []string
+}
+
+// Connection is an ssh connection accepted by a Gateway.
+type Connection struct {
+	// User is the hosted Grafana ID of the agent.
+	User string
+	// Principals are the ones of the certificate of the agent.
+	Principals []string
+}
+
+// NewGateway starts a Gateway accepting the user certificates signed by ca.
+func NewGateway(t testing.TB, ca ssh.Signer) *Gateway {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	g := &Gateway{HostKey: hostSigner.PublicKey(), conns: map[*ssh.ServerConn]struct{}{}}
+	g.cfg = &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			cert, ok := key.(*ssh.Certificate)
+			if !ok || cert.CertType != ssh.UserCert || !checker.IsUserAuthority(cert.SignatureKey) {
+				return nil, errors.New("only user certificates of the certificate authority are accepted")
+			}
+			// The PDC gateway checks the principals against the networks
+			// of the stack: only check the signature and validity here.
+			var principal string
+			if len(cert.ValidPrincipals) > 0 {
+				principal = cert.ValidPrincipals[0]
+			}
+			if err := checker.CheckCert(principal, cert); err != nil {
+				return nil, err
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"principals": strings.Join(cert.ValidPrincipals, ",")}}, nil
+		},
+	}
+	g.cfg.AddHostKey(hostSigner)
+
+	g.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Addr = g.listener.Addr().String()
+	t.Cleanup(g.Close)
+
+	go g.serve()
+	return g
+}
+
+// KnownHosts returns the known hosts line of the gateway, to return from the
+// mock PDC API.
+func (g *Gateway) KnownHosts() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(g.Addr)}, g.HostKey)
+}
+
+// Port returns the port of the gateway.
+func (g *Gateway) Port() int {
+	_, port, _ := net.SplitHostPort(g.Addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Connections returns the connections accepted by the gateway, including
+// closed ones.
+func (g *Gateway) Connections() []Connection {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]Connection(nil), g.connections...)
+}
+
+// Active returns the number of open connections.
+func (g *Gateway) Active() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.conns)
+}
+
+// Forwards returns the addresses of the reverse forwards set up by the
+// connections. Connections to them are forwarded to the agent.
+func (g *Gateway) Forwards() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.forwards...)
+}
+
+// Drop closes the open connections, as a gateway restart does.
+func (g *Gateway) Drop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for c := range g.conns {
+		c.Close()
+	}
+}
+
+// Close stops the gateway and closes its connections.
+func (g *Gateway) Close() {
+	g.listener.Close()
+	g.Drop()
+}
+
+func (g *Gateway) serve() {
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			return
+		}
+		go g.handle(conn)
+	}
+}
+
+func (g *Gateway) handle(conn net.Conn) {
+	defer conn.Close()
+
+	sc, chans, reqs, err := ssh.NewServerConn(conn, g.cfg)
+	if err != nil {
+		return
+	}
+	g.mu.Lock()
+	g.conns[sc] = struct{}{}
+	g.connections = append(g.connections, Connection{User: sc.User(), Principals: strings.Split(sc.Permissions.Extensions["principals"], ",")})
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.conns, sc)
+		g.mu.Unlock()
+	}()
+
+	go func() {
+		// reqs is closed with the connection.
+		var listeners []net.Listener
+		defer func() {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}()
+		for req := range reqs {
+			if req.Type != "tcpip-forward" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			var fwd struct {
+				Addr string
+				Port uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &fwd); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			l, err := g.forward(sc, fwd.Addr)
+			if err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			listeners = append(listeners, l)
+			_, port, _ := net.SplitHostPort(l.Addr().String())
+			p, _ := strconv.Atoi(port)
+			_ = req.Reply(true, ssh.Marshal(struct{ Port uint32 }{uint32(p)}))
+		}
+	}()
+
+	for ch := range chans {
+		if ch.ChannelType() != "session" {
+			_ = ch.Reject(ssh.UnknownChannelType, "only sessions are accepted")
+			continue
+		}
+		go acceptSession(ch)
+	}
+}
+
+// acceptSession accepts the session of ssh, which does not run -N, and keeps
+// it open until the connection is closed.
+func acceptSession(newCh ssh.NewChannel) {
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go func() { _, _ = io.Copy(io.Discard, ch) }()
+	for req := range reqs {
+		_ = req.Reply(req.Type == "shell" || req.Type == "pty-req" || req.Type == "env", nil)
+	}
+}
+
+// forward listens on a local port, and forwards its connections to the
+// agent through sc. bindAddr is the address requested by the agent, which
+// identifies the forward.
+func (g *Gateway) forward(sc *ssh.ServerConn, bindAddr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.forwards = append(g.forwards, l.Addr().String())
+	g.mu.Unlock()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				origin := conn.RemoteAddr().(*net.TCPAddr)
+				payload := ssh.Marshal(struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{bindAddr, uint32(p), origin.IP.String(), uint32(origin.Port)})
+				ch, reqs, err := sc.OpenChannel("forwarded-tcpip", payload)
+				if err != nil {
+					return
+				}
+				defer ch.Close()
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					_, _ = io.Copy(ch, conn)
+					// Let the agent close the channel once the client is done.
+					_ = ch.CloseWrite()
+				}()
+				_, _ = io.Copy(conn, ch)
+			}()
+		}
+	}()
+	return l, nil
+}
@@ -0,0 +1,226 @@
+// Package pdctest provides a mock of the PDC API for tests, signing the keys
+// of agents with its own certificate authority.
+package pdctest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The endpoints of the PDC API served by Server.
+const (
+	SignPublicKeyPath = "/pdc/api/v1/sign-public-key"
+	EnrollPath        = "/pdc/api/v1/enroll"
+	CapabilitiesPath  = "/pdc/api/v1/capabilities"
+)
+
+// Config are the responses of a Server.
+type Config struct {
+	// StatusCode is the status code of the responses. Defaults to 200.
+	StatusCode int
+	// Principals are the principals of the certificates. Defaults to
+	// "key".
+	Principals []string
+	// ValidAfter and ValidBefore are the validity window of the
+	// certificates, relative to the time of the request. Default to -5m and
+	// 1h.
+	ValidAfter  time.Duration
+	ValidBefore time.Duration
+	// KnownHosts is the known hosts file returned with the certificates.
+	// Defaults to "known hosts".
+	KnownHosts string
+	// Token is the token returned by enrollment requests. Defaults to
+	// "token".
+	Token string
+	// Latency delays the responses.
+	Latency time.Duration
+	// CA signs the certificates. Defaults to a new certificate authority.
+	CA ssh.Signer
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.StatusCode == 0 {
+		cfg.StatusCode = http.StatusOK
+	}
+	if cfg.Principals == nil {
+		cfg.Principals = []string{"key"}
+	}
+	if cfg.ValidAfter == 0 {
+		cfg.ValidAfter = -5 * time.Minute
+	}
+	if cfg.ValidBefore == 0 {
+		cfg.ValidBefore = time.Hour
+	}
+	if cfg.KnownHosts == "" {
+		cfg.KnownHosts = "known hosts"
+	}
+	if cfg.Token == "" {
+		cfg.Token = "token"
+	}
+}
+
+// Request is a request received by a Server.
+type Request struct {
+	Path   string
+	Header http.Header
+	// PublicKey and Labels are the ones of signing requests.
+	PublicKey string
+	Labels    map[string]string
+	// Code is the one of enrollment requests.
+	Code string
+	// Version and Features are the ones of capability reports.
+	Version  string
+	Features []string
+}
+
+// Server is a mock PDC API. It is closed when the test ends.
+type Server struct {
+	*httptest.Server
+	// CA signs the certificates, unless changed with Update.
+	CA ssh.Signer
+
+	mu       sync.Mutex
+	cfg      Config
+	requests []Request
+}
+
+// NewServer starts a Server responding according to cfg.
+func NewServer(t testing.TB, cfg Config) *Server {
+	t.Helper()
+
+	cfg.setDefaults()
+	if cfg.CA == nil {
+		cfg.CA = NewCA(t)
+	}
+	s := &Server{CA: cfg.CA, cfg: cfg}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// APIURL returns the URL of the server, to set as the URL of a pdc.Config.
+func (s *Server) APIURL() *url.URL {
+	u, _ := url.Parse(s.URL)
+	return u
+}
+
+// Update changes the responses of the server.
+func (s *Server) Update(update func(cfg *Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&s.cfg)
+	s.cfg.setDefaults()
+}
+
+// Requests returns the requests received by the server.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || (r.URL.Path != SignPublicKeyPath && r.URL.Path != EnrollPath && r.URL.Path != CapabilitiesPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	body := struct {
+		PublicKey string            `json:"publicKey"`
+		Labels    map[string]string `json:"labels"`
+		Code      string            `json:"code"`
+		Version   string            `json:"version"`
+		Features  []string          `json:"features"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	cfg := s.cfg
+	s.requests = append(s.requests, Request{Path: r.URL.Path, Header: r.Header.Clone(), PublicKey: body.PublicKey, Labels: body.Labels, Code: body.Code, Version: body.Version, Features: body.Features})
+	s.mu.Unlock()
+
+	if cfg.Latency > 0 {
+		select {
+		case <-time.After(cfg.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if cfg.StatusCode != http.StatusOK {
+		w.WriteHeader(cfg.StatusCode)
+		return
+	}
+
+	var resp any
+	switch r.URL.Path {
+	case EnrollPath:
+		resp = map[string]string{"token": cfg.Token}
+	case CapabilitiesPath:
+		resp = map[string]string{}
+	default:
+		now := time.Now()
+		cert, err := SignCert(cfg.CA, []byte(body.PublicKey), cfg.Principals, now.Add(cfg.ValidAfter), now.Add(cfg.ValidBefore))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp = map[string]string{
+			"known_hosts": cfg.KnownHosts,
+			"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ssh.MarshalAuthorizedKey(cert)})),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// NewCA returns a new certificate authority.
+func NewCA(t testing.TB) ssh.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// SignCert returns a user certificate for the public key in authorized keys
+// format, signed by ca, as the PDC API does.
+func SignCert(ca ssh.Signer, pubKey []byte, principals []string, validAfter, validBefore time.Time) (*ssh.Certificate, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             pk,
+		CertType:        ssh.UserCert,
+		KeyId:           "key",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
@@ -0,0 +1,65 @@
+package pdctest_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/pdctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func publicKey(t *testing.T) []byte {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return ssh.MarshalAuthorizedKey(sshPub)
+}
+
+func TestServer(t *testing.T) {
+	srv := pdctest.NewServer(t, pdctest.Config{Principals: []string{"a", "b"}, KnownHosts: "gateway ssh-ed25519 AAAA"})
+	client, err := pdc.NewClient(&pdc.Config{URL: srv.APIURL(), Token: "token", HostedGrafanaID: "1", Labels: map[string]string{"env": "test"}}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	resp, err := client.SignSSHKey(context.Background(), publicKey(t))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, resp.Certificate.ValidPrincipals)
+	assert.Equal(t, srv.CA.PublicKey().Marshal(), resp.Certificate.SignatureKey.Marshal())
+	assert.Equal(t, "gateway ssh-ed25519 AAAA", string(resp.KnownHosts))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), time.Unix(int64(resp.Certificate.ValidBefore), 0), time.Minute)
+
+	enrolled, err := client.Enroll(context.Background(), "code")
+	require.NoError(t, err)
+	assert.Equal(t, "token", enrolled.Token)
+
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, pdctest.SignPublicKeyPath, requests[0].Path)
+	assert.Equal(t, map[string]string{"env": "test"}, requests[0].Labels)
+	assert.NotEmpty(t, requests[0].Header.Get("Authorization"))
+	assert.Equal(t, pdctest.EnrollPath, requests[1].Path)
+	assert.Equal(t, "code", requests[1].Code)
+
+	srv.Update(func(cfg *pdctest.Config) { cfg.StatusCode = http.StatusUnauthorized })
+	_, err = client.SignSSHKey(context.Background(), publicKey(t))
+	assert.ErrorIs(t, err, pdc.ErrInvalidCredentials)
+}
+
+func TestServer_Latency(t *testing.T) {
+	srv := pdctest.NewServer(t, pdctest.Config{Latency: 200 * time.Millisecond})
+	client, err := pdc.NewClient(&pdc.Config{URL: srv.APIURL()}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = client.SignSSHKey(context.Background(), publicKey(t))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
@@ -1,12 +1,44 @@
 package random
 
 import (
+	"crypto/rand"
 	"fmt"
-	"math/rand"
+	"math/big"
+	mathrand "math/rand"
 )
 
+// Source is a source of random numbers. Int63n returns a number in [0, n).
+type Source interface {
+	Int63n(n int64) int64
+}
+
+// Crypto is a Source backed by crypto/rand. It is the default source.
+var Crypto Source = cryptoSource{}
+
+type cryptoSource struct{}
+
+func (cryptoSource) Int63n(n int64) int64 {
+	v, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		// crypto/rand only fails if the OS cannot provide randomness.
+		panic(fmt.Sprintf("reading random numbers: %s", err))
+	}
+	return v.Int64()
+}
+
+// NewSeeded returns a deterministic Source, for tests. It must not be used
+// by concurrent goroutines.
+func NewSeeded(seed int64) Source {
+	return mathrand.New(mathrand.NewSource(seed))
+}
+
 // Generates a number between min and max inclusive.
 func Range(min, max int) int {
+	return RangeFrom(Crypto, min, max)
+}
+
+// RangeFrom generates a number between min and max inclusive from src.
+func RangeFrom(src Source, min, max int) int {
 	if min > max {
 		panic(fmt.Sprintf("min cannot be greater than max: min=%d max=%d", min, max))
 	}
@@ -15,6 +47,6 @@ func Range(min, max int) int {
 		return min
 	}
 
-	n := min + rand.Intn(max-min+1)
+	n := min + int(src.Int63n(int64(max-min+1)))
 	return n
 }
@@ -41,3 +41,16 @@ func TestRange(t *testing.T) {
 		assert.True(t, n <= max)
 	}))
 }
+
+func TestRangeFrom_Seeded(t *testing.T) {
+	draw := func() []int {
+		src := NewSeeded(42)
+		n := make([]int, 10)
+		for i := range n {
+			n[i] = RangeFrom(src, 0, 1000)
+		}
+		return n
+	}
+
+	assert.Equal(t, draw(), draw())
+}
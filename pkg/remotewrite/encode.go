@@ -0,0 +1,125 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type label struct {
+	name, value string
+}
+
+type sample struct {
+	labels []label
+	value  float64
+}
+
+// encodeWriteRequest encodes families as a prometheus.WriteRequest protobuf
+// message, with one sample per series at now.
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(families []*dto.MetricFamily, extLabels map[string]string, now time.Time) []byte {
+	var req []byte
+	for _, s := range samples(families, extLabels) {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(now.UnixMilli()))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sb)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+// samples flattens families into series, the way Prometheus scrapes them:
+// histograms and summaries are split into their _bucket or quantile, _sum
+// and _count series.
+func samples(families []*dto.MetricFamily, extLabels map[string]string) []sample {
+	var out []sample
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			add := func(suffix string, value float64, extra ...label) {
+				out = append(out, sample{labels: seriesLabels(name+suffix, m.GetLabel(), extLabels, extra), value: value})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+				}
+				add("_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return out
+}
+
+// seriesLabels returns the sorted labels of a series. Metric labels take
+// precedence over extLabels.
+func seriesLabels(name string, metricLabels []*dto.LabelPair, extLabels map[string]string, extra []label) []label {
+	m := make(map[string]string, len(extLabels)+len(metricLabels)+len(extra)+1)
+	for k, v := range extLabels {
+		m[k] = v
+	}
+	for _, lp := range metricLabels {
+		m[lp.GetName()] = lp.GetValue()
+	}
+	for _, l := range extra {
+		m[l.name] = l.value
+	}
+	m["__name__"] = name
+
+	labels := make([]label, 0, len(m))
+	for k, v := range m {
+		labels = append(labels, label{k, v})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
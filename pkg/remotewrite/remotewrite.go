@@ -0,0 +1,157 @@
+// Package remotewrite pushes the agent metrics to a Prometheus remote write
+// endpoint, such as the one of a Grafana Cloud Prometheus instance.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Config configures the remote write push.
+type Config struct {
+	URL          string
+	Username     string
+	Password     string
+	PasswordFile string
+	Interval     time.Duration
+	Timeout      time.Duration
+}
+
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.URL, "metrics.remote-write-url", "", "the URL of a Prometheus remote write endpoint to push the agent metrics to, e.g. the one of a Grafana Cloud Prometheus instance. Disabled if empty")
+	fs.StringVar(&cfg.Username, "metrics.remote-write-username", "", "the basic auth username of the remote write endpoint. For Grafana Cloud, the Prometheus instance ID")
+	fs.StringVar(&cfg.Password, "metrics.remote-write-password", "", "the basic auth password of the remote write endpoint. For Grafana Cloud, a token with the metrics:write scope")
+	fs.StringVar(&cfg.PasswordFile, "metrics.remote-write-password-file", "", "the path of a file containing the basic auth password of the remote write endpoint")
+	fs.DurationVar(&cfg.Interval, "metrics.remote-write-interval", time.Minute, "how often the metrics are pushed")
+	fs.DurationVar(&cfg.Timeout, "metrics.remote-write-timeout", 30*time.Second, "the timeout of a push")
+}
+
+// Secrets returns the values which must never be logged. The password file
+// is read here, as the logger redacting them is set up before NewPusher, which
+// reports a file which cannot be read.
+func (cfg *Config) Secrets() []string {
+	var secrets []string
+	if cfg.Password != "" {
+		secrets = append(secrets, cfg.Password)
+	}
+	if password, err := cfg.password(); err == nil && password != "" && password != cfg.Password {
+		secrets = append(secrets, password)
+	}
+	return secrets
+}
+
+// password returns the basic auth password, read from -metrics.remote-write-password-file if set.
+func (cfg *Config) password() (string, error) {
+	if cfg.PasswordFile == "" {
+		return cfg.Password, nil
+	}
+	data, err := os.ReadFile(cfg.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("reading remote write password file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Pusher periodically pushes the metrics of a gatherer.
+type Pusher struct {
+	cfg      Config
+	url      string
+	password string
+	gatherer prometheus.Gatherer
+	labels   map[string]string
+	logger   log.Logger
+	client   *http.Client
+}
+
+// NewPusher returns a Pusher of the metrics of gatherer. labels are added to
+// every series.
+func NewPusher(cfg Config, gatherer prometheus.Gatherer, labels map[string]string, logger log.Logger) (*Pusher, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid -metrics.remote-write-url %q", cfg.URL)
+	}
+	if cfg.Interval <= 0 {
+		return nil, errors.New("-metrics.remote-write-interval must be positive")
+	}
+
+	password, err := cfg.password()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pusher{
+		cfg:      cfg,
+		url:      u.String(),
+		password: password,
+		gatherer: gatherer,
+		labels:   labels,
+		logger:   logger,
+		client:   &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// Run pushes the metrics every interval until ctx is done.
+func (p *Pusher) Run(ctx context.Context) {
+	level.Info(p.logger).Log("msg", "pushing metrics to remote write endpoint", "url", p.url, "interval", p.cfg.Interval)
+
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.Push(ctx); err != nil {
+			level.Warn(p.logger).Log("msg", "could not push metrics to remote write endpoint", "err", err)
+		}
+	}
+}
+
+// Push gathers the metrics and sends them in one remote write request.
+func (p *Pusher) Push(ctx context.Context) error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics: %w", err)
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(families, p.labels, time.Now()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.cfg.Username != "" || p.password != "" {
+		req.SetBasicAuth(p.cfg.Username, p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package remotewrite
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testRegistry(t *testing.T) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "test"}, []string{"result"})
+	c.WithLabelValues("ok").Add(3)
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "test", Buckets: []float64{1}})
+	h.Observe(0.5)
+	h.Observe(2)
+	require.NoError(t, reg.Register(c))
+	require.NoError(t, reg.Register(h))
+
+	return reg
+}
+
+func TestSamples(t *testing.T) {
+	families, err := testRegistry(t).Gather()
+	require.NoError(t, err)
+
+	expected := []sample{
+		{labels: []label{{"__name__", "test_seconds_bucket"}, {"job", "pdc-agent"}, {"le", "1"}}, value: 1},
+		{labels: []label{{"__name__", "test_seconds_bucket"}, {"job", "pdc-agent"}, {"le", "+Inf"}}, value: 2},
+		{labels: []label{{"__name__", "test_seconds_sum"}, {"job", "pdc-agent"}}, value: 2.5},
+		{labels: []label{{"__name__", "test_seconds_count"}, {"job", "pdc-agent"}}, value: 2},
+		{labels: []label{{"__name__", "test_total"}, {"job", "pdc-agent"}, {"result", "ok"}}, value: 3},
+	}
+	assert.Equal(t, expected, samples(families, map[string]string{"job": "pdc-agent"}))
+}
+
+func TestPusher_Push(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "123", user)
+		assert.Equal(t, "secret", password)
+
+		compressed, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		body, err = snappy.Decode(nil, compressed)
+		assert.NoError(t, err)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(ts.Close)
+
+	cfg := Config{URL: ts.URL, Username: "123", Password: "secret", Interval: 1}
+	p, err := NewPusher(cfg, testRegistry(t), nil, log.NewNopLogger())
+	require.NoError(t, err)
+	require.NoError(t, p.Push(context.Background()))
+
+	// The request has one TimeSeries field per series.
+	series := 0
+	for len(body) > 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		require.GreaterOrEqual(t, n, 0)
+		assert.Equal(t, protowire.Number(1), num)
+		assert.Equal(t, protowire.BytesType, typ)
+		_, m := protowire.ConsumeBytes(body[n:])
+		require.GreaterOrEqual(t, m, 0)
+		body = body[n+m:]
+		series++
+	}
+	assert.Equal(t, 5, series)
+}
+
+func TestPusher_PushError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+	}))
+	t.Cleanup(ts.Close)
+
+	p, err := NewPusher(Config{URL: ts.URL, Interval: 1}, testRegistry(t), nil, log.NewNopLogger())
+	require.NoError(t, err)
+	assert.EqualError(t, p.Push(context.Background()), "unexpected response 401: invalid credentials")
+}
+
+func TestConfig_Secrets(t *testing.T) {
+	assert.Empty(t, (&Config{}).Secrets())
+	assert.Equal(t, []string{"secret"}, (&Config{Password: "secret"}).Secrets())
+
+	// The password file is read, as the logger is set up before the pusher.
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("file-secret\n"), 0o600))
+	assert.Equal(t, []string{"file-secret"}, (&Config{PasswordFile: passwordFile}).Secrets())
+}
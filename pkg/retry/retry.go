@@ -1,37 +1,120 @@
 package retry
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"time"
 
 	"github.com/grafana/pdc-agent/pkg/random"
 )
 
+// Jitter is how the delay before a retry is randomized, so that many clients
+// failing at once do not retry in lockstep. See
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/.
+type Jitter int
+
+const (
+	// FullJitter waits a random delay between 0 and the exponential backoff.
+	FullJitter Jitter = iota
+	// EqualJitter waits at least half of the exponential backoff.
+	EqualJitter
+	// DecorrelatedJitter waits a random delay between InitialBackoff and
+	// three times the previous delay.
+	DecorrelatedJitter
+	// NoJitter waits the exponential backoff. Useful for testing.
+	NoJitter
+)
+
 type Opts struct {
 	MaxBackoff     time.Duration
 	InitialBackoff time.Duration
+	// StableAfter is how long a call must run before failing to be
+	// considered successful: the backoff is then reset, so that a long-lived
+	// connection which drops is retried quickly, while one failing shortly
+	// after it is established backs off. Disabled if 0.
+	StableAfter time.Duration
+	// Jitter defaults to FullJitter.
+	Jitter Jitter
+	// OnWait, if set, is called with the error of a failed call and the
+	// delay before the next one.
+	OnWait func(attempt int, err error, d time.Duration)
+	// Random is the source of the jitter. Defaults to random.Crypto.
+	Random random.Source
+	// MaxAttempts and MaxElapsed are the retry budget: Forever gives up
+	// once MaxAttempts calls failed, or calls have been failing for
+	// MaxElapsed, since the first one or the last stable one. Unlimited if 0.
+	MaxAttempts int
+	MaxElapsed  time.Duration
 }
 
+// ErrBudgetExhausted is returned by Forever when it gives up.
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// Overridden in tests.
+var sleep = time.Sleep
+
 // Calls a function until it succeeds, waiting an exponentially increasing amount of time between calls.
 // An initial backoff of 0 means the waiting time does not increase exponentially (useful for testing).
-func Forever(opts Opts, f func() error) {
+// It returns an error wrapping ErrBudgetExhausted and the last error if the
+// retry budget of opts is exhausted, nil otherwise.
+func Forever(opts Opts, f func() error) error {
 	attempt := 1
+	prev := opts.InitialBackoff
+	failingSince := time.Now()
 
 	for {
+		start := time.Now()
 		err := f()
 		if err == nil {
-			return
+			return nil
+		}
+		if opts.StableAfter > 0 && time.Since(start) >= opts.StableAfter {
+			attempt = 1
+			prev = opts.InitialBackoff
+			failingSince = start
+		}
+		if opts.MaxAttempts > 0 && attempt >= opts.MaxAttempts {
+			return fmt.Errorf("%w after %d attempts: %w", ErrBudgetExhausted, attempt, err)
+		}
+		if opts.MaxElapsed > 0 && time.Since(failingSince) >= opts.MaxElapsed {
+			return fmt.Errorf("%w after %s: %w", ErrBudgetExhausted, opts.MaxElapsed, err)
 		}
 
-		maxBackoff := opts.MaxBackoff.Seconds()
-		initialBackoff := opts.InitialBackoff.Seconds()
+		d := opts.delay(attempt, prev)
+		if opts.OnWait != nil {
+			opts.OnWait(attempt, err, d)
+		}
+		sleep(d)
 
-		max := int(min(maxBackoff, initialBackoff*math.Pow(2, float64(attempt))))
+		prev = d
+		attempt++
+	}
+}
 
-		duration := random.Range(0, max)
+// delay returns how long to wait after the attempt-th failed call, prev being
+// the previous delay.
+func (opts Opts) delay(attempt int, prev time.Duration) time.Duration {
+	backoff := time.Duration(min(opts.MaxBackoff.Seconds(), opts.InitialBackoff.Seconds()*math.Pow(2, float64(attempt))) * float64(time.Second))
 
-		time.Sleep(time.Duration(duration) * time.Second)
+	switch opts.Jitter {
+	case NoJitter:
+		return backoff
+	case EqualJitter:
+		return backoff/2 + opts.randomDuration(0, backoff/2)
+	case DecorrelatedJitter:
+		return min(opts.MaxBackoff, opts.randomDuration(opts.InitialBackoff, max(opts.InitialBackoff, 3*prev)))
+	default:
+		return opts.randomDuration(0, backoff)
+	}
+}
 
-		attempt++
+// randomDuration returns a random duration between min and max inclusive,
+// with a millisecond precision.
+func (opts Opts) randomDuration(min, max time.Duration) time.Duration {
+	src := opts.Random
+	if src == nil {
+		src = random.Crypto
 	}
+	return time.Duration(random.RangeFrom(src, int(min.Milliseconds()), int(max.Milliseconds()))) * time.Millisecond
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/grafana/pdc-agent/pkg/random"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,3 +31,130 @@ func TestForever(t *testing.T) {
 		assert.Equal(t, 1000, attempts)
 	})
 }
+
+// maxSource always returns the largest number.
+type maxSource struct{}
+
+func (maxSource) Int63n(n int64) int64 { return n - 1 }
+
+func TestForever_StableAfter(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	t.Cleanup(func() { sleep = time.Sleep })
+
+	// Three calls failing immediately, then one failing once it has been
+	// up for StableAfter, then one more failing immediately.
+	calls := 0
+	retryOpts := Opts{MaxBackoff: time.Hour, InitialBackoff: time.Second, StableAfter: 20 * time.Millisecond, Random: maxSource{}}
+	Forever(retryOpts, func() error {
+		calls++
+		switch calls {
+		case 4:
+			time.Sleep(30 * time.Millisecond)
+		case 6:
+			return nil
+		}
+		return fmt.Errorf("try again")
+	})
+
+	assert.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 2 * time.Second, 4 * time.Second}, slept)
+}
+
+func TestOpts_Delay(t *testing.T) {
+	opts := Opts{MaxBackoff: 16 * time.Second, InitialBackoff: time.Second}
+
+	testcases := []struct {
+		name     string
+		jitter   Jitter
+		attempt  int
+		prev     time.Duration
+		min, max time.Duration
+	}{
+		{name: "full jitter", jitter: FullJitter, attempt: 2, min: 0, max: 4 * time.Second},
+		{name: "full jitter is capped", jitter: FullJitter, attempt: 10, min: 0, max: 16 * time.Second},
+		{name: "equal jitter", jitter: EqualJitter, attempt: 2, min: 2 * time.Second, max: 4 * time.Second},
+		{name: "decorrelated jitter", jitter: DecorrelatedJitter, attempt: 2, prev: 3 * time.Second, min: time.Second, max: 9 * time.Second},
+		{name: "decorrelated jitter is capped", jitter: DecorrelatedJitter, attempt: 2, prev: 10 * time.Second, min: time.Second, max: 16 * time.Second},
+		{name: "no jitter", jitter: NoJitter, attempt: 3, min: 8 * time.Second, max: 8 * time.Second},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts.Jitter = tc.jitter
+			opts.Random = random.NewSeeded(1)
+			for i := 0; i < 100; i++ {
+				d := opts.delay(tc.attempt, tc.prev)
+				assert.GreaterOrEqual(t, d, tc.min)
+				assert.LessOrEqual(t, d, tc.max)
+			}
+		})
+	}
+}
+
+func TestForever_OnWait(t *testing.T) {
+	var waits []time.Duration
+	calls := 0
+	retryOpts := Opts{
+		MaxBackoff: 4 * time.Millisecond, InitialBackoff: time.Millisecond, Jitter: NoJitter,
+		OnWait: func(attempt int, err error, d time.Duration) {
+			assert.Equal(t, len(waits)+1, attempt)
+			assert.EqualError(t, err, "try again")
+			waits = append(waits, d)
+		},
+	}
+	Forever(retryOpts, func() error {
+		calls++
+		if calls < 4 {
+			return fmt.Errorf("try again")
+		}
+		return nil
+	})
+
+	assert.Equal(t, []time.Duration{2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond}, waits)
+}
+
+func TestForever_Budget(t *testing.T) {
+	testcases := []struct {
+		name     string
+		opts     Opts
+		expected string
+	}{
+		{
+			name:     "max attempts",
+			opts:     Opts{MaxAttempts: 3},
+			expected: "retry budget exhausted after 3 attempts: try again",
+		},
+		{
+			name:     "max elapsed",
+			opts:     Opts{MaxElapsed: 20 * time.Millisecond},
+			expected: "retry budget exhausted after 20ms: try again",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Forever(tc.opts, func() error {
+				time.Sleep(time.Millisecond)
+				return fmt.Errorf("try again")
+			})
+			assert.ErrorIs(t, err, ErrBudgetExhausted)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+
+	t.Run("a stable call resets the budget", func(t *testing.T) {
+		calls := 0
+		err := Forever(Opts{MaxAttempts: 2, StableAfter: 10 * time.Millisecond}, func() error {
+			calls++
+			if calls == 3 {
+				return nil
+			}
+			if calls == 2 {
+				time.Sleep(20 * time.Millisecond)
+			}
+			return fmt.Errorf("try again")
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+}
@@ -0,0 +1,52 @@
+// Package sandbox restricts what the agent, and the ssh processes it starts,
+// can do once it is initialized: on Linux, Landlock only lets them write to
+// the directories of the agent, and a seccomp filter denies the system calls
+// they never need, such as ptrace, mount or the loading of kernel modules.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// ModeOff does not restrict the agent.
+	ModeOff = "off"
+	// ModeStrict applies the Landlock ruleset and the seccomp filter, and
+	// fails when the kernel does not support them.
+	ModeStrict = "strict"
+)
+
+// ErrUnsupported is returned when the sandbox cannot be applied on this
+// platform.
+var ErrUnsupported = errors.New("the sandbox is not supported")
+
+// Config is the sandbox of the agent.
+type Config struct {
+	// Mode is ModeOff or ModeStrict.
+	Mode string
+	// WritableDirs are the directories the agent writes to. They are created
+	// if they do not exist. The rest of the file system is read-only, but
+	// for /dev/null.
+	WritableDirs []string
+}
+
+// Validate returns an error if the mode is not known.
+func (cfg Config) Validate() error {
+	if cfg.Mode != ModeOff && cfg.Mode != ModeStrict {
+		return fmt.Errorf("invalid -sandbox %q: must be %q or %q", cfg.Mode, ModeOff, ModeStrict)
+	}
+	return nil
+}
+
+// Apply restricts the agent and all its threads, and the processes it starts
+// afterwards. It cannot be undone.
+func Apply(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Mode == ModeOff {
+		return nil
+	}
+	return apply(cfg)
+}
@@ -0,0 +1,211 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsReadAccess are the Landlock rights to read and execute files.
+const fsReadAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+// landlockAccess returns the file system rights restricted by the ruleset,
+// the ones known to the Landlock ABI version of the kernel.
+func landlockAccess(abi int) uint64 {
+	access := uint64(fsReadAccess |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	return access
+}
+
+// deniedSyscalls are the system calls neither the agent nor ssh make, which
+// would let a compromised process inspect other processes, or change the
+// kernel, mounts or namespaces.
+var deniedSyscalls = []uint32{
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_SETNS,
+	unix.SYS_UNSHARE,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_ACCT,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_KEYCTL,
+}
+
+// auditArch is the architecture of the system calls of the agent, as seen by
+// seccomp.
+var auditArch = map[string]uint32{
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"386":     unix.AUDIT_ARCH_I386,
+	"arm":     unix.AUDIT_ARCH_ARM,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"s390x":   unix.AUDIT_ARCH_S390X,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+}
+
+const (
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+	// x32SyscallBit is set in the numbers of the x32 system calls, which
+	// have the architecture of amd64.
+	x32SyscallBit = 0x40000000
+)
+
+func apply(cfg Config) error {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("%w on %s", ErrUnsupported, runtime.GOARCH)
+	}
+
+	ruleset, err := landlockRuleset(cfg.WritableDirs)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(ruleset)
+
+	// Required to restrict the agent without CAP_SYS_ADMIN. Setuid binaries
+	// started by ssh, such as ssh-keysign, lose their privileges.
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %w", err)
+	}
+	if err := allThreads(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); err != nil {
+		return fmt.Errorf("applying the Landlock ruleset: %w", err)
+	}
+
+	filter := seccompFilter(arch)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	err = allThreads(unix.SYS_PRCTL, unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if err != nil {
+		return fmt.Errorf("applying the seccomp filter: %w", err)
+	}
+	return nil
+}
+
+// allThreads makes a system call on every thread of the agent: Landlock and
+// seccomp restrict the calling thread only.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("%w: the agent must be built with CGO_ENABLED=0", ErrUnsupported)
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// landlockRuleset returns a Landlock ruleset letting the agent read the file
+// system, and write to /dev/null and to writableDirs, which are created.
+func landlockRuleset(writableDirs []string) (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return -1, fmt.Errorf("%w: the kernel does not support Landlock: %s", ErrUnsupported, errno)
+	}
+	access := landlockAccess(int(abi))
+
+	attr := unix.LandlockRulesetAttr{Access_fs: access}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("creating the Landlock ruleset: %w", errno)
+	}
+	ruleset := int(fd)
+
+	err := addPathRule(ruleset, "/", fsReadAccess)
+	if err == nil {
+		// Child processes have their output written to /dev/null.
+		err = addPathRule(ruleset, os.DevNull, unix.LANDLOCK_ACCESS_FS_READ_FILE|unix.LANDLOCK_ACCESS_FS_WRITE_FILE)
+	}
+	for _, dir := range writableDirs {
+		if err != nil {
+			break
+		}
+		if err = os.MkdirAll(dir, 0700); err == nil {
+			err = addPathRule(ruleset, dir, access)
+		}
+	}
+	if err != nil {
+		unix.Close(ruleset)
+		return -1, err
+	}
+	return ruleset, nil
+}
+
+// addPathRule allows access to path, and to the files beneath it.
+func addPathRule(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer unix.Close(fd)
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("adding the Landlock rule of %s: %w", path, errno)
+	}
+	return nil
+}
+
+// seccompFilter returns a seccomp filter denying deniedSyscalls with EPERM,
+// and the system calls of other architectures than arch.
+func seccompFilter(arch uint32) []unix.SockFilter {
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)}
+	allow := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow}
+
+	filter := []unix.SockFilter{
+		// The architecture is at offset 4 of struct seccomp_data.
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: arch, Jt: 1},
+		deny,
+		// The system call number is at offset 0.
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+	}
+	// The checks jump over the checks left and the allow instruction to
+	// the final deny instruction.
+	checks := append([]uint32{x32SyscallBit}, deniedSyscalls...)
+	for i, nr := range checks {
+		code := uint16(unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K)
+		if i == 0 {
+			code = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		}
+		filter = append(filter, unix.SockFilter{Code: code, K: nr, Jt: uint8(len(checks) - i)})
+	}
+	return append(filter, allow, deny)
+}
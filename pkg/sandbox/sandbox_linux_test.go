@@ -0,0 +1,79 @@
+package sandbox_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/grafana/pdc-agent/pkg/sandbox"
+)
+
+// sandboxedEnv is set when the test binary is run again to be sandboxed, as
+// the sandbox cannot be undone.
+const sandboxedEnv = "PDC_AGENT_TEST_SANDBOXED"
+
+func TestApply_Strict(t *testing.T) {
+	if os.Getenv(sandboxedEnv) != "" {
+		sandboxed()
+		return
+	}
+
+	writable := filepath.Join(t.TempDir(), "writable")
+	readOnly := t.TempDir()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestApply_Strict$")
+	cmd.Env = append(os.Environ(), sandboxedEnv+"="+writable+string(os.PathListSeparator)+readOnly)
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "unsupported:") {
+		t.Skipf("the sandbox is not supported: %s", out)
+	}
+	require.NoError(t, err, string(out))
+
+	assert.FileExists(t, filepath.Join(writable, "file"))
+	assert.NoFileExists(t, filepath.Join(readOnly, "file"))
+}
+
+// sandboxed applies the sandbox and checks what it allows, exiting with an
+// error if it allows too much or too little.
+func sandboxed() {
+	dirs := filepath.SplitList(os.Getenv(sandboxedEnv))
+	writable, readOnly := dirs[0], dirs[1]
+
+	err := sandbox.Apply(sandbox.Config{Mode: sandbox.ModeStrict, WritableDirs: []string{writable}})
+	if errors.Is(err, sandbox.ErrUnsupported) {
+		fmt.Printf("unsupported: %s\n", err)
+		os.Exit(0)
+	}
+	fail := func(format string, a ...any) {
+		fmt.Printf(format+"\n", a...)
+		os.Exit(1)
+	}
+	if err != nil {
+		fail("applying the sandbox: %s", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(writable, "file"), nil, 0600); err != nil {
+		fail("writing to the writable directory: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(readOnly, "file"), nil, 0600); err == nil {
+		fail("writing to a read-only directory succeeded")
+	}
+	if _, err := os.ReadFile("/proc/self/status"); err != nil {
+		fail("reading a file: %s", err)
+	}
+	if err := unix.PtraceAttach(os.Getppid()); !errors.Is(err, unix.EPERM) {
+		fail("ptrace returned %v, expecting EPERM", err)
+	}
+	if err := exec.Command("true").Run(); err != nil {
+		fail("running a command: %s", err)
+	}
+	os.Exit(0)
+}
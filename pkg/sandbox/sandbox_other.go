@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func apply(Config) error {
+	return fmt.Errorf("%w on %s", ErrUnsupported, runtime.GOOS)
+}
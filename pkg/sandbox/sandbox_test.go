@@ -0,0 +1,36 @@
+package sandbox_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/pdc-agent/pkg/sandbox"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	testcases := []struct {
+		name    string
+		mode    string
+		wantErr bool
+	}{
+		{name: "off", mode: sandbox.ModeOff},
+		{name: "strict", mode: sandbox.ModeStrict},
+		{name: "empty", mode: "", wantErr: true},
+		{name: "unknown", mode: "permissive", wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := sandbox.Config{Mode: tc.mode}.Validate()
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestApply_Off(t *testing.T) {
+	assert.NoError(t, sandbox.Apply(sandbox.Config{Mode: sandbox.ModeOff}))
+}
@@ -0,0 +1,190 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafana/pdc-agent/pkg/cloud"
+)
+
+var (
+	gcpSecretRegexp   = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+	azureSecretRegexp = regexp.MustCompile(`^([a-zA-Z0-9-]+)/([a-zA-Z0-9-]+)(?:/([a-zA-Z0-9]+))?$`)
+)
+
+// awsSecret is a secret of AWS Secrets Manager.
+type awsSecret struct {
+	id       string
+	region   string
+	endpoint string
+}
+
+func newAWSSecret(id, query string) (*awsSecret, error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AWS secret %q: %w", id, err)
+	}
+
+	region := q.Get("region")
+	// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+	if arn := strings.Split(id, ":"); region == "" && len(arn) > 3 && arn[0] == "arn" {
+		region = arn[3]
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("invalid AWS secret %q: no region, set ?region=<region> or AWS_REGION", id)
+	}
+
+	return &awsSecret{
+		id:       id,
+		region:   region,
+		endpoint: "https://secretsmanager." + region + ".amazonaws.com/",
+	}, nil
+}
+
+func (s *awsSecret) Fetch(ctx context.Context) (string, error) {
+	creds, err := cloud.LoadAWSCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": s.id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	cloud.SignV4(req, body, creds, s.region, "secretsmanager", time.Now())
+
+	var resp struct {
+		SecretString string
+	}
+	if err := do(req, &resp); err != nil {
+		return "", fmt.Errorf("fetching AWS secret %s: %w", s.id, err)
+	}
+	if resp.SecretString == "" {
+		return "", fmt.Errorf("AWS secret %s has no string value", s.id)
+	}
+	return resp.SecretString, nil
+}
+
+// gcpSecret is a secret version of GCP Secret Manager.
+type gcpSecret struct {
+	name     string
+	endpoint string
+}
+
+func newGCPSecret(name string) (*gcpSecret, error) {
+	if !gcpSecretRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid GCP secret %q, expecting projects/<project>/secrets/<secret>[/versions/<version>]", name)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	return &gcpSecret{name: name, endpoint: "https://secretmanager.googleapis.com"}, nil
+}
+
+func (s *gcpSecret) Fetch(ctx context.Context) (string, error) {
+	token, _, err := cloud.GCPAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpoint+"/v1/"+s.name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := do(req, &resp); err != nil {
+		return "", fmt.Errorf("fetching GCP secret %s: %w", s.name, err)
+	}
+	value, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("decoding GCP secret %s: %w", s.name, err)
+	}
+	return string(value), nil
+}
+
+// azureSecret is a secret of Azure Key Vault.
+type azureSecret struct {
+	name string
+	url  string
+}
+
+func newAzureSecret(ref string) (*azureSecret, error) {
+	m := azureSecretRegexp.FindStringSubmatch(ref)
+	if m == nil {
+		return nil, fmt.Errorf("invalid Azure Key Vault secret %q, expecting <vault>/<secret>[/<version>]", ref)
+	}
+
+	u := "https://" + m[1] + ".vault.azure.net/secrets/" + m[2]
+	if m[3] != "" {
+		u += "/" + m[3]
+	}
+	return &azureSecret{name: ref, url: u + "?api-version=7.4"}, nil
+}
+
+func (s *azureSecret) Fetch(ctx context.Context) (string, error) {
+	token, _, err := cloud.AzureToken(ctx, "https://vault.azure.net")
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := do(req, &resp); err != nil {
+		return "", fmt.Errorf("fetching Azure Key Vault secret %s: %w", s.name, err)
+	}
+	return resp.Value, nil
+}
+
+// do sends req and decodes the JSON response into v.
+func do(req *http.Request, v interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response: %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.New("invalid response")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Package secrets fetches secrets, such as the PDC token, from the secret
+// managers of AWS, GCP and Azure.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpClient is used to call the secret manager APIs.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Source fetches the current value of a secret.
+type Source interface {
+	Fetch(ctx context.Context) (string, error)
+}
+
+// Parse returns the Source of a secret URI:
+//
+//	awssm://<secret name or ARN>[?region=<region>]
+//	gcpsm://projects/<project>/secrets/<secret>[/versions/<version>]
+//	azkv://<vault>/<secret>[/<version>]
+func Parse(uri string) (Source, error) {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok || rest == "" {
+		return nil, fmt.Errorf("invalid secret URI %q, expecting <scheme>://<secret>", uri)
+	}
+	ref, query, _ := strings.Cut(rest, "?")
+
+	switch scheme {
+	case "awssm":
+		return newAWSSecret(ref, query)
+	case "gcpsm":
+		return newGCPSecret(ref)
+	case "azkv":
+		return newAzureSecret(ref)
+	default:
+		return nil, fmt.Errorf("invalid secret URI %q: unknown scheme %q, expecting awssm, gcpsm or azkv", uri, scheme)
+	}
+}
+
+// retryInterval is how long a failed fetch is not retried, unless the refresh
+// interval is shorter, so a secret manager outage does not make every Get
+// call it.
+const retryInterval = 30 * time.Second
+
+// Cache caches the value of a Source, which is fetched again once the
+// refresh interval elapses, so that rotated secrets are picked up.
+type Cache struct {
+	src     Source
+	refresh time.Duration
+	now     func() time.Time
+
+	// OnFetch, if set, is called with each value fetched from the source,
+	// for example to redact it from the logs. It must be set before Get is
+	// called.
+	OnFetch func(value string)
+
+	mu      sync.Mutex
+	value   string
+	fetched time.Time
+	// failed is the time of the last failed fetch, and err its error.
+	failed time.Time
+	err    error
+}
+
+// NewCache returns a Cache of src.
+func NewCache(src Source, refresh time.Duration) *Cache {
+	return &Cache{src: src, refresh: refresh, now: time.Now}
+}
+
+// Get returns the value of the secret. When fetching a new value fails, the
+// previous one is returned, so a secret manager outage does not interrupt
+// the agent, and the fetch is not retried for retryInterval.
+func (c *Cache) Get(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if !c.fetched.IsZero() && now.Sub(c.fetched) < c.refresh {
+		return c.value, nil
+	}
+	if !c.failed.IsZero() && now.Sub(c.failed) < min(retryInterval, c.refresh) {
+		return c.cached()
+	}
+
+	value, err := c.src.Fetch(ctx)
+	if err != nil {
+		c.failed, c.err = now, err
+		return c.cached()
+	}
+
+	c.value = value
+	c.fetched = now
+	c.failed, c.err = time.Time{}, nil
+	if c.OnFetch != nil {
+		c.OnFetch(value)
+	}
+	return value, nil
+}
+
+// cached returns the previous value after a failed fetch, or the error of
+// the fetch if there is none.
+func (c *Cache) cached() (string, error) {
+	if c.value != "" {
+		return c.value, nil
+	}
+	return "", c.err
+}
+
+// Invalidate makes the next Get fetch the secret, for example after it was
+// rejected because it was rotated. A failed fetch is still not retried for
+// retryInterval.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetched = time.Time{}
+}
@@ -0,0 +1,147 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+
+	testcases := []struct {
+		uri      string
+		expected Source
+		err      bool
+	}{
+		{
+			uri:      "awssm://pdc-token?region=eu-west-1",
+			expected: &awsSecret{id: "pdc-token", region: "eu-west-1", endpoint: "https://secretsmanager.eu-west-1.amazonaws.com/"},
+		},
+		{
+			uri:      "awssm://arn:aws:secretsmanager:us-east-2:123456789012:secret:pdc-token",
+			expected: &awsSecret{id: "arn:aws:secretsmanager:us-east-2:123456789012:secret:pdc-token", region: "us-east-2", endpoint: "https://secretsmanager.us-east-2.amazonaws.com/"},
+		},
+		{uri: "awssm://pdc-token", err: true},
+		{
+			uri:      "gcpsm://projects/my-project/secrets/pdc-token",
+			expected: &gcpSecret{name: "projects/my-project/secrets/pdc-token/versions/latest", endpoint: "https://secretmanager.googleapis.com"},
+		},
+		{
+			uri:      "gcpsm://projects/my-project/secrets/pdc-token/versions/3",
+			expected: &gcpSecret{name: "projects/my-project/secrets/pdc-token/versions/3", endpoint: "https://secretmanager.googleapis.com"},
+		},
+		{uri: "gcpsm://pdc-token", err: true},
+		{
+			uri:      "azkv://my-vault/pdc-token",
+			expected: &azureSecret{name: "my-vault/pdc-token", url: "https://my-vault.vault.azure.net/secrets/pdc-token?api-version=7.4"},
+		},
+		{uri: "azkv://my-vault", err: true},
+		{uri: "vault://secret/pdc", err: true},
+		{uri: "pdc-token", err: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.uri, func(t *testing.T) {
+			src, err := Parse(tc.uri)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, src)
+		})
+	}
+}
+
+func TestAWSSecret_Fetch(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request")
+		var body map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "pdc-token", body["SecretId"])
+		_, _ = w.Write([]byte(`{"Name":"pdc-token","SecretString":"token"}`))
+	}))
+	t.Cleanup(ts.Close)
+
+	src := &awsSecret{id: "pdc-token", region: "eu-west-1", endpoint: ts.URL}
+	value, err := src.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token", value)
+}
+
+type mockSource struct {
+	values []string
+	err    error
+	calls  int
+}
+
+func (m *mockSource) Fetch(_ context.Context) (string, error) {
+	m.calls++
+	if m.err != nil {
+		return "", m.err
+	}
+	value := m.values[0]
+	m.values = m.values[1:]
+	return value, nil
+}
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	src := &mockSource{values: []string{"token-1", "token-2", "token-3", "token-4"}}
+	c := NewCache(src, time.Minute)
+	c.now = func() time.Time { return now }
+	var fetched []string
+	c.OnFetch = func(value string) { fetched = append(fetched, value) }
+
+	get := func() string {
+		value, err := c.Get(context.Background())
+		require.NoError(t, err)
+		return value
+	}
+
+	assert.Equal(t, "token-1", get())
+	assert.Equal(t, "token-1", get())
+	assert.Equal(t, 1, src.calls)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, "token-2", get())
+
+	c.Invalidate()
+	assert.Equal(t, "token-3", get())
+
+	assert.Equal(t, []string{"token-1", "token-2", "token-3"}, fetched)
+
+	// The previous value is used while the secret manager is unavailable,
+	// which is not called again until retryInterval elapses.
+	src.err = errors.New("unavailable")
+	c.Invalidate()
+	calls := src.calls
+	assert.Equal(t, "token-3", get())
+	c.Invalidate()
+	assert.Equal(t, "token-3", get())
+	assert.Equal(t, calls+1, src.calls)
+
+	src.err = nil
+	now = now.Add(retryInterval)
+	assert.Equal(t, "token-4", get())
+
+	failing := &mockSource{err: errors.New("unavailable")}
+	c = NewCache(failing, time.Minute)
+	_, err := c.Get(context.Background())
+	assert.Error(t, err)
+	_, err = c.Get(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 1, failing.calls)
+}
@@ -0,0 +1,369 @@
+// Package selfupdate replaces the agent binary with the latest release.
+package selfupdate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/pdc-agent/pkg/httpclient"
+)
+
+// DefaultReleasesURL is the GitHub API endpoint of the latest release.
+const DefaultReleasesURL = "https://api.github.com/repos/grafana/pdc-agent/releases/latest"
+
+// maxDownloadSize limits the size of downloaded release assets.
+const maxDownloadSize = 200 << 20
+
+var (
+	// ErrUpToDate is returned when the latest release is not newer than the
+	// running agent.
+	ErrUpToDate = errors.New("the agent is up to date")
+	// ErrChecksumMismatch is returned when a downloaded archive does not
+	// match the checksum of the release.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// Config configures the release feed and how releases are verified.
+type Config struct {
+	ReleasesURL string
+	// PublicKey is a base64 encoded ed25519 public key. When set, the
+	// checksums file of a release must have a valid signature.
+	PublicKey string
+	// Interval is how often the agent checks for a new release in the
+	// background. Disabled if 0.
+	Interval time.Duration
+}
+
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.ReleasesURL, "self-update.releases-url", DefaultReleasesURL, "the GitHub API URL of the latest agent release")
+	fs.StringVar(&cfg.PublicKey, "self-update.public-key", "", "a base64 encoded ed25519 public key. When set, the release checksums file must be signed with it, in a .sig asset")
+	fs.DurationVar(&cfg.Interval, "self-update.interval", 0, "how often to check for a new release, and update and restart the agent. Requires -self-update.public-key. Disabled if 0")
+}
+
+// Validate returns an error if the interval is negative, or if the agent
+// would update itself in the background without verifying the signature of
+// the releases.
+func (cfg Config) Validate() error {
+	if cfg.Interval < 0 {
+		return errors.New("-self-update.interval must not be negative")
+	}
+	if cfg.Interval > 0 && cfg.PublicKey == "" {
+		return errors.New("-self-update.interval requires -self-update.public-key, so that the releases installed in the background are signed")
+	}
+	return nil
+}
+
+// Release is an agent release.
+type Release struct {
+	Version string
+	Assets  map[string]string
+}
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// Updater downloads and installs releases.
+type Updater struct {
+	cfg    Config
+	client *http.Client
+	goos   string
+	goarch string
+}
+
+// NewUpdater returns an Updater.
+func NewUpdater(cfg Config) (*Updater, error) {
+	if cfg.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cfg.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid -self-update.public-key, expecting a base64 encoded ed25519 public key")
+		}
+	}
+	return &Updater{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 5 * time.Minute, Transport: httpclient.UserAgentTransport(nil)},
+		goos:   runtime.GOOS,
+		goarch: runtime.GOARCH,
+	}, nil
+}
+
+// Latest returns the latest release. It returns ErrUpToDate if it is not
+// newer than current. An empty current version, as in development builds,
+// is older than any release.
+func (u *Updater) Latest(ctx context.Context, current string) (*Release, error) {
+	body, err := u.get(ctx, u.cfg.ReleasesURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching latest release: %w", err)
+	}
+
+	var gr githubRelease
+	if err := json.Unmarshal(body, &gr); err != nil {
+		return nil, fmt.Errorf("parsing latest release: %w", err)
+	}
+
+	rel := &Release{Version: strings.TrimPrefix(gr.TagName, "v"), Assets: map[string]string{}}
+	for _, a := range gr.Assets {
+		rel.Assets[a.Name] = a.URL
+	}
+	if current != "" && !newer(rel.Version, current) {
+		return nil, ErrUpToDate
+	}
+	return rel, nil
+}
+
+// Install downloads the archive of the release for the current platform,
+// verifies it, and atomically replaces the binary at exe with the one of the
+// archive.
+func (u *Updater) Install(ctx context.Context, rel *Release, exe string) error {
+	archiveName, archiveURL, err := u.archive(rel)
+	if err != nil {
+		return err
+	}
+	checksumsName, checksumsURL, err := checksumsAsset(rel)
+	if err != nil {
+		return err
+	}
+
+	checksums, err := u.get(ctx, checksumsURL)
+	if err != nil {
+		return fmt.Errorf("downloading checksums: %w", err)
+	}
+	if u.cfg.PublicKey != "" {
+		sigURL, ok := rel.Assets[checksumsName+".sig"]
+		if !ok {
+			return fmt.Errorf("release %s has no %s.sig signature", rel.Version, checksumsName)
+		}
+		sig, err := u.get(ctx, sigURL)
+		if err != nil {
+			return fmt.Errorf("downloading signature: %w", err)
+		}
+		if err := verifySignature(u.cfg.PublicKey, checksums, sig); err != nil {
+			return err
+		}
+	}
+
+	expected, err := findChecksum(checksums, archiveName)
+	if err != nil {
+		return err
+	}
+	archive, err := u.get(ctx, archiveURL)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", archiveName, err)
+	}
+	sum := sha256.Sum256(archive)
+	if hex.EncodeToString(sum[:]) != expected {
+		return fmt.Errorf("%s: %w", archiveName, ErrChecksumMismatch)
+	}
+
+	name := "pdc"
+	if u.goos == "windows" {
+		name = "pdc.exe"
+	}
+	binary, err := extractBinary(archiveName, archive, name)
+	if err != nil {
+		return err
+	}
+	return replaceBinary(exe, binary)
+}
+
+// archive returns the name and URL of the archive of the current platform,
+// named <project>_<version>_<os>_<arch>.tar.gz, or .zip.
+func (u *Updater) archive(rel *Release) (string, string, error) {
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		suffix := fmt.Sprintf("_%s_%s%s", u.goos, u.goarch, ext)
+		for name, url := range rel.Assets {
+			if strings.HasSuffix(name, suffix) {
+				return name, url, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("release %s has no archive for %s/%s", rel.Version, u.goos, u.goarch)
+}
+
+func checksumsAsset(rel *Release) (string, string, error) {
+	for name, url := range rel.Assets {
+		if strings.HasSuffix(name, "checksums.txt") {
+			return name, url, nil
+		}
+	}
+	return "", "", fmt.Errorf("release %s has no checksums file", rel.Version)
+}
+
+func (u *Updater) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from %s: %d", req.URL.Host, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDownloadSize))
+}
+
+// verifySignature verifies the base64 encoded ed25519 signature of data.
+func verifySignature(publicKey string, data, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return err
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), data, rawSig) {
+		return errors.New("invalid signature of the release checksums")
+	}
+	return nil
+}
+
+// findChecksum returns the SHA-256 checksum of name in a checksums file in
+// the format of sha256sum.
+func findChecksum(checksums []byte, name string) (string, error) {
+	s := bufio.NewScanner(bytes.NewReader(checksums))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[1] == name {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// extractBinary returns the content of the file called name in archive.
+func extractBinary(archiveName string, archive []byte, name string) ([]byte, error) {
+	if strings.HasSuffix(archiveName, ".zip") {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if filepath.Base(f.Name) == name {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return io.ReadAll(io.LimitReader(rc, maxDownloadSize))
+			}
+		}
+		return nil, fmt.Errorf("no %s in %s", name, archiveName)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("no %s in %s", name, archiveName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.Base(hdr.Name) == name {
+			return io.ReadAll(io.LimitReader(tr, maxDownloadSize))
+		}
+	}
+}
+
+// replaceBinary writes binary next to exe, and renames it over exe, so exe
+// is never a partially written file.
+func replaceBinary(exe string, binary []byte) error {
+	dir := filepath.Dir(exe)
+	f, err := os.CreateTemp(dir, filepath.Base(exe)+".new")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(binary); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		return os.Rename(f.Name(), exe)
+	}
+
+	// A running executable cannot be replaced on Windows, but it can be
+	// renamed. It cannot be removed until it exits.
+	old := exe + ".old"
+	_ = os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), exe); err != nil {
+		_ = os.Rename(old, exe)
+		return err
+	}
+	_ = os.Remove(old)
+	return nil
+}
+
+// newer returns true if version a is newer than version b. Versions are
+// compared by their dot separated numeric components, a pre-release suffix
+// after "-" is ignored.
+func newer(a, b string) bool {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func versionParts(v string) []int {
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}
@@ -0,0 +1,162 @@
+package selfupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewer(t *testing.T) {
+	testcases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{a: "1.0.1", b: "1.0.0", expected: true},
+		{a: "1.10.0", b: "1.9.9", expected: true},
+		{a: "2.0.0", b: "1.99.0", expected: true},
+		{a: "1.0.0", b: "1.0.0", expected: false},
+		{a: "1.0.0", b: "1.0.1", expected: false},
+		{a: "v1.2.0", b: "1.1.0", expected: true},
+		{a: "1.2.0-rc1", b: "1.2.0", expected: false},
+		{a: "1.2", b: "1.1.9", expected: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(fmt.Sprintf("%s>%s", tc.a, tc.b), func(t *testing.T) {
+			assert.Equal(t, tc.expected, newer(tc.a, tc.b))
+		})
+	}
+}
+
+func tarGz(t *testing.T, name string, content []byte) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// releaseServer serves a release of version 1.2.0 for linux/amd64. The
+// checksums file is signed with key.
+func releaseServer(t *testing.T, key ed25519.PrivateKey, archive []byte, checksum string) *httptest.Server {
+	const archiveName = "pdc-agent_1.2.0_linux_amd64.tar.gz"
+	checksums := []byte(fmt.Sprintf("%s  %s\n0000  pdc-agent_1.2.0_darwin_arm64.tar.gz\n", checksum, archiveName))
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, checksums))
+
+	mux := http.NewServeMux()
+	var ts *httptest.Server
+	mux.HandleFunc("/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"tag_name": "v1.2.0",
+			"assets": []map[string]string{
+				{"name": archiveName, "browser_download_url": ts.URL + "/archive"},
+				{"name": "pdc-agent_1.2.0_checksums.txt", "browser_download_url": ts.URL + "/checksums"},
+				{"name": "pdc-agent_1.2.0_checksums.txt.sig", "browser_download_url": ts.URL + "/sig"},
+			},
+		})
+	})
+	mux.HandleFunc("/archive", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write(archive) })
+	mux.HandleFunc("/checksums", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write(checksums) })
+	mux.HandleFunc("/sig", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(sig)) })
+	ts = httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestUpdater(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	archive := tarGz(t, "pdc", []byte("new binary"))
+	sum := sha256.Sum256(archive)
+
+	testcases := []struct {
+		name      string
+		checksum  string
+		publicKey ed25519.PublicKey
+		err       string
+	}{
+		{name: "valid release", checksum: hex.EncodeToString(sum[:])},
+		{name: "valid signature", checksum: hex.EncodeToString(sum[:]), publicKey: pub},
+		{name: "checksum mismatch", checksum: "0000", err: "pdc-agent_1.2.0_linux_amd64.tar.gz: checksum mismatch"},
+		{name: "invalid signature", checksum: hex.EncodeToString(sum[:]), publicKey: otherPub, err: "invalid signature of the release checksums"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := releaseServer(t, key, archive, tc.checksum)
+			cfg := Config{ReleasesURL: ts.URL + "/releases/latest"}
+			if tc.publicKey != nil {
+				cfg.PublicKey = base64.StdEncoding.EncodeToString(tc.publicKey)
+			}
+			u, err := NewUpdater(cfg)
+			require.NoError(t, err)
+			u.goos, u.goarch = "linux", "amd64"
+
+			_, err = u.Latest(context.Background(), "1.2.0")
+			assert.ErrorIs(t, err, ErrUpToDate)
+
+			rel, err := u.Latest(context.Background(), "1.1.0")
+			require.NoError(t, err)
+			assert.Equal(t, "1.2.0", rel.Version)
+
+			exe := filepath.Join(t.TempDir(), "pdc")
+			require.NoError(t, os.WriteFile(exe, []byte("old binary"), 0755))
+
+			err = u.Install(context.Background(), rel, exe)
+			content, readErr := os.ReadFile(exe)
+			require.NoError(t, readErr)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				assert.Equal(t, "old binary", string(content))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "new binary", string(content))
+		})
+	}
+}
+
+func TestUpdater_NoArchiveForPlatform(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ts := releaseServer(t, key, nil, "")
+
+	u, err := NewUpdater(Config{ReleasesURL: ts.URL + "/releases/latest"})
+	require.NoError(t, err)
+	u.goos, u.goarch = "plan9", "386"
+
+	rel, err := u.Latest(context.Background(), "")
+	require.NoError(t, err)
+	assert.EqualError(t, u.Install(context.Background(), rel, filepath.Join(t.TempDir(), "pdc")), "release 1.2.0 has no archive for plan9/386")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{Interval: time.Hour, PublicKey: "key"}.Validate())
+	assert.ErrorContains(t, Config{Interval: time.Hour}.Validate(), "requires -self-update.public-key")
+	assert.ErrorContains(t, Config{Interval: -time.Hour}.Validate(), "must not be negative")
+}
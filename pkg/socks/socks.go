@@ -0,0 +1,221 @@
+// Package socks implements the CONNECT command of SOCKS5 (RFC 1928),
+// without authentication, which the gateway uses to open connections
+// through the agent.
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	version5 = 5
+
+	methodNoAuth       = 0
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 1
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+// Reply codes, see RFC 1928 section 6.
+const (
+	ReplySucceeded               byte = 0
+	ReplyGeneralFailure          byte = 1
+	ReplyNotAllowed              byte = 2
+	ReplyNetworkUnreachable      byte = 3
+	ReplyHostUnreachable         byte = 4
+	ReplyConnectionRefused       byte = 5
+	ReplyTTLExpired              byte = 6
+	ReplyCommandNotSupported     byte = 7
+	ReplyAddressTypeNotSupported byte = 8
+)
+
+// ErrCommandNotSupported is returned by ReadRequest for commands other than
+// CONNECT, once the failure is replied.
+var ErrCommandNotSupported = errors.New("socks: command not supported")
+
+// ReadRequest negotiates no authentication with the client of conn, and
+// reads its CONNECT request. It returns the host:port target of the request,
+// which must be replied to with WriteReply.
+func ReadRequest(conn io.ReadWriter) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != version5 {
+		return "", fmt.Errorf("socks: unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodNoAuth {
+			method = methodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{version5, method}); err != nil {
+		return "", err
+	}
+	if method == methodNoAcceptable {
+		return "", errors.New("socks: no acceptable authentication method")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != version5 {
+		return "", fmt.Errorf("socks: unsupported version %d", req[0])
+	}
+	host, err := readAddr(conn, req[3])
+	if err != nil {
+		if errors.Is(err, errAddressTypeNotSupported) {
+			_ = WriteReply(conn, ReplyAddressTypeNotSupported, nil)
+		}
+		return "", err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != cmdConnect {
+		_ = WriteReply(conn, ReplyCommandNotSupported, nil)
+		return "", ErrCommandNotSupported
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+var errAddressTypeNotSupported = errors.New("socks: address type not supported")
+
+func readAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		return string(domain), nil
+	default:
+		return "", errAddressTypeNotSupported
+	}
+}
+
+// WriteReply replies to a request with code. bound is the address the
+// connection to the target is bound to, or nil if there is none.
+func WriteReply(w io.Writer, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+	}
+	atyp := byte(atypIPv4)
+	if len(ip) == net.IPv6len {
+		atyp = atypIPv6
+	}
+	reply := append([]byte{version5, code, 0, atyp}, ip...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+	return err
+}
+
+// Connect asks the SOCKS5 server of conn to connect to target, a host:port
+// address.
+func Connect(conn io.ReadWriter, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("socks: invalid port %q", portStr)
+	}
+
+	if _, err := conn.Write([]byte{version5, 1, methodNoAuth}); err != nil {
+		return err
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		return err
+	}
+	if method[1] != methodNoAuth {
+		return errors.New("socks: the server requires authentication")
+	}
+
+	req := []byte{version5, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("socks: host name too long: %q", host)
+		}
+		req = append(append(req, atypDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, atypIPv4), ip4...)
+	} else {
+		req = append(append(req, atypIPv6), ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if _, err := readAddr(conn, reply[3]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		return err
+	}
+	if reply[1] != ReplySucceeded {
+		return &ReplyError{Code: reply[1]}
+	}
+	return nil
+}
+
+// ReplyError is returned by Connect when the server fails the request.
+type ReplyError struct {
+	Code byte
+}
+
+func (e *ReplyError) Error() string {
+	msgs := map[byte]string{
+		ReplyGeneralFailure:          "general failure",
+		ReplyNotAllowed:              "connection not allowed by ruleset",
+		ReplyNetworkUnreachable:      "network unreachable",
+		ReplyHostUnreachable:         "host unreachable",
+		ReplyConnectionRefused:       "connection refused",
+		ReplyTTLExpired:              "TTL expired",
+		ReplyCommandNotSupported:     "command not supported",
+		ReplyAddressTypeNotSupported: "address type not supported",
+	}
+	if msg, ok := msgs[e.Code]; ok {
+		return "socks: " + msg
+	}
+	return fmt.Sprintf("socks: unknown reply code %d", e.Code)
+}
@@ -0,0 +1,111 @@
+package socks_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/socks"
+)
+
+func TestConnect(t *testing.T) {
+	testcases := []struct {
+		name   string
+		target string
+		reply  byte
+		err    string
+	}{
+		{name: "IPv4", target: "10.0.0.1:5432", reply: socks.ReplySucceeded},
+		{name: "IPv6", target: "[fd00::1]:5432", reply: socks.ReplySucceeded},
+		{name: "domain", target: "postgres.internal:5432", reply: socks.ReplySucceeded},
+		{name: "failure", target: "postgres.internal:5432", reply: socks.ReplyConnectionRefused, err: "socks: connection refused"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			done := make(chan error, 1)
+			go func() { done <- socks.Connect(client, tc.target) }()
+
+			target, err := socks.ReadRequest(server)
+			require.NoError(t, err)
+			assert.Equal(t, tc.target, target)
+			require.NoError(t, socks.WriteReply(server, tc.reply, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}))
+
+			err = <-done
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				var replyErr *socks.ReplyError
+				require.ErrorAs(t, err, &replyErr)
+				assert.Equal(t, tc.reply, replyErr.Code)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestReadRequest_RejectsUnsupportedRequests(t *testing.T) {
+	testcases := []struct {
+		name    string
+		request []byte
+		reply   []byte
+		err     string
+	}{
+		{
+			name:    "SOCKS4",
+			request: []byte{4, 1},
+			err:     "socks: unsupported version 4",
+		},
+		{
+			name:    "authentication required",
+			request: []byte{5, 1, 2},
+			reply:   []byte{5, 0xff},
+			err:     "socks: no acceptable authentication method",
+		},
+		{
+			name:    "BIND command",
+			request: []byte{5, 1, 0, 5, 2, 0, 1, 10, 0, 0, 1, 0, 80},
+			reply:   []byte{5, 0, 5, socks.ReplyCommandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0},
+			err:     socks.ErrCommandNotSupported.Error(),
+		},
+		{
+			name:    "unknown address type",
+			request: []byte{5, 1, 0, 5, 1, 0, 9},
+			reply:   []byte{5, 0, 5, socks.ReplyAddressTypeNotSupported, 0, 1, 0, 0, 0, 0, 0, 0},
+			err:     "socks: address type not supported",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &fakeConn{in: tc.request}
+			_, err := socks.ReadRequest(conn)
+			assert.EqualError(t, err, tc.err)
+			assert.Equal(t, tc.reply, conn.out)
+		})
+	}
+}
+
+// fakeConn reads in and records its writes in out.
+type fakeConn struct {
+	in  []byte
+	out []byte
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	if len(c.in) == 0 {
+		return 0, net.ErrClosed
+	}
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	c.out = append(c.out, p...)
+	return len(p), nil
+}
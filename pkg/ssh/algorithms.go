@@ -0,0 +1,87 @@
+package ssh
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// FIPSPreset selects the FIPS 140 approved algorithms in the -ssh.ciphers,
+// -ssh.kex and -ssh.macs flags.
+const FIPSPreset = "fips"
+
+var fipsCiphers = []string{
+	"aes256-gcm@openssh.com",
+	"aes128-gcm@openssh.com",
+	"aes256-ctr",
+	"aes192-ctr",
+	"aes128-ctr",
+}
+
+var fipsKexAlgorithms = []string{
+	"ecdh-sha2-nistp521",
+	"ecdh-sha2-nistp384",
+	"ecdh-sha2-nistp256",
+	"diffie-hellman-group18-sha512",
+	"diffie-hellman-group16-sha512",
+	"diffie-hellman-group14-sha256",
+}
+
+var fipsMACs = []string{
+	"hmac-sha2-512-etm@openssh.com",
+	"hmac-sha2-256-etm@openssh.com",
+	"hmac-sha2-512",
+	"hmac-sha2-256",
+}
+
+// The names of algorithms, optionally prefixed with +, - or ^ to append,
+// remove or prepend them to the ssh defaults.
+var algorithmListRegexp = regexp.MustCompile(`^[+\-^]?[a-z0-9@.\-]+(,[a-z0-9@.\-]+)*$`)
+
+// EnableFIPS restricts ssh to FIPS 140 approved algorithms. Empty algorithm
+// lists are set to the approved algorithms, and an error is returned if the
+// configured ones are not approved. The key manager generates ECDSA P-256 keys
+// instead of ed25519 keys.
+func (cfg *Config) EnableFIPS() error {
+	cfg.FIPS = true
+	for _, a := range []struct {
+		flag     string
+		list     *string
+		approved []string
+	}{
+		{flag: "-ssh.ciphers", list: &cfg.Ciphers, approved: fipsCiphers},
+		{flag: "-ssh.kex", list: &cfg.KexAlgorithms, approved: fipsKexAlgorithms},
+		{flag: "-ssh.macs", list: &cfg.MACs, approved: fipsMACs},
+	} {
+		if *a.list == "" {
+			*a.list = strings.Join(a.approved, ",")
+			continue
+		}
+		if strings.ContainsAny((*a.list)[:1], "+-^") {
+			return fmt.Errorf("%s cannot modify the default algorithms of ssh in FIPS mode", a.flag)
+		}
+		for _, name := range strings.Split(*a.list, ",") {
+			if !slices.Contains(a.approved, name) {
+				return fmt.Errorf("%s: algorithm %q is not FIPS 140 approved", a.flag, name)
+			}
+		}
+	}
+	return nil
+}
+
+// algorithmsFlag returns a flag.Func setting dst to a comma separated list of
+// algorithms, or to the FIPS approved algorithms if the value is "fips".
+func algorithmsFlag(dst *string, fips []string) func(string) error {
+	return func(s string) error {
+		if s == FIPSPreset {
+			*dst = strings.Join(fips, ",")
+			return nil
+		}
+		if !algorithmListRegexp.MatchString(s) {
+			return fmt.Errorf("invalid algorithm list %q: expecting %q or comma separated algorithm names", s, FIPSPreset)
+		}
+		*dst = s
+		return nil
+	}
+}
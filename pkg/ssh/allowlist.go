@@ -0,0 +1,173 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TargetRule allows the connections forwarded by the gateway to a host name,
+// or to a network, on a range of ports.
+type TargetRule struct {
+	// Host is a host name, or a *.domain wildcard matching its subdomains.
+	// It is empty for network rules.
+	Host    string
+	Network *net.IPNet
+	// MinPort and MaxPort are the allowed ports. All ports are allowed if
+	// both are 0.
+	MinPort int
+	MaxPort int
+}
+
+// ParseTargetRule parses a rule in the host[:port[-port]] format, where host
+// is a host name, a *.domain wildcard, an IP address or a CIDR network. IPv6
+// addresses and networks must be enclosed in square brackets.
+func ParseTargetRule(s string) (TargetRule, error) {
+	parts, err := splitForward(s)
+	if err != nil {
+		return TargetRule{}, fmt.Errorf("invalid target %q: %w", s, err)
+	}
+	if len(parts) > 2 {
+		return TargetRule{}, fmt.Errorf("invalid target %q: expecting host[:port[-port]]", s)
+	}
+
+	var r TargetRule
+	if len(parts) == 2 {
+		minPort, maxPort, isRange := strings.Cut(parts[1], "-")
+		if r.MinPort, err = parsePort(minPort, 1); err != nil {
+			return TargetRule{}, fmt.Errorf("invalid target %q: %w", s, err)
+		}
+		r.MaxPort = r.MinPort
+		if isRange {
+			if r.MaxPort, err = parsePort(maxPort, r.MinPort); err != nil {
+				return TargetRule{}, fmt.Errorf("invalid target %q: %w", s, err)
+			}
+		}
+	}
+
+	host := parts[0]
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		r.Network = network
+		return r, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return r, nil
+	}
+	host = normalizeHost(host)
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*/ ") {
+		return TargetRule{}, fmt.Errorf("invalid target %q: expecting a host name, *.domain, IP address or CIDR network", s)
+	}
+	r.Host = host
+	return r, nil
+}
+
+// String returns the rule in the format of ParseTargetRule.
+func (r TargetRule) String() string {
+	host := r.Host
+	if r.Network != nil {
+		host = r.Network.String()
+		if ones, bits := r.Network.Mask.Size(); ones == bits {
+			host = r.Network.IP.String()
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	switch {
+	case r.MinPort == 0:
+		return host
+	case r.MinPort == r.MaxPort:
+		return host + ":" + strconv.Itoa(r.MinPort)
+	default:
+		return fmt.Sprintf("%s:%d-%d", host, r.MinPort, r.MaxPort)
+	}
+}
+
+func (r TargetRule) matchesPort(port int) bool {
+	return r.MinPort == 0 || (port >= r.MinPort && port <= r.MaxPort)
+}
+
+func (r TargetRule) matchesHost(host string) bool {
+	if r.Host == "" {
+		return false
+	}
+	host = normalizeHost(host)
+	if domain, ok := strings.CutPrefix(r.Host, "*."); ok {
+		return strings.HasSuffix(host, "."+domain)
+	}
+	return host == r.Host
+}
+
+func (r TargetRule) matchesIP(ip net.IP) bool {
+	return r.Network != nil && r.Network.Contains(ip)
+}
+
+// allowlist restricts the targets of the connections forwarded by the
+// gateway. All targets are allowed if it has no rules.
+type allowlist struct {
+	rules []TargetRule
+	// lookupIP resolves the host names which no host rule allows, to check
+	// their addresses against the network rules.
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// allow returns the address to connect to for target, a host:port address,
+// or false if no rule allows it. Host names allowed by a network rule are
+// replaced by an allowed address, so they are not resolved again.
+func (a allowlist) allow(ctx context.Context, target string) (string, bool, error) {
+	if len(a.rules) == 0 {
+		return target, true, nil
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", false, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", false, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, r := range a.rules {
+			if r.matchesPort(port) && r.matchesIP(ip) {
+				return target, true, nil
+			}
+		}
+		return "", false, nil
+	}
+
+	hasNetworks := false
+	for _, r := range a.rules {
+		if !r.matchesPort(port) {
+			continue
+		}
+		if r.matchesHost(host) {
+			return target, true, nil
+		}
+		hasNetworks = hasNetworks || r.Network != nil
+	}
+	if !hasNetworks {
+		return "", false, nil
+	}
+
+	ips, err := a.lookupIP(ctx, host)
+	if err != nil {
+		return "", false, err
+	}
+	for _, ip := range ips {
+		for _, r := range a.rules {
+			if r.matchesPort(port) && r.matchesIP(ip) {
+				return net.JoinHostPort(ip.String(), portStr), true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,90 @@
+package ssh_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTargetRule(t *testing.T) {
+	mustParseCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return n
+	}
+
+	testcases := []struct {
+		name     string
+		value    string
+		expected ssh.TargetRule
+		str      string
+		err      string
+	}{
+		{
+			name:     "host name",
+			value:    "Postgres.Internal.",
+			expected: ssh.TargetRule{Host: "postgres.internal"},
+			str:      "postgres.internal",
+		},
+		{
+			name:     "wildcard with a port",
+			value:    "*.db.internal:5432",
+			expected: ssh.TargetRule{Host: "*.db.internal", MinPort: 5432, MaxPort: 5432},
+		},
+		{
+			name:     "network with a port range",
+			value:    "10.0.0.0/8:5432-5433",
+			expected: ssh.TargetRule{Network: mustParseCIDR("10.0.0.0/8"), MinPort: 5432, MaxPort: 5433},
+		},
+		{
+			name:     "IP address",
+			value:    "10.0.0.1:3306",
+			expected: ssh.TargetRule{Network: mustParseCIDR("10.0.0.1/32"), MinPort: 3306, MaxPort: 3306},
+		},
+		{
+			name:     "IPv6 network",
+			value:    "[fd00::/8]:5432",
+			expected: ssh.TargetRule{Network: mustParseCIDR("fd00::/8"), MinPort: 5432, MaxPort: 5432},
+		},
+		{
+			name:  "unbracketed IPv6 address",
+			value: "fd00::1",
+			err:   `invalid target "fd00::1": expecting host[:port[-port]]`,
+		},
+		{
+			name:  "invalid port",
+			value: "postgres:0",
+			err:   `invalid target "postgres:0": invalid port "0"`,
+		},
+		{
+			name:  "reversed port range",
+			value: "postgres:5433-5432",
+			err:   `invalid target "postgres:5433-5432": invalid port "5432"`,
+		},
+		{
+			name:  "wildcard in the middle",
+			value: "db.*.internal",
+			err:   `invalid target "db.*.internal": expecting a host name, *.domain, IP address or CIDR network`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := ssh.ParseTargetRule(tc.value)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, r)
+
+			str := tc.str
+			if str == "" {
+				str = tc.value
+			}
+			assert.Equal(t, str, r.String())
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// reportCapabilities registers Capabilities with the PDC API, with the
+// version of the ssh binary. It is called once the first ssh process is
+// healthy.
+func (s *Client) reportCapabilities(ctx context.Context) {
+	if s.cfg.Capabilities == nil || s.km == nil || s.km.client == nil || s.cfg.NoAPI {
+		return
+	}
+
+	caps := *s.cfg.Capabilities
+	if version, err := OpenSSHVersion(ctx, s.SSHCmd); err == nil {
+		caps.OpenSSHVersion = version
+	}
+
+	err := s.km.client.ReportCapabilities(pdc.WithStack(ctx, s.cfg.PDC.HostedGrafanaID), caps)
+	switch {
+	case errors.Is(err, pdc.ErrNotFound):
+		level.Debug(s.logger).Log("msg", "the PDC API does not support capability reports")
+	case err != nil:
+		level.Warn(s.logger).Log("msg", "could not report capabilities to the PDC API", "err", err)
+	default:
+		level.Debug(s.logger).Log("msg", "reported capabilities to the PDC API", "features", len(caps.Features))
+	}
+}
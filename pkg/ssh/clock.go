@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+)
+
+const (
+	// clockCheckInterval is how often the wall clock is compared with the
+	// monotonic clock.
+	clockCheckInterval = 5 * time.Second
+	// clockJumpThreshold is how far the wall clock must move away from the
+	// monotonic clock between two checks to be reported as a jump.
+	clockJumpThreshold = 5 * time.Second
+)
+
+// watchClock reports the jumps of the wall clock, every interval, until ctx
+// is done. The wall clock jumps when the host resumes from suspend, as the
+// monotonic clock stops while it sleeps, after a VM migration, or when the
+// clock is set. A jump not received before the next check is dropped.
+func watchClock(ctx context.Context, interval time.Duration) <-chan time.Duration {
+	jumps := make(chan time.Duration, 1)
+	crash.Go(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		prev := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now()
+			// Round(0) strips the monotonic reading, to compare the wall
+			// clocks.
+			jump := clockJump(prev.Round(0), now.Round(0), now.Sub(prev))
+			prev = now
+			if jump == 0 {
+				continue
+			}
+			select {
+			case jumps <- jump:
+			default:
+			}
+		}
+	})
+	return jumps
+}
+
+// clockJump returns how far the wall clock moved from prevWall to wall,
+// besides the elapsed monotonic time, or 0 when the difference is below
+// clockJumpThreshold.
+func clockJump(prevWall, wall time.Time, elapsed time.Duration) time.Duration {
+	jump := wall.Sub(prevWall) - elapsed
+	if jump > -clockJumpThreshold && jump < clockJumpThreshold {
+		return 0
+	}
+	return jump
+}
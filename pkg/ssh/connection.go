@@ -0,0 +1,416 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+	"github.com/grafana/pdc-agent/pkg/events"
+	"github.com/grafana/pdc-agent/pkg/exitcode"
+	"github.com/grafana/pdc-agent/pkg/retry"
+)
+
+// connection is an ssh process which is restarted until it is closed.
+type connection struct {
+	cancel context.CancelFunc
+
+	healthyOnce sync.Once
+	// healthy is closed once an ssh process has been up for HealthyAfter.
+	healthy chan struct{}
+	// failed is closed if a replacement connection exits before it is healthy.
+	failed chan struct{}
+}
+
+func (c *connection) markHealthy() {
+	c.healthyOnce.Do(func() { close(c.healthy) })
+}
+
+func (c *connection) isHealthy() bool {
+	select {
+	case <-c.healthy:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the connection. The ssh process is given ShutdownDrainTimeout
+// to finish in-flight queries.
+func (c *connection) close() {
+	c.cancel()
+}
+
+// connect starts an ssh connection in the background. When replacement is
+// true, the connection gives up instead of restarting if its first ssh process
+// exits before it is healthy, so the connection it replaces is kept.
+func (s *Client) connect(ctx context.Context, replacement bool) *connection {
+	connCtx, cancel := context.WithCancel(ctx)
+	c := &connection{
+		cancel:  cancel,
+		healthy: make(chan struct{}),
+		failed:  make(chan struct{}),
+	}
+
+	// Only an ssh process which was healthy resets the backoff, so one
+	// dropped shortly after it connects does not cause a reconnect storm.
+	retryOpts := retry.Opts{
+		MaxBackoff:     16 * time.Second,
+		InitialBackoff: 1 * time.Second,
+		StableAfter:    s.HealthyAfter,
+		OnWait: func(attempt int, _ error, d time.Duration) {
+			level.Info(s.logger).Log("msg", fmt.Sprintf("retrying in %s", d.Round(100*time.Millisecond)), "attempt", attempt)
+		},
+		MaxAttempts: s.cfg.RetryMaxAttempts,
+		MaxElapsed:  s.cfg.RetryMaxElapsed,
+	}
+	crash.Go(func() {
+		if err := retry.Forever(retryOpts, s.connectOnce(connCtx, c, replacement)); err != nil {
+			level.Error(s.logger).Log("msg", "giving up reconnecting", "err", err)
+			s.giveUp(fmt.Errorf("%w: %w", ErrRetryBudgetExhausted, err))
+		}
+	})
+
+	return c
+}
+
+// connectOnce returns the function retried by connect, which runs an ssh
+// process until it exits.
+func (s *Client) connectOnce(connCtx context.Context, c *connection, replacement bool) func() error {
+	return func() error {
+		defer crash.Recover()
+
+		// Flags are generated for every ssh process, so that changes such as
+		// the log level are applied on reconnect.
+		flags, err := s.SSHFlagsFromConfig()
+		if err != nil {
+			level.Error(s.logger).Log("msg", fmt.Sprintf("could not parse flags: %s", err))
+			return err
+		}
+
+		exitCode, ok := s.runSSH(connCtx, c, flags)
+		if !ok || connCtx.Err() != nil {
+			return nil // context was canceled
+		}
+
+		if replacement && !c.isHealthy() {
+			level.Warn(s.logger).Log("msg", "replacement ssh connection exited before becoming healthy", "exit_code", exitCode)
+			close(c.failed)
+			c.cancel()
+			return nil
+		}
+
+		if exitCode == ConnectionLimitReachedCode {
+			level.Info(s.logger).Log("msg", "limit of connections for stack and network reached. exiting")
+			// Sent synchronously, before the agent exits.
+			events.Send(s.cfg.Events, events.ConnectionLimit, "limit of connections for stack and network reached")
+			os.Exit(exitcode.ConnectionLimit)
+		}
+
+		level.Error(s.logger).Log("msg", "ssh client exited. restarting")
+
+		// Check keys and cert validity before restart, create new cert if required.
+		// This covers the case where a certificate has become invalid since the last start.
+		// Do not return here: we want to keep trying to connect in case the PDC API
+		// is temporarily unavailable.
+		if s.km != nil {
+			err := s.km.CreateKeys(connCtx)
+			if err != nil {
+				level.Error(s.logger).Log("msg", "could not check or generate certificate", "error", err)
+			}
+		}
+
+		return fmt.Errorf("ssh client exited")
+	}
+}
+
+// runSSH runs a single ssh process until it exits and returns its exit code.
+// It returns false if the process was not started because the client is
+// stopping.
+func (s *Client) runSSH(ctx context.Context, c *connection, flags []string) (int, bool) {
+	s.mu.Lock()
+	if s.stopped || ctx.Err() != nil {
+		s.mu.Unlock()
+		return 0, false
+	}
+	s.running.Add(1)
+	s.mu.Unlock()
+	defer s.running.Done()
+
+	cmd := exec.CommandContext(ctx, s.SSHCmd, flags...)
+	if len(s.cfg.Env) > 0 {
+		cmd.Env = append(os.Environ(), s.cfg.Env...)
+	}
+	// Use one writer per stream, so partial lines are not interleaved.
+	stdout, stderr := newLoggerWriterAdapter(s.logger), newLoggerWriterAdapter(s.logger)
+	defer stdout.Flush()
+	defer stderr.Flush()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	var hostKeyFailure, authFailure, bannerFailure atomic.Bool
+	var channels *channelTracker
+	if s.cfg.TrafficMetrics {
+		channels = newChannelTracker(s.cfg.KeyFile)
+		defer channels.close()
+	}
+	stderr.observe = func(msg string) {
+		if hostKeyFailureRegexp.MatchString(msg) {
+			hostKeyFailure.Store(true)
+		}
+		if authFailureRegexp.MatchString(msg) {
+			authFailure.Store(true)
+		}
+		if bannerFailureRegexp.MatchString(msg) {
+			bannerFailure.Store(true)
+		}
+		if channels != nil {
+			channels.observe(msg)
+		}
+	}
+	if s.cfg.ShutdownDrainTimeout > 0 {
+		// Keep the tunnel open when the context is canceled, the process is
+		// killed once the drain timeout elapses.
+		cmd.Cancel = func() error {
+			level.Info(s.logger).Log("msg", "draining ssh connection", "timeout", s.cfg.ShutdownDrainTimeout)
+			return nil
+		}
+		cmd.WaitDelay = s.cfg.ShutdownDrainTimeout
+	}
+
+	if err := cmd.Start(); err != nil {
+		level.Error(s.logger).Log("msg", "could not start ssh", "err", err)
+		s.setLastError(fmt.Sprintf("could not start ssh: %s", err))
+		return -1, true
+	}
+	pid := cmd.Process.Pid
+	s.setPID(pid, 0)
+	var connected atomic.Bool
+	healthyTimer := time.AfterFunc(s.HealthyAfter, func() {
+		c.markHealthy()
+		connected.Store(true)
+		s.setConnected(time.Now())
+		sendEvent(s.cfg.Events, events.Connected, "")
+		s.reportOnce.Do(func() { crash.Go(func() { s.reportCapabilities(ctx) }) })
+	})
+	if s.cfg.DevDropInterval > 0 {
+		dropTimer := time.AfterFunc(s.cfg.DevDropInterval, func() {
+			level.Warn(s.logger).Log("msg", "dropping ssh connection", "interval", s.cfg.DevDropInterval)
+			_ = cmd.Process.Kill()
+		})
+		defer dropTimer.Stop()
+	}
+	_ = cmd.Wait()
+	healthyTimer.Stop()
+	s.setPID(0, pid)
+
+	exitCode := cmd.ProcessState.ExitCode()
+	sshLastExitCode.WithLabelValues(s.cfg.KeyFile).Set(float64(exitCode))
+	if ctx.Err() == nil {
+		sshExits.WithLabelValues(s.cfg.KeyFile, strconv.Itoa(exitCode)).Inc()
+	}
+
+	exitMsg := fmt.Sprintf("ssh exited with code %d", exitCode)
+	if connected.Load() {
+		sendEvent(s.cfg.Events, events.Disconnected, exitMsg)
+	}
+	if authFailure.Load() {
+		exitMsg = "the gateway rejected the certificate"
+		sendEvent(s.cfg.Events, events.AuthFailed, exitMsg)
+	}
+
+	if hostKeyFailure.Load() {
+		exitMsg = "the gateway host key could not be verified"
+		hostKeyVerificationFailures.Inc()
+		level.Error(s.logger).Log("msg", "the gateway host key could not be verified, which may indicate a man-in-the-middle attack. Not connecting",
+			"known_hosts", s.cfg.KnownHostsFilePath(),
+			"strict_host_key_checking", s.cfg.StrictHostKeyChecking)
+	}
+	if bannerFailure.Load() && ctx.Err() == nil {
+		if msg := s.checkInterception(ctx); msg != "" {
+			exitMsg = msg
+		}
+	}
+	// An ssh process stopped with the client is not a failure.
+	if ctx.Err() == nil {
+		s.setLastError(exitMsg)
+	}
+
+	return exitCode, true
+}
+
+// sendEvent sends an event of type typ to sink in the background, so a slow
+// webhook does not delay the connection.
+func sendEvent(sink events.Sink, typ, msg string) {
+	if sink == nil {
+		return
+	}
+	crash.Go(func() { events.Send(sink, typ, msg) })
+}
+
+// renewLoop periodically checks the certificate and its principals, and
+// renews it when RenewCertificate is called. The certificate is also checked
+// when the wall clock jumps, as its validity window may have been crossed
+// while the host was suspended, and the connection is replaced when the wall
+// clock jumps forward, see resume. When it is renewed, a new connection using the
+// new certificate is started and replaces the current one once it is healthy,
+// so the tunnel stays up. Reconnect replaces the connection the same way.
+func (s *Client) renewLoop(ctx context.Context) {
+	defer crash.Recover()
+
+	// Provisioned certificates cannot be renewed.
+	renewable := s.km != nil && !s.cfg.NoAPI
+
+	var tick, principalTick <-chan time.Time
+	clockJumps := watchClock(ctx, clockCheckInterval)
+	// The certificate check ticker is replaced when SetCertCheckInterval is
+	// called.
+	var certTicker *time.Ticker
+	resetCertTicker := func() {
+		if certTicker != nil {
+			certTicker.Stop()
+			certTicker, tick = nil, nil
+		}
+		if d := s.certCheckInterval(); d > 0 && renewable {
+			certTicker = time.NewTicker(d)
+			tick = certTicker.C
+		}
+	}
+	resetCertTicker()
+	defer func() {
+		if certTicker != nil {
+			certTicker.Stop()
+		}
+	}()
+	if s.cfg.PrincipalCheckInterval > 0 && renewable {
+		ticker := time.NewTicker(s.cfg.PrincipalCheckInterval)
+		defer ticker.Stop()
+		principalTick = ticker.C
+	}
+
+	for {
+		var renewed bool
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.certCheckChanged:
+			resetCertTicker()
+			continue
+		case <-s.renew:
+			level.Info(s.logger).Log("msg", "renewing certificate on request")
+			err = s.km.RenewCertificate(ctx)
+			renewed = err == nil
+		case <-s.reconnect:
+			level.Info(s.logger).Log("msg", "reconnecting on request")
+			renewed = true
+		case <-tick:
+			if !s.km.certExpired() {
+				continue
+			}
+			renewed, err = s.km.RefreshKeys(ctx)
+		case jump := <-clockJumps:
+			if jump > 0 {
+				level.Info(s.logger).Log("msg", "the wall clock jumped forward, the host may have been suspended: reconnecting", "jump", jump.Round(time.Second))
+				s.resume(ctx)
+				continue
+			}
+			level.Info(s.logger).Log("msg", "the wall clock jumped, checking the certificate", "jump", jump.Round(time.Second))
+			if !renewable || !s.km.certExpired() {
+				continue
+			}
+			renewed, err = s.km.RefreshKeys(ctx)
+		case <-principalTick:
+			renewed, err = s.km.CheckPrincipals(ctx)
+		}
+
+		if err != nil {
+			level.Error(s.logger).Log("msg", "could not renew certificate", "error", err)
+			continue
+		}
+		if renewed {
+			s.replaceConnection(ctx)
+		}
+	}
+}
+
+// RenewCertificate has the certificate renewed and the connection replaced,
+// even if the certificate is still valid, for example to get the principals
+// of a changed access policy. It returns once the renewal is scheduled; its
+// outcome is logged.
+func (s *Client) RenewCertificate() error {
+	if s.km == nil || s.cfg.NoAPI {
+		return errors.New("the certificate of this tunnel cannot be renewed")
+	}
+	select {
+	case s.renew <- struct{}{}:
+	default:
+		// A renewal is already pending.
+	}
+	return nil
+}
+
+// resume tears down the connection and starts a new one, once the keys and
+// certificate are checked. After the host slept, the gateway has likely
+// dropped the connection, which ssh would only notice once its keepalives
+// time out. Unlike replaceConnection, the current connection is closed first,
+// so that it does not count towards the limit of connections.
+func (s *Client) resume(ctx context.Context) {
+	sshResumes.WithLabelValues(s.cfg.KeyFile).Inc()
+	if s.km != nil {
+		if _, err := s.km.RefreshKeys(ctx); err != nil {
+			level.Error(s.logger).Log("msg", "could not check or renew certificate", "error", err)
+		}
+	}
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.conn != nil {
+		s.conn.close()
+	}
+	s.conn = s.connect(ctx, false)
+}
+
+// Reconnect has the connection replaced by a new one, which is only used
+// once healthy, so the tunnel stays up. It returns once the reconnection is
+// scheduled; its outcome is logged.
+func (s *Client) Reconnect() {
+	select {
+	case s.reconnect <- struct{}{}:
+	default:
+		// A reconnection is already pending.
+	}
+}
+
+// replaceConnection starts a new connection and, once it is healthy, closes
+// the current one. The current connection is kept if the new one fails.
+func (s *Client) replaceConnection(ctx context.Context) {
+	level.Info(s.logger).Log("msg", "starting new ssh connection to replace the current one")
+	next := s.connect(ctx, true)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-next.failed:
+		level.Warn(s.logger).Log("msg", "keeping the current ssh connection")
+		return
+	case <-next.healthy:
+	}
+
+	s.connMu.Lock()
+	prev := s.conn
+	s.conn = next
+	s.connMu.Unlock()
+
+	if prev != nil {
+		prev.close()
+	}
+	level.Info(s.logger).Log("msg", "replaced ssh connection")
+}
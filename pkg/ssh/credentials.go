@@ -0,0 +1,108 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-kit/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Credentials are the files making the identity of an agent: its key pair,
+// certificate, known hosts and arguments hash. Moved to another host, they
+// are used without a new certificate as long as the agent runs with the same
+// arguments.
+type Credentials struct {
+	Key           []byte `json:"key"`
+	PublicKey     []byte `json:"public_key"`
+	Certificate   []byte `json:"certificate"`
+	KnownHosts    []byte `json:"known_hosts"`
+	ArgumentsHash []byte `json:"arguments_hash,omitempty"`
+}
+
+// ReadCredentials reads the credentials of the key file of cfg. The
+// arguments hash is optional.
+func ReadCredentials(cfg *Config) (*Credentials, error) {
+	km := NewKeyManager(cfg, log.NewNopLogger(), nil)
+
+	c := &Credentials{}
+	var err error
+	if c.Key, err = km.readKeyFile(); err != nil {
+		return nil, err
+	}
+	if c.PublicKey, err = km.readPubKeyFile(); err != nil {
+		return nil, err
+	}
+	if c.Certificate, err = km.readCertFile(); err != nil {
+		return nil, err
+	}
+	if c.KnownHosts, err = os.ReadFile(cfg.KnownHostsFilePath()); err != nil {
+		return nil, err
+	}
+	if c.ArgumentsHash, err = km.readHashFile(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return c, nil
+}
+
+// RemoveKeyPair removes the key pair and certificate of the key file of cfg,
+// so new ones are generated.
+func RemoveKeyPair(cfg *Config) error {
+	for _, path := range []string{cfg.KeyFile, cfg.KeyFile + ".pub", cfg.KeyFile + "-cert.pub"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wipe overwrites the private key of c once it is no longer needed.
+func (c *Credentials) Wipe() {
+	wipe(c.Key)
+}
+
+// WriteCredentials writes c to the key file of cfg, replacing the existing
+// files, once it checked that the certificate is one of the key.
+func WriteCredentials(cfg *Config, c *Credentials) error {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(c.Certificate)
+	if err != nil {
+		return fmt.Errorf("parsing certificate: %w", err)
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return errors.New("certificate is incorrect format")
+	}
+	if err := verifyCertForKey(cert, c.Key); err != nil {
+		return err
+	}
+	if _, _, _, _, _, err := ssh.ParseKnownHosts(c.KnownHosts); err != nil {
+		return fmt.Errorf("parsing known hosts: %w", err)
+	}
+
+	if err := os.MkdirAll(cfg.KeyFileDir(), 0700); err != nil {
+		return err
+	}
+
+	km := NewKeyManager(cfg, log.NewNopLogger(), nil)
+	if err := km.writeKeyFile(c.Key); err != nil {
+		return err
+	}
+	if err := km.writePubKeyFile(c.PublicKey); err != nil {
+		return err
+	}
+	if err := km.writeCertFile(c.Certificate); err != nil {
+		return err
+	}
+	if err := km.writeKnownHostsFile(c.KnownHosts); err != nil {
+		return err
+	}
+	if len(c.ArgumentsHash) == 0 {
+		// Without a hash, the agent gets a new certificate on start.
+		if err := os.Remove(cfg.HashFilePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return km.writeHashFile(c.ArgumentsHash)
+}
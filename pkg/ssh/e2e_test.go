@@ -0,0 +1,241 @@
+package ssh_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/pdctest"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestE2E runs the agent lifecycle against the mock PDC API and an
+// in-process gateway, with the ssh binary of the host.
+func TestE2E(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh binary not found")
+	}
+
+	ca := pdctest.NewCA(t)
+	gw := pdctest.NewGateway(t, ca)
+	api := pdctest.NewServer(t, pdctest.Config{CA: ca, KnownHosts: gw.KnownHosts(), Principals: []string{"network"}})
+
+	cfg := ssh.DefaultConfig()
+	cfg.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+	cfg.URL = mustParseURL("127.0.0.1")
+	cfg.Port = gw.Port()
+	cfg.LogLevel = 0
+	cfg.CertCheckInterval = 100 * time.Millisecond
+	cfg.PDC = pdc.Config{URL: api.APIURL(), HostedGrafanaID: "1", Token: "token"}
+	cfg.Capabilities = &pdc.Capabilities{Version: "test", Features: []string{"e2e"}}
+
+	logger := log.NewNopLogger()
+	pdcClient, err := pdc.NewClient(&cfg.PDC, logger)
+	require.NoError(t, err)
+	client := ssh.NewClient(cfg, logger, ssh.NewKeyManager(cfg, logger, pdcClient))
+	client.HealthyAfter = 200 * time.Millisecond
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(ctx, client)
+	})
+
+	t.Log("connect")
+	require.Eventually(t, func() bool { return gw.Active() == 1 }, 10*time.Second, 50*time.Millisecond)
+	conn := gw.Connections()[0]
+	assert.Equal(t, "1", conn.User)
+	assert.Equal(t, []string{"network"}, conn.Principals)
+
+	t.Log("report the capabilities of the agent")
+	require.Eventually(t, func() bool { return len(apiRequests(api, pdctest.CapabilitiesPath)) == 1 }, 10*time.Second, 50*time.Millisecond)
+	report := apiRequests(api, pdctest.CapabilitiesPath)[0]
+	assert.Equal(t, "test", report.Version)
+	assert.Equal(t, []string{"e2e"}, report.Features)
+
+	t.Log("forward a connection to the agent network")
+	echo := startEchoServer(t)
+	require.Eventually(t, func() bool { return len(gw.Forwards()) == 1 }, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "ping", socks5Roundtrip(t, gw.Forwards()[0], echo, "ping"))
+
+	t.Log("reconnect once the connection drops")
+	gw.Drop()
+	require.Eventually(t, func() bool {
+		return len(gw.Connections()) == 2 && gw.Active() == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	t.Log("replace the connection on request")
+	client.Reconnect()
+	require.Eventually(t, func() bool {
+		return len(gw.Connections()) == 3 && gw.Active() == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	t.Log("renew the certificate once it expires")
+	api.Update(func(cfg *pdctest.Config) { cfg.ValidBefore = 2 * time.Second })
+	require.NoError(t, client.RenewCertificate())
+	signed := len(apiRequests(api, pdctest.SignPublicKeyPath))
+	require.Eventually(t, func() bool {
+		// The short-lived certificate is renewed once it expires, and the
+		// connection replaced.
+		return len(apiRequests(api, pdctest.SignPublicKeyPath)) > signed+1 && len(gw.Connections()) >= 5 && gw.Active() == 1
+	}, 15*time.Second, 50*time.Millisecond)
+
+	// The capabilities are reported once, not on every connection.
+	assert.Len(t, apiRequests(api, pdctest.CapabilitiesPath), 1)
+}
+
+// apiRequests returns the requests api received on path.
+func apiRequests(api *pdctest.Server, path string) []pdctest.Request {
+	var reqs []pdctest.Request
+	for _, r := range api.Requests() {
+		if r.Path == path {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// startEchoServer starts a TCP server writing back what it reads.
+func startEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// socks5Roundtrip connects to target through the SOCKS5 proxy of the agent
+// at proxy, sends msg and returns the response.
+func socks5Roundtrip(t *testing.T, proxy, target, msg string) string {
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// No authentication.
+	_, err = conn.Write([]byte{5, 1, 0})
+	require.NoError(t, err)
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 0}, reply)
+
+	addr, err := net.ResolveTCPAddr("tcp", target)
+	require.NoError(t, err)
+	req := append([]byte{5, 1, 0, 1}, addr.IP.To4()...)
+	req = append(req, byte(addr.Port>>8), byte(addr.Port))
+	_, err = conn.Write(req)
+	require.NoError(t, err)
+	reply = make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, byte(0), reply[1], "SOCKS5 connect failed")
+
+	_, err = conn.Write([]byte(msg))
+	require.NoError(t, err)
+	resp := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(t, err)
+	return string(resp)
+}
+
+func TestE2E_TrafficMetrics(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh binary not found")
+	}
+
+	ca := pdctest.NewCA(t)
+	gw := pdctest.NewGateway(t, ca)
+	api := pdctest.NewServer(t, pdctest.Config{CA: ca, KnownHosts: gw.KnownHosts(), Principals: []string{"network"}})
+
+	cfg := ssh.DefaultConfig()
+	cfg.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+	cfg.URL = mustParseURL("127.0.0.1")
+	cfg.Port = gw.Port()
+	cfg.LogLevel = 0
+	cfg.TrafficMetrics = true
+	// The forwarded connections are served by the agent rather than ssh.
+	cfg.MaxChannels = 4
+	cfg.PDC = pdc.Config{URL: api.APIURL(), HostedGrafanaID: "1", Token: "token"}
+
+	logger := log.NewNopLogger()
+	pdcClient, err := pdc.NewClient(&cfg.PDC, logger)
+	require.NoError(t, err)
+	client := ssh.NewClient(cfg, logger, ssh.NewKeyManager(cfg, logger, pdcClient))
+	client.HealthyAfter = 200 * time.Millisecond
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(ctx, client)
+	})
+
+	t.Log("connect through the relay, checking the gateway host key")
+	require.Eventually(t, func() bool { return gw.Active() == 1 }, 10*time.Second, 50*time.Millisecond)
+	sent := tunnelMetric(t, "pdc_agent_tunnel_sent_bytes_total", cfg.KeyFile)
+	assert.Greater(t, sent, 0.0)
+	assert.Greater(t, tunnelMetric(t, "pdc_agent_tunnel_received_bytes_total", cfg.KeyFile), 0.0)
+	if runtime.GOOS == "linux" {
+		assert.Greater(t, tunnelMetric(t, "pdc_agent_ssh_process_resident_memory_bytes", cfg.KeyFile), 0.0)
+		assert.Greater(t, tunnelMetric(t, "pdc_agent_ssh_process_open_fds", cfg.KeyFile), 0.0)
+	}
+
+	t.Log("count the forwarded channels and their traffic")
+	echo := startEchoServer(t)
+	require.Eventually(t, func() bool { return len(gw.Forwards()) == 1 }, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "ping", socks5Roundtrip(t, gw.Forwards()[0], echo, "ping"))
+	require.Eventually(t, func() bool {
+		return tunnelMetric(t, "pdc_agent_tunnel_channels_opened_total", cfg.KeyFile) == 1 &&
+			tunnelMetric(t, "pdc_agent_tunnel_channels_closed_total", cfg.KeyFile) == 1
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 0.0, tunnelMetric(t, "pdc_agent_tunnel_channels_active", cfg.KeyFile))
+	assert.Greater(t, tunnelMetric(t, "pdc_agent_tunnel_sent_bytes_total", cfg.KeyFile), sent)
+}
+
+// tunnelMetric returns the value of the metric name of keyFile.
+func tunnelMetric(t *testing.T, name, keyFile string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "key_file" && l.GetValue() == keyFile {
+					return m.GetCounter().GetValue() + m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
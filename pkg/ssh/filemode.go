@@ -0,0 +1,76 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultFileMode is the mode of the files written by the key manager, when
+// Config does not set one.
+const defaultFileMode os.FileMode = 0600
+
+// fileModeValue is a flag.Value of an octal file mode. Group and world
+// permissions are rejected unless allowOthers is set: ssh refuses to use a
+// private key which other users can access.
+type fileModeValue struct {
+	mode        *os.FileMode
+	allowOthers bool
+}
+
+func (v fileModeValue) String() string {
+	if v.mode == nil {
+		// The zero value, used by flag to tell whether a default is set.
+		return fmt.Sprintf("%04o", 0)
+	}
+	return fmt.Sprintf("%04o", *v.mode)
+}
+
+func (v fileModeValue) Set(s string) error {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return fmt.Errorf("invalid file mode %q: expecting an octal mode such as 0600", s)
+	}
+	if m&0400 == 0 {
+		return fmt.Errorf("invalid file mode %q: the agent must be able to read the file", s)
+	}
+	if !v.allowOthers && m&0077 != 0 {
+		return fmt.Errorf("invalid file mode %q: ssh refuses to use a private key which other users can access", s)
+	}
+	*v.mode = os.FileMode(m)
+	return nil
+}
+
+// modeOr returns mode, or defaultFileMode if it is not set.
+func modeOr(mode os.FileMode) os.FileMode {
+	if mode == 0 {
+		return defaultFileMode
+	}
+	return mode
+}
+
+// writeFile replaces the file at path with data, with mode whatever the
+// umask. data is written to a new file, created exclusively in the same
+// directory, which is renamed to path, so the file is never partially
+// written, and never left with the mode of a previous file.
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	// CreateTemp creates the file with 0600 permissions, less the umask.
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,117 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Forward is a port forward set up by ssh alongside the tunnel, equivalent to
+// the -L and -R flags of ssh.
+type Forward struct {
+	// Remote is true for forwards from the gateway to the agent network (-R),
+	// and false for forwards from the agent host to the gateway (-L).
+	Remote      bool
+	BindAddress string
+	Port        int
+	Host        string
+	HostPort    int
+}
+
+// ParseForward parses a forward in the [bind_address:]port:host:hostport
+// format of ssh. IPv6 addresses must be enclosed in square brackets.
+func ParseForward(s string, remote bool) (Forward, error) {
+	parts, err := splitForward(s)
+	if err != nil {
+		return Forward{}, fmt.Errorf("invalid forward %q: %w", s, err)
+	}
+
+	f := Forward{Remote: remote}
+	switch len(parts) {
+	case 3:
+	case 4:
+		f.BindAddress, parts = parts[0], parts[1:]
+	default:
+		return Forward{}, fmt.Errorf("invalid forward %q: expecting [bind_address:]port:host:hostport", s)
+	}
+
+	minPort := 1
+	if remote {
+		// ssh allocates a port on the gateway for remote forwards to port 0.
+		minPort = 0
+	}
+	if f.Port, err = parsePort(parts[0], minPort); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward %q: %w", s, err)
+	}
+	if f.HostPort, err = parsePort(parts[2], 1); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward %q: %w", s, err)
+	}
+	f.Host = parts[1]
+
+	for _, h := range []string{f.BindAddress, f.Host} {
+		if strings.ContainsFunc(h, func(r rune) bool { return unicode.IsSpace(r) || r == '"' || r == '\'' }) {
+			return Forward{}, fmt.Errorf("invalid forward %q: addresses cannot contain spaces or quotes", s)
+		}
+	}
+	if f.Host == "" {
+		return Forward{}, fmt.Errorf("invalid forward %q: host cannot be empty", s)
+	}
+
+	return f, nil
+}
+
+// splitForward splits s on colons, except in square brackets.
+func splitForward(s string) ([]string, error) {
+	parts := []string{}
+	for s != "" {
+		if s[0] == '[' {
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, errors.New("missing ]")
+			}
+			parts = append(parts, s[1:end])
+			s = s[end+1:]
+			if s != "" && s[0] != ':' {
+				return nil, errors.New("expecting : after ]")
+			}
+			s = strings.TrimPrefix(s, ":")
+			continue
+		}
+
+		part, rest, found := strings.Cut(s, ":")
+		parts = append(parts, part)
+		s = rest
+		if found && s == "" {
+			parts = append(parts, "")
+		}
+	}
+	return parts, nil
+}
+
+func parsePort(s string, min int) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < min || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// String returns the forward in the format of ssh.
+func (f Forward) String() string {
+	addr := net.JoinHostPort(f.Host, strconv.Itoa(f.HostPort))
+	if f.BindAddress != "" {
+		return net.JoinHostPort(f.BindAddress, strconv.Itoa(f.Port)) + ":" + addr
+	}
+	return strconv.Itoa(f.Port) + ":" + addr
+}
+
+// Flags returns the ssh flags setting up the forward.
+func (f Forward) Flags() []string {
+	if f.Remote {
+		return []string{"-R", f.String()}
+	}
+	return []string{"-L", f.String()}
+}
@@ -0,0 +1,107 @@
+package ssh_test
+
+import (
+	"testing"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForward(t *testing.T) {
+	testcases := []struct {
+		name     string
+		value    string
+		remote   bool
+		expected ssh.Forward
+		flags    []string
+		err      string
+	}{
+		{
+			name:     "local forward",
+			value:    "8080:db.internal:5432",
+			expected: ssh.Forward{Port: 8080, Host: "db.internal", HostPort: 5432},
+			flags:    []string{"-L", "8080:db.internal:5432"},
+		},
+		{
+			name:     "bind address",
+			value:    "127.0.0.1:8080:db.internal:5432",
+			expected: ssh.Forward{BindAddress: "127.0.0.1", Port: 8080, Host: "db.internal", HostPort: 5432},
+			flags:    []string{"-L", "127.0.0.1:8080:db.internal:5432"},
+		},
+		{
+			name:     "IPv6 addresses",
+			value:    "[::1]:8080:[fd00::1]:5432",
+			expected: ssh.Forward{BindAddress: "::1", Port: 8080, Host: "fd00::1", HostPort: 5432},
+			flags:    []string{"-L", "[::1]:8080:[fd00::1]:5432"},
+		},
+		{
+			name:     "remote forward to a dynamic port",
+			value:    "0:localhost:80",
+			remote:   true,
+			expected: ssh.Forward{Remote: true, Port: 0, Host: "localhost", HostPort: 80},
+			flags:    []string{"-R", "0:localhost:80"},
+		},
+		{
+			name:  "local forward to a dynamic port",
+			value: "0:localhost:80",
+			err:   `invalid port "0"`,
+		},
+		{
+			name:  "misquoted flag",
+			value: "-L 8080:db.internal:5432",
+			err:   `invalid port "-L 8080"`,
+		},
+		{
+			name:  "quotes",
+			value: `8080:"db.internal":5432`,
+			err:   "addresses cannot contain spaces or quotes",
+		},
+		{
+			name:  "missing host port",
+			value: "8080:db.internal",
+			err:   "expecting [bind_address:]port:host:hostport",
+		},
+		{
+			name:  "empty host",
+			value: "8080::5432",
+			err:   "host cannot be empty",
+		},
+		{
+			name:  "invalid port",
+			value: "8080:db.internal:65536",
+			err:   `invalid port "65536"`,
+		},
+		{
+			name:  "unclosed bracket",
+			value: "[::1:8080:db.internal:5432",
+			err:   "missing ]",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := ssh.ParseForward(tc.value, tc.remote)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, f)
+			assert.Equal(t, tc.flags, f.Flags())
+		})
+	}
+}
+
+func TestClient_SSHArgs_Forwards(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	cfg.Forwards = []ssh.Forward{
+		{Port: 8080, Host: "db.internal", HostPort: 5432},
+		{Remote: true, Port: 9090, Host: "localhost", HostPort: 80},
+	}
+	client := newTestClient(t, cfg, false)
+
+	result, err := client.SSHFlagsFromConfig()
+	require.NoError(t, err)
+	assert.Subset(t, result, []string{"-L", "8080:db.internal:5432", "-R", "9090:localhost:80"})
+}
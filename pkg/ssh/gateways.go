@@ -0,0 +1,199 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+)
+
+const (
+	// gatewayProbeTimeout is how long a gateway has to accept a connection
+	// and send its ssh banner to be healthy.
+	gatewayProbeTimeout = 5 * time.Second
+	// gatewaySwitchMargin is how much faster than the current gateway
+	// another one must be for the tunnel to move to it, so it does not
+	// flap between gateways with similar latencies.
+	gatewaySwitchMargin = 0.8
+)
+
+// gatewaySelector probes the latency of the gateway endpoints, and selects
+// the fastest healthy one.
+type gatewaySelector struct {
+	// endpoints are the host:port addresses of the gateways. The first one
+	// is the gateway of the cluster.
+	endpoints []string
+	logger    log.Logger
+	probe     func(ctx context.Context, addr string) (time.Duration, error)
+
+	mu       sync.Mutex
+	selected string
+}
+
+func newGatewaySelector(cfg *Config, logger log.Logger) *gatewaySelector {
+	endpoints := []string{net.JoinHostPort(cfg.URL.String(), strconv.Itoa(cfg.Port))}
+	for _, e := range cfg.GatewayEndpoints {
+		// Endpoints are validated when parsed.
+		addr, _ := parseGatewayEndpoint(e, cfg.Port)
+		if addr != endpoints[0] {
+			endpoints = append(endpoints, addr)
+		}
+	}
+	network := cfg.gatewayNetwork()
+	return &gatewaySelector{
+		endpoints: endpoints,
+		logger:    logger,
+		probe: func(ctx context.Context, addr string) (time.Duration, error) {
+			return probeGatewayLatency(ctx, network, addr)
+		},
+		selected: endpoints[0],
+	}
+}
+
+// current returns the host and port of the selected gateway.
+func (gs *gatewaySelector) current() (string, int) {
+	gs.mu.Lock()
+	addr := gs.selected
+	gs.mu.Unlock()
+
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// update probes the gateways and selects the fastest healthy one, unless the
+// selected gateway is healthy and about as fast. It returns true if the
+// selection changed.
+func (gs *gatewaySelector) update(ctx context.Context) bool {
+	latencies := make([]time.Duration, len(gs.endpoints))
+	errs := make([]error, len(gs.endpoints))
+	var wg sync.WaitGroup
+	for i, addr := range gs.endpoints {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			latencies[i], errs[i] = gs.probe(ctx, addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	best, current := -1, -1
+	for i, addr := range gs.endpoints {
+		if errs[i] != nil {
+			gatewayLatency.DeleteLabelValues(addr)
+			level.Debug(gs.logger).Log("msg", "gateway is unhealthy", "gateway", addr, "err", errs[i])
+			continue
+		}
+		gatewayLatency.WithLabelValues(addr).Set(latencies[i].Seconds())
+		if best < 0 || latencies[i] < latencies[best] {
+			best = i
+		}
+		if addr == gs.selected {
+			current = i
+		}
+	}
+	if best < 0 || best == current {
+		// Without a healthy gateway, ssh keeps retrying the selected one.
+		return false
+	}
+	if current >= 0 && float64(latencies[best]) > gatewaySwitchMargin*float64(latencies[current]) {
+		return false
+	}
+
+	level.Info(gs.logger).Log("msg", "selected gateway", "gateway", gs.endpoints[best], "latency", latencies[best], "previous", gs.selected)
+	gs.selected = gs.endpoints[best]
+	return true
+}
+
+// gateway returns the host and port of the gateway to connect to.
+func (s *Client) gateway() (string, int) {
+	if s.selector == nil {
+		return s.cfg.URL.String(), s.cfg.Port
+	}
+	return s.selector.current()
+}
+
+// gatewayLoop probes the gateways every GatewayProbeInterval, and replaces
+// the connection when a faster gateway is selected.
+func (s *Client) gatewayLoop(ctx context.Context) {
+	defer crash.Recover()
+
+	if s.cfg.GatewayProbeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.GatewayProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.selector.update(ctx) {
+				s.Reconnect()
+			}
+		}
+	}
+}
+
+// ProbeGateway checks that the gateway of cfg accepts a connection and sends
+// an ssh banner, without authenticating.
+func ProbeGateway(ctx context.Context, cfg *Config) error {
+	addr := net.JoinHostPort(cfg.URL.String(), strconv.Itoa(cfg.Port))
+	_, err := probeGatewayLatency(ctx, cfg.gatewayNetwork(), addr)
+	return err
+}
+
+// probeGatewayLatency returns how long the gateway at addr takes to accept a
+// connection over network. The gateway is only healthy if it then sends an
+// ssh banner.
+func probeGatewayLatency(ctx context.Context, network, addr string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, gatewayProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("reading ssh banner: %w", err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return 0, fmt.Errorf("unexpected banner %q", strings.TrimSpace(banner))
+	}
+	return latency, nil
+}
+
+// parseGatewayEndpoint parses a host[:port] gateway address into a
+// host:port one, with port as the default port.
+func parseGatewayEndpoint(s string, port int) (string, error) {
+	host, p, err := net.SplitHostPort(s)
+	if err != nil {
+		host, p = strings.Trim(s, "[]"), strconv.Itoa(port)
+	}
+	if host == "" || strings.ContainsAny(host, "/@ ") {
+		return "", fmt.Errorf("invalid gateway endpoint %q: expecting host[:port]", s)
+	}
+	if _, err := parsePort(p, 1); err != nil {
+		return "", fmt.Errorf("invalid gateway endpoint %q: %w", s, err)
+	}
+	return net.JoinHostPort(host, p), nil
+}
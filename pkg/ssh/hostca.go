@@ -0,0 +1,123 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// HostCAKeysFilter keeps the entries of the known hosts returned by the
+	// PDC API whose key is pinned.
+	HostCAKeysFilter = "filter"
+	// HostCAKeysReplace ignores the known hosts returned by the PDC API, and
+	// trusts the pinned keys for the gateway.
+	HostCAKeysReplace = "replace"
+)
+
+// ErrHostKeyNotPinned is returned when none of the host keys returned by the
+// PDC API is in the host CA keys file.
+var ErrHostKeyNotPinned = errors.New("none of the gateway host keys returned by the PDC API is pinned")
+
+// readHostCAKeys reads the public keys of path, one per line in the format of
+// authorized_keys. Empty lines and comments are ignored.
+func readHostCAKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for rest := data; len(bytes.TrimSpace(rest)) > 0; {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+	return keys, nil
+}
+
+// CheckHostCAKeysFile returns an error if HostCAKeysFile is set and cannot be
+// read, or has no keys.
+func (cfg *Config) CheckHostCAKeysFile() error {
+	if cfg.HostCAKeysFile == "" {
+		return nil
+	}
+	if _, err := readHostCAKeys(cfg.HostCAKeysFile); err != nil {
+		return fmt.Errorf("invalid -gateway.ca-keys-file: %w", err)
+	}
+	return nil
+}
+
+func (cfg *Config) setHostCAKeysMode(s string) error {
+	switch s {
+	case HostCAKeysFilter, HostCAKeysReplace:
+		cfg.HostCAKeysMode = s
+		return nil
+	default:
+		return fmt.Errorf("invalid value %q: must be %q or %q", s, HostCAKeysFilter, HostCAKeysReplace)
+	}
+}
+
+// pinKnownHosts returns the known hosts kh returned by the PDC API,
+// restricted to the pinned keys, or the entries of the pinned keys with
+// HostCAKeysReplace.
+func (km *KeyManager) pinKnownHosts(kh []byte, keys []ssh.PublicKey) ([]byte, error) {
+	if km.cfg.HostCAKeysMode == HostCAKeysReplace {
+		var b strings.Builder
+		for _, key := range keys {
+			fmt.Fprintf(&b, "@cert-authority * %s", ssh.MarshalAuthorizedKey(key))
+		}
+		return []byte(b.String()), nil
+	}
+
+	pinned, trusted, dropped := filterKnownHosts(kh, keys)
+	if dropped > 0 {
+		level.Warn(km.logger).Log("msg", "ignoring gateway host keys returned by the PDC API which are not in -gateway.ca-keys-file", "count", dropped)
+	}
+	if trusted == 0 {
+		return nil, ErrHostKeyNotPinned
+	}
+	return pinned, nil
+}
+
+// filterKnownHosts returns the entries of kh whose key is one of keys, the
+// number of those which are not revocations, and the number of entries it
+// drops. Revocations are kept, as they can only restrict the keys ssh
+// accepts.
+func filterKnownHosts(kh []byte, keys []ssh.PublicKey) (filtered []byte, trusted, dropped int) {
+	pinned := map[string]bool{}
+	for _, key := range keys {
+		pinned[string(key.Marshal())] = true
+	}
+
+	var kept []string
+	for _, line := range splitKnownHosts(kh) {
+		marker, _, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		switch {
+		case err != nil:
+			dropped++
+			continue
+		case marker == "revoked":
+		case pinned[string(key.Marshal())]:
+			trusted++
+		default:
+			dropped++
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if len(kept) == 0 {
+		return nil, trusted, dropped
+	}
+	return []byte(strings.Join(kept, "\n") + "\n"), trusted, dropped
+}
@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log/level"
+)
+
+// interceptionHint is logged with the gateway responses which are not ssh.
+const interceptionHint = "allow direct outbound TCP connections to the gateway, or exempt it from the SSL/TLS inspection or HTTP proxying of the network"
+
+// checkInterception checks whether the connections to the gateway are
+// intercepted, after ssh failed to read its banner. It logs and returns the
+// reason they seem to be, or "" if they do not.
+func (s *Client) checkInterception(ctx context.Context) string {
+	host, port := s.gateway()
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	resp, err := probeGatewayBanner(ctx, s.cfg.gatewayNetwork(), addr)
+	if err != nil || resp == "" {
+		return ""
+	}
+	level.Error(s.logger).Log("msg", "outbound SSH appears to be intercepted by a proxy/firewall", "gateway", addr, "response", resp, "hint", interceptionHint)
+	return "outbound SSH appears to be intercepted by a proxy/firewall: the gateway answered with " + resp
+}
+
+// probeGatewayBanner connects to the gateway at addr over network like ssh
+// does, and returns a description of its response if it is not an ssh
+// banner, or "" if it is. It returns an error if the gateway cannot be
+// reached at all.
+func probeGatewayBanner(ctx context.Context, network, addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gatewayProbeTimeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	// Proxies which wait for the client to speak first, e.g. HTTP proxies,
+	// answer the client banner.
+	if _, err := io.WriteString(conn, "SSH-2.0-pdc-agent\r\n"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 256)
+	n, err := io.ReadAtLeast(conn, buf, 4)
+	return describeBanner(buf[:n], err), nil
+}
+
+// describeBanner returns a description of resp, the first bytes sent by the
+// gateway before the read failed with err, if they are not an ssh banner.
+func describeBanner(resp []byte, err error) string {
+	var netErr net.Error
+	switch {
+	case bytes.HasPrefix(resp, []byte("SSH-")):
+		return ""
+	case bytes.HasPrefix(resp, []byte("HTTP/")):
+		line, _, _ := strings.Cut(string(resp), "\n")
+		return fmt.Sprintf("an HTTP response: %q", strings.TrimSpace(line))
+	case len(resp) > 0 && (resp[0] == 0x15 || resp[0] == 0x16):
+		// The content types of TLS alert and handshake records.
+		return "a TLS record"
+	case len(resp) > 0:
+		return fmt.Sprintf("an unexpected banner: %q", resp)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "no banner"
+	default:
+		return "a closed connection"
+	}
+}
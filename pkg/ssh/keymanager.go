@@ -1,20 +1,26 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
+	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"os"
-	"path"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
+	"github.com/grafana/pdc-agent/pkg/events"
 	"github.com/grafana/pdc-agent/pkg/pdc"
 	"github.com/mikesmitty/edkey"
 	"golang.org/x/crypto/ssh"
@@ -26,6 +32,14 @@ const (
 	KnownHostsFile = "grafana_pdc_known_hosts"
 )
 
+// ErrCertificateMismatch is returned when a certificate signed by the PDC API
+// does not match the local key, or is not a valid user certificate.
+var ErrCertificateMismatch = errors.New("certificate does not match the local key")
+
+// ErrSigningFailed is returned when the PDC API does not sign the public key,
+// or returns an invalid certificate.
+var ErrSigningFailed = errors.New("key signing request failed")
+
 // TODO
 // KeyManager implements KeyManager. If needed, it gets new certificates signed
 // by the PDC API.
@@ -36,65 +50,196 @@ type KeyManager struct {
 	cfg    *Config
 	client pdc.Client
 	logger log.Logger
+
+	// mu serialises access to the key files.
+	mu sync.Mutex
+	// warnedValidBefore is the expiry of the last certificate a warning was
+	// logged about, so it is only logged once per certificate.
+	warnedValidBefore uint64
 }
 
 // NewKeyManager returns a new KeyManager in an idle state
 func NewKeyManager(cfg *Config, logger log.Logger, client pdc.Client) *KeyManager {
-	km := KeyManager{
+	return &KeyManager{
 		cfg:    cfg,
 		client: client,
 		logger: logger,
 	}
-
-	return &km
 }
 
 func (km *KeyManager) CreateKeys(ctx context.Context) error {
 	level.Info(km.logger).Log("msg", "starting key manager")
 
+	_, err := km.RefreshKeys(ctx)
+	return err
+}
+
+// RefreshKeys ensures valid keys and a valid certificate exist, like
+// CreateKeys. It returns true if a new certificate was written.
+func (km *KeyManager) RefreshKeys(ctx context.Context) (bool, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.cfg.NoAPI {
+		return false, km.validateProvisionedFiles()
+	}
+
 	newCertRequired, err := km.ensureKeysExist(km.cfg.ForceKeyFileOverwrite)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	argumentHash := km.argumentsHash()
 	if km.argumentsHashIsDifferent(argumentHash) {
-		level.Info(km.logger).Log("msg", fmt.Sprintf("fetching new certificate: agent arguments changed hash=%s", argumentHash))
+		level.Info(km.logger).Log("msg", fmt.Sprintf("fetching new certificate: agent configuration changed hash=%s", argumentHash))
 		newCertRequired = true
 	}
 
-	if err := km.ensureCertExists(ctx, newCertRequired); err != nil {
-		return fmt.Errorf("ensuring certificate exists: %w", err)
+	renewed, err := km.ensureCertExists(ctx, newCertRequired)
+	if err != nil {
+		return false, fmt.Errorf("ensuring certificate exists: %w", err)
+	}
+	if cert, err := km.readCert(); err == nil {
+		km.checkExpiry(cert)
 	}
 
 	if err := km.writeHashFile([]byte(argumentHash)); err != nil {
-		return fmt.Errorf("writing to hash file: %w", err)
+		return renewed, fmt.Errorf("writing to hash file: %w", err)
 	}
 
+	return renewed, nil
+}
+
+// RenewCertificate gets a new certificate signed, even if the current one is
+// valid.
+func (km *KeyManager) RenewCertificate(ctx context.Context) error {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.cfg.NoAPI {
+		return errors.New("provisioned certificates cannot be renewed")
+	}
+	if _, err := km.ensureKeysExist(false); err != nil {
+		return err
+	}
+	if err := km.generateCert(ctx); err != nil {
+		return fmt.Errorf("failed to generate new certificate: %w", err)
+	}
+	if cert, err := km.readCert(); err == nil {
+		km.checkExpiry(cert)
+	}
 	return nil
 }
 
 // EnsureCertExists checks for the existence of a valid SSH certificate and
-// regenerates one if it cannot find one, or if forceCreate is true.
-func (km KeyManager) ensureCertExists(ctx context.Context, forceCreate bool) error {
-	newCertRequired := forceCreate
-
-	if newCertRequired {
-		err := km.generateCert(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to generate new certificate: %w", err)
-		}
-		return nil
+// regenerates one if it cannot find one, or if forceCreate is true. It returns
+// true if a new certificate was generated.
+func (km *KeyManager) ensureCertExists(ctx context.Context, forceCreate bool) (bool, error) {
+	if !forceCreate && !km.newCertRequired() {
+		return false, nil
 	}
 
-	newCertRequired = km.newCertRequired()
-	if !newCertRequired {
-		return nil
+	err := km.generateCert(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to generate new certificate: %w", err)
 	}
+	return true, nil
+}
 
-	err := km.generateCert(ctx)
+// validateProvisionedFiles checks the key pair, certificate and known hosts
+// files provisioned with NoAPI, which the key manager cannot replace.
+func (km *KeyManager) validateProvisionedFiles() error {
+	cert, err := km.readCert()
 	if err != nil {
-		return fmt.Errorf("failed to generate new certificate: %w", err)
+		return fmt.Errorf("-no-api requires a provisioned certificate: %w", err)
+	}
+	if err := km.certValidity(cert); err != nil {
+		return fmt.Errorf("invalid provisioned certificate: %w", err)
+	}
+	if err := km.verifyCert(cert); err != nil {
+		return fmt.Errorf("invalid provisioned certificate: %w", err)
+	}
+
+	kh, err := os.ReadFile(km.cfg.KnownHostsFilePath())
+	if err != nil {
+		return fmt.Errorf("-no-api requires a provisioned known hosts file: %w", err)
+	}
+	if _, _, _, _, _, err := ssh.ParseKnownHosts(kh); err != nil {
+		return fmt.Errorf("invalid provisioned known hosts file: %w", err)
+	}
+
+	km.checkExpiry(cert)
+	level.Info(km.logger).Log("msg", "using provisioned certificate, the PDC API is not called")
+	return nil
+}
+
+// CertValidBefore returns the end of the validity window of the certificate,
+// or the zero time if it does not expire.
+func (km *KeyManager) CertValidBefore() (time.Time, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	cert, err := km.readCert()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}, nil
+	}
+	return time.Unix(int64(cert.ValidBefore), 0), nil
+}
+
+// certExpired reports whether the certificate on disk is missing or outside
+// of its validity window. Unlike newCertRequired, it does not log.
+func (km *KeyManager) certExpired() bool {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	cert, err := km.readCert()
+	if err != nil {
+		return true
+	}
+	km.checkExpiry(cert)
+	return km.certValidity(cert) != nil
+}
+
+// checkExpiry exports the expiry of cert, and logs a warning the first time
+// it is checked less than CertExpiryWarning before it.
+func (km *KeyManager) checkExpiry(cert *ssh.Certificate) {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return
+	}
+	certValidBefore.WithLabelValues(km.cfg.KeyFile).Set(float64(cert.ValidBefore))
+
+	if km.cfg.CertExpiryWarning <= 0 || km.warnedValidBefore == cert.ValidBefore {
+		return
+	}
+	expiry := time.Unix(int64(cert.ValidBefore), 0)
+	if left := time.Until(expiry); left < km.cfg.CertExpiryWarning {
+		km.warnedValidBefore = cert.ValidBefore
+		level.Warn(km.logger).Log("msg", "the certificate expires soon, it is renewed once expired", "expiry", expiry.UTC().Format(time.RFC3339), "remaining", left.Round(time.Second))
+	}
+}
+
+// certValidity returns an error if cert is outside of its validity window.
+// The start of the window is moved back by ClockSkewTolerance.
+func (km *KeyManager) certValidity(cert *ssh.Certificate) error {
+	now := uint64(time.Now().Unix())
+	if now > cert.ValidBefore {
+		return errors.New("certificate validity has expired")
+	}
+	if km.cfg.DevCertTTL > 0 {
+		info, err := os.Stat(km.cfg.KeyFile + "-cert.pub")
+		if err == nil && time.Since(info.ModTime()) > km.cfg.DevCertTTL {
+			return errors.New("certificate is older than -dev.chaos-cert-ttl")
+		}
+	}
+	tolerance := uint64(0)
+	if km.cfg.ClockSkewTolerance > 0 {
+		tolerance = uint64(km.cfg.ClockSkewTolerance.Seconds())
+	}
+	if now+tolerance < cert.ValidAfter {
+		return errors.New("certificate is not yet valid")
 	}
 	return nil
 }
@@ -102,7 +247,7 @@ func (km KeyManager) ensureCertExists(ctx context.Context, forceCreate bool) err
 // ensureKeysExist checks for the existence of valid SSH keys. If they exist,
 // it does nothing. If they don't, it creates them. It returns a boolean
 // indicating whether new keys were created, and an error.
-func (km KeyManager) ensureKeysExist(forceCreate bool) (bool, error) {
+func (km *KeyManager) ensureKeysExist(forceCreate bool) (bool, error) {
 
 	// check if files already exist
 	r := forceCreate || km.newKeysRequired()
@@ -112,20 +257,21 @@ func (km KeyManager) ensureKeysExist(forceCreate bool) (bool, error) {
 	}
 
 	// ensure the key file dir exists before we try and write there
-	err := os.MkdirAll(km.cfg.KeyFileDir(), 0774)
+	err := os.MkdirAll(km.cfg.KeyFileDir(), 0700)
 	if err != nil && !os.IsExist(err) {
-		return false, err
+		return false, fmt.Errorf("creating the directory of -ssh-key-file: %w", err)
 	}
 
 	return true, km.generateKeyPair()
 }
 
-func (km KeyManager) newKeysRequired() bool {
+func (km *KeyManager) newKeysRequired() bool {
 	kb, err := km.readKeyFile()
 	if err != nil {
 		level.Info(km.logger).Log("msg", "new keys required: could not read private key file")
 		return true
 	}
+	defer wipe(kb)
 
 	block, _ := pem.Decode(kb)
 	if block == nil {
@@ -139,46 +285,39 @@ func (km KeyManager) newKeysRequired() bool {
 		return true
 	}
 
-	_, _, _, _, err = ssh.ParseAuthorizedKey(pbk)
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(pbk)
 	if err != nil {
 		level.Info(km.logger).Log("msg", "new keys required: could not parse public key")
 		return true
 	}
 
+	if km.cfg.FIPS && pk.Type() != ssh.KeyAlgoECDSA256 {
+		level.Info(km.logger).Log("msg", fmt.Sprintf("new keys required: %s keys are not allowed in FIPS mode", pk.Type()))
+		return true
+	}
+
 	return false
 }
 
-func (km KeyManager) newCertRequired() bool {
-	cb, err := km.readCertFile()
-	if err != nil {
-		level.Info(km.logger).Log("msg", "new certificate required: could not read certificate file")
-		return true
-	}
-	pk, _, _, _, err := ssh.ParseAuthorizedKey(cb)
+func (km *KeyManager) newCertRequired() bool {
+	cert, err := km.readCert()
 	if err != nil {
-		level.Info(km.logger).Log("msg", "new certificate required: could not parse certificate")
-		return true
-	}
-	cert, ok := pk.(*ssh.Certificate)
-	if !ok {
-		level.Info(km.logger).Log("msg", "new certificate required: certificate is incorrect format")
+		level.Info(km.logger).Log("msg", fmt.Sprintf("new certificate required: %s", err))
 		return true
 	}
-	now := uint64(time.Now().Unix())
-
-	if now > cert.ValidBefore {
-		level.Info(km.logger).Log("msg", "new certificate required: certificate validity has expired")
+	if err := km.certValidity(cert); err != nil {
+		level.Info(km.logger).Log("msg", fmt.Sprintf("new certificate required: %s", err))
 		return true
 	}
 
-	if now < cert.ValidAfter {
-		level.Info(km.logger).Log("msg", "new certificate required: certificate is not yet valid")
+	if err := km.verifyCert(cert); err != nil {
+		level.Info(km.logger).Log("msg", fmt.Sprintf("new certificate required: %s", err))
 		return true
 	}
 
 	level.Info(km.logger).Log("msg", "found existing valid certificate")
 
-	kh, err := os.ReadFile(path.Join(km.cfg.KeyFileDir(), KnownHostsFile))
+	kh, err := os.ReadFile(km.cfg.KnownHostsFilePath())
 	if err != nil {
 		level.Info(km.logger).Log("msg", "fetching new certificate: cannot not read known hosts file")
 		return true
@@ -193,9 +332,9 @@ func (km KeyManager) newCertRequired() bool {
 	return false
 }
 
-// argumentsHashIsDifferent returns true when specific arguments
-// passed to the pdc agent are different from the previous arguments.
-func (km KeyManager) argumentsHashIsDifferent(hash string) bool {
+// argumentsHashIsDifferent returns true when the configuration fingerprint
+// differs from the one of the current certificate.
+func (km *KeyManager) argumentsHashIsDifferent(hash string) bool {
 	bytes, err := km.readHashFile()
 	if errors.Is(err, os.ErrNotExist) {
 		// No hash stored yet, let's get a new certificate and store the hash.
@@ -207,28 +346,29 @@ func (km KeyManager) argumentsHashIsDifferent(hash string) bool {
 	return contents != hash
 }
 
-// argumentsHash returns a hash of the values that end up in the principals field of the certificate.
-func (km KeyManager) argumentsHash() string {
-	value := km.cfg.PDC.HostedGrafanaID
-
-	if km.cfg.PDC.DevNetwork != "" {
-		value = fmt.Sprintf("%s/%s", value, km.cfg.PDC.DevNetwork)
-	}
-
-	return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
+// argumentsHash returns the fingerprint of the configuration which ends up
+// in the principals field of the certificate.
+func (km *KeyManager) argumentsHash() string {
+	return km.cfg.PDC.Fingerprint()
 }
 
-func (km KeyManager) generateKeyPair() error {
+func (km *KeyManager) generateKeyPair() error {
+	if km.cfg.FIPS {
+		return km.generateFIPSKeyPair()
+	}
 
 	// Generate a new private/public keypair for OpenSSH
 	pubKey, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	defer wipeKey(privKey)
 	sshPubKey, _ := ssh.NewPublicKey(pubKey)
 
 	pemKey := &pem.Block{
 		Type:  "OPENSSH PRIVATE KEY",
 		Bytes: edkey.MarshalED25519PrivateKey(privKey),
 	}
+	defer wipe(pemKey.Bytes)
 	pemPrivKey := pem.EncodeToMemory(pemKey)
+	defer wipe(pemPrivKey)
 
 	err := km.writeKeyFile(pemPrivKey)
 	if err != nil {
@@ -239,25 +379,78 @@ func (km KeyManager) generateKeyPair() error {
 	return km.writePubKeyFile(ssh.MarshalAuthorizedKey(sshPubKey))
 }
 
-func (km KeyManager) generateCert(ctx context.Context) error {
+// generateFIPSKeyPair generates an ECDSA P-256 key pair, as ed25519 is not
+// available from FIPS 140 validated modules.
+func (km *KeyManager) generateFIPSKeyPair() error {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	defer wipeKey(privKey)
+	der, err := x509.MarshalECPrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+	defer wipe(der)
+	sshPubKey, err := ssh.NewPublicKey(&privKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	pemPrivKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	defer wipe(pemPrivKey)
+	err = km.writeKeyFile(pemPrivKey)
+	if err != nil {
+		return err
+	}
+
+	return km.writePubKeyFile(ssh.MarshalAuthorizedKey(sshPubKey))
+}
+
+func (km *KeyManager) generateCert(ctx context.Context) error {
 	level.Info(km.logger).Log("msg", "generating new certificate")
 
+	resp, err := km.signPublicKey(ctx)
+	if err != nil {
+		return err
+	}
+	return km.writeSigningResponse(resp)
+}
+
+// signPublicKey has the public key signed by the PDC API, and checks the
+// certificate, without writing it.
+func (km *KeyManager) signPublicKey(ctx context.Context) (*pdc.SigningResponse, error) {
 	pbk, err := km.readPubKeyFile()
 	if err != nil {
-		return fmt.Errorf("could not read public ssh key file: %w", err)
+		return nil, fmt.Errorf("could not read public ssh key file: %w", err)
 	}
 
-	resp, err := km.client.SignSSHKey(ctx, pbk)
+	// The client may hold the tokens of several stacks.
+	resp, err := km.client.SignSSHKey(pdc.WithStack(ctx, km.cfg.PDC.HostedGrafanaID), pbk)
 	if err != nil {
-		return fmt.Errorf("key signing request failed: %w", err)
+		if errors.Is(err, pdc.ErrInvalidCredentials) {
+			sendEvent(km.cfg.Events, events.AuthFailed, "the PDC API rejected the token")
+		}
+		if errors.Is(err, pdc.ErrConflict) {
+			level.Error(km.logger).Log("msg", "the PDC API reports that another agent uses the same key or instance ID: the key files may have been copied from another host. Two hosts must not share credentials: delete the key files of this agent, or restart it with -identity.on-copy=regenerate",
+				"key_file", km.cfg.KeyFile)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrSigningFailed, err)
 	}
 
 	if resp == nil {
-		return errors.New("received empty response from PDC API")
+		return nil, fmt.Errorf("%w: received empty response from PDC API", ErrSigningFailed)
+	}
+
+	if err := km.verifyCert(&resp.Certificate); err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate from PDC API: %w", ErrSigningFailed, err)
 	}
+	return resp, nil
+}
 
-	// write response to file
-	err = km.writeKnownHostsFile(resp.KnownHosts)
+// writeSigningResponse writes the certificate and known hosts of resp.
+func (km *KeyManager) writeSigningResponse(resp *pdc.SigningResponse) error {
+	err := km.updateKnownHostsFile(resp.KnownHosts)
 	if err != nil {
 		return fmt.Errorf("failed to write known hosts file: %w", err)
 	}
@@ -265,49 +458,149 @@ func (km KeyManager) generateCert(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	certRenewals.WithLabelValues(km.cfg.KeyFile).Inc()
+	sendEvent(km.cfg.Events, events.CertRenewed, "principals "+strings.Join(resp.Certificate.ValidPrincipals, ","))
+
+	return nil
+}
+
+// CheckPrincipals has the public key signed, and compares the principals of
+// the new certificate with the ones of the current certificate. When they
+// differ, for example after a change of the access policy of the token, the
+// new certificate replaces the current one and true is returned. Otherwise
+// the new certificate is discarded.
+func (km *KeyManager) CheckPrincipals(ctx context.Context) (bool, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.cfg.NoAPI {
+		return false, nil
+	}
+	current, err := km.readCert()
+	if err != nil {
+		return false, err
+	}
+	resp, err := km.signPublicKey(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	before, after := sortedPrincipals(current), sortedPrincipals(&resp.Certificate)
+	if slices.Equal(before, after) {
+		return false, nil
+	}
+
+	principalChanges.WithLabelValues(km.cfg.KeyFile).Inc()
+	level.Warn(km.logger).Log("msg", "the principals of the certificate changed, renewing it", "old", strings.Join(before, ","), "new", strings.Join(after, ","))
+	if err := km.writeSigningResponse(resp); err != nil {
+		return false, err
+	}
+	km.checkExpiry(&resp.Certificate)
+	return true, nil
+}
+
+func sortedPrincipals(cert *ssh.Certificate) []string {
+	principals := slices.Clone(cert.ValidPrincipals)
+	slices.Sort(principals)
+	return principals
+}
+
+// verifyCert checks that cert is a user certificate of the local private key,
+// with principals and a validity window, so that ssh does not fail to
+// authenticate when the files are out of sync.
+func (km *KeyManager) verifyCert(cert *ssh.Certificate) error {
+	kb, err := km.readKeyFile()
+	if err != nil {
+		return fmt.Errorf("could not read private key file: %w", err)
+	}
+	defer wipe(kb)
+	return verifyCertForKey(cert, kb)
+}
+
+// verifyCertForKey checks that cert is a valid user certificate of the PEM
+// encoded private key kb.
+func verifyCertForKey(cert *ssh.Certificate, kb []byte) error {
+	key, err := ssh.ParseRawPrivateKey(kb)
+	if err != nil {
+		return fmt.Errorf("could not parse private key: %w", err)
+	}
+	defer wipeKey(key)
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return fmt.Errorf("could not parse private key: %w", err)
+	}
 
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("%w: not a user certificate", ErrCertificateMismatch)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return fmt.Errorf("%w: the certificate is for another key", ErrCertificateMismatch)
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return fmt.Errorf("%w: the certificate has no principals", ErrCertificateMismatch)
+	}
+	if cert.ValidBefore <= cert.ValidAfter {
+		return fmt.Errorf("%w: the certificate validity window is empty", ErrCertificateMismatch)
+	}
 	return nil
 }
 
-func (km KeyManager) readKeyFile() ([]byte, error) {
-	return os.ReadFile(km.cfg.KeyFile)
+// readKeyFile reads the private key into a locked buffer, which the caller
+// wipes once used.
+func (km *KeyManager) readKeyFile() ([]byte, error) {
+	return readKeyMaterial(km.cfg.KeyFile)
 }
 
-func (km KeyManager) readPubKeyFile() ([]byte, error) {
+func (km *KeyManager) readPubKeyFile() ([]byte, error) {
 	path := km.cfg.KeyFile + ".pub"
 	return os.ReadFile(path)
 }
 
-func (km KeyManager) readCertFile() ([]byte, error) {
+func (km *KeyManager) readCertFile() ([]byte, error) {
 	path := km.cfg.KeyFile + "-cert.pub"
 	return os.ReadFile(path)
 }
 
-func (km KeyManager) readHashFile() ([]byte, error) {
-	path := km.cfg.KeyFile + "_hash"
-	return os.ReadFile(path)
+// readCert reads and parses the certificate file.
+func (km *KeyManager) readCert() (*ssh.Certificate, error) {
+	cb, err := km.readCertFile()
+	if err != nil {
+		return nil, errors.New("could not read certificate file")
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(cb)
+	if err != nil {
+		return nil, errors.New("could not parse certificate")
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("certificate is incorrect format")
+	}
+	return cert, nil
 }
 
-func (km KeyManager) writeKeyFile(data []byte) error {
-	return os.WriteFile(km.cfg.KeyFile, data, 0600)
+func (km *KeyManager) readHashFile() ([]byte, error) {
+	return os.ReadFile(km.cfg.HashFilePath())
 }
 
-func (km KeyManager) writePubKeyFile(data []byte) error {
+func (km *KeyManager) writeKeyFile(data []byte) error {
+	return writeFile(km.cfg.KeyFile, data, modeOr(km.cfg.KeyFileMode))
+}
+
+// writePubKeyFile writes the public key, with the mode of the certificate.
+func (km *KeyManager) writePubKeyFile(data []byte) error {
 	path := km.cfg.KeyFile + ".pub"
-	return os.WriteFile(path, data, 0600)
+	return writeFile(path, data, modeOr(km.cfg.CertFileMode))
 }
 
-func (km KeyManager) writeKnownHostsFile(data []byte) error {
-	path := path.Join(km.cfg.KeyFileDir(), KnownHostsFile)
-	return os.WriteFile(path, data, 0600)
+func (km *KeyManager) writeKnownHostsFile(data []byte) error {
+	return writeFile(km.cfg.KnownHostsFilePath(), data, modeOr(km.cfg.KnownHostsFileMode))
 }
 
-func (km KeyManager) writeCertFile(data []byte) error {
-	path := path.Join(km.cfg.KeyFile + "-cert.pub")
-	return os.WriteFile(path, data, 0600)
+func (km *KeyManager) writeCertFile(data []byte) error {
+	path := km.cfg.KeyFile + "-cert.pub"
+	return writeFile(path, data, modeOr(km.cfg.CertFileMode))
 }
 
-func (km KeyManager) writeHashFile(data []byte) error {
-	path := path.Join(km.cfg.KeyFile + "_hash")
-	return os.WriteFile(path, data, 0600)
+func (km *KeyManager) writeHashFile(data []byte) error {
+	return writeFile(km.cfg.HashFilePath(), data, modeOr(km.cfg.HashFileMode))
 }
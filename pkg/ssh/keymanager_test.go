@@ -1,4 +1,3 @@
-
 package ssh_test
 
 import (
@@ -6,20 +5,21 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
-	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"net/http"
-	"net/http/httptest"
 	"net/url"
 	"os"
-	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
 
 	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/pdctest"
 	"github.com/grafana/pdc-agent/pkg/ssh"
 	"github.com/mikesmitty/edkey"
 	"github.com/stretchr/testify/assert"
@@ -29,50 +29,7 @@ import (
 )
 
 const (
-	knownHosts   = `known hosts`
-	expectedCert = `
------BEGIN CERTIFICATE-----
-c3NoLWVkMjU1MTktY2VydC12MDFAb3BlbnNzaC5jb20gQUFBQUlITnphQzFsWkRJ
-MU5URTVMV05sY25RdGRqQXhRRzl3Wlc1emMyZ3VZMjl0QUFBQUlESlIvSnNPT1Ev
-UWlkdGhOVWZ3aUZoM0tDSHcySXpGaHI1dVNmOWJVR1pUQUFBQUlFMS9MRHBGd0Fl
-bit6WFZNcTZuZmpBaEFtL1NpM3ZpaFJjd3ZrdG1YQUtuQUFBQUFBQUFBQUFBQUFB
-Q0FBQUFBemN3TlFBQUFINEFBQUE3Y0hKcGRtRjBaUzFrWVhSaGMyOTFjbU5sTFdO
-dmJtNWxZM1F1YUc5emRHVmtMV2R5WVdaaGJtRXVjM1pqTG1Oc2RYTjBaWEl1Ykc5
-allXd0FBQUE3Y0hKcGRtRjBaUzFrWVhSaGMyOTFjbU5sTFdOdmJtNWxZM1F0WkdW
-MkxYVnpMV05sYm5SeVlXd3RNQzVuY21GbVlXNWhMV1JsZGk1dVpYUUFBQUFBWkZP
-SExBQUFBQUJrVTVVOEFBQUFBQUFBQUFBQUFBQUFBQUFDRndBQUFBZHpjMmd0Y25O
-aEFBQUFBd0VBQVFBQUFnRUE5R0MzZUVjREpzYnFMQnVnMWMvQmVsUW5uNEdGYWxP
-KzdJV2ZwdmU2YU9oYi8xVGRnNnVMMkRjRnRYMTlINGdycU1FV1paV0lvNHZQdHV3
-UGZHQ3Rod000cWY2ZFNocUpCcC9KZDg2aENwOENTRldDZFBQNVpVWVB3RHpsNStE
-ZG9zOExYVEF1czZXSWxxcGliRmJXS05NZkNTbld5M3J3UHRKeTEvbFhwT0FKenFE
-VC80SWdhZFNDM0MyUFo2L1lpUzN2anJWazdFS0VKclc2Yk9oQzI3TGcybkZNVzgw
-WEt5L0FsVktGa0k2OFV6Rll4QzMxbTd0VzkxOWNTOS9Gc1pFQWd4ZFdJU1VUVlg4
-UW5zbHdzRUN4OUlhNmxKbU5RQ1lMU3Q1d2NaeVloOFV0T21UbDFrZjlRdGhjcXRv
-Z3UybmhXRHRsWlp5cVpRS0tYaUJaRzl5YTl2WVZYdmUzbzcvUGJqNklHbFdybkFZ
-ZVB4YSs4ZzdFNmY2aFMwQ3lmZExEb1BweFJFYTlzdGxFRjk2am00bC9zcUUwTCta
-OVRjb0FzNTI5b0xQMkFkRStzK2xiWHR1ZlJjNHh4cWJJSW04TGlVY0pEa0NYZ0V3
-MnlpK3crTFNaMUhMRGFXelVkVzVFcmgvZC9qbXV6elZyZWNaL0p3clFEem5KNFp5
-VzJXUEtpTmY1bExLYkhyR2I4aFpoUEphRFVNOTlJMkVNbmNlbDNLOFlkYjl2YTFP
-ZnB2TWI5SjNpcVlmTEs4dm4rSEJZNGE5eXhIWGcwNEZwV3VtR2pvaTBINkJkelFL
-TkpNcUNFNVBOS0RicU1NeDc4cjRGUVJtNmlGaTdvdVRJUGRsU3FCdmt6ellIaXZQ
-UFJCMGFUbWV4OHJNMFBtMXNrSnNMelpWc1Bsa0FBQUlVQUFBQURISnpZUzF6YUdF
-eUxUVXhNZ0FBQWdDRkdyUTZVNHFHSVJXZE1rYlBIRCt4NDRaNFhsR08vTUhVemxP
-SEtOM0gyRVIzWkxpWFJHazFmclhKU1Y5enhmb1lxOWY2TXdETU85QnZsMnJValRy
-bGtwdTByaWE1cjYvSVYrZ3F2OHJXMHpNSUxkeWUyZnBqRXhlT3BReFdqU0pQeVI1
-Q0NtWFFtRlkwblEwK1dNQjNiNGQ4ZHNNMGcxakc3aGhhdkk2UUdsa2MvUmpJckg1
-QVZ3Z0I3dS80a2hUZE5aS3V1OE1KTkptNWprTkhUaEo2ekNLVi80SXl0dnl1MXpv
-cGUxemdBTnF2K1NHd2lIS0FXUzh4N0podG9QMWhOTFpKSHRKOGVteHVjVitlRXZZ
-STdQcjFZVzdkc0VUamhDQkUrZUpXd0ZBamYydUJtb1JGcEU1TzhHekg0aW91eEsw
-VDJ1OTNSK09ycnNNSTlyS215bk5OcVZGcXd3VU0rUU9Sa0tIbFRoblo0K29zQ2o4
-ejdzM3RnYUh4c1FkRW1mNFFEZ0ZBWnVlejlnLzJTYSsxeUhvNklURUs5Q1ZYOVJz
-aTFTdElFKzVxWjF0alFjTUtqbDZ0OVU4RGhwdXFKaW5WQnBiN3NjYkVmRVlNcXR6
-bTdaRzZBVmlGSm9vMjRMYkJxMi9MdEFwYUFpVU51c2ZYSUt1aTZhUlRuNlhyb0NN
-WkFZRERrbkJsS0EwOC9IbHZJYko2VEZ3T2VFbzVtTjhKN3hhSUZ4Zk9PZUNQdFho
-RnVYTEQrSmlyOEhuZWZyLzVVOTJjQ0dCS1VGOURYSDhQc1RYR1QxWWNQMkpGRXZL
-QW1RbmNCaFJzZE4rblR0WjJ3T2NNaFpyTkpkbFdoWHlrNUNvcnYxTXhiZVBPTUFK
-azl0ZGNvOFFqN0pIcFR0WnFBRm12c1E9PQo=
------END CERTIFICATE-----
-`
+	knownHosts = `known hosts`
 )
 
 // Contains a KeyManager that can be used for testing
@@ -92,9 +49,9 @@ func testKeyManager(t *testing.T) testKeyManagerOutput {
 	sshCfg := ssh.DefaultConfig()
 	sshCfg.PDC = pdcCfg
 
-	sshCfg.KeyFile = path.Join(t.TempDir(), "testkey")
+	sshCfg.KeyFile = filepath.Join(t.TempDir(), "testkey")
 
-	url, _ := mockPDC(t, http.MethodPost, "/pdc/api/v1/sign-public-key", http.StatusOK)
+	url, _ := mockPDC(t, http.StatusOK)
 	pdcCfg.URL = url
 
 	logger := log.NewNopLogger()
@@ -167,6 +124,30 @@ func TestKeyManager_CreateKeys(t *testing.T) {
 		// A new key should have been generated.
 		assert.NotEqual(t, key1, key2)
 	})
+
+	t.Run("in FIPS mode, ed25519 keys are replaced by ECDSA keys", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		sut := testKeyManager(t)
+
+		// The first call to CreateKeys will create an ed25519 key pair.
+		assert.NoError(t, sut.km.CreateKeys(ctx))
+
+		// After enabling FIPS mode, it is replaced by an ECDSA key pair.
+		require.NoError(t, sut.sshCfg.EnableFIPS())
+		assert.NoError(t, sut.km.CreateKeys(ctx))
+
+		key, err := os.ReadFile(sut.sshCfg.KeyFile)
+		require.NoError(t, err)
+		signer, err := gossh.ParsePrivateKey(key)
+		require.NoError(t, err)
+		assert.Equal(t, gossh.KeyAlgoECDSA256, signer.PublicKey().Type())
+
+		pubKey, err := os.ReadFile(sut.sshCfg.KeyFile + pubSuffix)
+		require.NoError(t, err)
+		assert.Equal(t, string(gossh.MarshalAuthorizedKey(signer.PublicKey())), string(pubKey))
+	})
 }
 
 func TestKeyManager_EnsureKeysExist(t *testing.T) {
@@ -201,7 +182,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				_ = os.WriteFile(cfg.KeyFile, []byte("invalid private key"), 0600)
 				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
 				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
-				_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
 				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
 			},
 			assertFn:           assertExpectedFiles,
@@ -215,7 +196,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
 				_ = os.WriteFile(cfg.KeyFile+pubSuffix, []byte("not a public key"), 0644)
 				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
-				_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
 				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
 			},
 			assertFn:           assertExpectedFiles,
@@ -229,7 +210,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
 				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
 				_ = os.WriteFile(cfg.KeyFile+certSuffix, []byte("invalid cert"), 0644)
-				_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
 				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
 			},
 			assertFn:           assertExpectedFiles,
@@ -243,7 +224,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
 				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
 				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
-				_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), []byte("invalid known_hosts"), 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), []byte("invalid known_hosts"), 0644)
 				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
 			},
 			wantSigningRequest: true,
@@ -262,7 +243,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
 				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
 				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
-				_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
 				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
 			},
 			wantSigningRequest: false,
@@ -276,7 +257,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				assert.NotNil(t, pubKeyFile)
 
 				kfd := cfg.KeyFileDir()
-				_, err = os.ReadFile(path.Join(kfd, ssh.KnownHostsFile))
+				_, err = os.ReadFile(filepath.Join(kfd, ssh.KnownHostsFile))
 				assert.NoError(t, err)
 
 				cert, err := os.ReadFile(cfg.KeyFile + certSuffix)
@@ -289,6 +270,33 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				assert.NotEmpty(t, contents)
 			},
 		},
+		{
+			name: "cert not yet valid, within the clock skew tolerance: no signing request",
+			setupFn: func(t *testing.T, cfg *ssh.Config) {
+				t.Helper()
+				privKey, pubKey, cert, kh := generateKeys("1h", "2m")
+				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
+				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
+				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
+			},
+			wantSigningRequest: false,
+		},
+		{
+			name: "cert not yet valid, beyond the clock skew tolerance: expect signing request",
+			setupFn: func(t *testing.T, cfg *ssh.Config) {
+				t.Helper()
+				privKey, pubKey, cert, kh := generateKeys("1h", "10m")
+				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
+				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
+				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
+			},
+			wantSigningRequest: true,
+			assertFn:           assertExpectedFiles,
+		},
 		{
 			name: "cert outside validity window: expect signing request",
 			setupFn: func(t *testing.T, cfg *ssh.Config) {
@@ -298,7 +306,22 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
 				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
 				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
-				_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+			},
+			wantSigningRequest: true,
+			assertFn:           assertExpectedFiles,
+		},
+		{
+			name: "valid cert for another key: expect signing request",
+			setupFn: func(t *testing.T, cfg *ssh.Config) {
+				t.Helper()
+				privKey, pubKey, _, kh := generateKeys("", "")
+				_, _, otherCert, _ := generateKeys("", "")
+				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
+				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
+				_ = os.WriteFile(cfg.KeyFile+certSuffix, otherCert, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
 			},
 			wantSigningRequest: true,
 			assertFn:           assertExpectedFiles,
@@ -312,7 +335,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
 				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
 				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
-				_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
 				// The new argument hash is different from the previous one.
 				_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("some hash"), 0644)
 			},
@@ -328,7 +351,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 				_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
 				_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
 				_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
-				_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+				_ = os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
 				// Note that we are not creating a hash file.
 			},
 			wantSigningRequest: true,
@@ -345,13 +368,13 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 			cfg := ssh.DefaultConfig()
 			cfg.PDC = pdcCfg
 
-			cfg.KeyFile = path.Join(t.TempDir(), "testkey")
+			cfg.KeyFile = filepath.Join(t.TempDir(), "testkey")
 
 			// create mock PDC server and use the URL in the pdc config
 			if tc.apiResponseCode == 0 {
 				tc.apiResponseCode = 200
 			}
-			url, called := mockPDC(t, http.MethodPost, "/pdc/api/v1/sign-public-key", tc.apiResponseCode)
+			url, called := mockPDC(t, tc.apiResponseCode)
 			pdcCfg.URL = url
 
 			// allow test case to modify cfg and add files to frw
@@ -373,7 +396,7 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 
 			require.Nil(t, err)
 
-			assert.Equal(t, tc.wantSigningRequest, *called)
+			assert.Equal(t, tc.wantSigningRequest, called())
 
 			if tc.assertFn != nil {
 				tc.assertFn(t, cfg)
@@ -382,42 +405,196 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 	}
 }
 
-func mockPDC(t *testing.T, method, path string, code int) (u *url.URL, called *bool) {
+func mockPDC(t *testing.T, code int) (u *url.URL, called func() bool) {
 	t.Helper()
 
-	called = new(bool)
-
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, method, r.Method)
-		assert.Equal(t, path, r.URL.Path)
-		*called = true
-
-		resp := struct {
-			KnownHosts  string `json:"known_hosts"`
-			Certificate string `json:"certificate"`
-		}{
-			KnownHosts:  knownHosts,
-			Certificate: expectedCert,
-		}
-		enc, err := json.Marshal(resp)
-		assert.NoError(t, err)
+	srv := pdctest.NewServer(t, pdctest.Config{StatusCode: code, KnownHosts: knownHosts, CA: testCA})
+	return srv.APIURL(), func() bool { return len(srv.Requests()) > 0 }
+}
 
-		w.WriteHeader(code)
-		_, err = w.Write(enc)
-		assert.NoError(t, err)
+// otherKeyPDCClient signs another key than the requested one.
+type otherKeyPDCClient struct{}
 
-	}))
-	t.Cleanup(ts.Close)
+func (otherKeyPDCClient) ReportCapabilities(_ context.Context, _ pdc.Capabilities) error {
+	return nil
+}
 
-	u, _ = url.Parse(ts.URL)
-	return u, called
+func (otherKeyPDCClient) RemoteConfig(_ context.Context) (*pdc.RemoteConfig, error) {
+	return &pdc.RemoteConfig{}, nil
 }
 
-func mustParseCert(t *testing.T) []byte {
-	t.Helper()
-	block, _ := pem.Decode([]byte(expectedCert))
-	return block.Bytes
+func (otherKeyPDCClient) UploadSupportBundle(_ context.Context, _ string, _ []byte) error {
+	return nil
+}
 
+func (otherKeyPDCClient) Discover(_ context.Context) (*pdc.Discovery, error) {
+	return nil, pdc.ErrNotFound
+}
+
+func (otherKeyPDCClient) Enroll(_ context.Context, _ string) (*pdc.EnrollResponse, error) {
+	return &pdc.EnrollResponse{Token: "token"}, nil
+}
+
+func (otherKeyPDCClient) SignSSHKey(_ context.Context, _ []byte) (*pdc.SigningResponse, error) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := gossh.NewPublicKey(pub)
+	cert, err := signTestCert(gossh.MarshalAuthorizedKey(sshPub), time.Now().Add(-5*time.Minute), time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	return &pdc.SigningResponse{KnownHosts: []byte(knownHosts), Certificate: *cert}, nil
+}
+
+func TestKeyManager_RejectsCertificateForAnotherKey(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	cfg.KeyFile = filepath.Join(t.TempDir(), "testkey")
+
+	km := ssh.NewKeyManager(cfg, log.NewNopLogger(), otherKeyPDCClient{})
+	err := km.CreateKeys(context.Background())
+	assert.ErrorIs(t, err, ssh.ErrCertificateMismatch)
+	assert.ErrorIs(t, err, ssh.ErrSigningFailed)
+
+	_, err = os.Stat(cfg.KeyFile + certSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestKeyManager_CertExpiryWarning(t *testing.T) {
+	testcases := []struct {
+		name     string
+		window   time.Duration
+		expected int
+	}{
+		{name: "disabled", window: 0, expected: 0},
+		{name: "expiry outside of the window", window: 30 * time.Minute, expected: 0},
+		{name: "expiry within the window", window: 2 * time.Hour, expected: 1},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ssh.DefaultConfig()
+			cfg.KeyFile = filepath.Join(t.TempDir(), "testkey")
+			cfg.CertExpiryWarning = tc.window
+
+			url, _ := mockPDC(t, http.StatusOK)
+			client, err := pdc.NewClient(&pdc.Config{URL: url}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			logs := &strings.Builder{}
+			km := ssh.NewKeyManager(cfg, log.NewLogfmtLogger(logs), client)
+			require.NoError(t, km.CreateKeys(context.Background()))
+			// The warning is logged once per certificate.
+			_, err = km.RefreshKeys(context.Background())
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.expected, strings.Count(logs.String(), "the certificate expires soon"))
+		})
+	}
+}
+
+func TestKeyManager_NoAPI(t *testing.T) {
+	testcases := []struct {
+		name        string
+		validBefore string
+		knownHosts  bool
+		expectedErr string
+	}{
+		{name: "valid provisioned files", validBefore: "1h", knownHosts: true},
+		{name: "expired certificate", validBefore: "-1m", knownHosts: true, expectedErr: "invalid provisioned certificate"},
+		{name: "missing known hosts file", validBefore: "1h", expectedErr: "requires a provisioned known hosts file"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ssh.DefaultConfig()
+			cfg.KeyFile = filepath.Join(t.TempDir(), "testkey")
+			cfg.NoAPI = true
+
+			privKey, pubKey, cert, kh := generateKeys(tc.validBefore, "-5m")
+			require.NoError(t, os.WriteFile(cfg.KeyFile, privKey, 0600))
+			require.NoError(t, os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644))
+			require.NoError(t, os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644))
+			if tc.knownHosts {
+				require.NoError(t, os.WriteFile(filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0600))
+			}
+
+			// The PDC API client is never used.
+			km := ssh.NewKeyManager(cfg, log.NewNopLogger(), nil)
+			err := km.CreateKeys(context.Background())
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			validBefore, err := km.CertValidBefore()
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), validBefore, time.Minute)
+
+			// The provisioned files are not replaced.
+			written, err := os.ReadFile(cfg.KeyFile + certSuffix)
+			require.NoError(t, err)
+			assert.Equal(t, cert, written)
+		})
+	}
+}
+
+func TestKeyManager_RenewCertificate(t *testing.T) {
+	sut := testKeyManager(t)
+	require.NoError(t, sut.km.CreateKeys(context.Background()))
+	before, err := os.ReadFile(sut.sshCfg.KeyFile + certSuffix)
+	require.NoError(t, err)
+
+	// The certificate is renewed although it is valid.
+	require.NoError(t, sut.km.RenewCertificate(context.Background()))
+	after, err := os.ReadFile(sut.sshCfg.KeyFile + certSuffix)
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+
+	sut.sshCfg.NoAPI = true
+	assert.Error(t, sut.km.RenewCertificate(context.Background()))
+}
+
+func TestKeyManager_CheckPrincipals(t *testing.T) {
+	sut := testKeyManager(t)
+	require.NoError(t, sut.km.CreateKeys(context.Background()))
+
+	changed, err := sut.km.CheckPrincipals(context.Background())
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Sign the current certificate again with other principals, as if the
+	// access policy changed since.
+	data, err := os.ReadFile(sut.sshCfg.KeyFile + certSuffix)
+	require.NoError(t, err)
+	pk, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	require.NoError(t, err)
+	cert := pk.(*gossh.Certificate)
+	cert.ValidPrincipals = []string{"old"}
+	require.NoError(t, cert.SignCert(rand.Reader, testCA))
+	require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile+certSuffix, gossh.MarshalAuthorizedKey(cert), 0600))
+
+	changed, err = sut.km.CheckPrincipals(context.Background())
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	data, err = os.ReadFile(sut.sshCfg.KeyFile + certSuffix)
+	require.NoError(t, err)
+	pk, _, _, _, err = gossh.ParseAuthorizedKey(data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key"}, pk.(*gossh.Certificate).ValidPrincipals)
+}
+
+// testCA signs the certificates returned by the mocked PDC API.
+var testCA = func() gossh.Signer {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := gossh.NewSignerFromKey(key)
+	return signer
+}()
+
+// signTestCert returns a user certificate for the public key in authorized
+// keys format, signed by testCA.
+func signTestCert(pubKey []byte, validAfter, validBefore time.Time) (*gossh.Certificate, error) {
+	return pdctest.SignCert(testCA, pubKey, []string{"key"}, validAfter, validBefore)
 }
 
 func generateKeys(validBeforeDur string, validAfterDur string) ([]byte, []byte, []byte, []byte) {
@@ -475,15 +652,116 @@ func assertExpectedFiles(t *testing.T, cfg *ssh.Config) {
 	assert.NotNil(t, pubKeyFile)
 
 	kfd := cfg.KeyFileDir()
-	kh, err := os.ReadFile(kfd + ssh.KnownHostsFile)
+	kh, err := os.ReadFile(filepath.Join(kfd, ssh.KnownHostsFile))
 	assert.NoError(t, err)
-	assert.Equal(t, knownHosts, string(kh))
+	// Entries of the previous known hosts file are kept after the new ones.
+	assert.Equal(t, knownHosts, strings.SplitN(string(kh), "\n", 2)[0])
 
-	cert, err := os.ReadFile(cfg.KeyFile + certSuffix)
+	certFile, err := os.ReadFile(cfg.KeyFile + certSuffix)
 	assert.NoError(t, err)
-	assert.Equal(t, mustParseCert(t), cert)
+	pk, _, _, _, err := gossh.ParseAuthorizedKey(certFile)
+	require.NoError(t, err)
+	cert, ok := pk.(*gossh.Certificate)
+	require.True(t, ok)
+	pubKey, _, _, _, err := gossh.ParseAuthorizedKey(pubKeyFile)
+	require.NoError(t, err)
+	assert.Equal(t, pubKey.Marshal(), cert.Key.Marshal())
 
 	contents, err := os.ReadFile(cfg.KeyFile + hashSuffix)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, contents)
-}
\ No newline at end of file
+}
+func TestKeyManager_DevCertTTL(t *testing.T) {
+	_, _, _, kh := generateKeys("1h", "-5m")
+	srv := pdctest.NewServer(t, pdctest.Config{KnownHosts: string(kh), CA: testCA})
+	client, err := pdc.NewClient(&pdc.Config{URL: srv.APIURL()}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	cfg := ssh.DefaultConfig()
+	cfg.KeyFile = filepath.Join(t.TempDir(), "testkey")
+	cfg.DevCertTTL = time.Minute
+	km := ssh.NewKeyManager(cfg, log.NewNopLogger(), client)
+	require.NoError(t, km.CreateKeys(context.Background()))
+
+	renewed, err := km.RefreshKeys(context.Background())
+	require.NoError(t, err)
+	assert.False(t, renewed)
+
+	// The certificate is renewed once older than the TTL, although it is
+	// valid for an hour.
+	old := time.Now().Add(-2 * time.Minute)
+	require.NoError(t, os.Chtimes(cfg.KeyFile+certSuffix, old, old))
+	renewed, err = km.RefreshKeys(context.Background())
+	require.NoError(t, err)
+	assert.True(t, renewed)
+}
+
+func TestRemoveKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	cfg := ssh.DefaultConfig()
+	cfg.KeyFile = filepath.Join(dir, "grafana_pdc")
+	for _, name := range []string{"grafana_pdc", "grafana_pdc.pub", "grafana_pdc_known_hosts"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("data"), 0600))
+	}
+
+	// The certificate is missing.
+	require.NoError(t, ssh.RemoveKeyPair(cfg))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "grafana_pdc_known_hosts", entries[0].Name())
+}
+
+func TestCheckKeyPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes don't reflect the ACLs of files on Windows")
+	}
+
+	testcases := []struct {
+		name      string
+		dirMode   os.FileMode
+		keyMode   os.FileMode
+		fix       bool
+		expectErr bool
+		// The modes after the check.
+		expectDirMode os.FileMode
+		expectKeyMode os.FileMode
+	}{
+		{name: "private", dirMode: 0700, keyMode: 0600, expectDirMode: 0700, expectKeyMode: 0600},
+		{name: "read-only key", dirMode: 0700, keyMode: 0400, expectDirMode: 0700, expectKeyMode: 0400},
+		{name: "readable key", dirMode: 0700, keyMode: 0644, expectErr: true, expectDirMode: 0700, expectKeyMode: 0644},
+		{name: "readable directory", dirMode: 0755, keyMode: 0600, expectDirMode: 0755, expectKeyMode: 0600},
+		{name: "fixed", dirMode: 0775, keyMode: 0640, fix: true, expectDirMode: 0700, expectKeyMode: 0600},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "keys")
+			keyFile := filepath.Join(dir, "grafana_pdc")
+			require.NoError(t, os.Mkdir(dir, 0700))
+			require.NoError(t, os.WriteFile(keyFile, []byte("key"), 0600))
+			require.NoError(t, os.Chmod(keyFile, tc.keyMode))
+			require.NoError(t, os.Chmod(dir, tc.dirMode))
+
+			err := ssh.CheckKeyPermissions(keyFile, tc.fix, log.NewNopLogger())
+			if tc.expectErr {
+				assert.ErrorIs(t, err, ssh.ErrKeyPermissions)
+				assert.ErrorContains(t, err, keyFile+" has mode 0644")
+			} else {
+				assert.NoError(t, err)
+			}
+
+			fi, err := os.Stat(dir)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectDirMode, fi.Mode().Perm())
+			fi, err = os.Stat(keyFile)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectKeyMode, fi.Mode().Perm())
+		})
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		assert.NoError(t, ssh.CheckKeyPermissions(filepath.Join(t.TempDir(), "grafana_pdc"), false, log.NewNopLogger()))
+	})
+}
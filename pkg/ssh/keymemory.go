@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// The agent only holds private keys while it generates, checks or copies
+// them: ssh reads them from the key file. The buffers holding them are
+// locked in memory, so they are not written to swap, and wiped once used.
+
+// readKeyMaterial reads the file at path into a buffer of its size, locked
+// in memory, which the caller wipes with wipe. Unlike os.ReadFile, the file
+// is not read into intermediate buffers left in memory.
+func readKeyMaterial(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, fi.Size())
+	// Locking fails when RLIMIT_MEMLOCK is exceeded, which does not prevent
+	// the key from being used.
+	_ = lockMemory(b)
+	if _, err := io.ReadFull(f, b); err != nil {
+		wipe(b)
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// wipe overwrites b with zeros and unlocks it.
+func wipe(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	clear(b)
+	runtime.KeepAlive(b)
+	_ = unlockMemory(b)
+}
+
+// wipeKey overwrites the private part of key, as parsed by
+// ssh.ParseRawPrivateKey or generated by the key manager.
+func wipeKey(key any) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		clear(k)
+	case *ed25519.PrivateKey:
+		clear(*k)
+	case *ecdsa.PrivateKey:
+		clear(k.D.Bits())
+		k.D.SetInt64(0)
+	}
+	runtime.KeepAlive(key)
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package ssh
+
+import "golang.org/x/sys/unix"
+
+func lockMemory(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return unix.Mlock(b)
+}
+
+func unlockMemory(b []byte) error {
+	return unix.Munlock(b)
+}
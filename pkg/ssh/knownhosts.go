@@ -0,0 +1,121 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHostsMu serializes the updates of the known hosts files. The tunnels
+// of -network.token and -stack.token share the file of the default one, and
+// each key manager reads, merges and writes it when its certificate is
+// renewed, so concurrent updates would lose each other's entries.
+var knownHostsMu sync.Mutex
+
+// retiredAtRegexp matches the comment added to known hosts entries which are
+// no longer returned by the PDC API.
+var retiredAtRegexp = regexp.MustCompile(`pdc-retired-at=(\S+)`)
+
+// mergeKnownHosts returns the entries of newKH, followed by the entries of
+// oldKH it does not contain. Those are kept until grace has elapsed since they
+// were first missing, so that connections keep working while the gateway host
+// CA is rotated. newKH is returned as is, even if it has invalid entries.
+func mergeKnownHosts(oldKH, newKH []byte, now time.Time, grace time.Duration) []byte {
+	current := map[string]bool{}
+	for _, line := range splitKnownHosts(newKH) {
+		if id, _, err := knownHostsEntry(line); err == nil {
+			current[id] = true
+		}
+	}
+
+	retained := []string{}
+	for _, line := range splitKnownHosts(oldKH) {
+		id, comment, err := knownHostsEntry(line)
+		if err != nil || current[id] {
+			// Drop entries which are invalid, or still current.
+			continue
+		}
+
+		if m := retiredAtRegexp.FindStringSubmatch(comment); m != nil {
+			retiredAt, err := time.Parse(time.RFC3339, m[1])
+			if err != nil || now.Sub(retiredAt) >= grace {
+				continue
+			}
+		} else {
+			line = fmt.Sprintf("%s pdc-retired-at=%s", line, now.UTC().Format(time.RFC3339))
+		}
+
+		current[id] = true
+		retained = append(retained, line)
+	}
+
+	if len(retained) == 0 {
+		return newKH
+	}
+	merged := append(bytes.TrimRight(newKH, "\n"), '\n')
+	return append(merged, strings.Join(retained, "\n")+"\n"...)
+}
+
+// splitKnownHosts returns the lines of a known hosts file which are not empty
+// or comments.
+func splitKnownHosts(kh []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(string(kh), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// knownHostsEntry parses a known hosts line, and returns an identifier of its
+// marker, hosts and key, and its comment.
+func knownHostsEntry(line string) (string, string, error) {
+	marker, hosts, key, comment, _, err := ssh.ParseKnownHosts([]byte(line))
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%s %s %s", marker, strings.Join(hosts, ","), key.Marshal()), comment, nil
+}
+
+// updateKnownHostsFile writes the known hosts returned by the PDC API,
+// restricted to the keys of HostCAKeysFile if set. Entries of the previous
+// file are kept for KnownHostsGracePeriod.
+func (km *KeyManager) updateKnownHostsFile(kh []byte) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	var keys []ssh.PublicKey
+	if km.cfg.HostCAKeysFile != "" {
+		var err error
+		if keys, err = readHostCAKeys(km.cfg.HostCAKeysFile); err != nil {
+			return err
+		}
+		if kh, err = km.pinKnownHosts(kh, keys); err != nil {
+			return err
+		}
+	}
+	if km.cfg.KnownHostsGracePeriod <= 0 {
+		return km.writeKnownHostsFile(kh)
+	}
+
+	old, err := os.ReadFile(km.cfg.KnownHostsFilePath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if keys != nil {
+		// The keys which are no longer pinned are not kept.
+		old, _, _ = filterKnownHosts(old, keys)
+	}
+
+	return km.writeKnownHostsFile(mergeKnownHosts(old, kh, time.Now(), km.cfg.KnownHostsGracePeriod))
+}
@@ -0,0 +1,81 @@
+package ssh
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var hostKeyVerificationFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pdc_agent_ssh_host_key_verification_failures_total",
+	Help: "Number of ssh connections which failed because the gateway host key could not be verified.",
+})
+
+var certValidBefore = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pdc_agent_cert_valid_before_timestamp",
+	Help: "Unix time at which the certificate of the agent expires, by key file.",
+}, []string{"key_file"})
+
+var certRenewals = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_cert_renewals_total",
+	Help: "Number of certificates signed by the PDC API, by key file.",
+}, []string{"key_file"})
+
+var principalChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_cert_principal_changes_total",
+	Help: "Number of times the principals the PDC API signs differed from the ones of the certificate, which was renewed, by key file.",
+}, []string{"key_file"})
+
+var sshResumes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_ssh_resumes_total",
+	Help: "Number of times the ssh connection was replaced because the wall clock jumped forward, as when the host resumes from suspend, by key file.",
+}, []string{"key_file"})
+
+var bytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_tunnel_sent_bytes_total",
+	Help: "Number of bytes sent to the gateway through the tunnel, by key file. Only set with -tunnel.traffic-metrics.",
+}, []string{"key_file"})
+
+var bytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_tunnel_received_bytes_total",
+	Help: "Number of bytes received from the gateway through the tunnel, by key file. Only set with -tunnel.traffic-metrics.",
+}, []string{"key_file"})
+
+var channelsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pdc_agent_tunnel_channels_active",
+	Help: "Number of channels forwarded by the gateway to the agent network which are open, by key file. Only set with -tunnel.traffic-metrics.",
+}, []string{"key_file"})
+
+var channelsOpened = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_tunnel_channels_opened_total",
+	Help: "Number of channels forwarded by the gateway to the agent network, by key file. Only set with -tunnel.traffic-metrics.",
+}, []string{"key_file"})
+
+var channelsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_tunnel_channels_closed_total",
+	Help: "Number of channels forwarded by the gateway to the agent network which were closed, by key file. Only set with -tunnel.traffic-metrics.",
+}, []string{"key_file"})
+
+var channelsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_tunnel_channels_rejected_total",
+	Help: "Number of connections forwarded by the gateway which were rejected, by key file and reason: max_channels when -tunnel.max-channels were open, not_allowed when -tunnel.allow-target does not allow their target.",
+}, []string{"key_file", "reason"})
+
+var channelsQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pdc_agent_tunnel_channels_queued",
+	Help: "Number of connections forwarded by the gateway which wait for one of the -tunnel.max-channels open ones to close, by key file.",
+}, []string{"key_file"})
+
+var gatewayLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pdc_agent_gateway_latency_seconds",
+	Help: "Time the gateways of -gateway.endpoints last took to accept a TCP connection, by gateway address. Unset while a gateway is unhealthy.",
+}, []string{"gateway"})
+
+var sshExits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdc_agent_ssh_process_exits_total",
+	Help: "Number of ssh processes which exited while the tunnel was running, and were restarted, by key file and exit code.",
+}, []string{"key_file", "exit_code"})
+
+var sshLastExitCode = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pdc_agent_ssh_process_last_exit_code",
+	Help: "Exit code of the last ssh process which exited, by key file. -1 if it was killed by a signal.",
+}, []string{"key_file"})
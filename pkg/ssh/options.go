@@ -0,0 +1,228 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// Options are the options of the ssh connection to the gateway. Args returns
+// the arguments of ssh setting them.
+type Options struct {
+	// User, Host and Port are the user and address ssh connects to.
+	User string
+	Host string
+	Port int
+
+	// KeyPath, CertificatePath and KnownHostsPath are the paths of the
+	// private key, of its certificate and of the known hosts file.
+	KeyPath         string
+	CertificatePath string
+	KnownHostsPath  string
+	// HostKeyAlias is the name the gateway host key is looked up with in the
+	// known hosts file, when it is not Host.
+	HostKeyAlias string
+	// NoHostIPCheck disables the check of the address of Host in the known
+	// hosts file, when Host is not the gateway.
+	NoHostIPCheck bool
+	// StrictHostKeyChecking is the ssh_config value: "yes", "accept-new" or
+	// "no".
+	StrictHostKeyChecking string
+	// AddressFamily is the ssh_config value: "inet", "inet6", or empty for
+	// both.
+	AddressFamily string
+
+	// Keepalives is how often ssh checks the gateway is alive. Disabled if 0.
+	Keepalives time.Duration
+	// ConnectTimeout is how long ssh waits for the gateway to accept the
+	// connection, rounded up to seconds, and at least a second.
+	ConnectTimeout time.Duration
+
+	// Ciphers, KexAlgorithms and MACs are the comma separated algorithms ssh
+	// may use. Defaults to the ones of ssh if empty.
+	Ciphers       string
+	KexAlgorithms string
+	MACs          string
+
+	// RemoteForward is the forward of the connections of the gateway: "0"
+	// for the SOCKS5 server of ssh, or "0:host:port" for another one.
+	RemoteForward string
+	// Forwards are the additional port forwards.
+	Forwards []Forward
+
+	// Verbosity is the number of -v flags.
+	Verbosity int
+
+	// ExtraOptions are ssh_config options overriding the ones above. Names
+	// are case insensitive, and the first value of an option wins, as in ssh.
+	ExtraOptions []Option
+	// ExtraFlags are added after the other arguments.
+	ExtraFlags []string
+}
+
+// Option is an ssh_config option.
+type Option struct {
+	Name  string
+	Value string
+}
+
+// Args returns the arguments of ssh, with the options sorted by name.
+func (o Options) Args() []string {
+	options, _ := o.sshOptions()
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := []string{
+		"-i", o.KeyPath,
+		fmt.Sprintf("%s@%s", o.User, o.Host),
+		"-p", strconv.Itoa(o.Port),
+		"-R", o.RemoteForward,
+	}
+	for _, name := range names {
+		args = append(args, "-o", fmt.Sprintf("%s=%s", name, options[name]))
+	}
+	for _, f := range o.Forwards {
+		args = append(args, f.Flags()...)
+	}
+	if o.Verbosity > 0 {
+		args = append(args, "-"+strings.Repeat("v", o.Verbosity))
+	}
+	return append(args, o.ExtraFlags...)
+}
+
+// sshOptions returns the ssh_config options, and the name=value options
+// replaced by ExtraOptions.
+func (o Options) sshOptions() (options map[string]string, overridden []string) {
+	options = map[string]string{
+		"UserKnownHostsFile": o.KnownHostsPath,
+		"CertificateFile":    o.CertificatePath,
+		"ConnectTimeout":     secondsOption(o.ConnectTimeout),
+	}
+	if o.Keepalives > 0 {
+		options["ServerAliveInterval"] = secondsOption(o.Keepalives)
+	}
+	if o.NoHostIPCheck {
+		options["CheckHostIP"] = "no"
+	}
+	for name, value := range map[string]string{
+		"HostKeyAlias":          o.HostKeyAlias,
+		"StrictHostKeyChecking": o.StrictHostKeyChecking,
+		"AddressFamily":         o.AddressFamily,
+		"Ciphers":               o.Ciphers,
+		"KexAlgorithms":         o.KexAlgorithms,
+		"MACs":                  o.MACs,
+	} {
+		if value != "" {
+			options[name] = value
+		}
+	}
+
+	extra := map[string]bool{}
+	for _, e := range o.ExtraOptions {
+		// ssh uses the first value of an option: the value set by the
+		// agent is removed rather than passed before the extra one, and
+		// the later extra values of the option are ignored, as ssh would.
+		lower := strings.ToLower(e.Name)
+		if extra[lower] {
+			continue
+		}
+		extra[lower] = true
+		for name, value := range options {
+			if !strings.EqualFold(name, e.Name) {
+				continue
+			}
+			delete(options, name)
+			if value != e.Value {
+				overridden = append(overridden, fmt.Sprintf("%s=%s", name, value))
+			}
+		}
+		options[e.Name] = e.Value
+	}
+	sort.Strings(overridden)
+	return options, overridden
+}
+
+// Options returns the options of the next ssh connection, from the config of
+// the client and its -ssh-flag values. The -ssh-flag options needed to
+// authenticate are rejected.
+func (s *Client) Options() (Options, error) {
+	gwURL := s.cfg.URL
+	host, port := s.gateway()
+	o := Options{
+		User:                  s.cfg.PDC.HostedGrafanaID,
+		Host:                  host,
+		Port:                  port,
+		KeyPath:               s.cfg.KeyFile,
+		CertificatePath:       fmt.Sprintf("%s-cert.pub", s.cfg.KeyFile),
+		KnownHostsPath:        s.cfg.KnownHostsFilePath(),
+		StrictHostKeyChecking: s.cfg.StrictHostKeyChecking,
+		Keepalives:            15 * time.Second,
+		ConnectTimeout:        s.cfg.ConnectTimeout,
+		Ciphers:               s.cfg.Ciphers,
+		KexAlgorithms:         s.cfg.KexAlgorithms,
+		MACs:                  s.cfg.MACs,
+		// ssh serves the SOCKS5 connections of the gateway, unless the
+		// agent does.
+		RemoteForward: "0",
+		Forwards:      s.cfg.Forwards,
+		Verbosity:     s.logLevel(),
+	}
+	if o.StrictHostKeyChecking == "off" {
+		o.StrictHostKeyChecking = "no"
+	}
+	if s.proxy != nil {
+		o.RemoteForward = "0:" + s.proxy.addr()
+	}
+	if s.cfg.TrafficMetrics && o.Verbosity < 1 {
+		// The forwarded channels are only logged with -v.
+		o.Verbosity = 1
+	}
+	if host != gwURL.String() || port != s.cfg.Port {
+		// The other gateways of the cluster share its host key.
+		o.HostKeyAlias = relayHostKeyAlias(gwURL.String(), s.cfg.Port)
+	}
+	switch s.cfg.GatewayIPVersion {
+	case "4":
+		o.AddressFamily = "inet"
+	case "6":
+		o.AddressFamily = "inet6"
+	}
+	if s.relay != nil {
+		// Connect to the relay, checking the host key of the gateway. The
+		// relay dials the gateway over GatewayIPVersion.
+		o.AddressFamily = ""
+		o.Host = "127.0.0.1"
+		o.Port = s.relay.port()
+		o.HostKeyAlias = relayHostKeyAlias(gwURL.String(), s.cfg.Port)
+		o.NoHostIPCheck = true
+	}
+
+	for _, f := range s.cfg.SSHFlags {
+		name, value, err := extractOptionFromFlag(f)
+		if err != nil {
+			return Options{}, err
+		}
+		if name == "" {
+			// for backwards compatibility, on -v particularly
+			o.ExtraFlags = append(o.ExtraFlags, f)
+			continue
+		}
+		if err := s.cfg.checkSSHOption(name); err != nil {
+			return Options{}, err
+		}
+		o.ExtraOptions = append(o.ExtraOptions, Option{Name: name, Value: value})
+	}
+	if _, overridden := o.sshOptions(); len(overridden) > 0 {
+		s.overrideWarning.Do(func() {
+			level.Warn(s.logger).Log("msg", "-ssh-flag overrides ssh options set by the agent", "overridden", strings.Join(overridden, ","))
+		})
+	}
+	return o, nil
+}
@@ -0,0 +1,130 @@
+package ssh_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+var update = flag.Bool("update", false, "update the golden files of testdata")
+
+func TestOptions_Args(t *testing.T) {
+	base := func() ssh.Options {
+		return ssh.Options{
+			User:                  "123",
+			Host:                  "private-datasource-connect-prod-us-central-0.grafana.net",
+			Port:                  22,
+			KeyPath:               "/var/lib/pdc/grafana_pdc",
+			CertificatePath:       "/var/lib/pdc/grafana_pdc-cert.pub",
+			KnownHostsPath:        "/var/lib/pdc/known_hosts",
+			StrictHostKeyChecking: "yes",
+			Keepalives:            15 * time.Second,
+			ConnectTimeout:        time.Second,
+			RemoteForward:         "0",
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		options func(o *ssh.Options)
+	}{
+		{
+			name:    "defaults",
+			options: func(o *ssh.Options) {},
+		},
+		{
+			name: "relay",
+			options: func(o *ssh.Options) {
+				o.Host = "127.0.0.1"
+				o.Port = 40123
+				o.HostKeyAlias = "private-datasource-connect-prod-us-central-0.grafana.net"
+				o.NoHostIPCheck = true
+				o.RemoteForward = "0:127.0.0.1:40124"
+				o.Verbosity = 1
+			},
+		},
+		{
+			name: "forwards and algorithms",
+			options: func(o *ssh.Options) {
+				o.AddressFamily = "inet"
+				o.Ciphers = "aes256-gcm@openssh.com"
+				o.KexAlgorithms = "ecdh-sha2-nistp384"
+				o.MACs = "hmac-sha2-256"
+				o.Keepalives = 0
+				o.ConnectTimeout = 1500 * time.Millisecond
+				o.Forwards = []ssh.Forward{
+					{Remote: true, Port: 8080, Host: "localhost", HostPort: 80},
+					{BindAddress: "127.0.0.1", Port: 9090, Host: "gateway", HostPort: 90},
+				}
+			},
+		},
+		{
+			name: "extra options and flags",
+			options: func(o *ssh.Options) {
+				o.Verbosity = 3
+				o.ExtraOptions = []ssh.Option{
+					{Name: "serveraliveinterval", Value: "30"},
+					{Name: "ServerAliveCountMax", Value: "5"},
+					{Name: "ServerAliveInterval", Value: "60"},
+				}
+				o.ExtraFlags = []string{"-4"}
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			o := base()
+			tt.options(&o)
+			got := strings.Join(o.Args(), "\n") + "\n"
+
+			golden := filepath.Join("testdata", "options", strings.ReplaceAll(tt.name, " ", "_")+".golden")
+			if *update {
+				require.NoError(t, os.MkdirAll(filepath.Dir(golden), 0755))
+				require.NoError(t, os.WriteFile(golden, []byte(got), 0644))
+			}
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), got)
+		})
+	}
+}
+
+func TestClient_Options(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	cfg.URL = mustParseURL("gateway.grafana.net")
+	cfg.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+	cfg.PDC.HostedGrafanaID = "123"
+	cfg.StrictHostKeyChecking = "off"
+	cfg.LogLevel = 0
+	cfg.SSHFlags = []string{"-o ServerAliveCountMax=5", "-4"}
+	client := ssh.NewClient(cfg, log.NewNopLogger(), nil)
+
+	o, err := client.Options()
+	require.NoError(t, err)
+	assert.Equal(t, ssh.Options{
+		User:                  "123",
+		Host:                  "gateway.grafana.net",
+		Port:                  22,
+		KeyPath:               cfg.KeyFile,
+		CertificatePath:       cfg.KeyFile + "-cert.pub",
+		KnownHostsPath:        filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile),
+		StrictHostKeyChecking: "no",
+		Keepalives:            15 * time.Second,
+		ConnectTimeout:        time.Second,
+		RemoteForward:         "0",
+		ExtraOptions:          []ssh.Option{{Name: "ServerAliveCountMax", Value: "5"}},
+		ExtraFlags:            []string{"-4"},
+	}, o)
+
+	args, err := client.SSHFlagsFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, o.Args(), args)
+}
@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// ErrKeyPermissions is returned when other users can access the private key:
+// ssh refuses to use it.
+var ErrKeyPermissions = errors.New("other users can access the private key, which ssh refuses to use")
+
+// CheckKeyPermissions checks that only its owner can access the private key
+// at keyFile, and logs a warning if other users can access its directory.
+// With fix, their modes are set to 0600 and 0700 instead. A missing key is
+// not an error, as it is generated. File modes don't reflect the ACLs of
+// files on Windows, where nothing is checked.
+func CheckKeyPermissions(keyFile string, fix bool, logger log.Logger) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir := filepath.Dir(keyFile)
+	if fi, err := os.Stat(dir); err == nil && fi.Mode().Perm()&0077 != 0 {
+		if fix {
+			if err := os.Chmod(dir, 0700); err != nil {
+				return fmt.Errorf("fixing the permissions of %s: %w", dir, err)
+			}
+			level.Info(logger).Log("msg", "fixed the permissions of the key directory", "path", dir, "mode", "0700", "previous_mode", fmt.Sprintf("%04o", fi.Mode().Perm()))
+		} else {
+			level.Warn(logger).Log("msg", "other users can access the key directory, it should have mode 0700. Run chmod 700 on it, or restart the agent with -fix-permissions", "path", dir, "mode", fmt.Sprintf("%04o", fi.Mode().Perm()))
+		}
+	}
+
+	fi, err := os.Stat(keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0077 == 0 {
+		return nil
+	}
+	if !fix {
+		return fmt.Errorf("%w: %s has mode %04o, it should have mode 0600. Run chmod 600 on it, or restart the agent with -fix-permissions", ErrKeyPermissions, keyFile, fi.Mode().Perm())
+	}
+	if err := os.Chmod(keyFile, 0600); err != nil {
+		return fmt.Errorf("fixing the permissions of %s: %w", keyFile, err)
+	}
+	level.Info(logger).Log("msg", "fixed the permissions of the private key", "path", keyFile, "mode", "0600", "previous_mode", fmt.Sprintf("%04o", fi.Mode().Perm()))
+	return nil
+}
@@ -0,0 +1,89 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Probe connects to the gateway, verifies its host key against the known
+// hosts file and authenticates with the key and certificate of cfg, then
+// closes the connection. No tunnel is set up.
+func Probe(ctx context.Context, cfg *Config) error {
+	keyPEM, err := readKeyMaterial(cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("reading key file: %w", err)
+	}
+	key, err := ssh.ParseRawPrivateKey(keyPEM)
+	wipe(keyPEM)
+	if err != nil {
+		return fmt.Errorf("parsing key file: %w", err)
+	}
+	defer wipeKey(key)
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return fmt.Errorf("parsing key file: %w", err)
+	}
+
+	cert, err := ReadCertificate(cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return err
+	}
+
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsFilePath())
+	if err != nil {
+		return fmt.Errorf("reading known hosts file: %w", err)
+	}
+
+	addr := net.JoinHostPort(cfg.URL.String(), strconv.Itoa(cfg.Port))
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("connecting to the gateway: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            cfg.PDC.HostedGrafanaID,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return fmt.Errorf("ssh handshake with the gateway: %w", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for ch := range chans {
+			_ = ch.Reject(ssh.Prohibited, "probe")
+		}
+	}()
+	return c.Close()
+}
+
+// ReadCertificate reads the certificate of the key pair at keyFile.
+func ReadCertificate(keyFile string) (*ssh.Certificate, error) {
+	certBytes, err := os.ReadFile(keyFile + "-cert.pub")
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate file: %w", err)
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate file: %w", err)
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s-cert.pub is not a certificate", keyFile)
+	}
+	return cert, nil
+}
@@ -0,0 +1,131 @@
+package ssh_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/mikesmitty/edkey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startTestGateway starts an ssh server which accepts user certificates
+// signed by testCA, and returns its address and host key.
+func startTestGateway(t *testing.T) (string, gossh.PublicKey) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := gossh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+
+	checker := &gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), testCA.PublicKey().Marshal())
+		},
+	}
+	serverCfg := &gossh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+	serverCfg.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sc, chans, reqs, err := gossh.NewServerConn(conn, serverCfg)
+				if err != nil {
+					return
+				}
+				defer sc.Close()
+				go gossh.DiscardRequests(reqs)
+				for ch := range chans {
+					_ = ch.Reject(gossh.Prohibited, "test")
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), hostSigner.PublicKey()
+}
+
+// writeTestKeys writes a key pair and a certificate valid from validAfter
+// signed by testCA at keyFile.
+func writeTestKeys(t *testing.T, keyFile string, validAfter time.Time) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block := &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: edkey.MarshalED25519PrivateKey(key)}
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+
+	sshPub, err := gossh.NewPublicKey(pub)
+	require.NoError(t, err)
+	cert, err := signTestCert(gossh.MarshalAuthorizedKey(sshPub), validAfter, validAfter.Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile+"-cert.pub", gossh.MarshalAuthorizedKey(cert), 0600))
+}
+
+func TestProbe(t *testing.T) {
+	addr, hostKey := startTestGateway(t)
+	host, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	_, otherHostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherHostSigner, err := gossh.NewSignerFromKey(otherHostKey)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name       string
+		hostKey    gossh.PublicKey
+		validAfter time.Time
+		err        bool
+	}{
+		{name: "valid certificate", hostKey: hostKey, validAfter: time.Now().Add(-time.Minute)},
+		{name: "certificate not yet valid", hostKey: hostKey, validAfter: time.Now().Add(time.Hour), err: true},
+		{name: "unknown host key", hostKey: otherHostSigner.PublicKey(), validAfter: time.Now().Add(-time.Minute), err: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := ssh.DefaultConfig()
+			cfg.KeyFile = filepath.Join(dir, "grafana_pdc")
+			cfg.URL = &url.URL{Path: host}
+			cfg.Port = port
+			cfg.PDC = pdc.Config{HostedGrafanaID: "key"}
+
+			writeTestKeys(t, cfg.KeyFile, tc.validAfter)
+			kh := knownhosts.Line([]string{knownhosts.Normalize(addr)}, tc.hostKey)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, ssh.KnownHostsFile), []byte(kh+"\n"), 0600))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := ssh.Probe(ctx, cfg)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
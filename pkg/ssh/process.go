@@ -0,0 +1,45 @@
+package ssh
+
+import (
+	"errors"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// setPID records pid as the one of the latest ssh process, or clears it
+// if pid is 0 and prev is the latest one.
+func (s *Client) setPID(pid, prev int) {
+	s.pidMu.Lock()
+	defer s.pidMu.Unlock()
+	if pid != 0 || s.pid == prev {
+		s.pid = pid
+	}
+}
+
+// sshPID returns the pid of the latest ssh process, which serves the tunnel
+// once healthy.
+func (s *Client) sshPID() (int, error) {
+	s.pidMu.Lock()
+	defer s.pidMu.Unlock()
+	if s.pid == 0 {
+		return 0, errors.New("ssh is not running")
+	}
+	return s.pid, nil
+}
+
+// registerProcessCollector exposes the CPU, memory and file descriptors of
+// the ssh process as pdc_agent_ssh_process_* metrics, labelled with the key
+// file. The ones of the agent are the process_* metrics.
+func (s *Client) registerProcessCollector() {
+	c := prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{
+		PidFn:     s.sshPID,
+		Namespace: "pdc_agent_ssh",
+	})
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"key_file": s.cfg.KeyFile}, prometheus.DefaultRegisterer)
+	if err := reg.Register(c); err != nil {
+		level.Debug(s.logger).Log("msg", "could not register ssh process metrics", "err", err)
+		return
+	}
+	s.unregisterProcessCollector = func() { reg.Unregister(c) }
+}
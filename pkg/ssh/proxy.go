@@ -0,0 +1,297 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+	"github.com/grafana/pdc-agent/pkg/socks"
+)
+
+// proxyDialTimeout is the timeout of the connections of the forward proxy to
+// the agent network.
+const proxyDialTimeout = 10 * time.Second
+
+// forwardProxy is the SOCKS5 server the gateway connections are forwarded
+// to, instead of the one of ssh, so the agent controls the connections to
+// its network.
+type forwardProxy struct {
+	l net.Listener
+	// local, if set, serves the SOCKS5 connections of the agent host.
+	local   net.Listener
+	logger  log.Logger
+	keyFile string
+
+	// slots holds a value for every open connection, if their number is
+	// limited. Connections wait for a slot for up to queueTimeout when
+	// fewer than queueSize already wait, and are rejected otherwise.
+	slots        chan struct{}
+	queueSize    int32
+	queueTimeout time.Duration
+	queued       atomic.Int32
+
+	resolver  *resolver
+	allowlist allowlist
+	// audit, if set, logs every connection.
+	audit log.Logger
+}
+
+// newForwardProxy starts the forward proxy of cfg on the loopback interface.
+func newForwardProxy(cfg *Config, logger log.Logger) (*forwardProxy, error) {
+	resolver, err := newResolver(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("starting forward proxy: %w", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("starting forward proxy: %w", err)
+	}
+	p := &forwardProxy{
+		l:            l,
+		logger:       logger,
+		keyFile:      cfg.KeyFile,
+		queueSize:    int32(cfg.ChannelQueueSize),
+		queueTimeout: cfg.ChannelQueueTimeout,
+		audit:        cfg.Audit,
+		resolver:     resolver,
+		allowlist:    allowlist{rules: cfg.AllowedTargets, lookupIP: resolver.lookupIP},
+	}
+	if cfg.MaxChannels > 0 {
+		p.slots = make(chan struct{}, cfg.MaxChannels)
+	}
+	if cfg.SOCKSListenAddr != "" {
+		if p.local, err = net.Listen("tcp", cfg.SOCKSListenAddr); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("starting SOCKS5 listener: %w", err)
+		}
+		level.Info(logger).Log("msg", "serving SOCKS5 connections to the agent network", "addr", p.local.Addr())
+		crash.Go(func() { p.serve(p.local, "local") })
+	}
+	crash.Go(func() { p.serve(p.l, "gateway") })
+	return p, nil
+}
+
+// addr is the address ssh forwards the gateway connections to.
+func (p *forwardProxy) addr() string {
+	return p.l.Addr().String()
+}
+
+func (p *forwardProxy) close() error {
+	if p.local != nil {
+		_ = p.local.Close()
+	}
+	return p.l.Close()
+}
+
+// serve handles the connections of l, from source, gateway or local.
+func (p *forwardProxy) serve(l net.Listener, source string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		crash.Go(func() { p.handle(conn, source) })
+	}
+}
+
+func (p *forwardProxy) handle(conn net.Conn, source string) {
+	defer conn.Close()
+
+	target, err := socks.ReadRequest(conn)
+	if err != nil {
+		level.Debug(p.logger).Log("msg", "invalid forwarded connection", "err", err)
+		return
+	}
+
+	rec := auditRecord{source: source, target: target, start: time.Now(), result: "error"}
+	defer p.logAudit(&rec)
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	addr, ok, err := p.allowlist.allow(ctx, target)
+	if err != nil {
+		level.Info(p.logger).Log("msg", "could not resolve forwarded connection target", "target", target, "err", err)
+		_ = socks.WriteReply(conn, dialErrorReply(err), nil)
+		return
+	}
+	if !ok {
+		rec.result = "not_allowed"
+		channelsRejected.WithLabelValues(p.keyFile, "not_allowed").Inc()
+		level.Warn(p.logger).Log("msg", "rejecting forwarded connection: target not allowed by -tunnel.allow-target", "target", target)
+		_ = socks.WriteReply(conn, socks.ReplyNotAllowed, nil)
+		return
+	}
+
+	release, ok := p.acquire()
+	if !ok {
+		rec.result = "max_channels"
+		channelsRejected.WithLabelValues(p.keyFile, "max_channels").Inc()
+		level.Warn(p.logger).Log("msg", "rejecting forwarded connection: too many concurrent connections", "target", target, "max", cap(p.slots))
+		_ = socks.WriteReply(conn, socks.ReplyGeneralFailure, nil)
+		return
+	}
+	defer release()
+
+	rec.addr = addr
+	tconn, err := p.dial(addr)
+	if err != nil {
+		level.Info(p.logger).Log("msg", "could not connect to forwarded connection target", "target", target, "err", err)
+		_ = socks.WriteReply(conn, dialErrorReply(err), nil)
+		return
+	}
+	defer tconn.Close()
+	if err := socks.WriteReply(conn, socks.ReplySucceeded, tconn.LocalAddr()); err != nil {
+		return
+	}
+	rec.result = "ok"
+
+	// Each side closing its end is passed on to the other, so the
+	// connection ends once both did.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	crash.Go(func() {
+		defer wg.Done()
+		n, _ := io.Copy(tconn, conn)
+		rec.sent.Store(n)
+		closeWrite(tconn)
+	})
+	crash.Go(func() {
+		defer wg.Done()
+		n, _ := io.Copy(conn, tconn)
+		rec.received.Store(n)
+		closeWrite(conn)
+	})
+	wg.Wait()
+}
+
+// dial connects to addr, a host:port address. Host names are resolved with
+// the resolver of the proxy, and their addresses tried in order.
+func (p *forwardProxy) dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	ips, err := p.resolver.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// closeWrite closes the write side of conn, or conn if it cannot be half
+// closed.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// auditRecord describes a forwarded connection in the audit log.
+type auditRecord struct {
+	// source is gateway, or local for the connections of
+	// -tunnel.socks-listen-addr.
+	source string
+	// target is the address requested by the gateway, addr the address
+	// connected to, if any.
+	target string
+	addr   string
+	start  time.Time
+	// result is ok, not_allowed, max_channels or error.
+	result string
+	// sent and received count the bytes sent to and received from the
+	// target.
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func (p *forwardProxy) logAudit(rec *auditRecord) {
+	if p.audit == nil {
+		return
+	}
+	host, port, _ := net.SplitHostPort(rec.target)
+	_ = p.audit.Log(
+		"msg", "forwarded connection",
+		"source", rec.source,
+		"host", host,
+		"port", port,
+		"addr", rec.addr,
+		"result", rec.result,
+		"duration", time.Since(rec.start),
+		"bytes_sent", rec.sent.Load(),
+		"bytes_received", rec.received.Load(),
+	)
+}
+
+// acquire waits for a connection slot, and returns the function releasing
+// it. It returns false if no slot is free in time.
+func (p *forwardProxy) acquire() (func(), bool) {
+	if p.slots == nil {
+		return func() {}, true
+	}
+	release := func() { <-p.slots }
+
+	select {
+	case p.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	if p.queued.Add(1) > p.queueSize {
+		p.queued.Add(-1)
+		return nil, false
+	}
+	channelsQueued.WithLabelValues(p.keyFile).Inc()
+	defer func() {
+		p.queued.Add(-1)
+		channelsQueued.WithLabelValues(p.keyFile).Dec()
+	}()
+
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// dialErrorReply is the SOCKS5 reply to a connection which failed with err.
+func dialErrorReply(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks.ReplyConnectionRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return socks.ReplyHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks.ReplyNetworkUnreachable
+	default:
+		return socks.ReplyGeneralFailure
+	}
+}
@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// resolver resolves the host names of the connections forwarded by the
+// gateway: with the overrides of -resolve and of a hosts file, then with the
+// DNS servers of the agent, or else of the system.
+type resolver struct {
+	hosts map[string][]net.IP
+	dns   *net.Resolver
+	// prefer is 4 or 6 to sort the addresses of that IP version first, or 0
+	// to keep the order of the DNS servers.
+	prefer int
+}
+
+// newResolver returns the resolver of cfg. It reads its hosts file, if any.
+func newResolver(cfg *Config) (*resolver, error) {
+	r := &resolver{
+		hosts: map[string][]net.IP{},
+		dns:   net.DefaultResolver,
+	}
+	switch cfg.IPPreference {
+	case "4":
+		r.prefer = 4
+	case "6":
+		r.prefer = 6
+	}
+
+	if cfg.HostsFile != "" {
+		hosts, err := readHostsFile(cfg.HostsFile)
+		if err != nil {
+			return nil, err
+		}
+		r.hosts = hosts
+	}
+	for host, ips := range cfg.Resolve {
+		r.hosts[host] = ips
+	}
+
+	if len(cfg.DNSServers) > 0 {
+		servers := cfg.DNSServers
+		var next atomic.Uint32
+		r.dns = &net.Resolver{
+			PreferGo: true,
+			// Every query attempt goes to the next server, so an unreachable
+			// server is skipped on retry.
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				server := servers[int(next.Add(1)-1)%len(servers)]
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r, nil
+}
+
+// lookupIP returns the addresses of host, the ones of the preferred IP
+// version first.
+func (r *resolver) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, ok := r.hosts[normalizeHost(host)]
+	if ok {
+		ips = append([]net.IP(nil), ips...)
+	} else {
+		var err error
+		if ips, err = r.dns.LookupIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+	if r.prefer != 0 {
+		sort.SliceStable(ips, func(i, j int) bool {
+			return ipVersion(ips[i]) == r.prefer && ipVersion(ips[j]) != r.prefer
+		})
+	}
+	return ips, nil
+}
+
+func ipVersion(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// readHostsFile reads a file in the format of /etc/hosts: an IP address
+// followed by host names on every line, with # comments.
+func readHostsFile(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts := map[string][]net.IP{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expecting an IP address followed by host names", path, n)
+		}
+		for _, name := range fields[1:] {
+			name = normalizeHost(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
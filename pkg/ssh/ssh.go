@@ -7,20 +7,26 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
-	"path"
-	"sort"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
 	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/crash"
+	"github.com/grafana/pdc-agent/pkg/events"
 	"github.com/grafana/pdc-agent/pkg/pdc"
-	"github.com/grafana/pdc-agent/pkg/retry"
 )
 
 const (
@@ -41,21 +47,185 @@ type Config struct {
 	// ForceKeyFileOverwrite forces a new ssh key pair to be generated.
 	ForceKeyFileOverwrite bool
 	URL                   *url.URL
+	// HashFile stores the fingerprint of the configuration the certificate
+	// was signed for. Defaults to the key file with a _hash suffix.
+	HashFile string
+	// KnownHostsFile is the known hosts file of the gateway. Defaults to
+	// the KnownHostsFile of the directory of the key file.
+	KnownHostsFile string
+	// KeyFileMode, CertFileMode, KnownHostsFileMode and HashFileMode are the
+	// modes of the files written by the key manager, whatever the umask. The
+	// public key has the mode of the certificate. Default to 0600 if 0.
+	KeyFileMode        os.FileMode
+	CertFileMode       os.FileMode
+	KnownHostsFileMode os.FileMode
+	HashFileMode       os.FileMode
+	// ShutdownDrainTimeout is how long the ssh process is kept running after
+	// the agent is asked to stop, so in-flight queries can complete.
+	ShutdownDrainTimeout time.Duration
+	// Ciphers, KexAlgorithms and MACs restrict the algorithms ssh
+	// negotiates, in the format of ssh_config(5). The defaults of ssh are used
+	// if empty.
+	Ciphers       string
+	KexAlgorithms string
+	MACs          string
+	// KnownHostsGracePeriod is how long known hosts entries which are no
+	// longer returned by the PDC API are kept. The known hosts file is
+	// overwritten if 0.
+	KnownHostsGracePeriod time.Duration
+	// ConnectTimeout is how long ssh waits for the gateway to accept the
+	// connection and send its banner. It is rounded up to seconds.
+	ConnectTimeout time.Duration
+	// StrictHostKeyChecking is "yes", "accept-new" or "off". See
+	// ssh_config(5). The ssh default is used if empty.
+	StrictHostKeyChecking string
+	// HostCAKeysFile pins the gateway host keys, in the format of
+	// authorized_keys: with HostCAKeysMode "filter", only the known hosts
+	// entries returned by the PDC API with a pinned key are written, and
+	// with "replace", the pinned keys are trusted as host CAs instead.
+	HostCAKeysFile string
+	HostCAKeysMode string
+	// FIPS is true when only FIPS 140 approved algorithms may be used. See
+	// EnableFIPS.
+	FIPS bool
+	// Forwards are additional port forwards set up by ssh.
+	Forwards []Forward
+	// BinaryPath is the ssh binary to run, looked up in PATH if it has no
+	// path separator.
+	BinaryPath string
+	// Env holds KEY=VALUE environment variables added to the environment of
+	// the ssh process.
+	Env []string
+	// ClockSkewTolerance is how long before the start of its validity window
+	// a certificate is considered valid, to tolerate a local clock behind the
+	// PDC API clock.
+	ClockSkewTolerance time.Duration
+	// CertCheckInterval is how often the certificate validity is checked
+	// while connected. A new connection replaces the current one when the
+	// certificate is renewed.
+	CertCheckInterval time.Duration
+	// CertExpiryWarning is how long before the end of its validity window a
+	// warning is logged about the certificate. Disabled if 0.
+	CertExpiryWarning time.Duration
+	// PrincipalCheckInterval is how often the principals the PDC API signs
+	// are compared with the ones of the certificate, which is renewed when
+	// they differ. Disabled if 0.
+	PrincipalCheckInterval time.Duration
+	// NoAPI is true when the key, certificate and known hosts files are
+	// provisioned, and the PDC API is never called. The certificate is not
+	// renewed: the agent exits NoAPIExitBeforeExpiry before it expires.
+	NoAPI                 bool
+	NoAPIExitBeforeExpiry time.Duration
+	// Events, if set, receives the lifecycle events of the tunnel.
+	Events events.Sink
+	// Capabilities, if set, are reported to the PDC API once the tunnel is
+	// first connected.
+	Capabilities *pdc.Capabilities
+	// RetryMaxAttempts and RetryMaxElapsed are the retry budget of the ssh
+	// connection: the client fails with ErrRetryBudgetExhausted once it
+	// failed to reconnect RetryMaxAttempts times, or for RetryMaxElapsed.
+	// Unlimited if 0.
+	RetryMaxAttempts int
+	RetryMaxElapsed  time.Duration
+	// GatewayEndpoints are host[:port] addresses of other gateways of the
+	// cluster, sharing its host key. The port defaults to Port. The tunnel
+	// connects to the fastest healthy gateway, probed every
+	// GatewayProbeInterval.
+	GatewayEndpoints     []string
+	GatewayProbeInterval time.Duration
+	// GatewayIPVersion is "4" or "6" to only connect to the gateway over
+	// that IP version. Both are tried otherwise.
+	GatewayIPVersion string
+	// TrafficMetrics is true when ssh connects to the gateway through a
+	// local relay counting the bytes of the tunnel, and runs with at least
+	// -v so the forwarded channels are counted from its output.
+	TrafficMetrics bool
+	// MaxBandwidth is the maximum throughput of the tunnel in each
+	// direction, in bytes per second, enforced by the local relay.
+	// Unlimited if 0.
+	MaxBandwidth int
+	// MaxChannels is the maximum number of connections the gateway forwards
+	// to the agent network at once. Connections beyond it wait for up to
+	// ChannelQueueTimeout when fewer than ChannelQueueSize already wait, and
+	// are rejected otherwise. Unlimited if 0.
+	MaxChannels         int
+	ChannelQueueSize    int
+	ChannelQueueTimeout time.Duration
+	// AllowedTargets restricts the targets of the connections forwarded by
+	// the gateway. All targets are allowed if empty.
+	AllowedTargets []TargetRule
+	// DNSServers are the host:port DNS servers resolving the targets of the
+	// connections forwarded by the gateway, instead of the ones of the
+	// system. HostsFile, in the format of /etc/hosts, overrides them.
+	// IPPreference is "4" or "6" to connect to the addresses of that IP
+	// version first.
+	DNSServers   []string
+	HostsFile    string
+	IPPreference string
+	// Resolve maps host names to the addresses they resolve to, overriding
+	// DNSServers and HostsFile.
+	Resolve map[string][]net.IP
+	// SOCKSListenAddr, if set, is a local address the forward proxy also
+	// serves, to test the connections to the agent network the way the
+	// gateway makes them.
+	SOCKSListenAddr string
+	// Audit, if set, logs the target, duration and bytes transferred of
+	// every connection forwarded by the gateway.
+	Audit log.Logger
+
+	// Used for local development, to exercise reconnection and renewal.
+	//
+	// DevDropInterval is how long each ssh process runs before it is killed.
+	// Disabled if 0.
+	DevDropInterval time.Duration
+	// DevCertTTL is how long a certificate is used after it is written,
+	// whatever its validity window. Disabled if 0.
+	DevCertTTL time.Duration
 }
 
 // DefaultConfig returns a Config with some sensible defaults set
 func DefaultConfig() *Config {
+	return &Config{
+		Port:                  22,
+		LogLevel:              2,
+		PDC:                   pdc.Config{},
+		KeyFile:               defaultKeyFile(),
+		KeyFileMode:           defaultFileMode,
+		CertFileMode:          defaultFileMode,
+		KnownHostsFileMode:    defaultFileMode,
+		HashFileMode:          defaultFileMode,
+		BinaryPath:            "ssh",
+		StrictHostKeyChecking: "yes",
+		HostCAKeysMode:        HostCAKeysFilter,
+		ConnectTimeout:        time.Second,
+		KnownHostsGracePeriod: 7 * 24 * time.Hour,
+		CertCheckInterval:     time.Minute,
+		ClockSkewTolerance:    5 * time.Minute,
+		ChannelQueueTimeout:   10 * time.Second,
+		GatewayProbeInterval:  5 * time.Minute,
+	}
+}
+
+// defaultKeyFile returns ~/.ssh/grafana_pdc or, when XDG_STATE_HOME is set
+// and there is no key file in ~/.ssh, $XDG_STATE_HOME/pdc-agent/grafana_pdc.
+// Agents which already have a key in ~/.ssh keep it.
+func defaultKeyFile() string {
 	root, err := os.UserHomeDir()
 	if err != nil {
 		// Use relative path (should not happen)
 		root = ""
 	}
-	return &Config{
-		Port:     22,
-		LogLevel: 2,
-		PDC:      pdc.Config{},
-		KeyFile:  path.Join(root, ".ssh/grafana_pdc"),
+	keyFile := filepath.Join(root, ".ssh", "grafana_pdc")
+
+	// Relative paths in XDG variables are invalid, and ignored.
+	state := os.Getenv("XDG_STATE_HOME")
+	if !filepath.IsAbs(state) {
+		return keyFile
 	}
+	if _, err := os.Stat(keyFile); err == nil {
+		return keyFile
+	}
+	return filepath.Join(state, "pdc-agent", "grafana_pdc")
 }
 
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
@@ -64,19 +234,81 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	def := DefaultConfig()
 
 	cfg.SSHFlags = []string{}
-	f.StringVar(&cfg.KeyFile, "ssh-key-file", def.KeyFile, "The path to the SSH key file.")
+	f.StringVar(&cfg.KeyFile, "ssh-key-file", def.KeyFile, "The path to the SSH key file. The certificate, known hosts and instance ID files are written to its directory. Defaults to $XDG_STATE_HOME/pdc-agent/grafana_pdc when XDG_STATE_HOME is set and ~/.ssh/grafana_pdc does not exist.")
+	cfg.KeyFileMode, cfg.CertFileMode, cfg.KnownHostsFileMode, cfg.HashFileMode = def.KeyFileMode, def.CertFileMode, def.KnownHostsFileMode, def.HashFileMode
+	f.Var(fileModeValue{mode: &cfg.KeyFileMode}, "ssh.key-file-mode", "The octal `mode` of the private key, whatever the umask. Group and world permissions are rejected, as ssh refuses such a key")
+	f.Var(fileModeValue{mode: &cfg.CertFileMode, allowOthers: true}, "ssh.cert-file-mode", "The octal `mode` of the certificate and of the public key, whatever the umask")
+	f.Var(fileModeValue{mode: &cfg.KnownHostsFileMode, allowOthers: true}, "ssh.known-hosts-file-mode", "The octal `mode` of the known hosts file, whatever the umask")
+	f.Var(fileModeValue{mode: &cfg.HashFileMode, allowOthers: true}, "ssh.hash-file-mode", "The octal `mode` of the hash file, whatever the umask")
+	f.StringVar(&cfg.HashFile, "ssh.hash-file", "", "The path of the file storing the fingerprint of the configuration the certificate was signed for. Defaults to the path of -ssh-key-file with a _hash suffix")
 	f.IntVar(&deprecatedInt, "log-level", def.LogLevel, "[DEPRECATED] Use the log.level flag. The level of log verbosity. The maximum is 3.")
 	// use default log level if invalid
 	if cfg.LogLevel > 3 {
 		cfg.LogLevel = def.LogLevel
 	}
 	f.Func("ssh-flag", "Additional flags to be passed to ssh. Can be set more than once.", cfg.addSSHFlag)
+	f.Func("ssh.local-forward", "A [bind_address:]port:host:hostport port forward from the agent host to the gateway network, like the -L flag of ssh. Can be set more than once.", cfg.addForward(false))
+	f.Func("ssh.remote-forward", "A [bind_address:]port:host:hostport port forward from the gateway to the agent network, like the -R flag of ssh. Can be set more than once.", cfg.addForward(true))
+	f.Func("ssh.ciphers", `The comma separated ciphers ssh may use, or "fips" for the FIPS 140 approved ones. Defaults to the ones of ssh.`, algorithmsFlag(&cfg.Ciphers, fipsCiphers))
+	f.Func("ssh.kex", `The comma separated key exchange algorithms ssh may use, or "fips" for the FIPS 140 approved ones. Defaults to the ones of ssh.`, algorithmsFlag(&cfg.KexAlgorithms, fipsKexAlgorithms))
+	f.Func("ssh.macs", `The comma separated MAC algorithms ssh may use, or "fips" for the FIPS 140 approved ones. Defaults to the ones of ssh.`, algorithmsFlag(&cfg.MACs, fipsMACs))
+	f.DurationVar(&cfg.KnownHostsGracePeriod, "ssh.known-hosts-grace-period", def.KnownHostsGracePeriod, "How long to keep gateway host keys which are no longer returned by the PDC API in the known hosts file, so connections keep working while they are rotated. The known hosts file is overwritten if 0.")
+	cfg.StrictHostKeyChecking = def.StrictHostKeyChecking
+	f.DurationVar(&cfg.ConnectTimeout, "ssh.connect-timeout", def.ConnectTimeout, "How long ssh waits for the gateway to accept the connection, rounded up to seconds, before retrying, so an unreachable gateway address fails fast.")
+	f.Func("ssh.strict-host-key-checking", `How ssh verifies the gateway host key: "yes" only accepts the keys of the known hosts file written by the agent, "accept-new" also adds new keys to it, "off" accepts any key. (default "yes")`, cfg.setStrictHostKeyChecking)
+	f.StringVar(&cfg.BinaryPath, "ssh.binary-path", def.BinaryPath, "The ssh binary to run. Looked up in PATH if it is not a path.")
+	f.Func("ssh.env", "A KEY=VALUE environment variable to set for the ssh process, e.g. SSH_AUTH_SOCK=/run/agent.sock. Can be set more than once.", cfg.addSSHEnv)
 	f.BoolVar(&cfg.ForceKeyFileOverwrite, "force-key-file-overwrite", false, "Force a new ssh key pair to be generated")
+	f.DurationVar(&cfg.CertCheckInterval, "cert.check-interval", def.CertCheckInterval, "How often to check the certificate validity while connected. When it is renewed, a new connection replaces the current one without downtime. Disabled if 0")
+	f.DurationVar(&cfg.PrincipalCheckInterval, "cert.principal-check-interval", 0, "How often to have the public key signed and compare the principals with the ones of the certificate, to renew it as soon as the access policy of the token changed. Each check is a signing request. Disabled if 0")
+	f.DurationVar(&cfg.CertExpiryWarning, "cert.expiry-warning", 0, "Log a warning when the certificate expires within this duration, checked every -cert.check-interval. Disabled if 0")
+	f.DurationVar(&cfg.ClockSkewTolerance, "cert.clock-skew-tolerance", def.ClockSkewTolerance, "How long before the start of its validity a certificate is considered valid, to tolerate a local clock behind the PDC API clock")
+	f.BoolVar(&cfg.NoAPI, "no-api", false, "Do not call the PDC API, for hosts which can reach the gateway but not the API. The key pair, certificate and known hosts files must be provisioned next to -ssh-key-file")
+	f.DurationVar(&cfg.NoAPIExitBeforeExpiry, "no-api.exit-before-expiry", time.Minute, "With -no-api, how long before the certificate expires the agent exits, to be restarted once new files are provisioned")
+	f.IntVar(&cfg.RetryMaxAttempts, "ssh.retry-max-attempts", 0, "Exit with code 4 after this many consecutive failed ssh connections, for orchestrators which reschedule the agent. A connection up for 10s resets the count. Unlimited if 0")
+	f.DurationVar(&cfg.RetryMaxElapsed, "ssh.retry-max-elapsed", 0, "Exit with code 4 once ssh connections have been failing for this long. Unlimited if 0")
+	f.IntVar(&cfg.MaxBandwidth, "tunnel.max-bandwidth", 0, "The maximum throughput of the tunnel in each direction, in bytes per second, so heavy queries do not saturate the uplink of the agent host. ssh connects to the gateway through a local relay. Unlimited if 0")
+	f.IntVar(&cfg.MaxChannels, "tunnel.max-channels", 0, "The maximum number of connections the gateway forwards to the agent network at once, so a misbehaving dashboard cannot exhaust the resources of the agent host. Unlimited if 0")
+	f.IntVar(&cfg.ChannelQueueSize, "tunnel.channel-queue-size", 0, "With -tunnel.max-channels, how many connections may wait for another one to close rather than being rejected")
+	f.DurationVar(&cfg.ChannelQueueTimeout, "tunnel.channel-queue-timeout", def.ChannelQueueTimeout, "With -tunnel.channel-queue-size, how long a connection waits for another one to close before being rejected")
+	f.Func("tunnel.allow-target", "A host[:port[-port]] the gateway may connect to through the agent, where host is a host name, a *.domain wildcard, an IP address or a CIDR network, e.g. 10.0.0.0/8:5432. Can be set more than once. All targets are allowed if not set.", cfg.addAllowedTarget)
+	f.Func("tunnel.dns-servers", "The comma separated host[:port] DNS servers resolving the targets of the connections forwarded by the gateway, e.g. for split-horizon DNS. Defaults to the resolver of the system.", cfg.setDNSServers)
+	f.StringVar(&cfg.HostsFile, "tunnel.hosts-file", "", "A file in the format of /etc/hosts overriding the addresses of the targets of the connections forwarded by the gateway.")
+	f.Func("tunnel.ip-preference", `The IP version of the addresses of targets to connect to first: "4", "6", or "auto" for the order of the resolver. (default "auto")`, cfg.setIPPreference)
+	f.Func("gateway.endpoints", "The comma separated host[:port] addresses of other gateways of the cluster, sharing its host key. The port defaults to the one of the gateway. The agent connects to the gateway with the lowest latency.", cfg.setGatewayEndpoints)
+	f.DurationVar(&cfg.GatewayProbeInterval, "gateway.probe-interval", def.GatewayProbeInterval, "With -gateway.endpoints, how often to probe the latency of the gateways, moving the tunnel to a faster one")
+	f.StringVar(&cfg.HostCAKeysFile, "gateway.ca-keys-file", "", "A file of the host CA `keys` of the gateway, one per line in the format of authorized_keys, so a compromised PDC API response cannot have the agent connect to another gateway. Disabled if empty")
+	cfg.HostCAKeysMode = def.HostCAKeysMode
+	f.Func("gateway.ca-keys-mode", `With -gateway.ca-keys-file, "filter" only keeps the host keys returned by the PDC API which are in the file, "replace" trusts the keys of the file instead of the ones returned by the PDC API. (default "filter")`, cfg.setHostCAKeysMode)
+	f.Func("gateway.ip-version", `The IP version to connect to the gateway over: "4", "6", or "auto" for both, e.g. "4" on hosts with broken IPv6 connectivity. (default "auto")`, cfg.setGatewayIPVersion)
+	f.Func("resolve", "A host=ip[,ip] override of the addresses of a target of the connections forwarded by the gateway, to reach datasources whose names the agent host cannot resolve. Can be set more than once.", cfg.addResolve)
+	f.StringVar(&cfg.SOCKSListenAddr, "tunnel.socks-listen-addr", "", "A local address, e.g. 127.0.0.1:1080, serving SOCKS5 connections to the agent network like the ones of the gateway, with the same allowed targets, resolver, limits and audit log, to test the reachability of datasources with e.g. curl --socks5-hostname.")
+	f.BoolVar(&cfg.TrafficMetrics, "tunnel.traffic-metrics", false, "Expose the bytes sent and received through the tunnel, and the forwarded channels, as metrics. ssh connects to the gateway through a local relay, and runs with at least -v")
+	f.DurationVar(&cfg.ShutdownDrainTimeout, "shutdown.drain-timeout", 0, "How long to keep the tunnel open after receiving SIGINT or SIGTERM, so in-flight queries can complete. The ssh process is stopped immediately if 0")
+}
+
+// HashFilePath returns the path of the hash file, HashFile or the path of the
+// key file with a _hash suffix.
+func (cfg Config) HashFilePath() string {
+	if cfg.HashFile != "" {
+		return cfg.HashFile
+	}
+	return cfg.KeyFile + "_hash"
+}
+
+// KnownHostsFilePath returns the path of the known hosts file,
+// KnownHostsFile or the KnownHostsFile of the directory of the key file.
+func (cfg Config) KnownHostsFilePath() string {
+	if cfg.KnownHostsFile != "" {
+		return cfg.KnownHostsFile
+	}
+	return filepath.Join(cfg.KeyFileDir(), KnownHostsFile)
 }
 
+// KeyFileDir returns the directory of the key file, using the path
+// separators and volume names of the current OS.
 func (cfg Config) KeyFileDir() string {
-	dir, _ := path.Split(cfg.KeyFile)
-	return dir
+	return filepath.Dir(cfg.KeyFile)
 }
 
 func (cfg *Config) addSSHFlag(s string) error {
@@ -84,6 +316,172 @@ func (cfg *Config) addSSHFlag(s string) error {
 	return nil
 }
 
+func (cfg *Config) addForward(remote bool) func(string) error {
+	return func(s string) error {
+		f, err := ParseForward(s, remote)
+		if err != nil {
+			return err
+		}
+		cfg.Forwards = append(cfg.Forwards, f)
+		return nil
+	}
+}
+
+func (cfg *Config) addAllowedTarget(s string) error {
+	r, err := ParseTargetRule(s)
+	if err != nil {
+		return err
+	}
+	cfg.AllowedTargets = append(cfg.AllowedTargets, r)
+	return nil
+}
+
+func (cfg *Config) setDNSServers(s string) error {
+	cfg.DNSServers = nil
+	for _, server := range strings.Split(s, ",") {
+		server = strings.TrimSpace(server)
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		host, _, _ := net.SplitHostPort(server)
+		if host == "" {
+			return fmt.Errorf("invalid DNS server %q", server)
+		}
+		cfg.DNSServers = append(cfg.DNSServers, server)
+	}
+	return nil
+}
+
+func (cfg *Config) addResolve(s string) error {
+	host, addrs, ok := strings.Cut(s, "=")
+	host = normalizeHost(host)
+	if !ok || host == "" {
+		return fmt.Errorf("invalid override %q: expecting host=ip[,ip]", s)
+	}
+	var ips []net.IP
+	for _, addr := range strings.Split(addrs, ",") {
+		ip := net.ParseIP(strings.Trim(strings.TrimSpace(addr), "[]"))
+		if ip == nil {
+			return fmt.Errorf("invalid override %q: invalid IP address %q", s, addr)
+		}
+		ips = append(ips, ip)
+	}
+	if cfg.Resolve == nil {
+		cfg.Resolve = map[string][]net.IP{}
+	}
+	cfg.Resolve[host] = ips
+	return nil
+}
+
+func (cfg *Config) setGatewayEndpoints(s string) error {
+	cfg.GatewayEndpoints = nil
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if _, err := parseGatewayEndpoint(e, 22); err != nil {
+			return err
+		}
+		cfg.GatewayEndpoints = append(cfg.GatewayEndpoints, e)
+	}
+	return nil
+}
+
+func (cfg *Config) setIPPreference(s string) (err error) {
+	cfg.IPPreference, err = parseIPVersion(s)
+	return err
+}
+
+func (cfg *Config) setGatewayIPVersion(s string) (err error) {
+	cfg.GatewayIPVersion, err = parseIPVersion(s)
+	return err
+}
+
+// parseIPVersion parses "auto", "4" or "6", returning "" for auto.
+func parseIPVersion(s string) (string, error) {
+	switch s {
+	case "auto":
+		return "", nil
+	case "4", "6":
+		return s, nil
+	default:
+		return "", errors.New(`must be "auto", "4" or "6"`)
+	}
+}
+
+// gatewayNetwork is the network the agent dials the gateway over.
+func (cfg *Config) gatewayNetwork() string {
+	return "tcp" + cfg.GatewayIPVersion
+}
+
+// secondsOption is the value of an ssh option in seconds, such as
+// ConnectTimeout, of d rounded up to a positive number of seconds.
+func secondsOption(d time.Duration) string {
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
+
+// relayEnabled is true when ssh connects to the gateway through the traffic
+// relay.
+func (cfg *Config) relayEnabled() bool {
+	return !cfg.LegacyMode && (cfg.TrafficMetrics || cfg.MaxBandwidth > 0)
+}
+
+// forwardProxyEnabled is true when the agent serves the connections
+// forwarded by the gateway rather than ssh.
+func (cfg *Config) forwardProxyEnabled() bool {
+	return !cfg.LegacyMode && (cfg.MaxChannels > 0 || len(cfg.AllowedTargets) > 0 || cfg.Audit != nil ||
+		len(cfg.DNSServers) > 0 || cfg.HostsFile != "" || cfg.IPPreference != "" || len(cfg.Resolve) > 0 ||
+		cfg.SOCKSListenAddr != "")
+}
+
+func (cfg *Config) setStrictHostKeyChecking(s string) error {
+	switch s {
+	case "yes", "accept-new", "off":
+		cfg.StrictHostKeyChecking = s
+		return nil
+	default:
+		return fmt.Errorf(`invalid value %q: must be "yes", "accept-new" or "off"`, s)
+	}
+}
+
+func (cfg *Config) addSSHEnv(s string) error {
+	name, _, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid environment variable %q: must be KEY=VALUE", s)
+	}
+	cfg.Env = append(cfg.Env, s)
+	return nil
+}
+
+// ErrSSHNotFound is returned on start when the ssh binary cannot be found.
+var ErrSSHNotFound = errors.New("ssh binary not found")
+
+// ErrRetryBudgetExhausted is the failure of a Client which gave up
+// reconnecting, once RetryMaxAttempts or RetryMaxElapsed is reached.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// lookupSSH checks that the ssh binary exists, and returns an error
+// explaining how to install it otherwise.
+func lookupSSH(name string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%w: %w. %s", ErrSSHNotFound, err, sshInstallGuidance())
+	}
+	return nil
+}
+
+func sshInstallGuidance() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "Install the OpenSSH client with `Add-WindowsCapability -Online -Name OpenSSH.Client~~~~0.0.1.0` in an administrator PowerShell, or add the directory containing ssh.exe to PATH"
+	case "darwin":
+		return "The OpenSSH client ships with macOS: check that the directory containing ssh, usually /usr/bin, is in PATH"
+	default:
+		return "Install the OpenSSH client with the package manager of your distribution, e.g. `apt-get install openssh-client`, `dnf install openssh-clients` or `apk add openssh-client`, and check that it is in PATH"
+	}
+}
+
 // Client is a client for ssh. It configures and runs ssh commands
 type Client struct {
 	*services.BasicService
@@ -91,24 +489,134 @@ type Client struct {
 	SSHCmd string // SSH command to run, defaults to "ssh". Require for testing.
 	logger log.Logger
 	km     *KeyManager
+
+	// HealthyAfter is how long a new ssh connection must stay up before it
+	// replaces the previous one. Configurable for testing.
+	HealthyAfter time.Duration
+
+	// mu guards stopped and the calls to running.Add, so that no new ssh
+	// process is started once stopping waits on running.
+	mu      sync.Mutex
+	stopped bool
+	running sync.WaitGroup
+
+	// pidMu guards pid, the pid of the latest ssh process, or 0.
+	pidMu sync.Mutex
+	pid   int
+	// unregisterProcessCollector, if set, removes the ssh process metrics.
+	unregisterProcessCollector func()
+
+	// connMu guards conn, the connection serving the tunnel.
+	connMu sync.Mutex
+	conn   *connection
+
+	// renew receives the requests of RenewCertificate.
+	renew chan struct{}
+	// certCheckChanged is notified by SetCertCheckInterval.
+	certCheckChanged chan struct{}
+	// reconnect receives the requests of Reconnect.
+	reconnect chan struct{}
+	// failed receives the error the service fails with, once the connection
+	// gives up reconnecting.
+	failed chan error
+
+	// selector selects the gateway to connect to, with GatewayEndpoints.
+	selector *gatewaySelector
+
+	// relay counts and limits the traffic of the tunnel, with TrafficMetrics
+	// or MaxBandwidth.
+	relay *trafficRelay
+
+	// proxy serves the connections forwarded by the gateway, in place of
+	// the SOCKS5 server of ssh, when enabled by the config.
+	proxy *forwardProxy
+
+	// reportOnce reports the capabilities of the agent on the first
+	// connection.
+	reportOnce sync.Once
+	// overrideWarning warns once about the -ssh-flag options replacing the
+	// ones set by the agent.
+	overrideWarning sync.Once
+
+	// statusMu guards lastConnected and lastError, reported by Status.
+	statusMu      sync.Mutex
+	lastConnected time.Time
+	lastError     string
+}
+
+// Status is the status of the tunnel of a Client.
+type Status struct {
+	// LastConnected is when an ssh process last became healthy. It is the
+	// zero time if none did.
+	LastConnected time.Time
+	// LastError is why the last ssh process exited, if it did.
+	LastError string
+	// CertValidBefore is when the certificate expires. It is the zero time
+	// if it never expires or cannot be read.
+	CertValidBefore time.Time
+}
+
+// Status returns the status of the tunnel.
+func (s *Client) Status() Status {
+	s.statusMu.Lock()
+	status := Status{LastConnected: s.lastConnected, LastError: s.lastError}
+	s.statusMu.Unlock()
+
+	if s.km != nil {
+		status.CertValidBefore, _ = s.km.CertValidBefore()
+	}
+	return status
+}
+
+func (s *Client) setConnected(t time.Time) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.lastConnected = t
+}
+
+func (s *Client) setLastError(msg string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.lastError = msg
 }
 
 // NewClient returns a new SSH client in an idle state
 func NewClient(cfg *Config, logger log.Logger, km *KeyManager) *Client {
+	sshCmd := cfg.BinaryPath
+	if sshCmd == "" {
+		sshCmd = "ssh"
+	}
+
 	client := &Client{
-		cfg:    cfg,
-		SSHCmd: "ssh",
-		logger: logger,
-		km:     km,
+		cfg:              cfg,
+		SSHCmd:           sshCmd,
+		HealthyAfter:     10 * time.Second,
+		logger:           logger,
+		km:               km,
+		renew:            make(chan struct{}, 1),
+		certCheckChanged: make(chan struct{}, 1),
+		reconnect:        make(chan struct{}, 1),
+		failed:           make(chan error, 1),
 	}
 
-	client.BasicService = services.NewIdleService(client.starting, client.stopping)
+	client.BasicService = services.NewBasicService(client.starting, client.run, client.stopping)
 	return client
 }
 
 func (s *Client) starting(ctx context.Context) error {
+	defer crash.Recover()
+
 	level.Info(s.logger).Log("msg", "starting ssh client")
 
+	// Fail now rather than retrying to run a missing binary forever.
+	if err := lookupSSH(s.SSHCmd); err != nil {
+		level.Error(s.logger).Log("msg", "cannot start ssh client", "err", err)
+		return err
+	}
+	if err := s.checkSSHVersion(ctx); err != nil {
+		return err
+	}
+
 	// check keys and cert validity before start, create new cert if required
 	// This will exit if it fails, rather than endlessly retrying to sign keys.
 	if s.km != nil {
@@ -119,6 +627,32 @@ func (s *Client) starting(ctx context.Context) error {
 		}
 	}
 
+	if len(s.cfg.GatewayEndpoints) > 0 && !s.cfg.LegacyMode {
+		s.selector = newGatewaySelector(s.cfg, s.logger)
+		s.selector.update(ctx)
+	}
+
+	if s.cfg.relayEnabled() {
+		relay, err := newTrafficRelay(s.cfg.gatewayNetwork(), func() string {
+			host, port := s.gateway()
+			return net.JoinHostPort(host, strconv.Itoa(port))
+		}, s.cfg.KeyFile, s.cfg.MaxBandwidth, s.logger)
+		if err != nil {
+			level.Error(s.logger).Log("msg", "cannot start ssh client", "err", err)
+			return err
+		}
+		s.relay = relay
+	}
+
+	if s.cfg.forwardProxyEnabled() {
+		proxy, err := newForwardProxy(s.cfg, s.logger)
+		if err != nil {
+			level.Error(s.logger).Log("msg", "cannot start ssh client", "err", err)
+			return err
+		}
+		s.proxy = proxy
+	}
+
 	// Attempt to parse SSH flags before triggering the goroutine, so we can exit
 	// if the parsing fails
 	flags, err := s.SSHFlagsFromConfig()
@@ -127,157 +661,309 @@ func (s *Client) starting(ctx context.Context) error {
 		return err
 	}
 	level.Debug(s.logger).Log("msg", fmt.Sprintf("parsed flags: %s", flags))
-
-	retryOpts := retry.Opts{MaxBackoff: 16 * time.Second, InitialBackoff: 1 * time.Second}
-	go retry.Forever(retryOpts, func() error {
-		cmd := exec.CommandContext(ctx, s.SSHCmd, flags...)
-		loggerWriter := newLoggerWriterAdapter(s.logger)
-		cmd.Stdout = loggerWriter
-		cmd.Stderr = loggerWriter
-		_ = cmd.Run()
-		if ctx.Err() != nil {
-			return nil // context was canceled
+	for _, f := range s.cfg.Forwards {
+		if s.cfg.LegacyMode {
+			break
 		}
+		level.Info(s.logger).Log("msg", "port forward configured", "remote", f.Remote, "forward", f.String())
+	}
 
-		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == ConnectionLimitReachedCode {
-			level.Info(s.logger).Log("msg", "limit of connections for stack and network reached. exiting")
-			os.Exit(1)
-		}
+	s.registerProcessCollector()
 
-		level.Error(s.logger).Log("msg", "ssh client exited. restarting")
-
-		// Check keys and cert validity before restart, create new cert if required.
-		// This covers the case where a certificate has become invalid since the last start.
-		// Do not return here: we want to keep trying to connect in case the PDC API
-		// is temporarily unavailable.
-		if s.km != nil {
-			err := s.km.CreateKeys(ctx)
-			if err != nil {
-				level.Error(s.logger).Log("msg", "could not check or generate certificate", "error", err)
-			}
-		}
+	s.connMu.Lock()
+	s.conn = s.connect(ctx, false)
+	s.connMu.Unlock()
 
-		return fmt.Errorf("ssh client exited")
-	})
+	go s.renewLoop(ctx)
+	if s.selector != nil {
+		go s.gatewayLoop(ctx)
+	}
 
 	return nil
 }
 
+// run waits until the client is stopped, or the connection gives up
+// reconnecting.
+func (s *Client) run(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-s.failed:
+		return err
+	}
+}
+
+// giveUp fails the service with err.
+func (s *Client) giveUp(err error) {
+	select {
+	case s.failed <- err:
+	default:
+		// The service is already failing.
+	}
+}
+
 func (s *Client) stopping(err error) error {
 	level.Info(s.logger).Log("msg", "stopping ssh client")
+
+	// The service context is already canceled: wait for the ssh process to
+	// exit, which takes up to ShutdownDrainTimeout.
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.running.Wait()
+
+	if s.relay != nil {
+		_ = s.relay.close()
+	}
+	if s.unregisterProcessCollector != nil {
+		s.unregisterProcessCollector()
+	}
+	if s.proxy != nil {
+		_ = s.proxy.close()
+	}
+
 	return err
 }
 
-// SSHFlagsFromConfig generates the array of flags to pass to the ssh command.
-// It does not stop default flags from being overidden, but only the first instance
-// of `-o` flags are used.
+// SetLogLevel changes the ssh verbosity. It is applied the next time an ssh
+// process is started.
+func (s *Client) SetLogLevel(lvl int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.LogLevel = lvl
+}
+
+func (s *Client) logLevel() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg.LogLevel
+}
+
+// SetCertCheckInterval changes how often the certificate validity is
+// checked while connected. Disabled if 0.
+func (s *Client) SetCertCheckInterval(d time.Duration) {
+	s.mu.Lock()
+	s.cfg.CertCheckInterval = d
+	s.mu.Unlock()
+
+	select {
+	case s.certCheckChanged <- struct{}{}:
+	default:
+		// A change is already pending, the loop reads the latest interval.
+	}
+}
+
+func (s *Client) certCheckInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg.CertCheckInterval
+}
+
+// SSHFlagsFromConfig generates the array of flags to pass to the ssh command,
+// the arguments of Options, or Args in legacy mode.
 func (s *Client) SSHFlagsFromConfig() ([]string, error) {
 	if s.cfg.LegacyMode {
 		level.Warn(s.logger).Log("msg", "running in legacy mode")
 		return s.cfg.Args, nil
 	}
 
-	keyFileArr := strings.Split(s.cfg.KeyFile, "/")
-	keyFileDir := strings.Join(keyFileArr[:len(keyFileArr)-1], "/")
-
-	logLevelFlag := ""
-	if s.cfg.LogLevel > 0 {
-		logLevelFlag = "-" + strings.Repeat("v", s.cfg.LogLevel)
+	o, err := s.Options()
+	if err != nil {
+		return nil, err
 	}
+	return o.Args(), nil
+}
 
-	gwURL := s.cfg.URL
-	user := fmt.Sprintf("%s@%s", s.cfg.PDC.HostedGrafanaID, gwURL.String())
+// managedFlags are the ssh flags set by the agent which ssh needs to
+// authenticate, with the agent flag to use instead.
+var managedFlags = map[string]string{
+	"-i": "the key is set with -ssh-key-file",
+}
 
-	// keep ssh_config parameters in a map so they can be oveeridden by the user
-	sshOptions := map[string]string{
-		"UserKnownHostsFile":  fmt.Sprintf("%s/%s", keyFileDir, KnownHostsFile),
-		"CertificateFile":     fmt.Sprintf("%s-cert.pub", s.cfg.KeyFile),
-		"ServerAliveInterval": "15",
-		"ConnectTimeout":      "1",
-	}
+// criticalOptions are the ssh options set by the agent which ssh needs to
+// authenticate, so -ssh-flag cannot override them, with the agent flag to use
+// instead. The keys are lower case, as ssh option names are case insensitive.
+var criticalOptions = map[string]string{
+	"identityfile":       "the key is set with -ssh-key-file",
+	"certificatefile":    "the certificate is the one of -ssh-key-file",
+	"userknownhostsfile": "the known hosts file is written next to -ssh-key-file",
+}
 
-	nonOptionFlags := []string{} // for backwards compatibility, on -v particularly
-	for _, f := range s.cfg.SSHFlags {
-		name, value, err := extractOptionFromFlag(f)
-		if err != nil {
-			return nil, err
+// CheckSSHFlags returns an error for the first -ssh-flag value which ssh
+// would reject, or which replaces a flag or option ssh needs to authenticate.
+func (cfg *Config) CheckSSHFlags() error {
+	for _, f := range cfg.SSHFlags {
+		name := flagName(f)
+		if hint, ok := managedFlags[name]; ok {
+			return fmt.Errorf("invalid -ssh-flag %q: %s is set by the agent, %s", f, name, hint)
 		}
-		if name == "" {
-			nonOptionFlags = append(nonOptionFlags, f)
-			continue
+		option, _, err := extractOptionFromFlag(f)
+		if err == nil && option != "" {
+			err = cfg.checkSSHOption(option)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid -ssh-flag %q: %w", f, err)
 		}
-		sshOptions[name] = value
 	}
+	return nil
+}
 
-	// make options ordering deterministic
-	optionsList := []string{}
-	for o := range sshOptions {
-		optionsList = append(optionsList, o)
+// checkSSHOption returns an error if the ssh option name cannot be set with
+// -ssh-flag.
+func (cfg *Config) checkSSHOption(name string) error {
+	lower := strings.ToLower(name)
+	if hint, ok := criticalOptions[lower]; ok {
+		return fmt.Errorf("the %s option is set by the agent, %s", name, hint)
 	}
-	sort.Strings(optionsList)
-
-	result := []string{
-		"-i",
-		s.cfg.KeyFile,
-		user,
-		"-p",
-		fmt.Sprintf("%d", s.cfg.Port),
-		"-R", "0",
-	}
-
-	for _, o := range optionsList {
-		result = append(result, "-o", fmt.Sprintf("%s=%s", o, sshOptions[o]))
+	if (lower == "proxycommand" || lower == "proxyjump") && cfg.relayEnabled() {
+		return fmt.Errorf("the %s option cannot be used with -tunnel.traffic-metrics or -tunnel.max-bandwidth, which connect ssh to a local relay", name)
 	}
+	return nil
+}
 
-	if logLevelFlag != "" {
-		result = append(result, logLevelFlag)
+// flagName returns the name of an ssh flag, e.g. -i for both "-i key" and
+// "-ikey", as ssh accepts the value attached to the flag.
+func flagName(flag string) string {
+	if len(flag) < 2 {
+		return flag
 	}
-
-	result = append(result, nonOptionFlags...)
-
-	return result, nil
+	return flag[:2]
 }
 
 func extractOptionFromFlag(flag string) (string, string, error) {
-	parts := strings.SplitN(flag, " ", 2)
-	if parts[0] != "-o" {
+	if flagName(flag) != "-o" {
 		return "", "", nil
 	}
+	option := strings.TrimSpace(flag[2:])
+	if option == "" {
+		return "", "", errors.New("invalid ssh option format, expecting '-o Name=string'")
+	}
 
-	oParts := strings.Split(parts[1], "=")
+	oParts := strings.Split(option, "=")
 	if len(oParts) != 2 {
 		return "", "", errors.New("invalid ssh option format, expecting '-o Name=string'")
 	}
 	return oParts[0], oParts[1], nil
 }
 
+// maxLogLineLength bounds the buffered output of the ssh process: a longer
+// line is logged without waiting for its end.
+const maxLogLineLength = 16 * 1024
+
+var (
+	ansiEscapeRegexp   = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+	sshDebugRegexp     = regexp.MustCompile(`^debug[0-9]: `)
+	sshWarningPrefixes = []string{"Warning:", "WARNING:"}
+	// Lines logged by ssh when the host key is unknown or has changed.
+	hostKeyFailureRegexp = regexp.MustCompile(`Host key verification failed|REMOTE HOST IDENTIFICATION HAS CHANGED|No [A-Z0-9-]+ host key is known`)
+	// Lines logged by ssh when the gateway does not send a valid ssh banner.
+	bannerFailureRegexp = regexp.MustCompile(`kex_exchange_identification|ssh_exchange_identification|during banner exchange|banner exchange: |Bad remote protocol version identification`)
+	// Line logged by ssh when the gateway rejects the certificate.
+	authFailureRegexp = regexp.MustCompile(`Permission denied \(`)
+)
+
 // Wraps a logger, implements io.Writer and writes to the logger.
+//
+// The ssh command output is separated by \r\n and the logger escapes strings.
+// By default, the logger output would look like this: msg="debug1: some message\r\ndebug2: some message\r\n".
+// Output is buffered until a line is complete, and each line is logged at a
+// time, with the level derived from the OpenSSH prefix:
+// level=debug msg="debug1: some message"
+// level=debug msg="debug2: some message"
 type loggerWriterAdapter struct {
 	logger log.Logger
+	// observe, if set, is called with every line before it is logged.
+	observe func(msg string)
+
+	mu  sync.Mutex
+	buf []byte
 }
 
-func newLoggerWriterAdapter(logger log.Logger) loggerWriterAdapter {
-	return loggerWriterAdapter{
+func newLoggerWriterAdapter(logger log.Logger) *loggerWriterAdapter {
+	return &loggerWriterAdapter{
 		logger: logger,
 	}
 }
 
 // Implements io.Writer.
-func (adapter loggerWriterAdapter) Write(p []byte) (n int, err error) {
-	// The ssh command output is separated by \r\n and the logger escapes strings.
-	// By default, the logger output would look like this: msg="debug: some message\r\ndebug2: some message\r\n".
-	// We split the messages on \r\n and log each of them at a time to make the output look like this:
-	// msg="debug: some message"
-	// msg="debug2: some message"
-	for _, msg := range bytes.Split(p, []byte{'\r', '\n'}) {
-		if len(msg) == 0 {
-			continue
+func (adapter *loggerWriterAdapter) Write(p []byte) (n int, err error) {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	adapter.buf = append(adapter.buf, p...)
+
+	consumed := 0
+	for {
+		i := bytes.IndexByte(adapter.buf[consumed:], '\n')
+		if i < 0 {
+			break
+		}
+		if err := adapter.logLine(adapter.buf[consumed : consumed+i]); err != nil {
+			return 0, err
 		}
+		consumed += i + 1
+	}
+	adapter.buf = append(adapter.buf[:0], adapter.buf[consumed:]...)
 
-		if err := level.Info(adapter.logger).Log("msg", msg); err != nil {
-			return 0, fmt.Errorf("writing log statement")
+	if len(adapter.buf) >= maxLogLineLength {
+		if err := adapter.logLine(adapter.buf); err != nil {
+			return 0, err
 		}
+		adapter.buf = adapter.buf[:0]
 	}
 
 	return len(p), nil
-}
\ No newline at end of file
+}
+
+// Flush logs the buffered partial line, if any. It is called once the ssh
+// process has exited.
+func (adapter *loggerWriterAdapter) Flush() {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	_ = adapter.logLine(adapter.buf)
+	adapter.buf = adapter.buf[:0]
+}
+
+func (adapter *loggerWriterAdapter) logLine(line []byte) error {
+	msg := sanitizeLogLine(line)
+	if msg == "" {
+		return nil
+	}
+	if adapter.observe != nil {
+		adapter.observe(msg)
+	}
+
+	if err := sshLineLevel(msg)(adapter.logger).Log("msg", msg); err != nil {
+		return fmt.Errorf("writing log statement")
+	}
+	return nil
+}
+
+// sanitizeLogLine removes ANSI escape sequences and control characters.
+func sanitizeLogLine(line []byte) string {
+	line = ansiEscapeRegexp.ReplaceAll(line, nil)
+	msg := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, string(line))
+	return strings.TrimSpace(msg)
+}
+
+// sshLineLevel returns the level of a line of ssh output.
+func sshLineLevel(msg string) func(log.Logger) log.Logger {
+	if sshDebugRegexp.MatchString(msg) {
+		return level.Debug
+	}
+	for _, prefix := range sshWarningPrefixes {
+		if strings.HasPrefix(msg, prefix) {
+			return level.Warn
+		}
+	}
+	return level.Info
+}
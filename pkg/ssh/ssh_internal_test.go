@@ -0,0 +1,1245 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/socks"
+)
+
+func TestLoggerWriterAdapter(t *testing.T) {
+	testcases := []struct {
+		name     string
+		writes   []string
+		flush    bool
+		expected []string
+	}{
+		{
+			name:     "splits lines separated by \\r\\n",
+			writes:   []string{"debug1: some message\r\ndebug2: some message\r\n"},
+			expected: []string{`level=debug msg="debug1: some message"`, `level=debug msg="debug2: some message"`},
+		},
+		{
+			name:     "buffers partial lines",
+			writes:   []string{"Authenticated to ", "gateway\r", "\nremote forward success\n"},
+			expected: []string{`level=info msg="Authenticated to gateway"`, `level=info msg="remote forward success"`},
+		},
+		{
+			name:     "partial lines are only logged when flushed",
+			writes:   []string{"complete\npartial"},
+			expected: []string{`level=info msg=complete`},
+		},
+		{
+			name:     "flush logs the partial line",
+			writes:   []string{"complete\npartial"},
+			flush:    true,
+			expected: []string{`level=info msg=complete`, `level=info msg=partial`},
+		},
+		{
+			name:     "strips control characters and escape sequences",
+			writes:   []string{"\x1b[31mred\x1b[0m\tand\x07 bell\n"},
+			expected: []string{`level=info msg="red and bell"`},
+		},
+		{
+			name:     "skips empty lines",
+			writes:   []string{"\r\n\n  \nmessage\n"},
+			expected: []string{`level=info msg=message`},
+		},
+		{
+			name:     "warnings are logged at warn level",
+			writes:   []string{"Warning: Permanently added 'gateway' to the list of known hosts.\n"},
+			expected: []string{`level=warn msg="Warning: Permanently added 'gateway' to the list of known hosts."`},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			adapter := newLoggerWriterAdapter(log.NewLogfmtLogger(buf))
+
+			for _, w := range tc.writes {
+				n, err := adapter.Write([]byte(w))
+				assert.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			if tc.flush {
+				adapter.Flush()
+			}
+
+			assert.Equal(t, tc.expected, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+		})
+	}
+
+	t.Run("long lines are logged without waiting for the end of line", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		adapter := newLoggerWriterAdapter(log.NewLogfmtLogger(buf))
+
+		_, err := adapter.Write(bytes.Repeat([]byte("a"), maxLogLineLength))
+		assert.NoError(t, err)
+
+		assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	})
+}
+
+func TestParseOpenSSHVersion(t *testing.T) {
+	testcases := []struct {
+		version string
+		major   int
+		minor   int
+		missing []string
+		err     bool
+	}{
+		{version: "OpenSSH_9.2p1 Debian-2+deb12u3, OpenSSL 3.0.15 3 Sep 2024", major: 9, minor: 2, missing: []string{}},
+		{version: "OpenSSH_for_Windows_8.1p1, LibreSSL 3.0.2", major: 8, minor: 1, missing: []string{}},
+		{version: "OpenSSH_7.6p1 Ubuntu-4ubuntu0.7, OpenSSL 1.0.2n  7 Dec 2017", major: 7, minor: 6, missing: []string{}},
+		{version: "OpenSSH_7.4p1, OpenSSL 1.0.2k-fips  26 Jan 2017", major: 7, minor: 4, missing: []string{"dynamic remote forwarding with -R 0"}},
+		{version: "OpenSSH_6.6.1p1 Ubuntu-2ubuntu2, OpenSSL 1.0.1f 6 Jan 2014", major: 6, minor: 6, missing: []string{"the CertificateFile option", "dynamic remote forwarding with -R 0"}},
+		{version: "Sun_SSH_2.2", err: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.version, func(t *testing.T) {
+			major, minor, err := parseOpenSSHVersion(tc.version)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.major, major)
+			assert.Equal(t, tc.minor, minor)
+
+			missing := []string{}
+			for _, f := range missingSSHFeatures(major, minor) {
+				missing = append(missing, f.name)
+			}
+			assert.Equal(t, tc.missing, missing)
+		})
+	}
+}
+
+func TestMergeKnownHosts(t *testing.T) {
+	newKey := func() string {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		sshPub, err := ssh.NewPublicKey(pub)
+		require.NoError(t, err)
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+	}
+	oldCA := "@cert-authority *.grafana.net " + newKey()
+	newCA := "@cert-authority *.grafana.net " + newKey()
+
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	grace := 7 * 24 * time.Hour
+
+	testcases := []struct {
+		name     string
+		oldKH    string
+		newKH    string
+		expected string
+	}{
+		{
+			name:     "no previous file",
+			newKH:    newCA + "\n",
+			expected: newCA + "\n",
+		},
+		{
+			name:     "unchanged entries",
+			oldKH:    newCA + "\n",
+			newKH:    newCA + "\n",
+			expected: newCA + "\n",
+		},
+		{
+			name:     "rotated CA is kept",
+			oldKH:    oldCA + "\n",
+			newKH:    newCA + "\n",
+			expected: newCA + "\n" + oldCA + " pdc-retired-at=2024-01-10T00:00:00Z\n",
+		},
+		{
+			name:     "rotated CA is kept during the grace period",
+			oldKH:    newCA + "\n" + oldCA + " pdc-retired-at=2024-01-04T00:00:00Z\n",
+			newKH:    newCA + "\n",
+			expected: newCA + "\n" + oldCA + " pdc-retired-at=2024-01-04T00:00:00Z\n",
+		},
+		{
+			name:     "rotated CA is removed after the grace period",
+			oldKH:    newCA + "\n" + oldCA + " pdc-retired-at=2024-01-03T00:00:00Z\n",
+			newKH:    newCA + "\n",
+			expected: newCA + "\n",
+		},
+		{
+			name:     "CA returned again is no longer retired",
+			oldKH:    newCA + "\n" + oldCA + " pdc-retired-at=2024-01-04T00:00:00Z\n",
+			newKH:    oldCA + "\n" + newCA + "\n",
+			expected: oldCA + "\n" + newCA + "\n",
+		},
+		{
+			name:     "invalid entries are dropped",
+			oldKH:    "invalid\n# comment\n",
+			newKH:    newCA + "\n",
+			expected: newCA + "\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			merged := mergeKnownHosts([]byte(tc.oldKH), []byte(tc.newKH), now, grace)
+			assert.Equal(t, tc.expected, string(merged))
+
+			// The result must be a valid known hosts file.
+			_, _, _, _, _, err := ssh.ParseKnownHosts(merged)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestTrafficRelay(t *testing.T) {
+	gw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer gw.Close()
+	go func() {
+		conn, err := gw.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("pong!"))
+	}()
+
+	keyFile := t.Name()
+	r, err := newTrafficRelay("tcp", gw.Addr().String, keyFile, 0, log.NewNopLogger())
+	require.NoError(t, err)
+	defer r.close()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(r.port())))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "pong!", string(reply))
+
+	assert.Equal(t, 4.0, testutil.ToFloat64(bytesSent.WithLabelValues(keyFile)))
+	assert.Equal(t, 5.0, testutil.ToFloat64(bytesReceived.WithLabelValues(keyFile)))
+}
+
+func TestChannelTracker(t *testing.T) {
+	keyFile := t.Name()
+	tracker := newChannelTracker(keyFile)
+	for _, msg := range []string{
+		"debug1: channel 0: new session [client-session] (inactive timeout: 0)",
+		"debug1: channel 1: new forwarded-tcpip [forwarded-tcpip] (inactive timeout: 0)",
+		"debug1: channel 2: new forwarded-tcpip [forwarded-tcpip] (inactive timeout: 0)",
+		"debug1: channel 3: new forwarded-tcpip [forwarded-tcpip] (inactive timeout: 0)",
+		"debug1: channel 1: free: 127.0.0.1, nchannels 4",
+		// Not a forwarded channel.
+		"debug1: channel 0: free: client-session, nchannels 3",
+	} {
+		tracker.observe(msg)
+	}
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(channelsOpened.WithLabelValues(keyFile)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(channelsClosed.WithLabelValues(keyFile)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(channelsActive.WithLabelValues(keyFile)))
+
+	// The channels of an ssh process which exited are closed.
+	tracker.close()
+	assert.Equal(t, 3.0, testutil.ToFloat64(channelsClosed.WithLabelValues(keyFile)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(channelsActive.WithLabelValues(keyFile)))
+}
+
+func TestClient_SSHArgs_TrafficRelay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.KeyFile = "/tmp/key"
+	cfg.URL = &url.URL{Path: "host.grafana.net"}
+	cfg.Port = 2222
+	cfg.LogLevel = 0
+	cfg.TrafficMetrics = true
+	cfg.GatewayIPVersion = "6"
+	cfg.PDC.HostedGrafanaID = "123"
+
+	r, err := newTrafficRelay("tcp", func() string { return "host.grafana.net:2222" }, t.Name(), 0, log.NewNopLogger())
+	require.NoError(t, err)
+	defer r.close()
+	client := NewClient(cfg, log.NewNopLogger(), nil)
+	client.relay = r
+
+	flags, err := client.SSHFlagsFromConfig()
+	require.NoError(t, err)
+	args := strings.Join(flags, " ")
+	assert.Contains(t, args, "123@127.0.0.1 -p "+strconv.Itoa(r.port())+" ")
+	assert.Contains(t, args, "-o CheckHostIP=no")
+	assert.Contains(t, args, "-o HostKeyAlias=[host.grafana.net]:2222")
+	assert.NotContains(t, args, "AddressFamily", "ssh connects to the relay over IPv4")
+	assert.True(t, strings.HasSuffix(args, " -v"), "the forwarded channels are only logged with -v")
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	var slept []time.Duration
+	l := newRateLimiter(1000)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+
+	// The bucket starts full.
+	l.wait(1000)
+	assert.Empty(t, slept)
+
+	// Then bytes are transferred at the rate.
+	l.wait(500)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, slept)
+
+	// A transfer larger than the bucket waits for all its bytes.
+	l.wait(2000)
+	assert.Equal(t, 2*time.Second, slept[1])
+
+	// An idle bucket refills up to one second of traffic.
+	now = now.Add(time.Hour)
+	l.wait(1000)
+	assert.Len(t, slept, 2)
+	l.wait(100)
+	assert.Equal(t, 100*time.Millisecond, slept[2])
+}
+
+func TestTrafficRelay_MaxBandwidth(t *testing.T) {
+	gw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer gw.Close()
+	go func() {
+		conn, err := gw.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(make([]byte, 30_000))
+	}()
+
+	r, err := newTrafficRelay("tcp", gw.Addr().String, t.Name(), 20_000, log.NewNopLogger())
+	require.NoError(t, err)
+	defer r.close()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(r.port())))
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Len(t, data, 30_000)
+	// One second of traffic is sent at once, the rest at 20kB/s.
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestForwardProxy_MaxChannels(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	cfg := &Config{KeyFile: t.Name(), MaxChannels: 1, ChannelQueueSize: 1, ChannelQueueTimeout: 5 * time.Second}
+	p, err := newForwardProxy(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+	defer p.close()
+
+	connect := func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", p.addr())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn, socks.Connect(conn, target.Addr().String())
+	}
+
+	first, err := connect()
+	require.NoError(t, err)
+
+	// The second connection waits for the first one to close.
+	second := make(chan error, 1)
+	go func() {
+		_, err := connect()
+		second <- err
+	}()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(channelsQueued.WithLabelValues(t.Name())) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The queue is full: the third one is rejected.
+	_, err = connect()
+	var replyErr *socks.ReplyError
+	require.ErrorAs(t, err, &replyErr)
+	assert.Equal(t, socks.ReplyGeneralFailure, replyErr.Code)
+	assert.Equal(t, 1.0, testutil.ToFloat64(channelsRejected.WithLabelValues(t.Name(), "max_channels")))
+
+	require.NoError(t, first.Close())
+	require.NoError(t, <-second)
+	assert.Equal(t, 0.0, testutil.ToFloat64(channelsQueued.WithLabelValues(t.Name())))
+}
+
+func TestForwardProxy_QueueTimeout(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cfg := &Config{KeyFile: t.Name(), MaxChannels: 1, ChannelQueueSize: 1, ChannelQueueTimeout: 50 * time.Millisecond}
+	p, err := newForwardProxy(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+	defer p.close()
+
+	for i, expected := range []error{nil, &socks.ReplyError{Code: socks.ReplyGeneralFailure}} {
+		conn, err := net.Dial("tcp", p.addr())
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, expected, socks.Connect(conn, target.Addr().String()), "connection %d", i)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(channelsRejected.WithLabelValues(t.Name(), "max_channels")))
+}
+
+func TestAllowlist(t *testing.T) {
+	var rules []TargetRule
+	for _, s := range []string{"postgres.internal:5432", "*.mysql.internal:3306", "10.0.0.0/8:9090-9093"} {
+		r, err := ParseTargetRule(s)
+		require.NoError(t, err)
+		rules = append(rules, r)
+	}
+	a := allowlist{
+		rules: rules,
+		lookupIP: func(_ context.Context, host string) ([]net.IP, error) {
+			switch host {
+			case "prometheus.internal":
+				return []net.IP{net.ParseIP("192.168.0.1"), net.ParseIP("10.0.0.1")}, nil
+			case "public.example.com":
+				return []net.IP{net.ParseIP("203.0.113.1")}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		},
+	}
+
+	testcases := []struct {
+		target string
+		addr   string
+		err    bool
+	}{
+		{target: "postgres.internal:5432", addr: "postgres.internal:5432"},
+		{target: "postgres.internal:5433"},
+		{target: "eu.mysql.internal:3306", addr: "eu.mysql.internal:3306"},
+		{target: "mysql.internal:3306"},
+		{target: "10.1.2.3:9091", addr: "10.1.2.3:9091"},
+		{target: "10.1.2.3:9094"},
+		{target: "192.168.0.1:9090"},
+		// Host names are resolved once, to an allowed address.
+		{target: "prometheus.internal:9090", addr: "10.0.0.1:9090"},
+		{target: "public.example.com:9090"},
+		{target: "unknown.internal:9090", err: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.target, func(t *testing.T) {
+			addr, ok, err := a.allow(context.Background(), tc.target)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.addr != "", ok)
+			assert.Equal(t, tc.addr, addr)
+		})
+	}
+
+	addr, ok, err := allowlist{}.allow(context.Background(), "anything:1")
+	require.NoError(t, err)
+	assert.True(t, ok, "all targets are allowed without rules")
+	assert.Equal(t, "anything:1", addr)
+}
+
+func TestForwardProxy_AllowedTargets(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	rule, err := ParseTargetRule(target.Addr().String())
+	require.NoError(t, err)
+	cfg := &Config{KeyFile: t.Name(), AllowedTargets: []TargetRule{rule}}
+	p, err := newForwardProxy(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+	defer p.close()
+
+	for _, tc := range []struct {
+		target   string
+		expected error
+	}{
+		{target: target.Addr().String()},
+		{target: "127.0.0.2:5432", expected: &socks.ReplyError{Code: socks.ReplyNotAllowed}},
+	} {
+		conn, err := net.Dial("tcp", p.addr())
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, tc.expected, socks.Connect(conn, tc.target), tc.target)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(channelsRejected.WithLabelValues(t.Name(), "not_allowed")))
+}
+
+func TestForwardProxy_Audit(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	rule, err := ParseTargetRule(echo.Addr().String())
+	require.NoError(t, err)
+	buf := &lockedBuffer{}
+	cfg := &Config{KeyFile: t.Name(), AllowedTargets: []TargetRule{rule}, Audit: log.NewLogfmtLogger(buf)}
+	p, err := newForwardProxy(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+	defer p.close()
+
+	conn, err := net.Dial("tcp", p.addr())
+	require.NoError(t, err)
+	require.NoError(t, socks.Connect(conn, echo.Addr().String()))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+	conn.Close()
+
+	conn, err = net.Dial("tcp", p.addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Error(t, socks.Connect(conn, "postgres.internal:5432"))
+
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	var lines []string
+	require.Eventually(t, func() bool {
+		lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+		return len(lines) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Regexp(t, `^msg="forwarded connection" source=gateway host=`+host+` port=`+port+` addr=`+echo.Addr().String()+` result=ok duration=\S+ bytes_sent=4 bytes_received=4$`, lines[0])
+	assert.Regexp(t, `^msg="forwarded connection" source=gateway host=postgres.internal port=5432 addr= result=not_allowed duration=\S+ bytes_sent=0 bytes_received=0$`, lines[1])
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestResolver_HostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte(`# private datasources
+10.0.0.1 postgres.internal db
+fd00::1  Postgres.Internal. # dual stack
+`), 0600))
+
+	for _, tc := range []struct {
+		prefer   string
+		expected []string
+	}{
+		{prefer: "", expected: []string{"10.0.0.1", "fd00::1"}},
+		{prefer: "6", expected: []string{"fd00::1", "10.0.0.1"}},
+	} {
+		r, err := newResolver(&Config{HostsFile: path, IPPreference: tc.prefer})
+		require.NoError(t, err)
+		ips, err := r.lookupIP(context.Background(), "postgres.internal")
+		require.NoError(t, err)
+		var addrs []string
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		assert.Equal(t, tc.expected, addrs)
+	}
+
+	// -resolve overrides the hosts file.
+	r, err := newResolver(&Config{HostsFile: path, Resolve: map[string][]net.IP{"db": {net.ParseIP("10.0.0.2")}}})
+	require.NoError(t, err)
+	ips, err := r.lookupIP(context.Background(), "db")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.2")}, ips)
+
+	require.NoError(t, os.WriteFile(path, []byte("postgres.internal 10.0.0.1\n"), 0600))
+	_, err = newResolver(&Config{HostsFile: path})
+	assert.EqualError(t, err, path+":1: expecting an IP address followed by host names")
+}
+
+func TestResolver_DNSServers(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	r, err := newResolver(&Config{DNSServers: []string{server.LocalAddr().String()}})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	go func() { _, _ = r.lookupIP(ctx, "postgres.internal") }()
+
+	// The query is sent to the server, which does not answer.
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 512)
+	n, _, err := server.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf[:n]), "postgres")
+}
+
+func TestForwardProxy_HostsFile(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte("127.0.0.1 postgres.internal\n"), 0600))
+	p, err := newForwardProxy(&Config{KeyFile: t.Name(), HostsFile: path}, log.NewNopLogger())
+	require.NoError(t, err)
+	defer p.close()
+
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+	conn, err := net.Dial("tcp", p.addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, socks.Connect(conn, "postgres.internal:"+port))
+}
+
+func TestForwardProxy_SOCKSListenAddr(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	buf := &lockedBuffer{}
+	cfg := &Config{KeyFile: t.Name(), SOCKSListenAddr: "127.0.0.1:0", Audit: log.NewLogfmtLogger(buf)}
+	p, err := newForwardProxy(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", p.local.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, socks.Connect(conn, target.Addr().String()))
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), "source=local")
+	}, time.Second, 10*time.Millisecond)
+
+	// The listener is closed with the proxy.
+	require.NoError(t, p.close())
+	_, err = net.Dial("tcp", p.local.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestGatewaySelector(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.URL = &url.URL{Path: "gw-a.grafana.net"}
+	cfg.Port = 22
+	cfg.GatewayEndpoints = []string{"gw-b.grafana.net", "gw-c.grafana.net:2222", "gw-a.grafana.net:22"}
+
+	latencies := map[string]time.Duration{}
+	var mu sync.Mutex
+	gs := newGatewaySelector(cfg, log.NewNopLogger())
+	gs.probe = func(_ context.Context, addr string) (time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		latency, ok := latencies[addr]
+		if !ok {
+			return 0, io.EOF
+		}
+		return latency, nil
+	}
+	assert.Equal(t, []string{"gw-a.grafana.net:22", "gw-b.grafana.net:22", "gw-c.grafana.net:2222"}, gs.endpoints)
+
+	set := func(a, b, c time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		for addr, latency := range map[string]time.Duration{"gw-a.grafana.net:22": a, "gw-b.grafana.net:22": b, "gw-c.grafana.net:2222": c} {
+			delete(latencies, addr)
+			if latency > 0 {
+				latencies[addr] = latency
+			}
+		}
+	}
+	current := func() string {
+		host, port := gs.current()
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	// The fastest gateway is selected.
+	set(30*time.Millisecond, 10*time.Millisecond, 20*time.Millisecond)
+	assert.True(t, gs.update(context.Background()))
+	assert.Equal(t, "gw-b.grafana.net:22", current())
+	assert.Equal(t, 0.03, testutil.ToFloat64(gatewayLatency.WithLabelValues("gw-a.grafana.net:22")))
+
+	// A gateway only slightly faster does not replace the selected one.
+	set(30*time.Millisecond, 10*time.Millisecond, 9*time.Millisecond)
+	assert.False(t, gs.update(context.Background()))
+	assert.Equal(t, "gw-b.grafana.net:22", current())
+
+	// The selected gateway is replaced once unhealthy.
+	set(30*time.Millisecond, 0, 20*time.Millisecond)
+	assert.True(t, gs.update(context.Background()))
+	assert.Equal(t, "gw-c.grafana.net:2222", current())
+	assert.Equal(t, 2, testutil.CollectAndCount(gatewayLatency), "the latency of unhealthy gateways is unset")
+
+	// Without healthy gateways, the selection is kept.
+	set(0, 0, 0)
+	assert.False(t, gs.update(context.Background()))
+	assert.Equal(t, "gw-c.grafana.net:2222", current())
+}
+
+func TestProbeGatewayLatency(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	banner := "SSH-2.0-OpenSSH_9.6\r\n"
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.WriteString(conn, banner)
+			conn.Close()
+		}
+	}()
+
+	_, err = probeGatewayLatency(context.Background(), "tcp", l.Addr().String())
+	assert.NoError(t, err)
+
+	banner = "HTTP/1.1 400 Bad Request\r\n"
+	_, err = probeGatewayLatency(context.Background(), "tcp", l.Addr().String())
+	assert.ErrorContains(t, err, "unexpected banner")
+}
+
+func TestClient_SSHArgs_GatewayEndpoints(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.KeyFile = "/tmp/key"
+	cfg.URL = &url.URL{Path: "host.grafana.net"}
+	cfg.Port = 22
+	cfg.PDC.HostedGrafanaID = "123"
+	cfg.GatewayEndpoints = []string{"host-2.grafana.net:2222"}
+
+	client := NewClient(cfg, log.NewNopLogger(), nil)
+	client.selector = newGatewaySelector(cfg, log.NewNopLogger())
+	client.selector.selected = "host-2.grafana.net:2222"
+
+	flags, err := client.SSHFlagsFromConfig()
+	require.NoError(t, err)
+	args := strings.Join(flags, " ")
+	assert.Contains(t, args, "123@host-2.grafana.net -p 2222 ")
+	assert.Contains(t, args, "-o HostKeyAlias=host.grafana.net")
+}
+
+func TestParseGatewayEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "gw.grafana.net", want: "gw.grafana.net:22"},
+		{in: "gw.grafana.net:2222", want: "gw.grafana.net:2222"},
+		{in: "10.0.0.1", want: "10.0.0.1:22"},
+		{in: "[::1]", want: "[::1]:22"},
+		{in: "[::1]:2222", want: "[::1]:2222"},
+		{in: "", wantErr: true},
+		{in: "gw.grafana.net:0", wantErr: true},
+		{in: "ssh://gw.grafana.net", wantErr: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := parseGatewayEndpoint(tc.in, 22)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestSecondsOption(t *testing.T) {
+	for _, tc := range []struct {
+		in   time.Duration
+		want string
+	}{
+		{in: 0, want: "1"},
+		{in: 500 * time.Millisecond, want: "1"},
+		{in: time.Second, want: "1"},
+		{in: 1500 * time.Millisecond, want: "2"},
+		{in: time.Minute, want: "60"},
+	} {
+		assert.Equal(t, tc.want, secondsOption(tc.in), tc.in.String())
+	}
+}
+
+func TestProbeGatewayBanner(t *testing.T) {
+	testcases := []struct {
+		name string
+		// serve answers the connections of the agent.
+		serve func(conn net.Conn)
+		want  string
+	}{
+		{
+			name:  "ssh",
+			serve: func(conn net.Conn) { _, _ = io.WriteString(conn, "SSH-2.0-OpenSSH_9.6\r\n") },
+		},
+		{
+			name: "HTTP proxy",
+			serve: func(conn net.Conn) {
+				_, _ = conn.Read(make([]byte, 64))
+				_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+			},
+			want: `an HTTP response: "HTTP/1.1 400 Bad Request"`,
+		},
+		{
+			name: "TLS",
+			serve: func(conn net.Conn) {
+				_, _ = conn.Read(make([]byte, 64))
+				_, _ = conn.Write([]byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x46})
+			},
+			want: "a TLS record",
+		},
+		{
+			name:  "closed",
+			serve: func(conn net.Conn) {},
+			want:  "a closed connection",
+		},
+		{
+			name:  "silent",
+			serve: func(conn net.Conn) { time.Sleep(time.Second) },
+			want:  "no banner",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				tc.serve(conn)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			got, err := probeGatewayBanner(ctx, "tcp", l.Addr().String())
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestClient_SSHPID(t *testing.T) {
+	client := NewClient(DefaultConfig(), log.NewNopLogger(), nil)
+	_, err := client.sshPID()
+	assert.Error(t, err)
+
+	// A replacement process is started before the previous one exits.
+	client.setPID(100, 0)
+	client.setPID(200, 0)
+	client.setPID(0, 100)
+	pid, err := client.sshPID()
+	require.NoError(t, err)
+	assert.Equal(t, 200, pid)
+
+	client.setPID(0, 200)
+	_, err = client.sshPID()
+	assert.Error(t, err)
+}
+
+func TestClockJump(t *testing.T) {
+	prev := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	testcases := []struct {
+		name    string
+		wall    time.Time
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{name: "no jump", wall: prev.Add(5 * time.Second), elapsed: 5 * time.Second, want: 0},
+		{name: "late tick", wall: prev.Add(7 * time.Second), elapsed: 7 * time.Second, want: 0},
+		{name: "small drift", wall: prev.Add(6 * time.Second), elapsed: 5 * time.Second, want: 0},
+		{name: "resumed from suspend", wall: prev.Add(2 * time.Hour), elapsed: 5 * time.Second, want: 2*time.Hour - 5*time.Second},
+		{name: "clock set back", wall: prev.Add(-time.Minute), elapsed: 5 * time.Second, want: -time.Minute - 5*time.Second},
+		{name: "other time zone", wall: prev.Add(5 * time.Second).In(time.FixedZone("UTC+2", 2*60*60)), elapsed: 5 * time.Second, want: 0},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, clockJump(prev, tc.wall, tc.elapsed))
+		})
+	}
+}
+
+func TestClient_Resume(t *testing.T) {
+	// A long-running process stands in for ssh.
+	cfg := &Config{LegacyMode: true, Args: []string{"30"}, KeyFile: filepath.Join(t.TempDir(), "resume")}
+	client := NewClient(cfg, log.NewNopLogger(), nil)
+	client.SSHCmd = "sleep"
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(ctx, client)
+	})
+
+	var pid int
+	require.Eventually(t, func() bool {
+		var err error
+		pid, err = client.sshPID()
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// In the renew loop, the context is the one of the service.
+	resumeCtx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	client.resume(resumeCtx)
+
+	assert.Eventually(t, func() bool {
+		next, err := client.sshPID()
+		return err == nil && next != pid
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(sshResumes.WithLabelValues(cfg.KeyFile)))
+}
+
+func TestDefaultKeyFile(t *testing.T) {
+	home := t.TempDir()
+	state := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	t.Setenv("XDG_STATE_HOME", "")
+	assert.Equal(t, filepath.Join(home, ".ssh", "grafana_pdc"), defaultKeyFile())
+
+	// Relative paths are ignored.
+	t.Setenv("XDG_STATE_HOME", "state")
+	assert.Equal(t, filepath.Join(home, ".ssh", "grafana_pdc"), defaultKeyFile())
+
+	t.Setenv("XDG_STATE_HOME", state)
+	assert.Equal(t, filepath.Join(state, "pdc-agent", "grafana_pdc"), defaultKeyFile())
+
+	// An existing key is kept.
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".ssh"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".ssh", "grafana_pdc"), nil, 0600))
+	assert.Equal(t, filepath.Join(home, ".ssh", "grafana_pdc"), defaultKeyFile())
+}
+
+func TestConfig_HashFilePath(t *testing.T) {
+	cfg := Config{KeyFile: "/keys/grafana_pdc"}
+	assert.Equal(t, "/keys/grafana_pdc_hash", cfg.HashFilePath())
+
+	cfg.HashFile = "/state/hash"
+	assert.Equal(t, "/state/hash", cfg.HashFilePath())
+}
+
+func TestFileModeValue(t *testing.T) {
+	testcases := []struct {
+		in          string
+		allowOthers bool
+		want        os.FileMode
+		wantErr     bool
+	}{
+		{in: "0600", want: 0600},
+		{in: "400", want: 0400},
+		{in: "0644", wantErr: true},
+		{in: "0644", allowOthers: true, want: 0644},
+		{in: "0200", wantErr: true},
+		{in: "0800", wantErr: true},
+		{in: "01600", allowOthers: true, wantErr: true},
+		{in: "rw", wantErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.in, func(t *testing.T) {
+			var mode os.FileMode
+			err := fileModeValue{mode: &mode, allowOthers: tc.allowOthers}.Set(tc.in)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, mode)
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes don't reflect the ACLs of files on Windows")
+	}
+	path := filepath.Join(t.TempDir(), "grafana_pdc-cert.pub")
+
+	// The mode is not restricted by the umask.
+	require.NoError(t, writeFile(path, []byte("cert"), 0666))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0666), fi.Mode().Perm())
+
+	// Nor kept from the previous file.
+	require.NoError(t, writeFile(path, []byte("new cert"), 0600))
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "new cert", string(data))
+
+	// No temporary file is left.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestReadKeyMaterial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grafana_pdc")
+	require.NoError(t, os.WriteFile(path, []byte("key material"), 0600))
+
+	b, err := readKeyMaterial(path)
+	require.NoError(t, err)
+	assert.Equal(t, "key material", string(b))
+	assert.Equal(t, len(b), cap(b))
+
+	wipe(b)
+	assert.Equal(t, make([]byte, len(b)), b)
+
+	_, err = readKeyMaterial(path + "_missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWipeKey(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	wipeKey(edKey)
+	assert.Equal(t, make([]byte, ed25519.PrivateKeySize), []byte(edKey))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	wipeKey(ecKey)
+	assert.Zero(t, ecKey.D.Sign())
+}
+
+func TestUpdateKnownHostsFile_HostCAKeys(t *testing.T) {
+	newKey := func() string {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		sshPub, err := ssh.NewPublicKey(pub)
+		require.NoError(t, err)
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+	}
+	pinnedKey, otherKey := newKey(), newKey()
+	pinnedCA := "@cert-authority *.grafana.net " + pinnedKey
+	otherCA := "@cert-authority *.grafana.net " + otherKey
+	revoked := "@revoked * " + otherKey
+
+	testcases := []struct {
+		name     string
+		mode     string
+		oldKH    string
+		newKH    string
+		expected string
+		err      error
+	}{
+		{
+			name:     "pinned CA is kept",
+			newKH:    pinnedCA + "\n" + otherCA + "\n",
+			expected: pinnedCA + "\n",
+		},
+		{
+			name:     "revocations are kept",
+			mode:     HostCAKeysFilter,
+			newKH:    revoked + "\n" + pinnedCA + "\n",
+			expected: revoked + "\n" + pinnedCA + "\n",
+		},
+		{
+			name:  "no pinned CA",
+			mode:  HostCAKeysFilter,
+			newKH: revoked + "\n" + otherCA + "\n",
+			err:   ErrHostKeyNotPinned,
+		},
+		{
+			name:     "previous entries which are not pinned are dropped",
+			oldKH:    otherCA + "\n",
+			newKH:    pinnedCA + "\n",
+			expected: pinnedCA + "\n",
+		},
+		{
+			name:     "replace",
+			mode:     HostCAKeysReplace,
+			oldKH:    otherCA + "\n",
+			newKH:    otherCA + "\n",
+			expected: "@cert-authority * " + pinnedKey + "\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			caKeysFile := filepath.Join(dir, "ca_keys")
+			require.NoError(t, os.WriteFile(caKeysFile, []byte("# gateway host CA\n"+pinnedKey+" pinned\n"), 0600))
+			knownHostsFile := filepath.Join(dir, KnownHostsFile)
+			if tc.oldKH != "" {
+				require.NoError(t, os.WriteFile(knownHostsFile, []byte(tc.oldKH), 0600))
+			}
+
+			cfg := &Config{
+				KeyFile:               filepath.Join(dir, "grafana_pdc"),
+				HostCAKeysFile:        caKeysFile,
+				HostCAKeysMode:        tc.mode,
+				KnownHostsGracePeriod: time.Hour,
+			}
+			km := NewKeyManager(cfg, log.NewNopLogger(), nil)
+
+			err := km.updateKnownHostsFile([]byte(tc.newKH))
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			kh, err := os.ReadFile(knownHostsFile)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(kh))
+		})
+	}
+}
+
+func TestUpdateKnownHostsFile_Concurrent(t *testing.T) {
+	dir := t.TempDir()
+
+	var (
+		wg    sync.WaitGroup
+		lines []string
+	)
+	for i := 0; i < 8; i++ {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		sshPub, err := ssh.NewPublicKey(pub)
+		require.NoError(t, err)
+		line := "@cert-authority *.grafana.net " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+		lines = append(lines, line)
+
+		// Each key manager has its own key file but shares the known hosts
+		// file of the directory, as the tunnels of -network.token do.
+		km := NewKeyManager(&Config{
+			KeyFile:               filepath.Join(dir, "grafana_pdc_"+strconv.Itoa(i)),
+			KnownHostsGracePeriod: time.Hour,
+		}, log.NewNopLogger(), nil)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, km.updateKnownHostsFile([]byte(line+"\n")))
+		}()
+	}
+	wg.Wait()
+
+	kh, err := os.ReadFile(filepath.Join(dir, KnownHostsFile))
+	require.NoError(t, err)
+	for _, line := range lines {
+		assert.Contains(t, string(kh), line)
+	}
+}
+
+func TestConfig_CheckHostCAKeysFile(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, os.WriteFile(empty, []byte("# no keys\n"), 0600))
+	invalid := filepath.Join(dir, "invalid")
+	require.NoError(t, os.WriteFile(invalid, []byte("not a key\n"), 0600))
+
+	assert.NoError(t, (&Config{}).CheckHostCAKeysFile())
+	assert.Error(t, (&Config{HostCAKeysFile: filepath.Join(dir, "missing")}).CheckHostCAKeysFile())
+	assert.Error(t, (&Config{HostCAKeysFile: empty}).CheckHostCAKeysFile())
+	assert.Error(t, (&Config{HostCAKeysFile: invalid}).CheckHostCAKeysFile())
+}
@@ -1,67 +1,30 @@
-
 package ssh_test
 
 import (
+	"bytes"
 	"context"
-	"encoding/pem"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"os"
-	"path"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/events"
 	"github.com/grafana/pdc-agent/pkg/pdc"
 	"github.com/grafana/pdc-agent/pkg/ssh"
 	"github.com/stretchr/testify/assert"
-	gossh "golang.org/x/crypto/ssh"
+	"github.com/stretchr/testify/require"
 )
 
-var certPEM = `
------BEGIN CERTIFICATE-----
-c3NoLWVkMjU1MTktY2VydC12MDFAb3BlbnNzaC5jb20gQUFBQUlITnphQzFsWkRJ
-MU5URTVMV05sY25RdGRqQXhRRzl3Wlc1emMyZ3VZMjl0QUFBQUlESlIvSnNPT1Ev
-UWlkdGhOVWZ3aUZoM0tDSHcySXpGaHI1dVNmOWJVR1pUQUFBQUlFMS9MRHBGd0Fl
-bit6WFZNcTZuZmpBaEFtL1NpM3ZpaFJjd3ZrdG1YQUtuQUFBQUFBQUFBQUFBQUFB
-Q0FBQUFBemN3TlFBQUFINEFBQUE3Y0hKcGRtRjBaUzFrWVhSaGMyOTFjbU5sTFdO
-dmJtNWxZM1F1YUc5emRHVmtMV2R5WVdaaGJtRXVjM1pqTG1Oc2RYTjBaWEl1Ykc5
-allXd0FBQUE3Y0hKcGRtRjBaUzFrWVhSaGMyOTFjbU5sTFdOdmJtNWxZM1F0WkdW
-MkxYVnpMV05sYm5SeVlXd3RNQzVuY21GbVlXNWhMV1JsZGk1dVpYUUFBQUFBWkZP
-SExBQUFBQUJrVTVVOEFBQUFBQUFBQUFBQUFBQUFBQUFDRndBQUFBZHpjMmd0Y25O
-aEFBQUFBd0VBQVFBQUFnRUE5R0MzZUVjREpzYnFMQnVnMWMvQmVsUW5uNEdGYWxP
-KzdJV2ZwdmU2YU9oYi8xVGRnNnVMMkRjRnRYMTlINGdycU1FV1paV0lvNHZQdHV3
-UGZHQ3Rod000cWY2ZFNocUpCcC9KZDg2aENwOENTRldDZFBQNVpVWVB3RHpsNStE
-ZG9zOExYVEF1czZXSWxxcGliRmJXS05NZkNTbld5M3J3UHRKeTEvbFhwT0FKenFE
-VC80SWdhZFNDM0MyUFo2L1lpUzN2anJWazdFS0VKclc2Yk9oQzI3TGcybkZNVzgw
-WEt5L0FsVktGa0k2OFV6Rll4QzMxbTd0VzkxOWNTOS9Gc1pFQWd4ZFdJU1VUVlg4
-UW5zbHdzRUN4OUlhNmxKbU5RQ1lMU3Q1d2NaeVloOFV0T21UbDFrZjlRdGhjcXRv
-Z3UybmhXRHRsWlp5cVpRS0tYaUJaRzl5YTl2WVZYdmUzbzcvUGJqNklHbFdybkFZ
-ZVB4YSs4ZzdFNmY2aFMwQ3lmZExEb1BweFJFYTlzdGxFRjk2am00bC9zcUUwTCta
-OVRjb0FzNTI5b0xQMkFkRStzK2xiWHR1ZlJjNHh4cWJJSW04TGlVY0pEa0NYZ0V3
-MnlpK3crTFNaMUhMRGFXelVkVzVFcmgvZC9qbXV6elZyZWNaL0p3clFEem5KNFp5
-VzJXUEtpTmY1bExLYkhyR2I4aFpoUEphRFVNOTlJMkVNbmNlbDNLOFlkYjl2YTFP
-ZnB2TWI5SjNpcVlmTEs4dm4rSEJZNGE5eXhIWGcwNEZwV3VtR2pvaTBINkJkelFL
-TkpNcUNFNVBOS0RicU1NeDc4cjRGUVJtNmlGaTdvdVRJUGRsU3FCdmt6ellIaXZQ
-UFJCMGFUbWV4OHJNMFBtMXNrSnNMelpWc1Bsa0FBQUlVQUFBQURISnpZUzF6YUdF
-eUxUVXhNZ0FBQWdDRkdyUTZVNHFHSVJXZE1rYlBIRCt4NDRaNFhsR08vTUhVemxP
-SEtOM0gyRVIzWkxpWFJHazFmclhKU1Y5enhmb1lxOWY2TXdETU85QnZsMnJValRy
-bGtwdTByaWE1cjYvSVYrZ3F2OHJXMHpNSUxkeWUyZnBqRXhlT3BReFdqU0pQeVI1
-Q0NtWFFtRlkwblEwK1dNQjNiNGQ4ZHNNMGcxakc3aGhhdkk2UUdsa2MvUmpJckg1
-QVZ3Z0I3dS80a2hUZE5aS3V1OE1KTkptNWprTkhUaEo2ekNLVi80SXl0dnl1MXpv
-cGUxemdBTnF2K1NHd2lIS0FXUzh4N0podG9QMWhOTFpKSHRKOGVteHVjVitlRXZZ
-STdQcjFZVzdkc0VUamhDQkUrZUpXd0ZBamYydUJtb1JGcEU1TzhHekg0aW91eEsw
-VDJ1OTNSK09ycnNNSTlyS215bk5OcVZGcXd3VU0rUU9Sa0tIbFRoblo0K29zQ2o4
-ejdzM3RnYUh4c1FkRW1mNFFEZ0ZBWnVlejlnLzJTYSsxeUhvNklURUs5Q1ZYOVJz
-aTFTdElFKzVxWjF0alFjTUtqbDZ0OVU4RGhwdXFKaW5WQnBiN3NjYkVmRVlNcXR6
-bTdaRzZBVmlGSm9vMjRMYkJxMi9MdEFwYUFpVU51c2ZYSUt1aTZhUlRuNlhyb0NN
-WkFZRERrbkJsS0EwOC9IbHZJYko2VEZ3T2VFbzVtTjhKN3hhSUZ4Zk9PZUNQdFho
-RnVYTEQrSmlyOEhuZWZyLzVVOTJjQ0dCS1VGOURYSDhQc1RYR1QxWWNQMkpGRXZL
-QW1RbmNCaFJzZE4rblR0WjJ3T2NNaFpyTkpkbFdoWHlrNUNvcnYxTXhiZVBPTUFK
-azl0ZGNvOFFqN0pIcFR0WnFBRm12c1E9PQo=
------END CERTIFICATE-----
-`
-
 func mustParseURL(s string) *url.URL {
 	url, err := url.Parse(s)
 	if err != nil {
@@ -97,6 +60,15 @@ func TestStartingAndStopping(t *testing.T) {
 
 }
 
+func TestClient_FailsToStartWithoutSSHBinary(t *testing.T) {
+	client := newTestClient(t, &ssh.Config{}, false)
+	client.SSHCmd = "pdc-agent-missing-ssh"
+
+	err := services.StartAndAwaitRunning(context.Background(), client)
+	assert.ErrorIs(t, err, ssh.ErrSSHNotFound)
+	assert.ErrorIs(t, err, exec.ErrNotFound)
+}
+
 // testClient returns a new SSH client with a mocked command
 // see https://npf.io/2015/06/testing-exec-command/
 func newTestClient(t *testing.T, cfg *ssh.Config, mockCmd bool) *ssh.Client {
@@ -112,7 +84,7 @@ func newTestClient(t *testing.T, cfg *ssh.Config, mockCmd bool) *ssh.Client {
 	}
 
 	dir := t.TempDir()
-	cfg.KeyFile = path.Join(dir, "test_cert")
+	cfg.KeyFile = filepath.Join(dir, "test_cert")
 
 	mClient := mockPDCClient{}
 	km := ssh.NewKeyManager(cfg, logger, mClient)
@@ -144,7 +116,23 @@ func TestClient_SSHArgs(t *testing.T) {
 		result, err := sshClient.SSHFlagsFromConfig()
 
 		assert.Nil(t, err)
-		assert.Equal(t, strings.Split(fmt.Sprintf("-i %s 123@host.grafana.net -p 22 -R 0 -o CertificateFile=%s -o ConnectTimeout=1 -o ServerAliveInterval=15 -o UserKnownHostsFile=%s -vv", cfg.KeyFile, cfg.KeyFile+certSuffix, path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)), " "), result)
+		assert.Equal(t, strings.Split(fmt.Sprintf("-i %s 123@host.grafana.net -p 22 -R 0 -o CertificateFile=%s -o ConnectTimeout=1 -o ServerAliveInterval=15 -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s -vv", cfg.KeyFile, cfg.KeyFile+certSuffix, filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)), " "), result)
+	})
+
+	t.Run("gateway IP version", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		cfg.RegisterFlags(fs)
+		require.Error(t, fs.Parse([]string{"-gateway.ip-version=ipv6"}))
+		require.NoError(t, fs.Parse([]string{"-gateway.ip-version=6"}))
+		cfg.URL = mustParseURL("host.grafana.net")
+
+		sshClient := newTestClient(t, cfg, false)
+		result, err := sshClient.SSHFlagsFromConfig()
+
+		assert.Nil(t, err)
+		assert.Contains(t, strings.Join(result, " "), "-o AddressFamily=inet6 ")
 	})
 
 	t.Run("legacy args (deprecated)", func(t *testing.T) {
@@ -193,8 +181,9 @@ func TestClient_SSHArgs(t *testing.T) {
 			"-o", "ConnectTimeout=3",
 			"-o", "PermitRemoteOpen=host:123 host:456",
 			"-o", "ServerAliveInterval=15",
+			"-o", "StrictHostKeyChecking=yes",
 			"-o", "TestOption=2",
-			"-o", fmt.Sprintf("UserKnownHostsFile=%s", path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)),
+			"-o", fmt.Sprintf("UserKnownHostsFile=%s", filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)),
 			"-vv",
 			"-vvv",
 		}
@@ -221,7 +210,8 @@ func TestClient_SSHArgs(t *testing.T) {
 			"-o", fmt.Sprintf("CertificateFile=%s", cfg.KeyFile+certSuffix),
 			"-o", "ConnectTimeout=1",
 			"-o", "ServerAliveInterval=15",
-			"-o", fmt.Sprintf("UserKnownHostsFile=%s", path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)),
+			"-o", "StrictHostKeyChecking=yes",
+			"-o", fmt.Sprintf("UserKnownHostsFile=%s", filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)),
 		}
 		assert.Equal(t, expected, result)
 
@@ -242,7 +232,8 @@ func TestClient_SSHArgs(t *testing.T) {
 			"-o", fmt.Sprintf("CertificateFile=%s", cfg.KeyFile+certSuffix),
 			"-o", "ConnectTimeout=1",
 			"-o", "ServerAliveInterval=15",
-			"-o", fmt.Sprintf("UserKnownHostsFile=%s", path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)),
+			"-o", "StrictHostKeyChecking=yes",
+			"-o", fmt.Sprintf("UserKnownHostsFile=%s", filepath.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)),
 			"-vv",
 		}
 		assert.Equal(t, expected, result)
@@ -268,21 +259,538 @@ func TestClient_SSHArgs(t *testing.T) {
 	})
 }
 
+func TestClient_SSHArgs_OptionOverrides(t *testing.T) {
+	newClient := func(flags ...string) (*ssh.Client, *syncBuffer) {
+		logs := &syncBuffer{}
+		cfg := ssh.DefaultConfig()
+		cfg.URL = mustParseURL("localhost")
+		cfg.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+		cfg.SSHFlags = flags
+		return ssh.NewClient(cfg, log.NewLogfmtLogger(logs), nil), logs
+	}
+
+	t.Run("options set by the agent are overridden with a warning", func(t *testing.T) {
+		client, logs := newClient("-o serveraliveinterval=30", "-o ServerAliveInterval=60", "-o ConnectTimeout=1")
+		args, err := client.SSHFlagsFromConfig()
+		require.NoError(t, err)
+		// ssh uses the first value of an option.
+		assert.Contains(t, args, "serveraliveinterval=30")
+		assert.NotContains(t, args, "ServerAliveInterval=60")
+		assert.NotContains(t, args, "ServerAliveInterval=15")
+		assert.Contains(t, logs.String(), `overridden="ServerAliveInterval=15"`)
+
+		// The warning is only logged once.
+		_, err = client.SSHFlagsFromConfig()
+		require.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(logs.String(), "-ssh-flag overrides"))
+	})
+
+	t.Run("options needed to authenticate are rejected", func(t *testing.T) {
+		for _, flag := range []string{"-o IdentityFile=/tmp/key", "-o certificatefile=/tmp/cert", "-o UserKnownHostsFile=/dev/null"} {
+			client, _ := newClient(flag)
+			_, err := client.SSHFlagsFromConfig()
+			assert.ErrorContains(t, err, "is set by the agent", flag)
+		}
+	})
+
+	t.Run("ProxyCommand is rejected with the relay", func(t *testing.T) {
+		client, _ := newClient("-o ProxyCommand=nc proxy 8080 %h %p")
+		_, err := client.SSHFlagsFromConfig()
+		require.NoError(t, err)
+
+		cfg := ssh.DefaultConfig()
+		cfg.TrafficMetrics = true
+		cfg.SSHFlags = []string{"-o ProxyCommand=nc proxy 8080 %h %p"}
+		assert.ErrorContains(t, cfg.CheckSSHFlags(), "-tunnel.traffic-metrics")
+	})
+}
+
+func TestConfig_CheckSSHFlags(t *testing.T) {
+	for _, tt := range []struct {
+		flags []string
+		err   string
+	}{
+		{flags: []string{"-vvv", "-o ServerAliveInterval=30", "-L 80:localhost:80"}},
+		{flags: []string{"-i /tmp/key"}, err: `invalid -ssh-flag "-i /tmp/key": -i is set by the agent, the key is set with -ssh-key-file`},
+		{flags: []string{"-R 8080:localhost:80", "-p 2222", "-l user"}},
+		{flags: []string{"-i/tmp/key"}, err: `invalid -ssh-flag "-i/tmp/key": -i is set by the agent`},
+		{flags: []string{"-oIdentityFile=/tmp/key"}, err: "the IdentityFile option is set by the agent"},
+		{flags: []string{"-oUserKnownHostsFile=/tmp/known_hosts"}, err: "the UserKnownHostsFile option is set by the agent"},
+		{flags: []string{"-o"}, err: `invalid -ssh-flag "-o": invalid ssh option format`},
+		{flags: []string{"-o ServerAliveInterval 30"}, err: "invalid ssh option format"},
+		{flags: []string{"-o IdentityFile=/tmp/key"}, err: "the IdentityFile option is set by the agent, the key is set with -ssh-key-file"},
+	} {
+		cfg := ssh.DefaultConfig()
+		cfg.SSHFlags = tt.flags
+		err := cfg.CheckSSHFlags()
+		if tt.err == "" {
+			assert.NoError(t, err, tt.flags)
+		} else {
+			assert.ErrorContains(t, err, tt.err, tt.flags)
+		}
+	}
+}
+
 type mockPDCClient struct {
 }
 
-func (m mockPDCClient) SignSSHKey(_ context.Context, _ []byte) (*pdc.SigningResponse, error) {
+func (m mockPDCClient) ReportCapabilities(_ context.Context, _ pdc.Capabilities) error {
+	return nil
+}
+
+func (m mockPDCClient) RemoteConfig(_ context.Context) (*pdc.RemoteConfig, error) {
+	return &pdc.RemoteConfig{}, nil
+}
+
+func (m mockPDCClient) UploadSupportBundle(_ context.Context, _ string, _ []byte) error {
+	return nil
+}
+
+func (m mockPDCClient) Discover(_ context.Context) (*pdc.Discovery, error) {
+	return nil, pdc.ErrNotFound
+}
+
+func (m mockPDCClient) Enroll(_ context.Context, _ string) (*pdc.EnrollResponse, error) {
+	return &pdc.EnrollResponse{Token: "token"}, nil
+}
 
-	block, _ := pem.Decode([]byte(certPEM))
-	pk, _, _, _, err := gossh.ParseAuthorizedKey(block.Bytes)
+// SignSSHKey returns an expired certificate, so that it is renewed on every
+// check.
+func (m mockPDCClient) SignSSHKey(_ context.Context, key []byte) (*pdc.SigningResponse, error) {
+	cert, err := signTestCert(key, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %w", err)
+		return nil, err
 	}
 
-	cert, _ := pk.(*gossh.Certificate)
-
 	return &pdc.SigningResponse{
 		KnownHosts:  []byte("known hosts"),
 		Certificate: *cert,
 	}, nil
-}
\ No newline at end of file
+}
+func TestClient_ShutdownDrainTimeout(t *testing.T) {
+	testcases := []struct {
+		name         string
+		drainTimeout time.Duration
+		minDuration  time.Duration
+		maxDuration  time.Duration
+	}{
+		{
+			name:        "without drain timeout the ssh process is stopped immediately",
+			maxDuration: 2 * time.Second,
+		},
+		{
+			name:         "with a drain timeout the ssh process is kept running until the timeout elapses",
+			drainTimeout: 500 * time.Millisecond,
+			minDuration:  500 * time.Millisecond,
+			maxDuration:  3 * time.Second,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			// A long-running process stands in for ssh.
+			cfg := &ssh.Config{LegacyMode: true, Args: []string{"30"}, ShutdownDrainTimeout: tc.drainTimeout}
+			client := newTestClient(t, cfg, false)
+			client.SSHCmd = "sleep"
+
+			ctx := context.Background()
+			require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+			// Give the process time to start.
+			time.Sleep(100 * time.Millisecond)
+
+			start := time.Now()
+			require.NoError(t, services.StopAndAwaitTerminated(ctx, client))
+			elapsed := time.Since(start)
+
+			assert.GreaterOrEqual(t, elapsed, tc.minDuration)
+			assert.Less(t, elapsed, tc.maxDuration)
+		})
+	}
+}
+
+func TestClient_ReplacesConnectionWhenCertificateIsRenewed(t *testing.T) {
+	logs := &syncBuffer{}
+	logger := log.NewLogfmtLogger(logs)
+
+	// A long-running process stands in for ssh. The mocked PDC client returns
+	// an expired certificate, so it is renewed on every check.
+	cfg := &ssh.Config{
+		LegacyMode:        true,
+		Args:              []string{"30"},
+		KeyFile:           filepath.Join(t.TempDir(), "test_cert"),
+		CertCheckInterval: 100 * time.Millisecond,
+		URL:               mustParseURL("localhost"),
+	}
+	km := ssh.NewKeyManager(cfg, logger, mockPDCClient{})
+	client := ssh.NewClient(cfg, logger, km)
+	client.SSHCmd = "sleep"
+	client.HealthyAfter = 100 * time.Millisecond
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(ctx, client)
+	})
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "replaced ssh connection")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestClient_KeepsConnectionWhenReplacementFails(t *testing.T) {
+	logs := &syncBuffer{}
+	logger := log.NewLogfmtLogger(logs)
+
+	// The fake ssh command exits immediately, so the replacement never
+	// becomes healthy.
+	cfg := &ssh.Config{
+		LegacyMode:        true,
+		Args:              []string{"-test.run=TestFakeSSHCmd", "--"},
+		KeyFile:           filepath.Join(t.TempDir(), "test_cert"),
+		CertCheckInterval: 100 * time.Millisecond,
+		URL:               mustParseURL("localhost"),
+	}
+	km := ssh.NewKeyManager(cfg, logger, mockPDCClient{})
+	client := ssh.NewClient(cfg, logger, km)
+	client.SSHCmd = os.Args[0]
+	client.HealthyAfter = time.Hour
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(ctx, client)
+	})
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "keeping the current ssh connection")
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NotContains(t, logs.String(), "replaced ssh connection")
+}
+
+// syncBuffer is a bytes.Buffer that can be written and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestClient_SetLogLevel(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	sshClient := newTestClient(t, cfg, false)
+
+	result, err := sshClient.SSHFlagsFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "-vv", result[len(result)-1])
+
+	sshClient.SetLogLevel(3)
+
+	result, err = sshClient.SSHFlagsFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "-vvv", result[len(result)-1])
+}
+
+func TestClient_BinaryPathAndEnv(t *testing.T) {
+	logs := &syncBuffer{}
+	logger := log.NewLogfmtLogger(logs)
+
+	cfg := ssh.DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-ssh.binary-path=sh", "-ssh.env=PDC_TEST_ENV=from-flag"}))
+	assert.Error(t, fs.Parse([]string{"-ssh.env=PDC_TEST_ENV"}))
+
+	// A shell stands in for ssh, and prints the variable.
+	cfg.LegacyMode = true
+	cfg.Args = []string{"-c", "echo PDC_TEST_ENV=$PDC_TEST_ENV; exec sleep 30"}
+	client := ssh.NewClient(cfg, logger, nil)
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(ctx, client)
+	})
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "PDC_TEST_ENV=from-flag")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestClient_SSHArgs_Algorithms(t *testing.T) {
+	testcases := []struct {
+		name     string
+		args     []string
+		expected []string
+		err      bool
+	}{
+		{
+			name: "fips preset",
+			args: []string{"-ssh.ciphers=fips", "-ssh.kex=fips", "-ssh.macs=fips"},
+			expected: []string{
+				"Ciphers=aes256-gcm@openssh.com,aes128-gcm@openssh.com,aes256-ctr,aes192-ctr,aes128-ctr",
+				"KexAlgorithms=ecdh-sha2-nistp521,ecdh-sha2-nistp384,ecdh-sha2-nistp256,diffie-hellman-group18-sha512,diffie-hellman-group16-sha512,diffie-hellman-group14-sha256",
+				"MACs=hmac-sha2-512-etm@openssh.com,hmac-sha2-256-etm@openssh.com,hmac-sha2-512,hmac-sha2-256",
+			},
+		},
+		{
+			name:     "algorithm lists",
+			args:     []string{"-ssh.ciphers=aes256-gcm@openssh.com,aes256-ctr", "-ssh.kex=-diffie-hellman-group14-sha256"},
+			expected: []string{"Ciphers=aes256-gcm@openssh.com,aes256-ctr", "KexAlgorithms=-diffie-hellman-group14-sha256"},
+		},
+		{
+			name: "invalid list",
+			args: []string{"-ssh.ciphers=aes256-ctr aes128-ctr"},
+			err:  true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ssh.DefaultConfig()
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.RegisterFlags(fs)
+			err := fs.Parse(tc.args)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			result, err := newTestClient(t, cfg, false).SSHFlagsFromConfig()
+			require.NoError(t, err)
+			assert.Subset(t, result, tc.expected)
+		})
+	}
+}
+
+func TestConfig_EnableFIPS(t *testing.T) {
+	testcases := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{
+			name: "defaults to the approved algorithms",
+		},
+		{
+			name: "approved algorithms",
+			args: []string{"-ssh.ciphers=aes256-gcm@openssh.com", "-ssh.macs=fips"},
+		},
+		{
+			name: "algorithm not approved",
+			args: []string{"-ssh.ciphers=aes256-gcm@openssh.com,chacha20-poly1305@openssh.com"},
+			err:  `-ssh.ciphers: algorithm "chacha20-poly1305@openssh.com" is not FIPS 140 approved`,
+		},
+		{
+			name: "modified defaults",
+			args: []string{"-ssh.kex=-diffie-hellman-group14-sha256"},
+			err:  "-ssh.kex cannot modify the default algorithms of ssh in FIPS mode",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ssh.DefaultConfig()
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			cfg.RegisterFlags(fs)
+			require.NoError(t, fs.Parse(tc.args))
+
+			err := cfg.EnableFIPS()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, cfg.FIPS)
+			assert.NotEmpty(t, cfg.Ciphers)
+			assert.NotEmpty(t, cfg.KexAlgorithms)
+			assert.NotEmpty(t, cfg.MACs)
+		})
+	}
+}
+
+func TestClient_StrictHostKeyChecking(t *testing.T) {
+	testcases := []struct {
+		value    string
+		expected string
+		err      bool
+	}{
+		{value: "yes", expected: "StrictHostKeyChecking=yes"},
+		{value: "accept-new", expected: "StrictHostKeyChecking=accept-new"},
+		{value: "off", expected: "StrictHostKeyChecking=no"},
+		{value: "ask", err: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.value, func(t *testing.T) {
+			cfg := ssh.DefaultConfig()
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.RegisterFlags(fs)
+			err := fs.Parse([]string{"-ssh.strict-host-key-checking=" + tc.value})
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			result, err := newTestClient(t, cfg, false).SSHFlagsFromConfig()
+			require.NoError(t, err)
+			assert.Contains(t, result, tc.expected)
+		})
+	}
+}
+
+func TestClient_LogsHostKeyVerificationFailures(t *testing.T) {
+	logs := &syncBuffer{}
+	logger := log.NewLogfmtLogger(logs)
+
+	// A shell stands in for ssh, and fails like ssh on a host key mismatch.
+	cfg := ssh.DefaultConfig()
+	cfg.LegacyMode = true
+	cfg.BinaryPath = "sh"
+	cfg.Args = []string{"-c", "echo 'Host key verification failed.' >&2; exit 255"}
+	client := ssh.NewClient(cfg, logger, nil)
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(ctx, client)
+	})
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "the gateway host key could not be verified")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestClient_FailsOnceRetryBudgetExhausted(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	cfg.LegacyMode = true
+	cfg.BinaryPath = "sh"
+	cfg.Args = []string{"-c", "exit 255"}
+	cfg.RetryMaxAttempts = 2
+	client := ssh.NewClient(cfg, log.NewNopLogger(), nil)
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+
+	// The client fails instead of exiting the agent, so that the agent can
+	// stop its other tunnels, or fail over.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	assert.ErrorIs(t, client.AwaitTerminated(ctx), ssh.ErrRetryBudgetExhausted)
+	assert.Equal(t, services.Failed, client.State())
+}
+
+// eventRecorder records the types of the events it receives.
+type eventRecorder struct {
+	mu    sync.Mutex
+	types []string
+}
+
+func (r *eventRecorder) Send(ev events.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types = append(r.types, ev.Type)
+}
+
+func (r *eventRecorder) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.types...)
+}
+
+func TestClient_SendsEventsAndReportsStatus(t *testing.T) {
+	recorder := &eventRecorder{}
+
+	// A shell stands in for ssh: it stays up long enough to be connected,
+	// then fails like ssh when the gateway rejects the certificate.
+	cfg := ssh.DefaultConfig()
+	cfg.LegacyMode = true
+	cfg.BinaryPath = "sh"
+	cfg.Args = []string{"-c", "sleep 0.3; echo 'Permission denied (publickey).' >&2; exit 255"}
+	cfg.Events = recorder
+	client := ssh.NewClient(cfg, log.NewNopLogger(), nil)
+	client.HealthyAfter = 100 * time.Millisecond
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, client))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(ctx, client)
+	})
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		received := recorder.received()
+		assert.Contains(c, received, events.Connected)
+		assert.Contains(c, received, events.Disconnected)
+		assert.Contains(c, received, events.AuthFailed)
+
+		status := client.Status()
+		assert.False(c, status.LastConnected.IsZero())
+		assert.Equal(c, "the gateway rejected the certificate", status.LastError)
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestConfig_TunnelResolverFlags(t *testing.T) {
+	testcases := []struct {
+		name       string
+		args       []string
+		dnsServers []string
+		preference string
+		err        bool
+	}{
+		{
+			name:       "DNS servers with default port",
+			args:       []string{"-tunnel.dns-servers=10.0.0.2, [fd00::2]:5353,fd00::3"},
+			dnsServers: []string{"10.0.0.2:53", "[fd00::2]:5353", "[fd00::3]:53"},
+		},
+		{name: "IPv6 first", args: []string{"-tunnel.ip-preference=6"}, preference: "6"},
+		{name: "resolver order", args: []string{"-tunnel.ip-preference=auto"}},
+		{name: "invalid preference", args: []string{"-tunnel.ip-preference=ipv6"}, err: true},
+		{name: "empty DNS server", args: []string{"-tunnel.dns-servers=10.0.0.2,"}, err: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ssh.DefaultConfig()
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.RegisterFlags(fs)
+			err := fs.Parse(tc.args)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.dnsServers, cfg.DNSServers)
+			assert.Equal(t, tc.preference, cfg.IPPreference)
+		})
+	}
+}
+
+func TestConfig_Resolve(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-resolve=Postgres.Internal=10.0.0.1", "-resolve=mysql.internal=10.0.0.2,[fd00::2]"}))
+	assert.Equal(t, map[string][]net.IP{
+		"postgres.internal": {net.ParseIP("10.0.0.1")},
+		"mysql.internal":    {net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")},
+	}, cfg.Resolve)
+
+	for _, value := range []string{"postgres.internal", "=10.0.0.1", "postgres.internal=db.internal"} {
+		assert.Error(t, fs.Parse([]string{"-resolve=" + value}), value)
+	}
+}
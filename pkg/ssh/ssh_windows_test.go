@@ -0,0 +1,49 @@
+//go:build windows
+
+package ssh_test
+
+import (
+	"testing"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_KeyFileDir_Windows(t *testing.T) {
+	testcases := []struct {
+		name     string
+		keyFile  string
+		expected string
+	}{
+		{
+			name:     "drive letter",
+			keyFile:  `C:\Users\grafana\.ssh\grafana_pdc`,
+			expected: `C:\Users\grafana\.ssh`,
+		},
+		{
+			name:     "forward slashes",
+			keyFile:  `C:/Users/grafana/.ssh/grafana_pdc`,
+			expected: `C:\Users\grafana\.ssh`,
+		},
+		{
+			name:     "UNC path",
+			keyFile:  `\\server\share\pdc\grafana_pdc`,
+			expected: `\\server\share\pdc`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ssh.Config{KeyFile: tc.keyFile}
+			assert.Equal(t, tc.expected, cfg.KeyFileDir())
+		})
+	}
+}
+
+func TestDefaultConfig_Windows(t *testing.T) {
+	t.Setenv("USERPROFILE", `C:\Users\grafana`)
+
+	cfg := ssh.DefaultConfig()
+	assert.Equal(t, `C:\Users\grafana\.ssh\grafana_pdc`, cfg.KeyFile)
+	assert.Equal(t, `C:\Users\grafana\.ssh`, cfg.KeyFileDir())
+}
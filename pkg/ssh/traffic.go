@@ -0,0 +1,250 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/pdc-agent/pkg/crash"
+)
+
+// relayDialTimeout is the timeout of the connections of the relay to the
+// gateway.
+const relayDialTimeout = 10 * time.Second
+
+// Lines of ssh -v about the channels forwarded by the gateway to the agent
+// network.
+var (
+	channelOpenRegexp = regexp.MustCompile(`^debug1: channel (\d+): new forwarded-tcpip`)
+	channelFreeRegexp = regexp.MustCompile(`^debug1: channel (\d+): free: `)
+)
+
+// channelTracker counts the forwarded channels of one ssh process from its
+// -v output.
+type channelTracker struct {
+	keyFile string
+
+	mu   sync.Mutex
+	open map[string]bool
+}
+
+func newChannelTracker(keyFile string) *channelTracker {
+	return &channelTracker{keyFile: keyFile, open: map[string]bool{}}
+}
+
+func (t *channelTracker) observe(msg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if m := channelOpenRegexp.FindStringSubmatch(msg); m != nil {
+		t.open[m[1]] = true
+		channelsOpened.WithLabelValues(t.keyFile).Inc()
+		channelsActive.WithLabelValues(t.keyFile).Inc()
+		return
+	}
+	// Channel IDs are reused once free, only forwarded ones are counted.
+	if m := channelFreeRegexp.FindStringSubmatch(msg); m != nil && t.open[m[1]] {
+		delete(t.open, m[1])
+		channelsClosed.WithLabelValues(t.keyFile).Inc()
+		channelsActive.WithLabelValues(t.keyFile).Dec()
+	}
+}
+
+// close counts the channels still open as closed, once the ssh process
+// exited.
+func (t *channelTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id := range t.open {
+		delete(t.open, id)
+		channelsClosed.WithLabelValues(t.keyFile).Inc()
+		channelsActive.WithLabelValues(t.keyFile).Dec()
+	}
+}
+
+// trafficRelay listens on the loopback interface and relays the connections
+// of ssh to the gateway, counting the bytes they carry and limiting their
+// throughput.
+type trafficRelay struct {
+	l net.Listener
+	// target returns the host:port address of the gateway to connect to
+	// over network.
+	network string
+	target  func() string
+	logger  log.Logger
+
+	sent     prometheus.Counter
+	received prometheus.Counter
+
+	// upload and download limit the throughput of all the connections of
+	// the relay, in each direction. Unlimited if nil.
+	upload   *rateLimiter
+	download *rateLimiter
+}
+
+// newTrafficRelay starts a relay to the gateway at the address returned by
+// target for every connection, dialed over network: tcp, tcp4 or tcp6. Its
+// metrics are labelled with keyFile. maxBandwidth is the maximum throughput
+// in each direction, in bytes per second. Unlimited if 0.
+func newTrafficRelay(network string, target func() string, keyFile string, maxBandwidth int, logger log.Logger) (*trafficRelay, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("starting traffic relay: %w", err)
+	}
+	r := &trafficRelay{
+		l:        l,
+		network:  network,
+		target:   target,
+		logger:   logger,
+		sent:     bytesSent.WithLabelValues(keyFile),
+		received: bytesReceived.WithLabelValues(keyFile),
+	}
+	if maxBandwidth > 0 {
+		r.upload = newRateLimiter(maxBandwidth)
+		r.download = newRateLimiter(maxBandwidth)
+	}
+	crash.Go(r.serve)
+	return r, nil
+}
+
+// port is the port ssh connects to instead of the one of the gateway.
+func (r *trafficRelay) port() int {
+	return r.l.Addr().(*net.TCPAddr).Port
+}
+
+func (r *trafficRelay) close() error {
+	return r.l.Close()
+}
+
+func (r *trafficRelay) serve() {
+	for {
+		conn, err := r.l.Accept()
+		if err != nil {
+			return
+		}
+		crash.Go(func() { r.relay(conn) })
+	}
+}
+
+func (r *trafficRelay) relay(conn net.Conn) {
+	defer conn.Close()
+
+	target := r.target()
+	gw, err := net.DialTimeout(r.network, target, relayDialTimeout)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "could not connect to the gateway", "gateway", target, "err", err)
+		return
+	}
+	defer gw.Close()
+
+	conn = &rateLimitedConn{Conn: conn, read: r.upload, write: r.download}
+
+	done := make(chan struct{}, 2)
+	crash.Go(func() {
+		_, _ = io.Copy(gw, &countingReader{r: conn, counter: r.sent})
+		done <- struct{}{}
+	})
+	crash.Go(func() {
+		_, _ = io.Copy(conn, &countingReader{r: gw, counter: r.received})
+		done <- struct{}{}
+	})
+	// Either side closing ends the connection.
+	<-done
+}
+
+// countingReader adds the number of bytes read from r to counter.
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.counter.Add(float64(n))
+	return n, err
+}
+
+// rateLimiter is a token bucket of bytes, refilled at rate bytes per second
+// up to one second of traffic.
+type rateLimiter struct {
+	rate float64
+
+	// now and sleep are replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		now:    time.Now,
+		sleep:  time.Sleep,
+		tokens: float64(rate),
+	}
+}
+
+// wait blocks until n bytes may be transferred. The bucket goes into debt
+// for transfers larger than what it holds, which delays the next ones.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	tokens := l.tokens
+	l.mu.Unlock()
+
+	if tokens < 0 {
+		l.sleep(time.Duration(-tokens / l.rate * float64(time.Second)))
+	}
+}
+
+// rateLimitedConn limits the throughput of the reads and writes of a
+// connection. A nil limiter does not limit.
+type rateLimitedConn struct {
+	net.Conn
+	read  *rateLimiter
+	write *rateLimiter
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.read != nil && n > 0 {
+		c.read.wait(n)
+	}
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(p []byte) (int, error) {
+	if c.write != nil {
+		c.write.wait(len(p))
+	}
+	return c.Conn.Write(p)
+}
+
+// relayHostKeyAlias is the name of the gateway in the known hosts file,
+// which ssh connecting to the relay must check the host key of.
+func relayHostKeyAlias(host string, port int) string {
+	if port == 22 {
+		return host
+	}
+	return "[" + host + "]:" + strconv.Itoa(port)
+}
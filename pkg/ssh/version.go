@@ -0,0 +1,126 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// ErrSSHTooOld is returned on start when the ssh binary lacks features the
+// agent relies on.
+var ErrSSHTooOld = errors.New("ssh version is too old")
+
+// sshFeature is a feature of OpenSSH the agent relies on, and the version
+// which introduced it.
+type sshFeature struct {
+	name  string
+	major int
+	minor int
+}
+
+// requiredSSHFeatures is sorted by version.
+var requiredSSHFeatures = []sshFeature{
+	{name: "ed25519 keys", major: 6, minor: 5},
+	{name: "the CertificateFile option", major: 7, minor: 2},
+	{name: "dynamic remote forwarding with -R 0", major: 7, minor: 6},
+}
+
+// Matches "OpenSSH_9.2p1 Debian-2" and "OpenSSH_for_Windows_8.1p1".
+var openSSHVersionRegexp = regexp.MustCompile(`OpenSSH_(?:for_Windows_)?(\d+)\.(\d+)`)
+
+// OpenSSHVersion returns the version reported by sshCmd -V.
+func OpenSSHVersion(ctx context.Context, sshCmd string) (string, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	buffer := bytes.NewBuffer([]byte{})
+
+	cmd := exec.CommandContext(timeoutCtx, sshCmd, "-V")
+	// ssh -V outputs to stderr.
+	cmd.Stderr = buffer
+
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buffer.String()), nil
+}
+
+// parseOpenSSHVersion returns the major and minor version of an ssh -V output.
+func parseOpenSSHVersion(version string) (int, int, error) {
+	m := openSSHVersionRegexp.FindStringSubmatch(version)
+	if m == nil {
+		return 0, 0, fmt.Errorf("not an OpenSSH version: %q", version)
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major, minor, nil
+}
+
+// missingSSHFeatures returns the required features that version lacks.
+func missingSSHFeatures(major, minor int) []sshFeature {
+	missing := []sshFeature{}
+	for _, f := range requiredSSHFeatures {
+		if major < f.major || (major == f.major && minor < f.minor) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// checkSSHVersion refuses ssh versions lacking required features. If the
+// version cannot be determined, it logs a warning and lets ssh start.
+func (s *Client) checkSSHVersion(ctx context.Context) error {
+	version, err := OpenSSHVersion(ctx, s.SSHCmd)
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "cannot get ssh version, not checking it supports the required features", "err", err)
+		return nil
+	}
+
+	major, minor, err := parseOpenSSHVersion(version)
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "unknown ssh version, not checking it supports the required features", "err", err)
+		return nil
+	}
+
+	missing := missingSSHFeatures(major, minor)
+	for _, f := range missing {
+		level.Error(s.logger).Log("msg", "ssh version lacks a required feature", "version", version, "feature", f.name, "required_version", fmt.Sprintf("%d.%d", f.major, f.minor))
+	}
+	if len(missing) > 0 {
+		minimum := requiredSSHFeatures[len(requiredSSHFeatures)-1]
+		return fmt.Errorf("%w: %s: OpenSSH %d.%d or later is required", ErrSSHTooOld, version, minimum.major, minimum.minor)
+	}
+
+	return nil
+}
+
+// CheckSSH returns the version of sshCmd, and an error if it cannot be found
+// or lacks required features. Unknown versions are not an error.
+func CheckSSH(ctx context.Context, sshCmd string) (string, error) {
+	if err := lookupSSH(sshCmd); err != nil {
+		return "", err
+	}
+
+	version, err := OpenSSHVersion(ctx, sshCmd)
+	if err != nil {
+		return "", fmt.Errorf("getting ssh version: %w", err)
+	}
+
+	major, minor, err := parseOpenSSHVersion(version)
+	if err != nil {
+		return version, nil
+	}
+	if missing := missingSSHFeatures(major, minor); len(missing) > 0 {
+		return version, fmt.Errorf("%w: %s lacks %s", ErrSSHTooOld, version, missing[0].name)
+	}
+	return version, nil
+}